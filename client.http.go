@@ -1,78 +1,412 @@
 package redwood
 
 import (
-	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/sha3"
+	"golang.org/x/net/http2"
 	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
 
 	"redwood.dev/crypto"
 	"redwood.dev/tree"
 	"redwood.dev/types"
 )
 
+// HTTPClientVersion is reported in the default User-Agent header.
+const HTTPClientVersion = "0.0.1"
+
 type HTTPClient struct {
-	dialAddr  string
-	sigkeys   *crypto.SigningKeypair
-	enckeys   *crypto.EncryptingKeypair
-	cookieJar http.CookieJar
-	tls       bool
+	dialAddr       string
+	sigkeys        *crypto.SigningKeypair
+	enckeys        *crypto.EncryptingKeypair
+	cookieJar      http.CookieJar
+	tls            bool
+	defaultHeaders http.Header
+	gzip           bool
+	gzipMinSize    int64
+	h2cTransport   *http2.Transport
+	userAgent      string
+	limiter        *rate.Limiter
+	redirectPolicy RedirectPolicy
+
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+}
+
+const (
+	defaultHTTPClientDialTimeout         = 10 * time.Second
+	defaultHTTPClientKeepAlive           = 30 * time.Second
+	defaultHTTPClientTLSHandshakeTimeout = 10 * time.Second
+)
+
+type HTTPClientOption func(*HTTPClient)
+
+// HTTPClientDefaultHeader adds a header to every request the client makes.
+// Headers that the client sets itself (State-URI, Subscribe, etc.) always
+// take precedence.
+func HTTPClientDefaultHeader(key, value string) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.defaultHeaders.Add(key, value)
+	}
+}
+
+// HTTPClientGzip enables gzip compression.  Responses are requested with
+// Accept-Encoding: gzip and transparently decompressed, and request bodies
+// of at least minBodySize bytes (such as those sent by Put and StoreRef) are
+// compressed and sent with Content-Encoding: gzip.  Leave this off when
+// mostly sending data that's already compressed.
+func HTTPClientGzip(minBodySize int64) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.gzip = true
+		c.gzipMinSize = minBodySize
+	}
+}
+
+// HTTPClientH2C makes the client speak HTTP/2 over cleartext (h2c), for
+// servers that sit behind an h2c-only gateway.  All requests share a single
+// multiplexed connection, which is much cheaper when holding many concurrent
+// subscriptions.  The tls argument to NewHTTPClient is ignored, and
+// SubscribeWS still dials a separate HTTP/1.1 connection.
+func HTTPClientH2C() HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.h2cTransport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return c.dialer().Dial(network, addr)
+			},
+		}
+	}
+}
+
+// HTTPClientDialTimeout limits how long the client waits for a TCP connection
+// to be established.  It defaults to 10 seconds.
+func HTTPClientDialTimeout(timeout time.Duration) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.dialTimeout = timeout
+	}
+}
+
+// HTTPClientKeepAlive sets the interval between TCP keepalive probes.  It
+// defaults to 30 seconds.  A negative value disables keepalives.
+func HTTPClientKeepAlive(interval time.Duration) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.keepAlive = interval
+	}
 }
 
-func NewHTTPClient(dialAddr string, sigkeys *crypto.SigningKeypair, enckeys *crypto.EncryptingKeypair, tls bool) (*HTTPClient, error) {
+// HTTPClientTLSHandshakeTimeout limits how long the client waits for a TLS
+// handshake to complete.  It defaults to 10 seconds.
+func HTTPClientTLSHandshakeTimeout(timeout time.Duration) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.tlsHandshakeTimeout = timeout
+	}
+}
+
+// HTTPClientResponseHeaderTimeout limits how long the client waits for the
+// server's response headers after sending a request.  It doesn't limit how
+// long the body takes to arrive, so subscriptions are unaffected.  By
+// default, there's no limit.
+func HTTPClientResponseHeaderTimeout(timeout time.Duration) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.responseHeaderTimeout = timeout
+	}
+}
+
+// HTTPClientUserAgent overrides the default User-Agent header, which is
+// "redwood-go/<HTTPClientVersion>".
+func HTTPClientUserAgent(userAgent string) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.userAgent = userAgent
+	}
+}
+
+// HTTPClientRateLimiter makes every request wait for the limiter before it's
+// sent, so that a busy sync loop doesn't trip the peer's own rate limiting.
+// The wait is abandoned (and the request fails) if the request's context is
+// canceled first.  A limiter can be shared by several clients to throttle
+// them together.
+func HTTPClientRateLimiter(limiter *rate.Limiter) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.limiter = limiter
+	}
+}
+
+// RedirectPolicy controls which redirects an HTTPClient follows.  A redirect
+// that isn't followed fails the request with ErrRedirectRefused.
+type RedirectPolicy int
+
+const (
+	// RedirectNone never follows redirects.  It's the default.
+	RedirectNone RedirectPolicy = iota
+	// RedirectSameHost follows redirects of GET and HEAD requests (Get,
+	// Subscribe, FetchTx, etc.) as long as they stay on the same scheme, host,
+	// and port.  Requests that change anything on the server (Put, StoreRef,
+	// Authorize) are still never redirected.
+	RedirectSameHost
+)
+
+// ErrRedirectRefused is returned when the server redirects a request and
+// the client's RedirectPolicy doesn't allow it to follow.
+var ErrRedirectRefused = errors.New("refusing to follow redirect")
+
+const maxHTTPClientRedirects = 10
+
+// HTTPClientRedirectPolicy sets which redirects the client follows.  By
+// default, it follows none, so that requests (and the cookies that
+// authenticate them) never end up somewhere unexpected.
+func HTTPClientRedirectPolicy(policy RedirectPolicy) HTTPClientOption {
+	return func(c *HTTPClient) {
+		c.redirectPolicy = policy
+	}
+}
+
+func NewHTTPClient(dialAddr string, sigkeys *crypto.SigningKeypair, enckeys *crypto.EncryptingKeypair, tls bool, opts ...HTTPClientOption) (*HTTPClient, error) {
 	cookieJar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		return nil, err
 	}
 
-	return &HTTPClient{
-		dialAddr:  dialAddr,
-		sigkeys:   sigkeys,
-		enckeys:   enckeys,
-		cookieJar: cookieJar,
-		tls:       tls,
-	}, nil
+	c := &HTTPClient{
+		dialAddr:       dialAddr,
+		sigkeys:        sigkeys,
+		enckeys:        enckeys,
+		cookieJar:      cookieJar,
+		tls:            tls,
+		defaultHeaders: make(http.Header),
+		userAgent:      "redwood-go/" + HTTPClientVersion,
+
+		dialTimeout:         defaultHTTPClientDialTimeout,
+		keepAlive:           defaultHTTPClientKeepAlive,
+		tlsHandshakeTimeout: defaultHTTPClientTLSHandshakeTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 func (c *HTTPClient) client() *http.Client {
+	if c.h2cTransport != nil {
+		return &http.Client{Jar: c.cookieJar, Transport: c.h2cTransport, CheckRedirect: c.checkRedirect}
+	}
+
 	var tlsConfig *tls.Config
 	if c.tls {
 		tlsConfig = &tls.Config{
 			InsecureSkipVerify: true,
 		}
 	}
-	tr := &http.Transport{TLSClientConfig: tlsConfig}
-	return &http.Client{Jar: c.cookieJar, Transport: tr}
+	tr := &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		DialContext:           c.dialer().DialContext,
+		TLSHandshakeTimeout:   c.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: c.responseHeaderTimeout,
+	}
+	return &http.Client{Jar: c.cookieJar, Transport: tr, CheckRedirect: c.checkRedirect}
+}
+
+func (c *HTTPClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	orig := via[0]
+	follow := c.redirectPolicy == RedirectSameHost &&
+		(orig.Method == "GET" || orig.Method == "HEAD") &&
+		req.URL.Scheme == orig.URL.Scheme &&
+		req.URL.Host == orig.URL.Host &&
+		len(via) < maxHTTPClientRedirects
+	if follow {
+		return nil
+	}
+	return errors.Wrapf(ErrRedirectRefused, "%v %v redirected to %v", orig.Method, orig.URL, req.URL)
+}
+
+func (c *HTTPClient) waitForLimiter(ctx context.Context) error {
+	if c.limiter == nil {
+		return nil
+	}
+	return c.limiter.Wait(ctx)
+}
+
+func (c *HTTPClient) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: c.dialTimeout, KeepAlive: c.keepAlive}
+}
+
+func (c *HTTPClient) do(req *http.Request) (*http.Response, error) {
+	err := c.waitForLimiter(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	for key, vals := range c.defaultHeaders {
+		if _, exists := req.Header[key]; exists {
+			continue
+		}
+		req.Header[key] = append([]string(nil), vals...)
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	// Every request gets an ID so that it can be matched up with the
+	// server's logs.  Failed requests report it in HTTPError.RequestID.
+	if req.Header.Get("X-Request-Id") == "" {
+		requestID, err := newRequestID()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Request-Id", requestID)
+	}
+
+	if !c.gzip {
+		return c.send(req)
+	}
+
+	err = c.gzipRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, errors.WithStack(err)
+		}
+		resp.Body = &gzipResponseBody{Reader: gzipReader, body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	return resp, nil
+}
+
+// send sends the request.  The http.Client doesn't follow some redirects at
+// all (for instance, those of requests with streamed bodies), so any
+// redirect response that makes it back here counts as refused.
+func (c *HTTPClient) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		resp.Body.Close()
+		return nil, errors.Wrapf(ErrRedirectRefused, "%v %v redirected to %v", req.Method, req.URL, resp.Header.Get("Location"))
+	}
+	return resp, nil
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() (string, error) {
+	var uuid [16]byte
+	_, err := io.ReadFull(rand.Reader, uuid[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+func (c *HTTPClient) gzipRequestBody(req *http.Request) error {
+	// A ContentLength of 0 with a non-nil Body means the length is unknown
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return nil
+	} else if req.ContentLength > 0 && req.ContentLength < c.gzipMinSize {
+		return nil
+	}
+	defer req.Body.Close()
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	_, err := io.Copy(gzipWriter, req.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	compressed := buf.Bytes()
+	req.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	req.ContentLength = int64(len(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
+
+type gzipResponseBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r *gzipResponseBody) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
 }
 
+// Authorize proves to the remote host that we control c.sigkeys.
 func (c *HTTPClient) Authorize() error {
-	client := c.client()
+	return c.AuthorizeWithSigner(context.Background(), func(challenge []byte) ([]byte, error) {
+		return c.sigkeys.SignHash(types.HashBytes(challenge))
+	})
+}
 
-	req, err := http.NewRequest("AUTHORIZE", c.dialAddr, nil)
+// AuthorizeWithSigner is like Authorize, but the challenge is signed by the
+// given function, so the signing key doesn't need to be held in memory (it
+// might live in an HSM or hardware wallet, for instance).  sign receives the
+// raw challenge bytes, and must return a signature over
+// types.HashBytes(challenge) in the same format as SigningPrivateKey.SignHash.
+func (c *HTTPClient) AuthorizeWithSigner(ctx context.Context, sign func(challenge []byte) ([]byte, error)) error {
+	req, err := http.NewRequestWithContext(ctx, "AUTHORIZE", c.dialAddr, nil)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return errors.WithStack(err)
-	} else if resp.StatusCode != 200 {
-		return errors.Errorf("error verifying peer address: (%v) %v", resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.Wrap(newHTTPError(resp), "error verifying peer address")
+	}
 
 	challengeHex, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -84,102 +418,322 @@ func (c *HTTPClient) Authorize() error {
 		return errors.WithStack(err)
 	}
 
-	sig, err := c.sigkeys.SignHash(types.HashBytes(challenge))
+	sig, err := sign(challenge)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	sigHex := hex.EncodeToString(sig)
-
-	req2, err := http.NewRequest("AUTHORIZE", c.dialAddr, nil)
+	req2, err := http.NewRequestWithContext(ctx, "AUTHORIZE", c.dialAddr, nil)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	req.Header.Set("Response", sigHex)
-	resp2, err := client.Do(req2)
+	req2.Header.Set("Response", hex.EncodeToString(sig))
+	resp2, err := c.do(req2)
 	if err != nil {
 		return errors.WithStack(err)
-	} else if resp2.StatusCode != 200 {
-		return errors.Errorf("error verifying peer address: (%v) %v", resp2.StatusCode, resp2.Status)
 	}
 	defer resp2.Body.Close()
+	if resp2.StatusCode != 200 {
+		return errors.Wrap(newHTTPError(resp2), "error verifying peer address")
+	}
+	return nil
+}
+
+// HTTPError is returned when the remote host responds with an unexpected
+// status code.  Body holds (up to the first 64kb of) the response body, which
+// usually explains what went wrong.  Use errors.As or errors.Cause to get at
+// it.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+	RequestID  string // the X-Request-Id of the failed request
+}
+
+const maxHTTPErrorBodySize = 64 * 1024
+
+// newHTTPError reads the body of resp into an HTTPError.  It doesn't close
+// the body.
+func newHTTPError(resp *http.Response) HTTPError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBodySize))
+	httpErr := HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+	if resp.Request != nil {
+		httpErr.RequestID = resp.Request.Header.Get("X-Request-Id")
+	}
+	return httpErr
+}
+
+func (err HTTPError) Error() string {
+	return fmt.Sprintf("http error: (%v) %v", err.StatusCode, err.Status)
+}
+
+// IsNotFound returns true if err means that the remote host didn't have what
+// was asked for, either because it's types.Err404 (as returned by FetchTx) or
+// because it's an HTTPError with a 404 status.
+func IsNotFound(err error) bool {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusNotFound
+	}
+	return errors.Cause(err) == types.Err404
+}
+
+// Ping checks whether the host at dialAddr is reachable and responsive.  It
+// returns an HTTPError if the host responds with a non-2xx status.
+func (c *HTTPClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.dialAddr, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.WithStack(newHTTPError(resp))
+	}
 	return nil
 }
 
+// ErrNotModified is returned by GetIfNoneMatch when the state hasn't changed.
+var ErrNotModified = errors.New("not modified")
+
 type MaybeTx struct {
 	*Tx
 	Err error
+
+	// EndOfBacklog is set on the sentinel that SubscribeFrom delivers once
+	// the server has finished replaying historical txs.  Tx and Err are nil.
+	EndOfBacklog bool
+}
+
+// Subscribe streams the txs of a state URI.  The server may send them as
+// NDJSON, as any other series of JSON values (pretty-printed ones included),
+// or as a single JSON array that grows over time.
+//
+// Like every HTTPClient method, it takes a types.StateURI, which it sends as
+// is.  StringHTTPClient wraps these methods for callers that have plain
+// strings, and validates them first.
+func (c *HTTPClient) Subscribe(ctx context.Context, stateURI types.StateURI) (chan MaybeTx, error) {
+	return c.subscribe(ctx, stateURI, nil, nil)
+}
+
+// SubscribeKeypath is like Subscribe, but only delivers txs with at least one
+// patch that touches the given keypath (see Tx.TouchesKeypath).  The keypath
+// is sent to the server in the Subscribe-Keypath header so that it can skip
+// the rest, and incoming txs are filtered here as well in case the server
+// doesn't support that.  A nil keypath matches every tx.
+func (c *HTTPClient) SubscribeKeypath(ctx context.Context, stateURI types.StateURI, keypath tree.Keypath) (chan MaybeTx, error) {
+	return c.subscribe(ctx, stateURI, keypath, nil)
 }
 
-func (c *HTTPClient) Subscribe(ctx context.Context, stateURI string) (chan MaybeTx, error) {
-	client := c.client()
+// SubscribeFrom is like Subscribe, but asks the server (via the From-Tx
+// header) to replay the txs from fromTxID onward before streaming live ones.
+// The server marks the end of the replay with a `{"endOfBacklog": true}`
+// line, which is delivered on the channel as a MaybeTx with EndOfBacklog set.
+func (c *HTTPClient) SubscribeFrom(ctx context.Context, stateURI types.StateURI, fromTxID types.ID) (chan MaybeTx, error) {
+	return c.subscribe(ctx, stateURI, nil, &fromTxID)
+}
 
-	req, err := http.NewRequest("GET", c.dialAddr, nil)
+func (c *HTTPClient) subscribe(ctx context.Context, stateURI types.StateURI, keypath tree.Keypath, fromTxID *types.ID) (chan MaybeTx, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.dialAddr, nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	req.Header.Set("Subscribe", "true")
-	req.Header.Set("State-URI", stateURI)
+	req.Header.Set("State-URI", stateURI.String())
+	if len(keypath) > 0 {
+		req.Header.Set("Subscribe-Keypath", keypath.String())
+	}
+	if fromTxID != nil {
+		req.Header.Set("From-Tx", fromTxID.Hex())
+	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	} else if resp.StatusCode != 200 {
-		return nil, errors.Errorf("error subscribing: (%v) %v", resp.StatusCode, resp.Status)
+		defer resp.Body.Close()
+		return nil, errors.Wrap(newHTTPError(resp), "error subscribing")
 	}
-	defer resp.Body.Close()
 
 	ch := make(chan MaybeTx)
 	go func() {
 		defer close(ch)
+		defer resp.Body.Close()
 
+		inBacklog := fromTxID != nil
+		stream := newJSONStream(resp.Body)
 		for {
+			var bs json.RawMessage
+			err := stream.Next(&bs)
+			if err != nil {
+				if ctx.Err() == nil {
+					select {
+					case ch <- MaybeTx{Err: err}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+
+			var maybeTx MaybeTx
+			if inBacklog && isEndOfBacklog(bs) {
+				inBacklog = false
+				maybeTx.EndOfBacklog = true
+			} else {
+				var tx Tx
+				err = json.Unmarshal(bs, &tx)
+				if err != nil {
+					maybeTx.Err = err
+				} else if !tx.TouchesKeypath(keypath) {
+					continue
+				} else {
+					maybeTx.Tx = &tx
+				}
+			}
+
 			select {
+			case ch <- maybeTx:
 			case <-ctx.Done():
 				return
-			default:
 			}
+		}
+	}()
+	return ch, nil
+}
+
+func isEndOfBacklog(bs []byte) bool {
+	var marker struct {
+		EndOfBacklog bool `json:"endOfBacklog"`
+	}
+	err := json.Unmarshal(bs, &marker)
+	return err == nil && marker.EndOfBacklog
+}
+
+// SubscribeWS is like Subscribe, but it streams txs over a WebSocket
+// connection (which survives more proxies than a long-lived HTTP response).
+// Each WebSocket message carries one tx.  The server's pings are answered
+// automatically, and the connection is considered dead if none arrive for a
+// while.  The channel is closed when ctx is canceled or the connection drops.
+func (c *HTTPClient) SubscribeWS(ctx context.Context, stateURI types.StateURI) (chan MaybeTx, error) {
+	wsURL, err := url.Parse(c.dialAddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch wsURL.Scheme {
+	case "https":
+		wsURL.Scheme = "wss"
+	default:
+		wsURL.Scheme = "ws"
+	}
+	wsURL.Path = "/ws"
+	wsURL.RawQuery = url.Values{
+		"state_uri":         []string{stateURI.String()},
+		"subscription_type": []string{"transactions"},
+	}.Encode()
+
+	dialer := websocket.Dialer{
+		Jar:              c.cookieJar,
+		NetDialContext:   c.dialer().DialContext,
+		HandshakeTimeout: 10 * time.Second,
+	}
+	if c.tls {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	err = c.waitForLimiter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, resp, err := dialer.DialContext(ctx, wsURL.String(), c.defaultHeaders.Clone())
+	if err != nil {
+		if resp != nil {
+			defer resp.Body.Close()
+			return nil, errors.Wrap(newHTTPError(resp), "error subscribing")
+		}
+		return nil, errors.WithStack(err)
+	}
 
-			var tx Tx
-			r := bufio.NewReader(resp.Body)
-			bs, err := r.ReadBytes(byte('\n'))
+	// The server pings every wsPingPeriod, so if we go a couple of periods
+	// without hearing anything, the connection is gone
+	readWait := 2 * wsPingPeriod
+	conn.SetReadDeadline(time.Now().Add(readWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(wsWriteWait))
+	})
+
+	chDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+		case <-chDone:
+		}
+		conn.Close()
+	}()
+
+	ch := make(chan MaybeTx)
+	go func() {
+		defer close(ch)
+		defer close(chDone)
+
+		for {
+			_, bs, err := conn.ReadMessage()
 			if err != nil {
-				ch <- MaybeTx{Err: err}
-				continue
+				if ctx.Err() == nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					select {
+					case ch <- MaybeTx{Err: errors.WithStack(err)}:
+					case <-ctx.Done():
+					}
+				}
+				return
 			}
-			bs = bytes.Trim(bs, "\n ")
 
-			err = json.Unmarshal(bs, &tx)
+			var msg struct {
+				Tx *Tx `json:"tx"`
+			}
+			err = json.Unmarshal(bs, &msg)
 			if err != nil {
-				ch <- MaybeTx{Err: err}
+				msg.Tx = nil
+			} else if msg.Tx == nil {
 				continue
 			}
 
-			ch <- MaybeTx{Tx: &tx}
+			select {
+			case ch <- MaybeTx{Tx: msg.Tx, Err: errors.WithStack(err)}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	return ch, nil
 }
 
-func (c *HTTPClient) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
-	client := c.client()
+func (c *HTTPClient) FetchTx(stateURI types.StateURI, txID types.ID) (*Tx, error) {
 	req, err := http.NewRequest("GET", c.dialAddr+"/__tx/"+txID.Hex(), nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	req.Header.Set("State-URI", stateURI)
+	req.Header.Set("State-URI", stateURI.String())
 
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, errors.WithStack(err)
-	} else if resp.StatusCode == 404 {
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
 		return nil, types.Err404
 	} else if resp.StatusCode != 200 {
-		return nil, errors.Errorf("error fetching tx: (%v) %v", resp.StatusCode, resp.Status)
+		return nil, errors.Wrap(newHTTPError(resp), "error fetching tx")
 	}
-	defer resp.Body.Close()
 
 	var tx Tx
 	err = json.NewDecoder(resp.Body).Decode(&tx)
@@ -189,19 +743,152 @@ func (c *HTTPClient) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
 	return &tx, nil
 }
 
-func (c *HTTPClient) Get(stateURI string, version *types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
-	client := c.client()
+// TxExists reports whether the server has the given tx, without fetching it.
+func (c *HTTPClient) TxExists(stateURI types.StateURI, txID types.ID) (bool, error) {
+	req, err := http.NewRequest("HEAD", c.dialAddr+"/__tx/"+txID.Hex(), nil)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	req.Header.Set("State-URI", stateURI.String())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, errors.Wrap(newHTTPError(resp), "error checking for tx")
+	}
+}
+
+// Leaves returns the IDs of the txs at the tips of the given state URI's
+// history, like TxStore.Leaves.
+func (c *HTTPClient) Leaves(stateURI types.StateURI) ([]types.ID, error) {
+	req, err := http.NewRequest("HEAD", c.dialAddr, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	req.Header.Set("State-URI", stateURI.String())
+	req.Header.Set("Leaves", "true")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.Wrap(newHTTPError(resp), "error fetching leaves")
+	}
+
+	leavesHeader, ok := resp.Header["Leaves"]
+	if !ok {
+		return nil, errors.New("server didn't send a Leaves header")
+	}
+
+	var leaves []types.ID
+	for _, header := range leavesHeader {
+		for _, leafStr := range strings.Split(header, ",") {
+			leafStr = strings.TrimSpace(leafStr)
+			if leafStr == "" {
+				continue
+			}
+			leaf, err := types.IDFromHex(leafStr)
+			if err != nil {
+				return nil, errors.New("bad Leaves header")
+			}
+			leaves = append(leaves, leaf)
+		}
+	}
+	return leaves, nil
+}
+
+// Get fetches the state at keypath.  An empty stateURI leaves the choice of
+// state URI to the server.
+func (c *HTTPClient) Get(stateURI types.StateURI, version *types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
+	return c.get(context.Background(), stateURI, version, keypath, rng, raw)
+}
+
+// GetToWriter is like Get, but copies the response into w rather than
+// handing back the body, which is always closed.  It returns the number of
+// bytes copied.  Canceling ctx aborts the download.
+func (c *HTTPClient) GetToWriter(ctx context.Context, stateURI types.StateURI, version *types.ID, keypath tree.Keypath, w io.Writer) (int64, error) {
+	body, _, _, err := c.get(ctx, stateURI, version, keypath, nil, false)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.Copy(w, body)
+	if ctx.Err() != nil {
+		return n, ctx.Err()
+	} else if err != nil {
+		return n, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+func (c *HTTPClient) get(ctx context.Context, stateURI types.StateURI, version *types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
+	resp, err := c.doGet(ctx, stateURI, version, keypath, rng, raw, nil)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return parseGetResponse(resp)
+}
+
+// GetIfNoneMatch is like Get, but sends lastSeen (the version(s) returned by
+// an earlier call) in an If-None-Match header.  If the state hasn't changed
+// since then, it returns ErrNotModified and a nil body without transferring
+// the state.  Otherwise it returns the state along with the version(s) it
+// reflects, which can be passed as lastSeen next time.
+func (c *HTTPClient) GetIfNoneMatch(stateURI types.StateURI, lastSeen []types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
+	resp, err := c.doGet(context.Background(), stateURI, nil, keypath, rng, raw, lastSeen)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, 0, lastSeen, ErrNotModified
+	}
+
+	var versions []types.ID
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		versions, err = versionsFromETag(etag)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, nil, err
+		}
+	}
+
+	body, contentLength, _, err := parseGetResponse(resp)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return body, contentLength, versions, nil
+}
+
+// doGet issues a state request.  Any response other than a 200 or, when
+// ifNoneMatch is set, a 304 is returned as an error.
+func (c *HTTPClient) doGet(ctx context.Context, stateURI types.StateURI, version *types.ID, keypath tree.Keypath, rng *tree.Range, raw bool, ifNoneMatch []types.ID) (*http.Response, error) {
 	url := c.dialAddr + "/" + string(keypath)
 	if raw {
 		url += "?raw=true"
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, 0, nil, errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
 	if stateURI != "" {
-		req.Header.Set("State-URI", stateURI)
+		req.Header.Set("State-URI", stateURI.String())
 	}
 	if version != nil {
 		req.Header.Set("Version", version.Hex())
@@ -209,21 +896,130 @@ func (c *HTTPClient) Get(stateURI string, version *types.ID, keypath tree.Keypat
 	if rng != nil {
 		req.Header.Set("Range", fmt.Sprintf("json=%d:%d", rng.Start, rng.End))
 	}
+	if len(ifNoneMatch) > 0 {
+		req.Header.Set("If-None-Match", versionsETag(ifNoneMatch))
+	}
 
-	resp, err := client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, 0, nil, errors.WithStack(err)
+		return nil, errors.WithStack(err)
+	} else if resp.StatusCode == http.StatusNotModified && len(ifNoneMatch) > 0 {
+		return resp, nil
 	} else if resp.StatusCode != 200 {
+		defer resp.Body.Close()
 		if version != nil {
-			return nil, 0, nil, errors.Errorf("error getting state@%v: (%v) %v", version.Hex(), resp.StatusCode, resp.Status)
+			return nil, errors.Wrapf(newHTTPError(resp), "error getting state@%v", version.Hex())
 		}
-		return nil, 0, nil, errors.Errorf("error getting state@HEAD (%v) %v", resp.StatusCode, resp.Status)
+		return nil, errors.Wrap(newHTTPError(resp), "error getting state@HEAD")
+	}
+	return resp, nil
+}
+
+// StringHTTPClient wraps an HTTPClient with string-based state URI
+// signatures, for compatibility.  Each state URI is checked with
+// types.ParseStateURI before anything is sent, so a malformed one fails
+// with types.ErrInvalidStateURI.  The Get methods also accept an empty
+// state URI, which leaves the choice to the server.
+type StringHTTPClient struct {
+	*HTTPClient
+}
+
+func (c StringHTTPClient) Subscribe(ctx context.Context, stateURI string) (chan MaybeTx, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient.Subscribe(ctx, uri)
+}
+
+func (c StringHTTPClient) SubscribeKeypath(ctx context.Context, stateURI string, keypath tree.Keypath) (chan MaybeTx, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient.SubscribeKeypath(ctx, uri, keypath)
+}
+
+func (c StringHTTPClient) SubscribeFrom(ctx context.Context, stateURI string, fromTxID types.ID) (chan MaybeTx, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient.SubscribeFrom(ctx, uri, fromTxID)
+}
+
+func (c StringHTTPClient) SubscribeWS(ctx context.Context, stateURI string) (chan MaybeTx, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient.SubscribeWS(ctx, uri)
+}
+
+func (c StringHTTPClient) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTPClient.FetchTx(uri, txID)
+}
+
+func (c StringHTTPClient) TxExists(stateURI string, txID types.ID) (bool, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return false, err
+	}
+	return c.HTTPClient.TxExists(uri, txID)
+}
+
+func (c StringHTTPClient) Leaves(stateURI string) ([]types.ID, error) {
+	uri, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
 	}
+	return c.HTTPClient.Leaves(uri)
+}
 
+func (c StringHTTPClient) Get(stateURI string, version *types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
+	uri, err := parseOptionalStateURI(stateURI)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return c.HTTPClient.Get(uri, version, keypath, rng, raw)
+}
+
+func (c StringHTTPClient) GetToWriter(ctx context.Context, stateURI string, version *types.ID, keypath tree.Keypath, w io.Writer) (int64, error) {
+	uri, err := parseOptionalStateURI(stateURI)
+	if err != nil {
+		return 0, err
+	}
+	return c.HTTPClient.GetToWriter(ctx, uri, version, keypath, w)
+}
+
+func (c StringHTTPClient) GetIfNoneMatch(stateURI string, lastSeen []types.ID, keypath tree.Keypath, rng *tree.Range, raw bool) (io.ReadCloser, int64, []types.ID, error) {
+	uri, err := parseOptionalStateURI(stateURI)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return c.HTTPClient.GetIfNoneMatch(uri, lastSeen, keypath, rng, raw)
+}
+
+func parseOptionalStateURI(stateURI string) (types.StateURI, error) {
+	if stateURI == "" {
+		return "", nil
+	}
+	return types.ParseStateURI(stateURI)
+}
+
+// parseGetResponse takes ownership of the body of a successful state
+// response.
+func parseGetResponse(resp *http.Response) (io.ReadCloser, int64, []types.ID, error) {
 	var contentLength int
 	if contentLengthStr := resp.Header.Get("Content-Length"); contentLengthStr != "" {
+		var err error
 		contentLength, err = strconv.Atoi(contentLengthStr)
 		if err != nil {
+			resp.Body.Close()
 			return nil, 0, nil, err
 		}
 	}
@@ -235,6 +1031,7 @@ func (c *HTTPClient) Get(stateURI string, version *types.ID, keypath tree.Keypat
 			pstr = strings.TrimSpace(pstr)
 			pid, err := types.IDFromHex(pstr)
 			if err != nil {
+				resp.Body.Close()
 				return nil, 0, nil, errors.New("bad parents header")
 			}
 			parents = append(parents, pid)
@@ -245,6 +1042,28 @@ func (c *HTTPClient) Get(stateURI string, version *types.ID, keypath tree.Keypat
 }
 
 func (c *HTTPClient) Put(ctx context.Context, tx *Tx, recipientAddress types.Address, recipientEncPubkey crypto.EncryptingPublicKey) error {
+	return c.put(ctx, tx, nil, recipientAddress, recipientEncPubkey)
+}
+
+// ErrConflict is returned by ControllerHub.AddTx, and by PutIfParents, when
+// the state URI's leaves aren't the ones that were expected.
+var ErrConflict = errors.New("conflict")
+
+// PutIfParents is like Put, but sends the leaves that the caller expects the
+// state URI to have (typically the tx's parents, as last seen by Get) in an
+// If-Parents header.  If the state has moved on since, the server rejects the
+// tx with a 409 and ErrConflict is returned.  An empty, non-nil
+// expectedLeaves asserts that the state has no txs yet.
+func (c *HTTPClient) PutIfParents(ctx context.Context, tx *Tx, expectedLeaves []types.ID, recipientAddress types.Address, recipientEncPubkey crypto.EncryptingPublicKey) error {
+	if expectedLeaves == nil {
+		expectedLeaves = []types.ID{}
+	}
+	return c.put(ctx, tx, expectedLeaves, recipientAddress, recipientEncPubkey)
+}
+
+// put sends a tx.  If ifParents is non-nil, it's sent in an If-Parents
+// header.
+func (c *HTTPClient) put(ctx context.Context, tx *Tx, ifParents []types.ID, recipientAddress types.Address, recipientEncPubkey crypto.EncryptingPublicKey) error {
 	if len(tx.Sig) == 0 {
 		sig, err := c.sigkeys.SignHash(tx.Hash())
 		if err != nil {
@@ -257,52 +1076,269 @@ func (c *HTTPClient) Put(ctx context.Context, tx *Tx, recipientAddress types.Add
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	if ifParents != nil {
+		parentStrs := make([]string, len(ifParents))
+		for i, parent := range ifParents {
+			parentStrs[i] = parent.Hex()
+		}
+		req.Header.Set("If-Parents", strings.Join(parentStrs, ","))
+	}
 
-	resp, err := c.client().Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return errors.WithStack(err)
-	} else if resp.StatusCode != 200 {
-		return errors.Errorf("error putting tx: (%v) %v", resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict && ifParents != nil {
+		return errors.Wrapf(ErrConflict, "error putting tx: %v", newHTTPError(resp))
+	} else if resp.StatusCode != 200 {
+		return errors.Wrap(newHTTPError(resp), "error putting tx")
+	}
 	return nil
 }
 
+// RetryPolicy controls how many times, and how often, a request is retried.
+type RetryPolicy struct {
+	MaxAttempts    int           // including the first attempt
+	InitialBackoff time.Duration // the delay before the first retry
+	MaxBackoff     time.Duration // the delay doubles after each retry, up to this (zero means no cap)
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// PutWithRetry is like Put, but retries when the connection times out, is
+// refused or is reset, or when the server responds with a 502, 503 or 504.  Retrying is safe even if an earlier
+// attempt reached the server, because servers ignore txs that they already
+// have.  The tx is signed once, before the first attempt.  It gives up after
+// policy.MaxAttempts attempts (returning the last error), or when ctx is
+// canceled.
+func (c *HTTPClient) PutWithRetry(ctx context.Context, tx *Tx, recipientAddress types.Address, recipientEncPubkey crypto.EncryptingPublicKey, policy RetryPolicy) error {
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.Put(ctx, tx, recipientAddress, recipientEncPubkey)
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if attempt >= policy.MaxAttempts || !isRetryableHTTPError(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff <= math.MaxInt64/2 {
+			backoff *= 2
+		}
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// isRetryableHTTPError returns true for errors that might go away if the
+// request is repeated: network timeouts, refused or reset connections, and
+// gateway or availability errors.  Anything else that fails before a
+// response arrives (bad TLS, an unsupported scheme, a refused redirect, a
+// canceled context) will just fail the same way again.
+func isRetryableHTTPError(err error) bool {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrRedirectRefused) {
+		return false
+	} else if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	// *url.Error is itself a net.Error, so look for the error it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// StoreRef uploads a blob to the server.  Before uploading, it hashes the
+// blob (spooling it to a temp file if file isn't an io.ReadSeeker) and asks
+// the server whether it already has it, in which case nothing is uploaded.
+// If the server reports that it holds a partial upload of the blob and
+// advertises "Accept-Ranges: bytes", only the remainder is sent.  The blob
+// is labelled application/octet-stream; use StoreRefWithContentType to tell
+// the server its real type.
 func (c *HTTPClient) StoreRef(file io.Reader) (StoreRefResponse, error) {
-	client := c.client()
+	return c.StoreRefWithContentType(file, "application/octet-stream")
+}
 
-	var buf bytes.Buffer
-	w := multipart.NewWriter(&buf)
+// StoreRefWithContentType is like StoreRef, but labels the uploaded blob with
+// the given content type.  If contentType is empty, it's sniffed from the
+// blob's contents.
+func (c *HTTPClient) StoreRefWithContentType(file io.Reader, contentType string) (StoreRefResponse, error) {
+	seeker, ok := file.(io.ReadSeeker)
+	if !ok {
+		spool, err := ioutil.TempFile("", "redwood-ref-")
+		if err != nil {
+			return StoreRefResponse{}, errors.WithStack(err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		_, err = io.Copy(spool, file)
+		if err != nil {
+			return StoreRefResponse{}, errors.WithStack(err)
+		}
+		seeker = spool
+	}
 
-	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "ref", "ref"))
-	h.Set("Content-Type", "application/octet-stream")
-	fileWriter, err := w.CreatePart(h)
+	if contentType == "" {
+		var err error
+		contentType, err = SniffContentTypeSeeker("", seeker)
+		if err != nil {
+			return StoreRefResponse{}, err
+		}
+	}
+
+	hashes, size, err := hashRef(seeker)
+	if err != nil {
+		return StoreRefResponse{}, err
+	}
+
+	received, exists, err := c.refUploadStatus(hashes.SHA3)
+	if err != nil {
+		return StoreRefResponse{}, err
+	} else if exists {
+		return hashes, nil
+	}
+
+	if received > 0 && received < size {
+		return c.resumeStoreRef(seeker, contentType, hashes, received, size)
+	}
+	return c.storeRef(seeker, contentType)
+}
+
+func hashRef(file io.ReadSeeker) (StoreRefResponse, int64, error) {
+	sha1Hasher := sha1.New()
+	sha3Hasher := sha3.NewLegacyKeccak256()
+
+	size, err := io.Copy(io.MultiWriter(sha1Hasher, sha3Hasher), file)
+	if err != nil {
+		return StoreRefResponse{}, 0, errors.WithStack(err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return StoreRefResponse{}, 0, errors.WithStack(err)
+	}
+
+	var hashes StoreRefResponse
+	copy(hashes.SHA1[:], sha1Hasher.Sum(nil))
+	copy(hashes.SHA3[:], sha3Hasher.Sum(nil))
+	return hashes, size, nil
+}
+
+// refUploadStatus asks the server whether it has the blob with the given
+// sha3 hash.  If it doesn't, but it has received part of it and supports
+// resuming, the number of bytes received so far is returned.  Servers that
+// don't understand the request simply never report that the ref exists.
+func (c *HTTPClient) refUploadStatus(sha3Hash types.Hash) (received int64, exists bool, _ error) {
+	req, err := http.NewRequest("HEAD", c.dialAddr, nil)
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+	req.Header.Set("Ref", "true")
+	req.Header.Set("Ref-SHA3", sha3Hash.Hex())
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Ref-Exists") == "true" {
+		return 0, true, nil
+	} else if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return 0, false, nil
+	}
+	received, err = strconv.ParseInt(resp.Header.Get("Ref-Received"), 10, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	return received, false, nil
+}
+
+func (c *HTTPClient) resumeStoreRef(file io.ReadSeeker, contentType string, hashes StoreRefResponse, offset, size int64) (StoreRefResponse, error) {
+	_, err := file.Seek(offset, io.SeekStart)
 	if err != nil {
 		return StoreRefResponse{}, errors.WithStack(err)
 	}
 
-	// @@TODO: streaming?
-	_, err = io.Copy(fileWriter, file)
+	req, err := http.NewRequest("POST", c.dialAddr, ioutil.NopCloser(file))
 	if err != nil {
 		return StoreRefResponse{}, errors.WithStack(err)
 	}
-	w.Close()
+	req.ContentLength = size - offset
+	req.Header.Set("Ref", "true")
+	req.Header.Set("Ref-SHA3", hashes.SHA3.Hex())
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	return c.doStoreRef(req)
+}
+
+func (c *HTTPClient) storeRef(file io.Reader, contentType string) (StoreRefResponse, error) {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+
+	go func() {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "ref", "ref"))
+		h.Set("Content-Type", contentType)
+		fileWriter, err := w.CreatePart(h)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(fileWriter, file)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
 
-	req, err := http.NewRequest("POST", c.dialAddr, &buf)
+	req, err := http.NewRequest("POST", c.dialAddr, pr)
 	if err != nil {
+		pr.Close()
 		return StoreRefResponse{}, errors.WithStack(err)
 	}
 	req.Header.Set("Ref", "true")
 	req.Header.Set("Content-Type", w.FormDataContentType())
 
-	resp, err := client.Do(req)
+	resp, err := c.doStoreRef(req)
+	pr.Close()
+	return resp, err
+}
+
+func (c *HTTPClient) doStoreRef(req *http.Request) (StoreRefResponse, error) {
+	resp, err := c.do(req)
 	if err != nil {
 		return StoreRefResponse{}, errors.WithStack(err)
-	} else if resp.StatusCode != 200 {
-		return StoreRefResponse{}, errors.Errorf("error storing ref: (%v) %v", resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return StoreRefResponse{}, errors.Wrap(newHTTPError(resp), "error storing ref")
+	}
 
 	var body StoreRefResponse
 	err = json.NewDecoder(resp.Body).Decode(&body)
@@ -311,3 +1347,74 @@ func (c *HTTPClient) StoreRef(file io.Reader) (StoreRefResponse, error) {
 	}
 	return body, nil
 }
+
+// StoreRefs uploads several blobs in a single multipart request.  The
+// responses are returned in the lexical order of the files' names.  Each
+// part is labelled with its own sniffed content type.
+func (c *HTTPClient) StoreRefs(files map[string]io.Reader) ([]StoreRefResponse, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+
+	go func() {
+		var err error
+		defer func() { pw.CloseWithError(err) }()
+
+		for _, name := range names {
+			var contentType string
+			var file io.Reader
+			contentType, file, err = SniffAndReturn(name, files[name])
+			if err != nil {
+				return
+			}
+
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "ref", name))
+			h.Set("Content-Type", contentType)
+
+			var fileWriter io.Writer
+			fileWriter, err = w.CreatePart(h)
+			if err != nil {
+				return
+			}
+			_, err = io.Copy(fileWriter, file)
+			if err != nil {
+				return
+			}
+		}
+		err = w.Close()
+	}()
+
+	req, err := http.NewRequest("POST", c.dialAddr, pr)
+	if err != nil {
+		pr.Close()
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Ref", "true")
+	req.Header.Set("Ref-Batch", "true")
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	resp, err := c.do(req)
+	if err != nil {
+		pr.Close()
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.Wrap(newHTTPError(resp), "error storing refs")
+	}
+
+	var body []StoreRefResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	} else if len(body) != len(names) {
+		return nil, errors.Errorf("error storing refs: sent %v, got %v responses", len(names), len(body))
+	}
+	return body, nil
+}
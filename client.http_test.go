@@ -0,0 +1,1276 @@
+package redwood_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
+
+	"redwood.dev"
+	"redwood.dev/crypto"
+	"redwood.dev/tree"
+	"redwood.dev/types"
+)
+
+func newTestHTTPClient(t *testing.T, server *httptest.Server) *redwood.HTTPClient {
+	t.Helper()
+
+	c, err := redwood.NewHTTPClient(server.URL, nil, nil, false)
+	require.NoError(t, err)
+	return c
+}
+
+func TestHTTPClient_Ping(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "HEAD", r.Method)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		err := newTestHTTPClient(t, server).Ping(context.Background())
+		require.NoError(t, err)
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		err := newTestHTTPClient(t, server).Ping(context.Background())
+		require.Error(t, err)
+
+		httpErr, is := errors.Cause(err).(redwood.HTTPError)
+		require.True(t, is)
+		require.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+
+		err := newTestHTTPClient(t, server).Ping(context.Background())
+		require.Error(t, err)
+
+		_, is := errors.Cause(err).(redwood.HTTPError)
+		require.False(t, is)
+	})
+}
+
+func TestHTTPClient_HTTPError(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		call func(c *redwood.HTTPClient) error
+	}{
+		{"Authorize", func(c *redwood.HTTPClient) error {
+			return c.Authorize()
+		}},
+		{"Subscribe", func(c *redwood.HTTPClient) error {
+			_, err := c.Subscribe(context.Background(), "foo.bar/blah")
+			return err
+		}},
+		{"FetchTx", func(c *redwood.HTTPClient) error {
+			_, err := c.FetchTx("foo.bar/blah", types.RandomID())
+			return err
+		}},
+		{"Get", func(c *redwood.HTTPClient) error {
+			_, _, _, err := c.Get("foo.bar/blah", nil, nil, nil, false)
+			return err
+		}},
+		{"Put", func(c *redwood.HTTPClient) error {
+			tx := &redwood.Tx{ID: types.RandomID(), StateURI: "foo.bar/blah", From: sigkeys.Address()}
+			return c.Put(context.Background(), tx, types.Address{}, nil)
+		}},
+		{"StoreRef", func(c *redwood.HTTPClient) error {
+			_, err := c.StoreRef(bytes.NewReader([]byte("blob")))
+			return err
+		}},
+		{"StoreRefs", func(c *redwood.HTTPClient) error {
+			_, err := c.StoreRefs(map[string]io.Reader{"a": bytes.NewReader([]byte("blob"))})
+			return err
+		}},
+	}
+
+	for _, statusCode := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		statusCode := statusCode
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				return
+			}
+			http.Error(w, "something went wrong", statusCode)
+		}))
+		defer server.Close()
+
+		c, err := redwood.NewHTTPClient(server.URL, sigkeys, nil, false)
+		require.NoError(t, err)
+
+		for _, test := range tests {
+			test := test
+			t.Run(fmt.Sprintf("%v %v", test.name, statusCode), func(t *testing.T) {
+				err := test.call(c)
+				require.Error(t, err)
+
+				var httpErr redwood.HTTPError
+				require.True(t, errors.As(err, &httpErr), "%+v", err)
+				require.Equal(t, statusCode, httpErr.StatusCode)
+				require.Equal(t, "something went wrong\n", string(httpErr.Body))
+				require.False(t, redwood.IsNotFound(err))
+			})
+		}
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		}))
+		defer server.Close()
+
+		c := newTestHTTPClient(t, server)
+
+		// FetchTx still reports types.Err404
+		_, err := c.FetchTx("foo.bar/blah", types.RandomID())
+		require.Equal(t, types.Err404, err)
+		require.True(t, redwood.IsNotFound(err))
+
+		_, _, _, err = c.Get("foo.bar/blah", nil, nil, nil, false)
+		require.True(t, redwood.IsNotFound(err))
+	})
+}
+
+func TestHTTPClient_TxExists(t *testing.T) {
+	existing := types.RandomID()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		require.Equal(t, "foo.bar/blah", r.Header.Get("State-URI"))
+
+		switch r.URL.Path {
+		case "/__tx/" + existing.Hex():
+		case "/__tx/" + redwood.GenesisTxID.Hex():
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestHTTPClient(t, server)
+
+	exists, err := c.TxExists("foo.bar/blah", existing)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	exists, err = c.TxExists("foo.bar/blah", types.RandomID())
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, err = c.TxExists("foo.bar/blah", redwood.GenesisTxID)
+	var httpErr redwood.HTTPError
+	require.True(t, errors.As(err, &httpErr))
+	require.Equal(t, http.StatusInternalServerError, httpErr.StatusCode)
+}
+
+func TestHTTPClient_Leaves(t *testing.T) {
+	leaves := []types.ID{types.RandomID(), types.RandomID()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		require.Equal(t, "true", r.Header.Get("Leaves"))
+
+		switch r.Header.Get("State-URI") {
+		case "foo.bar/blah":
+			w.Header().Set("Leaves", leaves[0].Hex()+","+leaves[1].Hex())
+		case "foo.bar/empty":
+			w.Header().Set("Leaves", "")
+		case "foo.bar/unsupported":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestHTTPClient(t, server)
+
+	got, err := c.Leaves("foo.bar/blah")
+	require.NoError(t, err)
+	require.Equal(t, leaves, got)
+
+	got, err = c.Leaves("foo.bar/empty")
+	require.NoError(t, err)
+	require.Len(t, got, 0)
+
+	_, err = c.Leaves("foo.bar/unsupported")
+	require.Error(t, err)
+
+	_, err = c.Leaves("foo.bar/missing")
+	require.True(t, redwood.IsNotFound(err))
+}
+
+func TestStringHTTPClient(t *testing.T) {
+	var stateURIs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stateURIs = append(stateURIs, r.Header.Get("State-URI"))
+	}))
+	defer server.Close()
+
+	c := redwood.StringHTTPClient{HTTPClient: newTestHTTPClient(t, server)}
+
+	const malformed = "foo.bar"
+
+	_, err := c.Subscribe(context.Background(), malformed)
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	_, err = c.SubscribeWS(context.Background(), malformed)
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	_, err = c.FetchTx(malformed, types.RandomID())
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	_, err = c.TxExists(malformed, types.RandomID())
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	_, err = c.Leaves(malformed)
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	_, _, _, err = c.Get(malformed, nil, nil, nil, false)
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	require.Len(t, stateURIs, 0)
+
+	// Well-formed URIs are passed along, and Get may leave the state URI up
+	// to the server
+	_, err = c.TxExists("foo.bar/blah", types.RandomID())
+	require.NoError(t, err)
+	body, _, _, err := c.Get("", nil, nil, nil, false)
+	require.NoError(t, err)
+	body.Close()
+	require.Equal(t, []string{"foo.bar/blah", ""}, stateURIs)
+}
+
+func TestHTTPClient_DefaultHeaders(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c, err := redwood.NewHTTPClient(server.URL, nil, nil, false,
+		redwood.HTTPClientDefaultHeader("X-Trace-Id", "abc123"),
+		redwood.HTTPClientDefaultHeader("State-URI", "should.not/win"),
+	)
+	require.NoError(t, err)
+
+	body, _, _, err := c.Get("foo.bar/blah", nil, nil, nil, false)
+	require.NoError(t, err)
+	body.Close()
+
+	require.Equal(t, "abc123", headers.Get("X-Trace-Id"))
+	require.Equal(t, []string{"foo.bar/blah"}, headers["State-Uri"])
+}
+
+func TestHTTPClient_Timeouts(t *testing.T) {
+	t.Run("dial", func(t *testing.T) {
+		// A non-routable address, so the SYN goes unanswered
+		const blackHole = "10.255.255.1:80"
+		conn, err := net.DialTimeout("tcp", blackHole, 200*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			t.Skip("this network accepts connections to " + blackHole)
+		}
+
+		c, err := redwood.NewHTTPClient("http://"+blackHole, nil, nil, false, redwood.HTTPClientDialTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		start := time.Now()
+		err = c.Ping(context.Background())
+		require.Error(t, err)
+		require.True(t, time.Since(start) < 5*time.Second, "%v", time.Since(start))
+	})
+
+	t.Run("TLS handshake", func(t *testing.T) {
+		// Accepts connections, but never says anything
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		c, err := redwood.NewHTTPClient("https://"+listener.Addr().String(), nil, nil, true, redwood.HTTPClientTLSHandshakeTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		start := time.Now()
+		err = c.Ping(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "TLS handshake timeout")
+		require.True(t, time.Since(start) < 5*time.Second, "%v", time.Since(start))
+	})
+
+	t.Run("response headers", func(t *testing.T) {
+		chDone := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-chDone
+		}))
+		defer server.Close()
+		defer close(chDone)
+
+		c, err := redwood.NewHTTPClient(server.URL, nil, nil, false, redwood.HTTPClientResponseHeaderTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		start := time.Now()
+		err = c.Ping(context.Background())
+		require.Error(t, err)
+		require.True(t, time.Since(start) < 5*time.Second, "%v", time.Since(start))
+	})
+}
+
+func TestHTTPClient_RateLimiter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	t.Run("spaces out requests", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+
+		const interval = 50 * time.Millisecond
+		c, err := redwood.NewHTTPClient(server.URL, nil, nil, false,
+			redwood.HTTPClientRateLimiter(rate.NewLimiter(rate.Every(interval), 1)),
+		)
+		require.NoError(t, err)
+
+		const n = 5
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			_, err := c.TxExists("foo.bar/blah", types.RandomID())
+			require.NoError(t, err)
+		}
+		// The first request uses up the burst
+		require.True(t, time.Since(start) >= (n-1)*interval, "%v", time.Since(start))
+		require.Equal(t, int32(n), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("waiting respects the context", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+
+		c, err := redwood.NewHTTPClient(server.URL, nil, nil, false,
+			redwood.HTTPClientRateLimiter(rate.NewLimiter(rate.Every(time.Hour), 1)),
+		)
+		require.NoError(t, err)
+
+		_, err = c.GetToWriter(context.Background(), "foo.bar/blah", nil, nil, ioutil.Discard)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err = c.GetToWriter(ctx, "foo.bar/blah", nil, nil, ioutil.Discard)
+		require.Equal(t, context.Canceled, errors.Cause(err))
+		require.True(t, time.Since(start) < 5*time.Second)
+		require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	})
+}
+
+func TestHTTPClient_Redirects(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	var elsewhereHits int32
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&elsewhereHits, 1)
+	}))
+	defer elsewhere.Close()
+
+	// Sends requests for /away to the other server, and everything else to
+	// /here on itself.  307 preserves the method and body.
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/here":
+			w.Write([]byte(`"landed"`))
+		case strings.HasPrefix(r.URL.Path, "/away"):
+			http.Redirect(w, r, elsewhere.URL+"/", http.StatusTemporaryRedirect)
+		default:
+			http.Redirect(w, r, server.URL+"/here", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer server.Close()
+
+	newClient := func(t *testing.T, path string, opts ...redwood.HTTPClientOption) *redwood.HTTPClient {
+		t.Helper()
+		c, err := redwood.NewHTTPClient(server.URL+path, sigkeys, nil, false, opts...)
+		require.NoError(t, err)
+		return c
+	}
+
+	tx := &redwood.Tx{
+		ID:       types.RandomID(),
+		StateURI: "foo.bar/blah",
+		From:     sigkeys.Address(),
+		Parents:  []types.ID{redwood.GenesisTxID},
+		Patches:  []redwood.Patch{{Keypath: tree.Keypath("text"), Val: "hello"}},
+	}
+
+	// Wrapping the reader hides its Seek method, so StoreRef goes straight to
+	// the upload
+	storeRef := func(c *redwood.HTTPClient) error {
+		_, err := c.StoreRef(ioutil.NopCloser(bytes.NewReader([]byte("blob"))))
+		return err
+	}
+	put := func(c *redwood.HTTPClient) error {
+		return c.Put(context.Background(), tx, sigkeys.Address(), nil)
+	}
+	get := func(c *redwood.HTTPClient) error {
+		_, err := c.GetToWriter(context.Background(), "foo.bar/blah", nil, nil, ioutil.Discard)
+		return err
+	}
+
+	requireRefused := func(t *testing.T, err error) {
+		t.Helper()
+		require.True(t, errors.Is(err, redwood.ErrRedirectRefused), "%+v", err)
+	}
+
+	t.Run("refuses cross-host redirects by default", func(t *testing.T) {
+		c := newClient(t, "/away")
+		requireRefused(t, put(c))
+		requireRefused(t, storeRef(c))
+		requireRefused(t, c.Authorize())
+		requireRefused(t, get(c))
+		require.Equal(t, int32(0), atomic.LoadInt32(&elsewhereHits))
+	})
+
+	t.Run("refuses same-host redirects by default", func(t *testing.T) {
+		requireRefused(t, get(newClient(t, "/elsewhere")))
+	})
+
+	t.Run("same-host policy", func(t *testing.T) {
+		opt := redwood.HTTPClientRedirectPolicy(redwood.RedirectSameHost)
+
+		require.NoError(t, get(newClient(t, "/elsewhere", opt)))
+
+		// Still no cross-host redirects
+		requireRefused(t, get(newClient(t, "/away", opt)))
+		require.Equal(t, int32(0), atomic.LoadInt32(&elsewhereHits))
+
+		// And nothing that changes state is redirected at all
+		c := newClient(t, "/elsewhere", opt)
+		requireRefused(t, put(c))
+		requireRefused(t, storeRef(c))
+		requireRefused(t, c.Authorize())
+	})
+}
+
+func TestHTTPClient_UserAgentAndRequestID(t *testing.T) {
+	var userAgent, requestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		requestID = r.Header.Get("X-Request-Id")
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	t.Run("defaults", func(t *testing.T) {
+		c := newTestHTTPClient(t, server)
+
+		_, err := c.FetchTx("foo.bar/blah", types.RandomID())
+		var httpErr redwood.HTTPError
+		require.True(t, errors.As(err, &httpErr))
+		require.Equal(t, "redwood-go/"+redwood.HTTPClientVersion, userAgent)
+		require.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, requestID)
+		require.Equal(t, requestID, httpErr.RequestID)
+
+		firstRequestID := requestID
+		_, err = c.FetchTx("foo.bar/blah", types.RandomID())
+		require.True(t, errors.As(err, &httpErr))
+		require.NotEqual(t, firstRequestID, requestID)
+		require.Equal(t, requestID, httpErr.RequestID)
+	})
+
+	t.Run("overridden", func(t *testing.T) {
+		c, err := redwood.NewHTTPClient(server.URL, nil, nil, false, redwood.HTTPClientUserAgent("my-app/1.2"))
+		require.NoError(t, err)
+
+		_, err = c.FetchTx("foo.bar/blah", types.RandomID())
+		var httpErr redwood.HTTPError
+		require.True(t, errors.As(err, &httpErr))
+		require.Equal(t, "my-app/1.2", userAgent)
+		require.Equal(t, requestID, httpErr.RequestID)
+	})
+}
+
+func TestHTTPClient_Gzip(t *testing.T) {
+	t.Run("responses are decompressed", func(t *testing.T) {
+		tx := &redwood.Tx{ID: types.RandomID(), StateURI: "foo.bar/blah"}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(w)
+			defer gzipWriter.Close()
+			err := json.NewEncoder(gzipWriter).Encode(tx)
+			require.NoError(t, err)
+		}))
+		defer server.Close()
+
+		c, err := redwood.NewHTTPClient(server.URL, nil, nil, false, redwood.HTTPClientGzip(1024))
+		require.NoError(t, err)
+
+		fetched, err := c.FetchTx(types.StateURI(tx.StateURI), tx.ID)
+		require.NoError(t, err)
+		require.Equal(t, tx.ID, fetched.ID)
+		require.Equal(t, tx.StateURI, fetched.StateURI)
+	})
+
+	t.Run("large request bodies are compressed", func(t *testing.T) {
+		data := bytes.Repeat([]byte("redwood "), 1000)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				// StoreRef's existence precheck
+				return
+			}
+			require.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+			require.Less(t, r.ContentLength, int64(len(data)))
+
+			gzipReader, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			r.Body = gzipReader
+
+			file, _, err := r.FormFile("ref")
+			require.NoError(t, err)
+			bs, err := ioutil.ReadAll(file)
+			require.NoError(t, err)
+			require.Equal(t, data, bs)
+
+			err = json.NewEncoder(w).Encode(redwood.StoreRefResponse{})
+			require.NoError(t, err)
+		}))
+		defer server.Close()
+
+		c, err := redwood.NewHTTPClient(server.URL, nil, nil, false, redwood.HTTPClientGzip(1024))
+		require.NoError(t, err)
+
+		_, err = c.StoreRef(bytes.NewReader(data))
+		require.NoError(t, err)
+	})
+}
+
+func TestHTTPClient_H2C(t *testing.T) {
+	var protoMajor int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoMajor = r.ProtoMajor
+		require.Equal(t, "foo.bar/blah", r.Header.Get("State-URI"))
+		w.Write([]byte(`{"text":"hello"}`))
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+
+	c, err := redwood.NewHTTPClient(server.URL, nil, nil, false, redwood.HTTPClientH2C())
+	require.NoError(t, err)
+
+	body, _, _, err := c.Get("foo.bar/blah", nil, nil, nil, false)
+	require.NoError(t, err)
+	defer body.Close()
+
+	bs, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.Equal(t, `{"text":"hello"}`, string(bs))
+	require.Equal(t, 2, protoMajor)
+}
+
+func TestHTTPClient_GetToWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/foo/bar", r.URL.Path)
+		require.Equal(t, "foo.bar/blah", r.Header.Get("State-URI"))
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	n, err := newTestHTTPClient(t, server).GetToWriter(context.Background(), "foo.bar/blah", nil, tree.Keypath("foo/bar"), &buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), n)
+	require.Equal(t, content, buf.Bytes())
+
+	t.Run("canceled", func(t *testing.T) {
+		chStarted := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content[:1024])
+			w.(http.Flusher).Flush()
+			close(chStarted)
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-chStarted
+			cancel()
+		}()
+
+		var buf bytes.Buffer
+		_, err := newTestHTTPClient(t, server).GetToWriter(ctx, "foo.bar/blah", nil, nil, &buf)
+		require.True(t, errors.Is(err, context.Canceled), "%+v", err)
+	})
+}
+
+func TestHTTPClient_GetIfNoneMatch(t *testing.T) {
+	version := types.RandomID()
+	var bodiesSent int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + version.Hex() + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		bodiesSent++
+		w.Write([]byte(`"hello"`))
+	}))
+	defer server.Close()
+
+	c := newTestHTTPClient(t, server)
+
+	body, _, versions, err := c.GetIfNoneMatch("foo.bar/blah", nil, tree.Keypath("text"), nil, false)
+	require.NoError(t, err)
+	bs, err := ioutil.ReadAll(body)
+	body.Close()
+	require.NoError(t, err)
+	require.Equal(t, `"hello"`, string(bs))
+	require.Equal(t, []types.ID{version}, versions)
+	require.Equal(t, 1, bodiesSent)
+
+	body, _, versions, err = c.GetIfNoneMatch("foo.bar/blah", versions, tree.Keypath("text"), nil, false)
+	require.Equal(t, redwood.ErrNotModified, err)
+	require.Nil(t, body)
+	require.Equal(t, []types.ID{version}, versions)
+	require.Equal(t, 1, bodiesSent)
+
+	version = types.RandomID()
+
+	body, _, versions, err = c.GetIfNoneMatch("foo.bar/blah", versions, tree.Keypath("text"), nil, false)
+	require.NoError(t, err)
+	body.Close()
+	require.Equal(t, []types.ID{version}, versions)
+	require.Equal(t, 2, bodiesSent)
+}
+
+func TestHTTPClient_PutWithRetry(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	policy := redwood.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	newTx := func() *redwood.Tx {
+		return &redwood.Tx{
+			ID:       types.RandomID(),
+			StateURI: "foo.bar/blah",
+			From:     sigkeys.Address(),
+			Parents:  []types.ID{redwood.GenesisTxID},
+			Patches:  []redwood.Patch{{Keypath: tree.Keypath("text"), Val: "hello"}},
+		}
+	}
+
+	type landedTx struct {
+		id  string
+		sig string
+	}
+
+	// responses[i] is the status code for the ith attempt.  A 502 still
+	// stores the tx, as if only the response were lost.
+	setup := func(t *testing.T, responses ...int) (*redwood.HTTPClient, *int32, *[]landedTx, func()) {
+		t.Helper()
+
+		var (
+			attempts int32
+			mu       sync.Mutex
+			landed   []landedTx
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "PUT", r.Method)
+			i := atomic.AddInt32(&attempts, 1) - 1
+
+			statusCode := http.StatusOK
+			if int(i) < len(responses) {
+				statusCode = responses[i]
+			}
+			if statusCode == http.StatusOK || statusCode == http.StatusBadGateway {
+				mu.Lock()
+				tx := landedTx{r.Header.Get("Version"), r.Header.Get("Signature")}
+				// Like a real server, ignore txs that are already known
+				var known bool
+				for _, x := range landed {
+					known = known || x.id == tx.id
+				}
+				if !known {
+					landed = append(landed, tx)
+				}
+				mu.Unlock()
+			}
+			w.WriteHeader(statusCode)
+		}))
+
+		c, err := redwood.NewHTTPClient(server.URL, sigkeys, nil, false)
+		require.NoError(t, err)
+		return c, &attempts, &landed, server.Close
+	}
+
+	t.Run("fails twice, then succeeds", func(t *testing.T) {
+		c, attempts, landed, cleanup := setup(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+		defer cleanup()
+
+		tx := newTx()
+		err := c.PutWithRetry(context.Background(), tx, types.Address{}, nil, policy)
+		require.NoError(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(attempts))
+		require.Equal(t, []landedTx{{tx.ID.Hex(), tx.Sig.Hex()}}, *landed)
+	})
+
+	t.Run("gives up after MaxAttempts", func(t *testing.T) {
+		c, attempts, _, cleanup := setup(t, 503, 503, 503, 503, 503, 503)
+		defer cleanup()
+
+		err := c.PutWithRetry(context.Background(), newTx(), types.Address{}, nil, policy)
+		var httpErr redwood.HTTPError
+		require.True(t, errors.As(err, &httpErr))
+		require.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode)
+		require.Equal(t, int32(policy.MaxAttempts), atomic.LoadInt32(attempts))
+	})
+
+	t.Run("doesn't retry other errors", func(t *testing.T) {
+		c, attempts, _, cleanup := setup(t, http.StatusBadRequest)
+		defer cleanup()
+
+		err := c.PutWithRetry(context.Background(), newTx(), types.Address{}, nil, policy)
+		require.Error(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(attempts))
+	})
+
+	t.Run("retries connection errors", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Close()
+
+		c, err := redwood.NewHTTPClient(server.URL, sigkeys, nil, false)
+		require.NoError(t, err)
+
+		// Long enough backoff that the context expires first
+		slowPolicy := redwood.RetryPolicy{MaxAttempts: 100, InitialBackoff: 50 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		err = c.PutWithRetry(ctx, newTx(), types.Address{}, nil, slowPolicy)
+		require.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	// A backoff long enough that the context expires if anything is retried
+	noRetryPolicy := redwood.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Minute}
+
+	t.Run("doesn't retry TLS errors", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		c, err := redwood.NewHTTPClient(strings.Replace(server.URL, "http://", "https://", 1), sigkeys, nil, true)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = c.PutWithRetry(ctx, newTx(), types.Address{}, nil, noRetryPolicy)
+		require.Error(t, err)
+		require.NotEqual(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("doesn't retry refused redirects", func(t *testing.T) {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			http.Redirect(w, r, "/elsewhere", http.StatusTemporaryRedirect)
+		}))
+		defer server.Close()
+
+		c, err := redwood.NewHTTPClient(server.URL, sigkeys, nil, false)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = c.PutWithRetry(ctx, newTx(), types.Address{}, nil, noRetryPolicy)
+		require.True(t, errors.Is(err, redwood.ErrRedirectRefused), "%+v", err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	})
+
+	t.Run("zero MaxBackoff doesn't cap the backoff", func(t *testing.T) {
+		c, attempts, _, cleanup := setup(t, 503, 503)
+		defer cleanup()
+
+		uncapped := redwood.RetryPolicy{MaxAttempts: 3, InitialBackoff: 50 * time.Millisecond}
+		start := time.Now()
+		err := c.PutWithRetry(context.Background(), newTx(), types.Address{}, nil, uncapped)
+		require.NoError(t, err)
+		require.Equal(t, int32(3), atomic.LoadInt32(attempts))
+		require.True(t, time.Since(start) >= 150*time.Millisecond, "%v", time.Since(start))
+	})
+}
+
+func TestHTTPClient_PutIfParents(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	leaf := types.RandomID()
+	var ifParentsHeaders [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifParentsHeaders = append(ifParentsHeaders, r.Header["If-Parents"])
+		if ifParents, exists := r.Header["If-Parents"]; exists && ifParents[0] != leaf.Hex() {
+			http.Error(w, "state has moved past If-Parents", http.StatusConflict)
+		}
+	}))
+	defer server.Close()
+
+	c, err := redwood.NewHTTPClient(server.URL, sigkeys, nil, false)
+	require.NoError(t, err)
+
+	newTx := func() *redwood.Tx {
+		return &redwood.Tx{
+			ID:       types.RandomID(),
+			StateURI: "foo.bar/blah",
+			From:     sigkeys.Address(),
+			Parents:  []types.ID{leaf},
+			Patches:  []redwood.Patch{{Keypath: tree.Keypath("text"), Val: "hello"}},
+		}
+	}
+
+	// A plain Put doesn't send the header
+	err = c.Put(context.Background(), newTx(), types.Address{}, nil)
+	require.NoError(t, err)
+
+	err = c.PutIfParents(context.Background(), newTx(), []types.ID{leaf}, types.Address{}, nil)
+	require.NoError(t, err)
+
+	stale := types.RandomID()
+	err = c.PutIfParents(context.Background(), newTx(), []types.ID{stale}, types.Address{}, nil)
+	require.True(t, errors.Is(err, redwood.ErrConflict), "%v", err)
+
+	err = c.PutIfParents(context.Background(), newTx(), nil, types.Address{}, nil)
+	require.True(t, errors.Is(err, redwood.ErrConflict), "%v", err)
+
+	require.Equal(t, [][]string{nil, {leaf.Hex()}, {stale.Hex()}, {""}}, ifParentsHeaders)
+}
+
+func TestHTTPClient_StoreRefWithContentType(t *testing.T) {
+	content := []byte("<html><body>hello</body></html>")
+
+	var partContentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			return
+		}
+		mr, err := r.MultipartReader()
+		require.NoError(t, err)
+		part, err := mr.NextPart()
+		require.NoError(t, err)
+		partContentType = part.Header.Get("Content-Type")
+
+		bs, err := ioutil.ReadAll(part)
+		require.NoError(t, err)
+		require.Equal(t, content, bs)
+
+		json.NewEncoder(w).Encode(redwood.StoreRefResponse{SHA3: types.HashBytes(bs)})
+	}))
+	defer server.Close()
+
+	c := newTestHTTPClient(t, server)
+
+	tests := []struct {
+		name        string
+		store       func() (redwood.StoreRefResponse, error)
+		contentType string
+	}{
+		{"provided", func() (redwood.StoreRefResponse, error) {
+			return c.StoreRefWithContentType(bytes.NewReader(content), "text/x-custom")
+		}, "text/x-custom"},
+		{"sniffed", func() (redwood.StoreRefResponse, error) {
+			return c.StoreRefWithContentType(bytes.NewReader(content), "")
+		}, "text/html; charset=utf-8"},
+		{"default", func() (redwood.StoreRefResponse, error) {
+			return c.StoreRef(bytes.NewReader(content))
+		}, "application/octet-stream"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			partContentType = ""
+			resp, err := test.store()
+			require.NoError(t, err)
+			require.Equal(t, types.HashBytes(content), resp.SHA3)
+			require.Equal(t, test.contentType, partContentType)
+		})
+	}
+}
+
+func TestHTTPClient_StoreRefResume(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	sha3Hash := types.HashBytes(content)
+
+	var (
+		contentRange string
+		uploaded     []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "HEAD":
+			require.Equal(t, sha3Hash.Hex(), r.Header.Get("Ref-SHA3"))
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Ref-Received", "8")
+		case "POST":
+			contentRange = r.Header.Get("Content-Range")
+			bs, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			uploaded = bs
+			json.NewEncoder(w).Encode(redwood.StoreRefResponse{SHA3: sha3Hash})
+		}
+	}))
+	defer server.Close()
+
+	resp, err := newTestHTTPClient(t, server).StoreRef(bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, sha3Hash, resp.SHA3)
+	require.Equal(t, "bytes 8-19/20", contentRange)
+	require.Equal(t, content[8:], uploaded)
+}
+
+func TestHTTPClient_SubscribeKeypath(t *testing.T) {
+	newTx := func(keypaths ...string) *redwood.Tx {
+		tx := &redwood.Tx{ID: types.RandomID(), StateURI: "foo.bar/blah", Parents: []types.ID{redwood.GenesisTxID}}
+		for _, keypath := range keypaths {
+			tx.Patches = append(tx.Patches, redwood.Patch{Keypath: tree.Keypath(keypath), Val: "x"})
+		}
+		return tx
+	}
+
+	txs := []*redwood.Tx{
+		newTx("users/alice"),
+		newTx("messages/0/text"),
+		newTx("settings", "users/bob"),
+		newTx("users/carol", "messages"),
+		newTx("messagesArchive"),
+		newTx(""),
+	}
+	expected := []types.ID{txs[1].ID, txs[3].ID, txs[5].ID}
+
+	// The server ignores the Subscribe-Keypath header, so the client has to
+	// filter the txs itself
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "foo.bar/blah", r.Header.Get("State-URI"))
+		require.Equal(t, "messages", r.Header.Get("Subscribe-Keypath"))
+
+		for _, tx := range txs {
+			bs, err := json.Marshal(tx)
+			require.NoError(t, err)
+			_, err = w.Write(append(bs, '\n'))
+			require.NoError(t, err)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := newTestHTTPClient(t, server).SubscribeKeypath(ctx, "foo.bar/blah", tree.Keypath("messages"))
+	require.NoError(t, err)
+
+	for _, txID := range expected {
+		select {
+		case maybeTx := <-ch:
+			require.NoError(t, maybeTx.Err)
+			require.Equal(t, txID, maybeTx.Tx.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for tx")
+		}
+	}
+
+	select {
+	case maybeTx := <-ch:
+		t.Fatalf("received an unexpected tx: %+v", maybeTx)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHTTPClient_SubscribeStreamFormats(t *testing.T) {
+	txs := []*redwood.Tx{
+		{
+			ID:       types.RandomID(),
+			StateURI: "foo.bar/blah",
+			Parents:  []types.ID{redwood.GenesisTxID},
+			Patches:  []redwood.Patch{{Keypath: tree.Keypath("text"), Val: "two\nlines"}},
+		},
+		{ID: types.RandomID(), StateURI: "foo.bar/blah", Parents: []types.ID{redwood.GenesisTxID}},
+	}
+
+	marshalIndent := func(t *testing.T, v interface{}) []byte {
+		bs, err := json.MarshalIndent(v, "", "    ")
+		require.NoError(t, err)
+		return bs
+	}
+
+	tests := []struct {
+		name  string
+		write func(t *testing.T, w io.Writer)
+	}{
+		{"pretty-printed values", func(t *testing.T, w io.Writer) {
+			for _, tx := range txs {
+				_, err := w.Write(append(marshalIndent(t, tx), '\n'))
+				require.NoError(t, err)
+			}
+		}},
+		{"values with no separator", func(t *testing.T, w io.Writer) {
+			for _, tx := range txs {
+				bs, err := json.Marshal(tx)
+				require.NoError(t, err)
+				_, err = w.Write(bs)
+				require.NoError(t, err)
+			}
+		}},
+		{"JSON array", func(t *testing.T, w io.Writer) {
+			_, err := w.Write([]byte("  [\n"))
+			require.NoError(t, err)
+			for i, tx := range txs {
+				if i > 0 {
+					_, err = w.Write([]byte(",\n"))
+					require.NoError(t, err)
+				}
+				_, err = w.Write(marshalIndent(t, tx))
+				require.NoError(t, err)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				test.write(t, w)
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			ch, err := newTestHTTPClient(t, server).Subscribe(ctx, "foo.bar/blah")
+			require.NoError(t, err)
+
+			for _, expected := range txs {
+				select {
+				case maybeTx := <-ch:
+					require.NoError(t, maybeTx.Err)
+					require.Equal(t, expected.ID, maybeTx.Tx.ID)
+					require.Equal(t, expected.Patches, maybeTx.Tx.Patches)
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for tx")
+				}
+			}
+
+			select {
+			case maybeTx := <-ch:
+				t.Fatalf("received an unexpected message: %+v", maybeTx)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestHTTPClient_SubscribeFrom(t *testing.T) {
+	newTx := func() *redwood.Tx {
+		return &redwood.Tx{ID: types.RandomID(), StateURI: "foo.bar/blah", Parents: []types.ID{redwood.GenesisTxID}}
+	}
+	fromTx := newTx()
+	history := []*redwood.Tx{fromTx, newTx()}
+	live := newTx()
+
+	chLive := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "foo.bar/blah", r.Header.Get("State-URI"))
+		require.Equal(t, fromTx.ID.Hex(), r.Header.Get("From-Tx"))
+
+		write := func(v interface{}) {
+			bs, err := json.Marshal(v)
+			require.NoError(t, err)
+			_, err = w.Write(append(bs, '\n'))
+			require.NoError(t, err)
+			w.(http.Flusher).Flush()
+		}
+		for _, tx := range history {
+			write(tx)
+		}
+		write(map[string]interface{}{"endOfBacklog": true})
+
+		<-chLive
+		write(live)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := newTestHTTPClient(t, server).SubscribeFrom(ctx, "foo.bar/blah", fromTx.ID)
+	require.NoError(t, err)
+
+	recv := func() redwood.MaybeTx {
+		t.Helper()
+		select {
+		case maybeTx := <-ch:
+			require.NoError(t, maybeTx.Err)
+			return maybeTx
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for tx")
+		}
+		return redwood.MaybeTx{}
+	}
+
+	for _, tx := range history {
+		maybeTx := recv()
+		require.False(t, maybeTx.EndOfBacklog)
+		require.Equal(t, tx.ID, maybeTx.Tx.ID)
+	}
+
+	maybeTx := recv()
+	require.True(t, maybeTx.EndOfBacklog)
+	require.Nil(t, maybeTx.Tx)
+
+	close(chLive)
+	maybeTx = recv()
+	require.False(t, maybeTx.EndOfBacklog)
+	require.Equal(t, live.ID, maybeTx.Tx.ID)
+}
+
+func TestHTTPClient_SubscribeWS(t *testing.T) {
+	txs := []*redwood.Tx{
+		{ID: types.RandomID(), StateURI: "foo.bar/blah", Parents: []types.ID{redwood.GenesisTxID}},
+		{ID: types.RandomID(), StateURI: "foo.bar/blah", Parents: []types.ID{redwood.GenesisTxID}},
+	}
+
+	chClosed := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/ws", r.URL.Path)
+		require.Equal(t, "foo.bar/blah", r.URL.Query().Get("state_uri"))
+		require.Equal(t, "transactions", r.URL.Query().Get("subscription_type"))
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		for _, tx := range txs {
+			err := conn.WriteJSON(redwood.SubscriptionMsg{Tx: tx})
+			require.NoError(t, err)
+		}
+
+		// Wait for the client to hang up
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+				close(chClosed)
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := newTestHTTPClient(t, server).SubscribeWS(ctx, "foo.bar/blah")
+	require.NoError(t, err)
+
+	for _, expected := range txs {
+		select {
+		case maybeTx := <-ch:
+			require.NoError(t, maybeTx.Err)
+			require.Equal(t, expected.ID, maybeTx.Tx.ID)
+			require.Equal(t, expected.Parents, maybeTx.Tx.Parents)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for tx")
+		}
+	}
+
+	cancel()
+
+	select {
+	case <-chClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed cleanly")
+	}
+
+	select {
+	case _, open := <-ch:
+		require.False(t, open)
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel wasn't closed")
+	}
+}
+
+func TestHTTPClient_AuthorizeWithSigner(t *testing.T) {
+	challenge := []byte("prove it")
+	sig := []byte("a signature from somewhere else")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "AUTHORIZE", r.Method)
+		if response := r.Header.Get("Response"); response == "" {
+			w.Write([]byte(hex.EncodeToString(challenge)))
+		} else {
+			require.Equal(t, hex.EncodeToString(sig), response)
+		}
+	}))
+	defer server.Close()
+
+	var received []byte
+	err := newTestHTTPClient(t, server).AuthorizeWithSigner(context.Background(), func(c []byte) ([]byte, error) {
+		received = c
+		return sig, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, challenge, received)
+
+	t.Run("signer errors are returned", func(t *testing.T) {
+		signerErr := errors.New("device locked")
+		err := newTestHTTPClient(t, server).AuthorizeWithSigner(context.Background(), func(c []byte) ([]byte, error) {
+			return nil, signerErr
+		})
+		require.True(t, errors.Is(err, signerErr))
+	})
+}
@@ -16,7 +16,7 @@ type ControllerHub interface {
 	Start() error
 	Close()
 
-	AddTx(tx *Tx, force bool) error
+	AddTx(tx *Tx, force bool, expectedLeaves []types.ID) error
 	FetchTx(stateURI string, txID types.ID) (*Tx, error)
 	FetchTxs(stateURI string, fromTxID types.ID) TxIterator
 	HaveTx(stateURI string, txID types.ID) (bool, error)
@@ -78,7 +78,7 @@ func (m *controllerHub) Start() (err error) {
 	}
 
 	for _, stateURI := range stateURIs {
-		_, err := m.EnsureController(stateURI)
+		_, err := m.EnsureController(string(stateURI))
 		if err != nil {
 			return err
 		}
@@ -124,14 +124,24 @@ func (m *controllerHub) EnsureController(stateURI string) (Controller, error) {
 }
 
 func (m *controllerHub) KnownStateURIs() ([]string, error) {
-	return m.txStore.KnownStateURIs()
+	stateURIs, err := m.txStore.KnownStateURIs()
+	if err != nil {
+		return nil, err
+	}
+	return stateURIStrings(stateURIs), nil
 }
 
 var (
 	ErrInvalidPrivateRootKey = errors.New("invalid private root key")
 )
 
-func (m *controllerHub) AddTx(tx *Tx, force bool) error {
+func (m *controllerHub) AddTx(tx *Tx, force bool, expectedLeaves []types.ID) error {
+	// Otherwise, a typo would quietly create a new state URI
+	_, err := types.ParseStateURI(tx.StateURI)
+	if err != nil {
+		return err
+	}
+
 	if tx.IsPrivate() {
 		parts := strings.Split(tx.StateURI, "/")
 		if parts[len(parts)-1] != tx.PrivateRootKey() {
@@ -143,15 +153,15 @@ func (m *controllerHub) AddTx(tx *Tx, force bool) error {
 	if err != nil {
 		return err
 	}
-	return ctrl.AddTx(tx, force)
+	return ctrl.AddTx(tx, force, expectedLeaves)
 }
 
 func (m *controllerHub) FetchTxs(stateURI string, fromTxID types.ID) TxIterator {
-	return m.txStore.AllTxsForStateURI(stateURI, fromTxID)
+	return m.txStore.AllTxsForStateURI(types.StateURI(stateURI), fromTxID)
 }
 
 func (m *controllerHub) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
-	return m.txStore.FetchTx(stateURI, txID)
+	return m.txStore.FetchTx(types.StateURI(stateURI), txID)
 }
 
 func (m *controllerHub) HaveTx(stateURI string, txID types.ID) (bool, error) {
@@ -192,7 +202,7 @@ func (m *controllerHub) RefObjectReader(refID types.RefID) (io.ReadCloser, int64
 }
 
 func (m *controllerHub) Leaves(stateURI string) ([]types.ID, error) {
-	return m.txStore.Leaves(stateURI)
+	return m.txStore.Leaves(types.StateURI(stateURI))
 }
 
 func (m *controllerHub) IsPrivate(stateURI string) (bool, error) {
@@ -0,0 +1,27 @@
+package redwood
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"redwood.dev/types"
+)
+
+func TestControllerHub_AddTxRejectsMalformedStateURIs(t *testing.T) {
+	txStore := NewMemoryTxStore()
+	require.NoError(t, txStore.Start())
+	defer txStore.Close()
+
+	hub := NewControllerHub("", txStore, NewMemoryRefStore())
+
+	for _, stateURI := range []string{"", "foo.bar", "foo.bar/", "foo bar/blah"} {
+		err := hub.AddTx(&Tx{ID: GenesisTxID, StateURI: stateURI}, false, nil)
+		require.True(t, errors.Is(err, types.ErrInvalidStateURI), "%q: %v", stateURI, err)
+	}
+
+	stateURIs, err := hub.KnownStateURIs()
+	require.NoError(t, err)
+	require.Len(t, stateURIs, 0)
+}
@@ -8,7 +8,6 @@ import (
 
 	"github.com/pkg/errors"
 
-	"redwood.dev/crypto"
 	"redwood.dev/ctx"
 	"redwood.dev/nelson"
 	"redwood.dev/tree"
@@ -20,7 +19,7 @@ type Controller interface {
 	Start() error
 	Close()
 
-	AddTx(tx *Tx, force bool) error
+	AddTx(tx *Tx, force bool, expectedLeaves []types.ID) error
 	HaveTx(txID types.ID) (bool, error)
 
 	StateAtVersion(version *types.ID) tree.Node
@@ -146,7 +145,7 @@ func (c *controller) StateAtVersion(version *types.ID) tree.Node {
 }
 
 func (c *controller) Leaves() ([]types.ID, error) {
-	return c.txStore.Leaves(c.stateURI)
+	return c.txStore.Leaves(types.StateURI(c.stateURI))
 }
 
 func (c *controller) IsPrivate() (bool, error) {
@@ -201,13 +200,18 @@ func (c *controller) Members() []types.Address {
 	return addrs
 }
 
-func (c *controller) AddTx(tx *Tx, force bool) error {
+// AddTx stores tx and queues it to be applied.  If expectedLeaves is non-nil,
+// tx is only accepted if the state's leaves are exactly expectedLeaves, and
+// ErrConflict is returned otherwise.  An accepted tx is marked as a leaf right
+// away, under the same lock as the check and as tryApplyTx's leaf updates, so
+// that of two txs expecting the same leaves, only one gets in.
+func (c *controller) AddTx(tx *Tx, force bool, expectedLeaves []types.ID) error {
 	c.addTxMu.Lock()
 	defer c.addTxMu.Unlock()
 
 	if !force {
 		// Ignore duplicates
-		exists, err := c.txStore.TxExists(tx.StateURI, tx.ID)
+		exists, err := c.txStore.TxExists(types.StateURI(tx.StateURI), tx.ID)
 		if err != nil {
 			return err
 		} else if exists {
@@ -218,6 +222,15 @@ func (c *controller) AddTx(tx *Tx, force bool) error {
 		c.Infof(0, "new tx %v (%v)", tx.ID.Pretty(), tx.Hash().String())
 	}
 
+	if expectedLeaves != nil {
+		leaves, err := c.txStore.Leaves(types.StateURI(c.stateURI))
+		if err != nil {
+			return err
+		} else if !utils.NewIDSet(expectedLeaves).Equal(utils.NewIDSet(leaves)) {
+			return errors.Wrapf(ErrConflict, "tx %v: state has moved past the expected leaves", tx.ID.Pretty())
+		}
+	}
+
 	// Store the tx (so we can ignore txs we've seen before)
 	tx.Status = TxStatusInMempool
 	err := c.txStore.AddTx(tx)
@@ -225,6 +238,13 @@ func (c *controller) AddTx(tx *Tx, force bool) error {
 		return err
 	}
 
+	if expectedLeaves != nil {
+		err = c.txStore.MarkLeaf(types.StateURI(c.stateURI), tx.ID)
+		if err != nil {
+			return err
+		}
+	}
+
 	c.mempool.Add(tx)
 	return nil
 }
@@ -254,6 +274,7 @@ func (c *controller) processMempoolTx(tx *Tx) processTxOutcome {
 	switch errors.Cause(err) {
 	case ErrTxMissingParents, ErrInvalidParent, ErrInvalidSignature, ErrInvalidTx:
 		c.Errorf("invalid tx %v: %+v: %v", tx.ID.Pretty(), err, PrettyJSON(tx))
+		c.unmarkFailedTx(tx)
 		return processTxOutcome_Failed
 
 	case ErrPendingParent, ErrMissingCriticalRefs, ErrNoParentYet:
@@ -262,10 +283,28 @@ func (c *controller) processMempoolTx(tx *Tx) processTxOutcome {
 
 	default:
 		c.Errorf("error processing tx %v: %+v: %v", tx.ID.Pretty(), err, PrettyJSON(tx))
+		c.unmarkFailedTx(tx)
 		return processTxOutcome_Failed
 	}
 }
 
+// unmarkFailedTx drops a tx that won't be applied from the leaves, in case
+// AddTx marked it as one when it was accepted against expected leaves.  A tx
+// that got as far as being marked valid is left alone.
+func (c *controller) unmarkFailedTx(tx *Tx) {
+	if tx.Status == TxStatusValid {
+		return
+	}
+
+	c.addTxMu.Lock()
+	defer c.addTxMu.Unlock()
+
+	err := c.txStore.UnmarkLeaf(types.StateURI(c.stateURI), tx.ID)
+	if err != nil {
+		c.Errorf("error unmarking failed tx %v as a leaf: %v", tx.ID.Pretty(), err)
+	}
+}
+
 func (c *controller) tryApplyTx(tx *Tx) (err error) {
 	defer utils.Annotate(&err, "stateURI=%v tx=%v", tx.StateURI, tx.ID.Pretty())
 
@@ -277,7 +316,7 @@ func (c *controller) tryApplyTx(tx *Tx) (err error) {
 	}
 
 	for _, parentID := range tx.Parents {
-		parentTx, err := c.txStore.FetchTx(tx.StateURI, parentID)
+		parentTx, err := c.txStore.FetchTx(types.StateURI(tx.StateURI), parentID)
 		if errors.Cause(err) == types.Err404 {
 			return errors.Wrapf(ErrNoParentYet, "parent=%v", parentID.Pretty())
 		} else if err != nil {
@@ -289,13 +328,9 @@ func (c *controller) tryApplyTx(tx *Tx) (err error) {
 		}
 	}
 
-	sigPubKey, err := crypto.RecoverSigningPubkey(tx.Hash(), tx.Sig)
+	_, err = VerifyTx(tx)
 	if err != nil {
-		return errors.Wrap(ErrInvalidSignature, err.Error())
-	} else if sigPubKey.VerifySignature(tx.Hash(), tx.Sig) == false {
-		return ErrInvalidSignature
-	} else if sigPubKey.Address() != tx.From {
-		return errors.Wrapf(ErrInvalidSignature, "address doesn't match (expected=%v received=%v)", tx.From.Hex(), sigPubKey.Address().Hex())
+		return err
 	}
 
 	state := c.states.StateAtVersion(nil, true)
@@ -438,16 +473,7 @@ func (c *controller) tryApplyTx(tx *Tx) (err error) {
 		}
 	}
 
-	// Unmark parents as leaves
-	for _, parentID := range tx.Parents {
-		err := c.txStore.UnmarkLeaf(c.stateURI, parentID)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Mark this tx as a leaf
-	err = c.txStore.MarkLeaf(c.stateURI, tx.ID)
+	err = c.updateLeaves(tx)
 	if err != nil {
 		return err
 	}
@@ -459,7 +485,7 @@ func (c *controller) tryApplyTx(tx *Tx) (err error) {
 		return err
 	}
 
-	leaves, err := c.txStore.Leaves(c.stateURI)
+	leaves, err := c.txStore.Leaves(types.StateURI(c.stateURI))
 	if err != nil {
 		return err
 	}
@@ -471,11 +497,29 @@ func (c *controller) tryApplyTx(tx *Tx) (err error) {
 	return nil
 }
 
+// updateLeaves replaces tx's parents with tx in the leaves.  It holds addTxMu
+// so that AddTx's expected leaves check never sees a half-updated set.
+func (c *controller) updateLeaves(tx *Tx) error {
+	c.addTxMu.Lock()
+	defer c.addTxMu.Unlock()
+
+	// Unmark parents as leaves
+	for _, parentID := range tx.Parents {
+		err := c.txStore.UnmarkLeaf(types.StateURI(c.stateURI), parentID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mark this tx as a leaf
+	return c.txStore.MarkLeaf(types.StateURI(c.stateURI), tx.ID)
+}
+
 func (c *controller) handleNewRefs(state tree.Node) {
 	var refs []types.RefID
 	defer func() {
 		if len(refs) > 0 {
-			c.refStore.MarkRefsAsNeeded(refs)
+			c.refStore.MarkRefsAsNeededForStateURI(c.stateURI, refs)
 		}
 	}()
 
@@ -753,7 +797,7 @@ func (c *controller) notifyNewStateListeners(tx *Tx, state tree.Node, leaves []t
 }
 
 func (c *controller) HaveTx(txID types.ID) (bool, error) {
-	return c.txStore.TxExists(c.stateURI, txID)
+	return c.txStore.TxExists(types.StateURI(c.stateURI), txID)
 }
 
 func (c *controller) QueryIndex(version *types.ID, keypath tree.Keypath, indexName tree.Keypath, queryParam tree.Keypath, rng *tree.Range) (node tree.Node, err error) {
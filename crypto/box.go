@@ -2,10 +2,13 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"io"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -16,11 +19,14 @@ type (
 	EncryptingPrivateKey interface {
 		SealMessageFor(recipientPubKey EncryptingPublicKey, msg []byte) ([]byte, error)
 		OpenMessageFrom(senderPublicKey EncryptingPublicKey, msgEncrypted []byte) ([]byte, error)
+		SealMessageForWithAD(recipientPubKey EncryptingPublicKey, msg, associatedData []byte) ([]byte, error)
+		OpenMessageFromWithAD(senderPublicKey EncryptingPublicKey, msgEncrypted, associatedData []byte) ([]byte, error)
 		Bytes() []byte
 	}
 
 	EncryptingPublicKey interface {
 		Bytes() []byte
+		Equal(other EncryptingPublicKey) bool
 	}
 
 	EncryptingKeypair struct {
@@ -72,6 +78,36 @@ func (pubkey *encryptingPublicKey) Bytes() []byte {
 	return bs
 }
 
+// Equal compares the two keys in constant time.  Keys of the wrong length
+// (or a nil key) are never equal to anything.
+func (pubkey *encryptingPublicKey) Equal(other EncryptingPublicKey) bool {
+	if pubkey == nil || other == nil {
+		return false
+	}
+	otherBytes := other.Bytes()
+	if len(otherBytes) != ENCRYPTING_KEY_LENGTH {
+		return false
+	}
+	return subtle.ConstantTimeCompare((*pubkey)[:], otherBytes) == 1
+}
+
+// KeypairMatches returns true if pubkey is the public half of privkey.
+func KeypairMatches(privkey EncryptingPrivateKey, pubkey EncryptingPublicKey) bool {
+	if privkey == nil || pubkey == nil {
+		return false
+	}
+	privBytes := privkey.Bytes()
+	pubBytes := pubkey.Bytes()
+	if len(privBytes) != ENCRYPTING_KEY_LENGTH || len(pubBytes) != ENCRYPTING_KEY_LENGTH {
+		return false
+	}
+
+	var priv, derived [ENCRYPTING_KEY_LENGTH]byte
+	copy(priv[:], privBytes)
+	curve25519.ScalarBaseMult(&derived, &priv)
+	return subtle.ConstantTimeCompare(derived[:], pubBytes) == 1
+}
+
 func EncryptingPrivateKeyFromBytes(bs []byte) EncryptingPrivateKey {
 	var pk encryptingPrivateKey
 	copy(pk[:], bs)
@@ -133,3 +169,39 @@ func (privkey *encryptingPrivateKey) OpenMessageFrom(senderPublicKey EncryptingP
 	}
 	return decrypted, nil
 }
+
+// SealMessageForWithAD is like SealMessageFor, but also authenticates
+// associatedData (a tx ID or state URI, for instance) without encrypting it.
+// The message can only be opened by OpenMessageFromWithAD with the same
+// associated data.
+//
+// nacl/box isn't an AEAD, so the associated data is bound by sealing its
+// SHA-256 hash in front of the plaintext.  The result is:
+//
+//	nonce (24 bytes) || box(sha256(associatedData) (32 bytes) || msg)
+func (privkey *encryptingPrivateKey) SealMessageForWithAD(recipientPubKey EncryptingPublicKey, msg, associatedData []byte) ([]byte, error) {
+	adHash := sha256.Sum256(associatedData)
+	framed := make([]byte, 0, len(adHash)+len(msg))
+	framed = append(framed, adHash[:]...)
+	framed = append(framed, msg...)
+	return privkey.SealMessageFor(recipientPubKey, framed)
+}
+
+// OpenMessageFromWithAD decrypts a message produced by SealMessageForWithAD.
+// It returns ErrCannotDecrypt if the message has been tampered with or if
+// associatedData doesn't match what it was sealed with.
+func (privkey *encryptingPrivateKey) OpenMessageFromWithAD(senderPublicKey EncryptingPublicKey, msgEncrypted, associatedData []byte) ([]byte, error) {
+	if len(msgEncrypted) < ENCRYPTING_NONCE_LENGTH+box.Overhead+sha256.Size {
+		return nil, ErrCannotDecrypt
+	}
+	framed, err := privkey.OpenMessageFrom(senderPublicKey, msgEncrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	adHash := sha256.Sum256(associatedData)
+	if subtle.ConstantTimeCompare(framed[:sha256.Size], adHash[:]) != 1 {
+		return nil, ErrCannotDecrypt
+	}
+	return framed[sha256.Size:], nil
+}
@@ -27,3 +27,104 @@ func TestEncryptingKeyConstructors(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, bytes, privkey.Bytes())
 }
+
+type shortPublicKey []byte
+
+func (k shortPublicKey) Bytes() []byte                               { return []byte(k) }
+func (k shortPublicKey) Equal(other crypto.EncryptingPublicKey) bool { return false }
+
+func TestEncryptingPublicKey_Equal(t *testing.T) {
+	keys1, err := crypto.GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	keys2, err := crypto.GenerateEncryptingKeypair()
+	require.NoError(t, err)
+
+	t.Run("matching", func(t *testing.T) {
+		other := crypto.EncryptingPublicKeyFromBytes(keys1.EncryptingPublicKey.Bytes())
+		require.True(t, keys1.EncryptingPublicKey.Equal(other))
+		require.True(t, other.Equal(keys1.EncryptingPublicKey))
+	})
+
+	t.Run("non-matching", func(t *testing.T) {
+		require.False(t, keys1.EncryptingPublicKey.Equal(keys2.EncryptingPublicKey))
+	})
+
+	t.Run("wrong length", func(t *testing.T) {
+		short := shortPublicKey(keys1.EncryptingPublicKey.Bytes()[:crypto.ENCRYPTING_KEY_LENGTH-1])
+		require.False(t, keys1.EncryptingPublicKey.Equal(short))
+		require.False(t, keys1.EncryptingPublicKey.Equal(nil))
+	})
+}
+
+func TestKeypairMatches(t *testing.T) {
+	keys1, err := crypto.GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	keys2, err := crypto.GenerateEncryptingKeypair()
+	require.NoError(t, err)
+
+	t.Run("matching", func(t *testing.T) {
+		require.True(t, crypto.KeypairMatches(keys1.EncryptingPrivateKey, keys1.EncryptingPublicKey))
+		require.True(t, crypto.KeypairMatches(keys2.EncryptingPrivateKey, keys2.EncryptingPublicKey))
+	})
+
+	t.Run("non-matching", func(t *testing.T) {
+		require.False(t, crypto.KeypairMatches(keys1.EncryptingPrivateKey, keys2.EncryptingPublicKey))
+		require.False(t, crypto.KeypairMatches(keys2.EncryptingPrivateKey, keys1.EncryptingPublicKey))
+	})
+
+	t.Run("wrong length", func(t *testing.T) {
+		short := shortPublicKey(keys1.EncryptingPublicKey.Bytes()[:crypto.ENCRYPTING_KEY_LENGTH-1])
+		require.False(t, crypto.KeypairMatches(keys1.EncryptingPrivateKey, short))
+		require.False(t, crypto.KeypairMatches(keys1.EncryptingPrivateKey, nil))
+		require.False(t, crypto.KeypairMatches(nil, keys1.EncryptingPublicKey))
+	})
+}
+
+func TestSealMessageForWithAD(t *testing.T) {
+	sender, err := crypto.GenerateEncryptingKeypair()
+	require.NoError(t, err)
+	recipient, err := crypto.GenerateEncryptingKeypair()
+	require.NoError(t, err)
+
+	msg := []byte("the eagle has landed")
+	ad := []byte("some tx id")
+
+	sealed, err := sender.SealMessageForWithAD(recipient.EncryptingPublicKey, msg, ad)
+	require.NoError(t, err)
+
+	t.Run("correct associated data", func(t *testing.T) {
+		opened, err := recipient.OpenMessageFromWithAD(sender.EncryptingPublicKey, sealed, ad)
+		require.NoError(t, err)
+		require.Equal(t, msg, opened)
+	})
+
+	t.Run("wrong associated data", func(t *testing.T) {
+		_, err := recipient.OpenMessageFromWithAD(sender.EncryptingPublicKey, sealed, []byte("another tx id"))
+		require.Equal(t, crypto.ErrCannotDecrypt, err)
+
+		_, err = recipient.OpenMessageFromWithAD(sender.EncryptingPublicKey, sealed, nil)
+		require.Equal(t, crypto.ErrCannotDecrypt, err)
+	})
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		tampered := append([]byte(nil), sealed...)
+		tampered[len(tampered)-1] ^= 0xff
+
+		_, err := recipient.OpenMessageFromWithAD(sender.EncryptingPublicKey, tampered, ad)
+		require.Equal(t, crypto.ErrCannotDecrypt, err)
+	})
+
+	t.Run("truncated ciphertext", func(t *testing.T) {
+		_, err := recipient.OpenMessageFromWithAD(sender.EncryptingPublicKey, sealed[:10], ad)
+		require.Equal(t, crypto.ErrCannotDecrypt, err)
+	})
+
+	t.Run("empty message", func(t *testing.T) {
+		sealed, err := sender.SealMessageForWithAD(recipient.EncryptingPublicKey, nil, ad)
+		require.NoError(t, err)
+
+		opened, err := recipient.OpenMessageFromWithAD(sender.EncryptingPublicKey, sealed, ad)
+		require.NoError(t, err)
+		require.Len(t, opened, 0)
+	})
+}
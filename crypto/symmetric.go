@@ -0,0 +1,266 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+type SymmetricKey [SYMMETRIC_KEY_LENGTH]byte
+
+const (
+	SYMMETRIC_KEY_LENGTH   = 32
+	SYMMETRIC_NONCE_LENGTH = 24
+)
+
+func GenerateSymmetricKey() (SymmetricKey, error) {
+	var key SymmetricKey
+	_, err := io.ReadFull(rand.Reader, key[:])
+	if err != nil {
+		return SymmetricKey{}, errors.WithStack(err)
+	}
+	return key, nil
+}
+
+func SymmetricKeyFromBytes(bs []byte) SymmetricKey {
+	var key SymmetricKey
+	copy(key[:], bs)
+	return key
+}
+
+func SymmetricKeyFromHex(s string) (SymmetricKey, error) {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return SymmetricKey{}, errors.WithStack(err)
+	}
+	return SymmetricKeyFromBytes(bs), nil
+}
+
+func (key SymmetricKey) Bytes() []byte {
+	bs := make([]byte, SYMMETRIC_KEY_LENGTH)
+	copy(bs, key[:])
+	return bs
+}
+
+// Seal encrypts msg with secretbox.  The random nonce is prepended to the
+// result.
+func (key SymmetricKey) Seal(msg []byte) ([]byte, error) {
+	var nonce [SYMMETRIC_NONCE_LENGTH]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	k := [SYMMETRIC_KEY_LENGTH]byte(key)
+	return secretbox.Seal(nonce[:], msg, &nonce, &k), nil
+}
+
+// Open decrypts a message produced by Seal.
+func (key SymmetricKey) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < SYMMETRIC_NONCE_LENGTH {
+		return nil, ErrCannotDecrypt
+	}
+	var nonce [SYMMETRIC_NONCE_LENGTH]byte
+	copy(nonce[:], sealed[:SYMMETRIC_NONCE_LENGTH])
+
+	k := [SYMMETRIC_KEY_LENGTH]byte(key)
+	msg, ok := secretbox.Open(nil, sealed[SYMMETRIC_NONCE_LENGTH:], &nonce, &k)
+	if !ok {
+		return nil, ErrCannotDecrypt
+	}
+	return msg, nil
+}
+
+// Streams are encrypted in fixed-size chunks so that arbitrarily large blobs
+// don't have to be held in memory.  The stream starts with a random nonce
+// prefix, and each chunk's nonce is that prefix followed by the chunk's index.
+// The high bit of the index marks the final chunk, which means that
+// reordered, dropped, or truncated chunks all fail to decrypt.
+const (
+	symmetricStreamChunkSize   = 64 * 1024
+	symmetricStreamNoncePrefix = 16
+	symmetricStreamFinalFlag   = uint64(1) << 63
+	symmetricStreamSealedChunk = symmetricStreamChunkSize + secretbox.Overhead
+)
+
+// SymmetricStreamPlaintextSize returns the size of the plaintext contained in
+// an encrypted stream of the given size.
+func SymmetricStreamPlaintextSize(ciphertextSize int64) int64 {
+	payload := ciphertextSize - symmetricStreamNoncePrefix
+	if payload <= 0 {
+		return 0
+	}
+	numChunks := (payload + symmetricStreamSealedChunk - 1) / symmetricStreamSealedChunk
+	return payload - numChunks*secretbox.Overhead
+}
+
+type symmetricStreamNonce struct {
+	prefix [symmetricStreamNoncePrefix]byte
+	index  uint64
+}
+
+func (n *symmetricStreamNonce) next(final bool) *[SYMMETRIC_NONCE_LENGTH]byte {
+	var nonce [SYMMETRIC_NONCE_LENGTH]byte
+	copy(nonce[:], n.prefix[:])
+
+	index := n.index
+	if final {
+		index |= symmetricStreamFinalFlag
+	}
+	binary.BigEndian.PutUint64(nonce[symmetricStreamNoncePrefix:], index)
+	n.index++
+	return &nonce
+}
+
+type symmetricEncryptingWriter struct {
+	key         [SYMMETRIC_KEY_LENGTH]byte
+	w           io.Writer
+	nonce       symmetricStreamNonce
+	wroteHeader bool
+	buf         []byte
+	closed      bool
+}
+
+// NewSymmetricEncryptingWriter returns a writer that encrypts everything
+// written to it and writes the ciphertext to w.  Close must be called to
+// flush the final chunk.  It does not close w.
+func NewSymmetricEncryptingWriter(key SymmetricKey, w io.Writer) (io.WriteCloser, error) {
+	ew := &symmetricEncryptingWriter{
+		key: [SYMMETRIC_KEY_LENGTH]byte(key),
+		w:   w,
+		buf: make([]byte, 0, symmetricStreamChunkSize),
+	}
+	_, err := io.ReadFull(rand.Reader, ew.nonce.prefix[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ew, nil
+}
+
+func (ew *symmetricEncryptingWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("write to closed symmetricEncryptingWriter")
+	}
+
+	var written int
+	for len(p) > 0 {
+		if len(ew.buf) == symmetricStreamChunkSize {
+			err := ew.flush(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := symmetricStreamChunkSize - len(ew.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		ew.buf = append(ew.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *symmetricEncryptingWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+
+	// The final chunk must be shorter than a full chunk so that the reader
+	// can recognize it
+	if len(ew.buf) == symmetricStreamChunkSize {
+		err := ew.flush(false)
+		if err != nil {
+			return err
+		}
+	}
+	return ew.flush(true)
+}
+
+func (ew *symmetricEncryptingWriter) flush(final bool) error {
+	if !ew.wroteHeader {
+		_, err := ew.w.Write(ew.nonce.prefix[:])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ew.wroteHeader = true
+	}
+
+	sealed := secretbox.Seal(nil, ew.buf, ew.nonce.next(final), &ew.key)
+	_, err := ew.w.Write(sealed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+type symmetricDecryptingReader struct {
+	key        [SYMMETRIC_KEY_LENGTH]byte
+	r          io.Reader
+	nonce      symmetricStreamNonce
+	readHeader bool
+	sealed     []byte
+	plaintext  []byte
+	done       bool
+}
+
+// NewSymmetricDecryptingReader returns a reader that decrypts a stream
+// produced by NewSymmetricEncryptingWriter.  It returns ErrCannotDecrypt if
+// the stream has been tampered with or truncated.
+func NewSymmetricDecryptingReader(key SymmetricKey, r io.Reader) io.Reader {
+	return &symmetricDecryptingReader{
+		key:    [SYMMETRIC_KEY_LENGTH]byte(key),
+		r:      r,
+		sealed: make([]byte, symmetricStreamSealedChunk),
+	}
+}
+
+func (dr *symmetricDecryptingReader) Read(p []byte) (int, error) {
+	for len(dr.plaintext) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		err := dr.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.plaintext)
+	dr.plaintext = dr.plaintext[n:]
+	return n, nil
+}
+
+func (dr *symmetricDecryptingReader) readChunk() error {
+	if !dr.readHeader {
+		_, err := io.ReadFull(dr.r, dr.nonce.prefix[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrCannotDecrypt
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+		dr.readHeader = true
+	}
+
+	// Only the final chunk is shorter than a full chunk
+	n, err := io.ReadFull(dr.r, dr.sealed)
+	if err == io.EOF {
+		return ErrCannotDecrypt
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return errors.WithStack(err)
+	}
+	final := err == io.ErrUnexpectedEOF
+
+	plaintext, ok := secretbox.Open(dr.plaintext[:0], dr.sealed[:n], dr.nonce.next(final), &dr.key)
+	if !ok {
+		return ErrCannotDecrypt
+	}
+	dr.plaintext = plaintext
+	dr.done = final
+	return nil
+}
@@ -0,0 +1,69 @@
+package crypto_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"redwood.dev/crypto"
+)
+
+func TestSymmetricKey_SealOpen(t *testing.T) {
+	key, err := crypto.GenerateSymmetricKey()
+	require.NoError(t, err)
+
+	msg := []byte("hello, redwood")
+	sealed, err := key.Seal(msg)
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), string(msg))
+
+	opened, err := key.Open(sealed)
+	require.NoError(t, err)
+	require.Equal(t, msg, opened)
+
+	otherKey, err := crypto.GenerateSymmetricKey()
+	require.NoError(t, err)
+	_, err = otherKey.Open(sealed)
+	require.Equal(t, crypto.ErrCannotDecrypt, err)
+}
+
+func TestSymmetricStream(t *testing.T) {
+	key, err := crypto.GenerateSymmetricKey()
+	require.NoError(t, err)
+
+	encrypt := func(t *testing.T, plaintext []byte) []byte {
+		var buf bytes.Buffer
+		w, err := crypto.NewSymmetricEncryptingWriter(key, &buf)
+		require.NoError(t, err)
+		_, err = w.Write(plaintext)
+		require.NoError(t, err)
+		err = w.Close()
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	for _, size := range []int{0, 1, 1000, 64 * 1024, 64*1024 + 1, 200 * 1024} {
+		plaintext := bytes.Repeat([]byte{0xab}, size)
+		ciphertext := encrypt(t, plaintext)
+		require.Equal(t, int64(size), crypto.SymmetricStreamPlaintextSize(int64(len(ciphertext))))
+
+		decrypted, err := ioutil.ReadAll(crypto.NewSymmetricDecryptingReader(key, bytes.NewReader(ciphertext)))
+		require.NoError(t, err)
+		require.Equal(t, plaintext, decrypted)
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		ciphertext := encrypt(t, bytes.Repeat([]byte{0xab}, 200*1024))
+
+		// Drop the final chunk entirely
+		truncated := ciphertext[:16+2*(64*1024+16)]
+		_, err := ioutil.ReadAll(crypto.NewSymmetricDecryptingReader(key, bytes.NewReader(truncated)))
+		require.Equal(t, crypto.ErrCannotDecrypt, err)
+
+		// Cut off partway through a chunk
+		truncated = ciphertext[:len(ciphertext)-100]
+		_, err = ioutil.ReadAll(crypto.NewSymmetricDecryptingReader(key, bytes.NewReader(truncated)))
+		require.Equal(t, crypto.ErrCannotDecrypt, err)
+	})
+}
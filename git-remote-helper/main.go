@@ -158,7 +158,7 @@ func speakGit(r io.Reader, w io.Writer, client *redwood.HTTPClient) error {
 }
 
 func getRefs(client *redwood.HTTPClient) ([]string, error) {
-	stateReader, _, _, err := client.Get(StateURI, nil, RootKeypath.Push(tree.Keypath("refs/heads")), nil, true)
+	stateReader, _, _, err := client.Get(types.StateURI(StateURI), nil, RootKeypath.Push(tree.Keypath("refs/heads")), nil, true)
 	if err != nil {
 		return nil, err
 	}
@@ -220,7 +220,7 @@ func fetch(client *redwood.HTTPClient, headCommitHash string) error {
 		commitHash := stack[0]
 		stack = stack[1:]
 
-		stateReader, _, _, err := client.Get(StateURI, nil, RootKeypath.Push(tree.Keypath("commits/"+commitHash)), nil, true)
+		stateReader, _, _, err := client.Get(types.StateURI(StateURI), nil, RootKeypath.Push(tree.Keypath("commits/"+commitHash)), nil, true)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -280,7 +280,7 @@ func fetchCommit(commitHash string, commit Commit, client *redwood.HTTPClient, o
 				}
 			}()
 
-			refObj, _, _, err := client.Get(StateURI, nil, tree.Keypath("commits/"+commitHash+"/files").Push(filePath).Push(tree.Keypath("value")), nil, true)
+			refObj, _, _, err := client.Get(types.StateURI(StateURI), nil, tree.Keypath("commits/"+commitHash+"/files").Push(filePath).Push(tree.Keypath("value")), nil, true)
 			if err != nil {
 				err = errors.WithStack(err)
 				return
@@ -304,7 +304,7 @@ func fetchCommit(commitHash string, commit Commit, client *redwood.HTTPClient, o
 			if !alreadyExists {
 				absFileKeypath := tree.Keypath("commits/" + commitHash + "/files").Push(filePath)
 
-				ref, size, _, err := client.Get(StateURI, nil, absFileKeypath, nil, false)
+				ref, size, _, err := client.Get(types.StateURI(StateURI), nil, absFileKeypath, nil, false)
 				if err != nil {
 					err = errors.WithStack(err)
 					return
@@ -438,7 +438,7 @@ func push(srcRefName string, destRefName string, client *redwood.HTTPClient) err
 		stack = stack[1:]
 
 		txID := types.IDFromBytes(commitId[:])
-		_, err := client.FetchTx(StateURI, txID)
+		_, err := client.FetchTx(types.StateURI(StateURI), txID)
 		if err == types.Err404 {
 			err = pushCommit(commitId, destRefName, client)
 			if err != nil {
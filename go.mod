@@ -47,6 +47,7 @@ require (
 	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
 	google.golang.org/grpc v1.31.1
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 	rogchap.com/v8go v0.5.0
@@ -404,7 +404,7 @@ func (h *host) HandleTxReceived(tx Tx, peer Peer) {
 	}
 
 	if !have {
-		err := h.controllerHub.AddTx(&tx, false)
+		err := h.controllerHub.AddTx(&tx, false, nil)
 		if err != nil {
 			h.Errorf("error adding tx to controllerHub: %v", err)
 		}
@@ -1083,7 +1083,7 @@ func (h *host) SendTx(ctx context.Context, tx Tx) (err error) {
 		}
 	}
 
-	err = h.controllerHub.AddTx(&tx, false)
+	err = h.controllerHub.AddTx(&tx, false, nil)
 	if err != nil {
 		return err
 	}
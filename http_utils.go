@@ -1,9 +1,11 @@
 package redwood
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"strings"
 
@@ -71,7 +73,7 @@ func PutRequestFromTx(
 		}
 	}
 
-	req, err := http.NewRequest("PUT", dialAddr, &body)
+	req, err := http.NewRequestWithContext(requestContext, "PUT", dialAddr, &body)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -85,3 +87,98 @@ func PutRequestFromTx(
 	}
 	return req, nil
 }
+
+// versionsETag returns the ETag for a state at the given version(s): their hex
+// IDs, comma-separated and quoted.  A state with several leaves has several
+// versions.
+func versionsETag(versions []types.ID) string {
+	strs := make([]string, len(versions))
+	for i, version := range versions {
+		strs[i] = version.Hex()
+	}
+	return `"` + strings.Join(strs, ",") + `"`
+}
+
+// versionsFromETag parses an ETag produced by versionsETag.
+func versionsFromETag(etag string) ([]types.ID, error) {
+	etag = strings.TrimPrefix(etag, "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return nil, errors.Errorf("bad ETag: %v", etag)
+	}
+	etag = etag[1 : len(etag)-1]
+	if etag == "" {
+		return nil, nil
+	}
+
+	var versions []types.ID
+	for _, str := range strings.Split(etag, ",") {
+		version, err := types.IDFromHex(str)
+		if err != nil {
+			return nil, errors.Errorf("bad ETag: %v", etag)
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// jsonStream reads successive JSON values off of a stream, regardless of how
+// they're separated (newlines, other whitespace, or nothing at all) or
+// whether they contain newlines themselves.  The stream may also be a single
+// JSON array whose elements arrive over time.
+type jsonStream struct {
+	r       *bufio.Reader
+	dec     *json.Decoder
+	started bool
+	inArray bool
+}
+
+func newJSONStream(r io.Reader) *jsonStream {
+	br := bufio.NewReader(r)
+	return &jsonStream{r: br, dec: json.NewDecoder(br)}
+}
+
+// Next decodes the next value into v.  It returns io.EOF at the end of the
+// stream (or of the array).
+func (s *jsonStream) Next(v interface{}) error {
+	if !s.started {
+		s.started = true
+		isArray, err := s.startsWithArray()
+		if err != nil {
+			return err
+		}
+		if isArray {
+			// Consume the opening bracket so that Decode returns the elements
+			_, err = s.dec.Token()
+			if err != nil {
+				return err
+			}
+			s.inArray = true
+		}
+	}
+
+	if !s.dec.More() {
+		if s.inArray {
+			// Consume the closing bracket (or find out why there isn't one)
+			_, err := s.dec.Token()
+			if err != nil {
+				return err
+			}
+		}
+		return io.EOF
+	}
+	return s.dec.Decode(v)
+}
+
+func (s *jsonStream) startsWithArray() (bool, error) {
+	for {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b == '[', s.r.UnreadByte()
+	}
+}
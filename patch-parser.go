@@ -2,7 +2,9 @@ package redwood
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -12,160 +14,456 @@ import (
 
 var ErrBadPatch = errors.New("bad patch string")
 
+// PatchParseError describes where and why a patch string failed to parse.
+// It wraps ErrBadPatch, so errors.Cause and errors.Is still match that.
+type PatchParseError struct {
+	Offset   int    // byte offset into the patch string
+	Token    string // the offending token, or "" at the end of the input
+	Expected string // a description of what the parser expected instead
+}
+
+func (err *PatchParseError) Error() string {
+	got := "EOF"
+	if err.Token != "" {
+		got = "'" + err.Token + "'"
+	}
+	return fmt.Sprintf("parse error at offset %d: expected %v, got %v", err.Offset, err.Expected, got)
+}
+
+func (err *PatchParseError) Cause() error  { return ErrBadPatch }
+func (err *PatchParseError) Unwrap() error { return ErrBadPatch }
+
+func newPatchParseError(s []byte, offset int, expected string) error {
+	var token string
+	if offset < len(s) {
+		token = string(s[offset])
+	}
+	return &PatchParseError{Offset: offset, Token: token, Expected: expected}
+}
+
+// PatchParseOption configures ParsePatchWithOptions.
+type PatchParseOption func(*patchParseOptions)
+
+type patchParseOptions struct {
+	allowNegativeIndices bool
+}
+
+// PatchParseAllowNegativeIndices controls whether range bounds may be
+// negative (counting from the end, as in `.list[-2:]`).  They're allowed by
+// default.
+func PatchParseAllowNegativeIndices(allow bool) PatchParseOption {
+	return func(opts *patchParseOptions) {
+		opts.allowNegativeIndices = allow
+	}
+}
+
+// ParsePatch parses a patch string such as `.foo["bar"][1:3] = [1, 2]`.
+// Ranges are half-open: `[start:end]` covers start up to but not including
+// end, so `[0:0]` and `[3:3]` are empty ranges (insertion points) and `[0:1]`
+// is the first element.  A start greater than the end is rejected.  The value
+// is JSON, extended with b64"..." tokens for []byte values (see
+// Patch.String).
 func ParsePatch(s []byte) (Patch, error) {
+	return ParsePatchWithOptions(s)
+}
+
+// ParsePatchWithOptions is like ParsePatch, but accepts PatchParseOptions.
+func ParsePatchWithOptions(s []byte, opts ...PatchParseOption) (Patch, error) {
+	options := patchParseOptions{allowNegativeIndices: true}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	patch := Patch{}
+	var numKeys int
 
-	s = bytes.TrimSpace(s)
+	// Offsets in errors are relative to the untrimmed input
+	end := len(bytes.TrimRight(s, " \t\r\n"))
+	i := end - len(bytes.TrimLeft(s[:end], " \t\r\n"))
+	s = s[:end]
 
-	for i := 0; i < len(s); {
+	for i < len(s) {
 		switch s[i] {
 		case '.':
-			key, err := parseDotKey(s[i:])
+			key, length, err := parseDotKey(s, i)
 			if err != nil {
 				return Patch{}, err
 			}
-			patch.Keypath = patch.Keypath.Push(key)
-			i += len(key) + 1
+			patch.Keypath = pushKey(patch.Keypath, numKeys, key)
+			numKeys++
+			i += length
 
 		case '[':
+			if i+1 >= len(s) {
+				return Patch{}, newPatchParseError(s, i+1, "a key or range")
+			}
 			switch s[i+1] {
 			case '"', '\'':
-				key, err := parseBracketKey(s[i:])
+				key, length, err := parseBracketKey(s, i)
 				if err != nil {
 					return Patch{}, err
 				}
-				patch.Keypath = patch.Keypath.Push(key)
-				i += len(key) + 4
+				patch.Keypath = pushKey(patch.Keypath, numKeys, key)
+				numKeys++
+				i += length
 
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				rng, length, err := parseRange(s[i:])
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '-', ':':
+				rng, length, err := parseRange(s, i, options.allowNegativeIndices)
 				if err != nil {
 					return Patch{}, err
 				}
 				patch.Range = rng
 				i += length
+
+			default:
+				return Patch{}, newPatchParseError(s, i+1, "a key or range")
 			}
 
-		case ' ', '=':
-			for s[i] != '=' {
+		case ' ', '=', '+':
+			for s[i] == ' ' {
 				i++
 				if i == len(s) {
-					return Patch{}, ErrBadPatch
+					return Patch{}, newPatchParseError(s, i, "'='")
 				}
 			}
+			// `.list += value` is shorthand for `.list[-] = value`
+			if s[i] == '+' {
+				if i+1 >= len(s) || s[i+1] != '=' {
+					return Patch{}, newPatchParseError(s, i+1, "'='")
+				} else if patch.Range != nil {
+					return Patch{}, newPatchParseError(s, i, "'='")
+				}
+				patch.Range = tree.AppendRange()
+				i++
+			}
+			if s[i] != '=' {
+				return Patch{}, newPatchParseError(s, i, "'='")
+			}
 			i++
-			err := json.Unmarshal([]byte(s[i:]), &patch.Val)
+
+			var err error
+			patch.Val, err = decodePatchValue(s[i:])
 			if err != nil {
-				return Patch{}, errors.Wrapf(ErrBadPatch, err.Error())
+				offset := i
+				if syntaxErr, is := err.(*json.SyntaxError); is && syntaxErr.Offset > 0 {
+					offset += int(syntaxErr.Offset) - 1
+				}
+				return Patch{}, newPatchParseError(s, offset, "a JSON value")
 			}
 			return patch, nil
+
+		default:
+			return Patch{}, newPatchParseError(s, i, "'.', '[', '=', or '+='")
 		}
 	}
-	return Patch{}, errors.WithStack(ErrBadPatch)
+	return Patch{}, newPatchParseError(s, i, "'='")
 }
 
 func ParsePatchPath(s []byte) ([]byte, tree.Keypath, *tree.Range, error) {
 	var keypath tree.Keypath
+	var numKeys int
 	var rng *tree.Range
 	var i int
+Loop:
 	for i = 0; i < len(s); {
 		switch s[i] {
 		case '.':
-			key, err := parseDotKey(s[i:])
+			key, length, err := parseDotKey(s, i)
 			if err != nil {
 				return nil, nil, nil, err
 			}
-			keypath = keypath.Push(key)
-			i += len(key) + 1
+			keypath = pushKey(keypath, numKeys, key)
+			numKeys++
+			i += length
 
 		case '[':
+			if i+1 >= len(s) {
+				return nil, nil, nil, newPatchParseError(s, i+1, "a key or range")
+			}
 			switch s[i+1] {
 			case '"', '\'':
-				key, err := parseBracketKey(s[i:])
+				key, length, err := parseBracketKey(s, i)
 				if err != nil {
 					return nil, nil, nil, err
 				}
-				keypath = keypath.Push(key)
-				i += len(key) + 4
+				keypath = pushKey(keypath, numKeys, key)
+				numKeys++
+				i += length
 
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '-', ':':
 				var length int
 				var err error
-				rng, length, err = parseRange(s[i:])
+				rng, length, err = parseRange(s, i, true)
 				if err != nil {
 					return nil, nil, nil, err
 				}
 				i += length
+
+			default:
+				return nil, nil, nil, newPatchParseError(s, i+1, "a key or range")
 			}
+
+		default:
+			break Loop
 		}
 	}
 	return s[i:], keypath, rng, nil
 }
 
-func parseDotKey(s []byte) ([]byte, error) {
+// parseDotKey parses a `.key` starting at s[start].  It returns the key and
+// the number of bytes consumed.
+func parseDotKey(s []byte, start int) ([]byte, int, error) {
 	buf := []byte{}
-	// start at index 1, skip first dot
-	for i := 1; i < len(s); i++ {
-		if s[i] == '.' || s[i] == '[' || s[i] == ' ' {
-			return buf, nil
-		} else {
-			buf = append(buf, s[i])
+	// skip the dot
+	i := start + 1
+	for ; i < len(s); i++ {
+		if s[i] == '.' || s[i] == '[' || s[i] == ' ' || s[i] == '=' {
+			break
+		} else if s[i] == '+' && i+1 < len(s) && s[i+1] == '=' {
+			break
 		}
+		buf = append(buf, s[i])
 	}
-	return buf, nil
+	if len(buf) == 0 {
+		return nil, 0, newPatchParseError(s, i, "a key")
+	}
+	return buf, i - start, nil
 }
 
-func parseBracketKey(s []byte) ([]byte, error) {
-	if len(s) < 5 {
-		return nil, errors.WithStack(ErrBadPatch)
-	} else if s[0] != '[' && s[1] != '"' {
-		return nil, errors.WithStack(ErrBadPatch)
-	}
+// parseBracketKey parses a `["key"]` or `['key']` starting at s[start].  It
+// returns the key and the number of bytes consumed.  Inside the quotes, a
+// backslash escapes a following backslash or quote (of either kind), and is
+// otherwise taken literally.  The key may be empty.
+func parseBracketKey(s []byte, start int) ([]byte, int, error) {
+	quote := s[start+1]
 
 	buf := []byte{}
-	// start at index 2, skip ["
-	for i := 2; i < len(s); i++ {
-		if s[i] == '"' {
-			return buf, nil
-		} else {
+	// skip the [ and the opening quote
+	for i := start + 2; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '\\' || s[i+1] == '"' || s[i+1] == '\'') {
+			i++
+			buf = append(buf, s[i])
+			continue
+		} else if s[i] != quote {
 			buf = append(buf, s[i])
+			continue
+		}
+		if i+1 >= len(s) || s[i+1] != ']' {
+			return nil, 0, newPatchParseError(s, i+1, "']'")
 		}
+		return buf, i + 2 - start, nil
 	}
-	return nil, errors.WithStack(ErrBadPatch)
+	return nil, 0, newPatchParseError(s, len(s), fmt.Sprintf("'%c'", quote))
 }
 
-func parseRange(s []byte) (*tree.Range, int, error) {
-	rng := &tree.Range{}
-	haveStart := false
-	buf := []byte{}
-	// start at index 1, skip [
-	for i := 1; i < len(s); i++ {
-		if s[i] == ']' {
-			if !haveStart {
-				return nil, 0, errors.WithStack(ErrBadPatch)
+// pushKey adds key to keypath, which already has numKeys keys.  Unlike
+// Keypath.Push, it keeps empty keys.
+func pushKey(keypath tree.Keypath, numKeys int, key []byte) tree.Keypath {
+	if numKeys > 0 {
+		keypath = append(keypath, tree.KeypathSeparator...)
+	}
+	return append(keypath, key...)
+}
+
+// parseRange parses a `[start:end]` starting at s[start].  It returns the
+// range and the number of bytes consumed.  The range is half-open (the end is
+// exclusive).  Either bound may be omitted: an omitted start means the
+// beginning, and an omitted end means the end.  A negative start counts from
+// the end, in which case the end must also be omitted or <= 0 (see
+// tree.Range).  Negative bounds are rejected unless allowNegative is set.
+// `[-]` is an append.
+func parseRange(s []byte, start int, allowNegative bool) (*tree.Range, int, error) {
+	if bytes.HasPrefix(s[start:], []byte("[-]")) {
+		return tree.AppendRange(), 3, nil
+	}
+
+	colon := -1
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case ':':
+			if colon != -1 {
+				return nil, 0, newPatchParseError(s, i, "']'")
 			}
-			end, err := strconv.ParseInt(string(buf), 10, 64)
+			colon = i
+
+		case ']':
+			if colon == -1 {
+				return nil, 0, newPatchParseError(s, i, "':'")
+			}
+			rng, err := parseRangeBounds(s, start+1, colon, i, allowNegative)
 			if err != nil {
-				return nil, 0, errors.WithStack(ErrBadPatch)
+				return nil, 0, err
 			}
-			rng.End = end
-			return rng, i + 1, nil
+			return rng, i + 1 - start, nil
+		}
+	}
+	return nil, 0, newPatchParseError(s, len(s), "']'")
+}
+
+func parseRangeBounds(s []byte, startIdx, colonIdx, endIdx int, allowNegative bool) (*tree.Range, error) {
+	rng := &tree.Range{}
+
+	if startIdx < colonIdx {
+		rangeStart, err := strconv.ParseInt(string(s[startIdx:colonIdx]), 10, 64)
+		if err != nil {
+			return nil, newPatchParseError(s, startIdx, "an integer")
+		} else if rangeStart < 0 && !allowNegative {
+			return nil, newPatchParseError(s, startIdx, "a non-negative integer")
+		}
+		rng.Start = rangeStart
+	}
+
+	if colonIdx+1 == endIdx {
+		if rng.Start >= 0 {
+			rng.End = tree.RangeToEnd
+		} else {
+			rng.End = 0
+		}
+		return rng, nil
+	}
+
+	rangeEnd, err := strconv.ParseInt(string(s[colonIdx+1:endIdx]), 10, 64)
+	if err != nil {
+		return nil, newPatchParseError(s, colonIdx+1, "an integer")
+	} else if rng.Start >= 0 && rangeEnd < 0 {
+		return nil, newPatchParseError(s, colonIdx+1, "a non-negative end (the start is non-negative)")
+	} else if rng.Start < 0 && rangeEnd > 0 {
+		return nil, newPatchParseError(s, colonIdx+1, "a non-positive end (the start is negative)")
+	} else if rangeEnd < rng.Start {
+		return nil, newPatchParseError(s, colonIdx+1, "an end >= the start")
+	}
+	rng.End = rangeEnd
+	return rng, nil
+}
+
+// decodePatchValue decodes the JSON value of a patch.  Any b64"..." tokens
+// (which canonicalJSON writes for []byte values) are decoded to []byte.  If
+// the value can't be decoded, the error is encoding/json's, so that callers
+// can report its offset.
+func decodePatchValue(s []byte) (interface{}, error) {
+	var val interface{}
+	err := json.Unmarshal(s, &val)
+	if err == nil || !bytes.Contains(s, []byte(`b64"`)) {
+		return val, err
+	}
+
+	d := taggedJSONDecoder{s: s}
+	val, ok := d.value()
+	d.skipSpace()
+	if !ok || d.i != len(s) {
+		return nil, err
+	}
+	return val, nil
+}
+
+// taggedJSONDecoder decodes JSON extended with b64"..." tokens.  Scalars are
+// handed to encoding/json, so they decode exactly as they otherwise would.
+type taggedJSONDecoder struct {
+	s []byte
+	i int
+}
+
+func (d *taggedJSONDecoder) value() (interface{}, bool) {
+	d.skipSpace()
+	if d.i >= len(d.s) {
+		return nil, false
+	}
 
-		} else if s[i] == ':' {
-			if haveStart {
-				return nil, 0, errors.WithStack(ErrBadPatch)
+	switch {
+	case d.s[d.i] == '{':
+		d.i++
+		obj := make(map[string]interface{})
+		if d.consume('}') {
+			return obj, true
+		}
+		for {
+			d.skipSpace()
+			key, ok := d.string()
+			if !ok || !d.consume(':') {
+				return nil, false
+			}
+			obj[key], ok = d.value()
+			if !ok {
+				return nil, false
+			} else if d.consume('}') {
+				return obj, true
+			} else if !d.consume(',') {
+				return nil, false
 			}
+		}
 
-			start, err := strconv.ParseInt(string(buf), 10, 64)
-			if err != nil {
-				return nil, 0, errors.WithStack(ErrBadPatch)
+	case d.s[d.i] == '[':
+		d.i++
+		arr := []interface{}{}
+		if d.consume(']') {
+			return arr, true
+		}
+		for {
+			elem, ok := d.value()
+			if !ok {
+				return nil, false
 			}
-			buf = []byte{}
-			rng.Start = start
-			haveStart = true
-		} else {
-			buf = append(buf, s[i])
+			arr = append(arr, elem)
+			if d.consume(']') {
+				return arr, true
+			} else if !d.consume(',') {
+				return nil, false
+			}
+		}
+
+	case d.s[d.i] == '"':
+		return d.string()
+
+	case bytes.HasPrefix(d.s[d.i:], []byte(`b64"`)):
+		d.i += len("b64")
+		encoded, ok := d.string()
+		if !ok {
+			return nil, false
+		}
+		bs, err := base64.StdEncoding.DecodeString(encoded)
+		return bs, err == nil
+
+	default:
+		start := d.i
+		for d.i < len(d.s) && !bytes.ContainsAny(d.s[d.i:d.i+1], ",]} \t\r\n") {
+			d.i++
+		}
+		var scalar interface{}
+		err := json.Unmarshal(d.s[start:d.i], &scalar)
+		return scalar, err == nil
+	}
+}
+
+func (d *taggedJSONDecoder) string() (string, bool) {
+	if d.i >= len(d.s) || d.s[d.i] != '"' {
+		return "", false
+	}
+	start := d.i
+	for d.i++; d.i < len(d.s); d.i++ {
+		if d.s[d.i] == '\\' {
+			d.i++
+		} else if d.s[d.i] == '"' {
+			d.i++
+			var str string
+			err := json.Unmarshal(d.s[start:d.i], &str)
+			return str, err == nil
 		}
 	}
-	return nil, 0, errors.WithStack(ErrBadPatch)
+	return "", false
+}
+
+// consume skips whitespace and then c, if c is next.
+func (d *taggedJSONDecoder) consume(c byte) bool {
+	d.skipSpace()
+	if d.i < len(d.s) && d.s[d.i] == c {
+		d.i++
+		return true
+	}
+	return false
+}
+
+func (d *taggedJSONDecoder) skipSpace() {
+	for d.i < len(d.s) && bytes.IndexByte([]byte(" \t\r\n"), d.s[d.i]) >= 0 {
+		d.i++
+	}
 }
@@ -3,6 +3,7 @@ package redwood
 import (
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
 	"redwood.dev/tree"
@@ -18,3 +19,202 @@ func TestParsePatch(t *testing.T) {
 	require.Equal(t, int64(0), patch.Range.End)
 	require.Equal(t, "a", patch.Val)
 }
+
+func TestParsePatch_Errors(t *testing.T) {
+	tests := []struct {
+		input    string
+		offset   int
+		token    string
+		expected string
+	}{
+		{`.foo [0:1] = 1`, 5, "[", "'='"},
+		{`  .foo [0:1] = 1`, 7, "[", "'='"},
+		{`.foo.bar`, 8, "", "'='"},
+		{`.foo = {"a": }`, 13, "}", "a JSON value"},
+		{`.foo[0:x] = 1`, 7, "x", "an integer"},
+		{`.foo[0:1 = 1`, 12, "", "']'"},
+		{`.foo[x] = 1`, 5, "x", "a key or range"},
+		{`.foo["bar" = 1`, 10, " ", "']'"},
+		{`foo = 1`, 0, "f", "'.', '[', '=', or '+='"},
+		{`.[0:1] = 1`, 1, "[", "a key"},
+		{`.foo = b64"!!"`, 7, "b", "a JSON value"},
+		{`.foo = [b64"AA==" 1]`, 8, "b", "a JSON value"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			_, err := ParsePatch([]byte(test.input))
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ErrBadPatch))
+
+			var parseErr *PatchParseError
+			require.True(t, errors.As(err, &parseErr))
+			require.Equal(t, test.offset, parseErr.Offset)
+			require.Equal(t, test.token, parseErr.Token)
+			require.Equal(t, test.expected, parseErr.Expected)
+		})
+	}
+
+	_, err := ParsePatch([]byte(`.foo.bar [0:1] = 1`))
+	require.EqualError(t, err, `parse error at offset 9: expected '=', got '['`)
+}
+
+func TestParsePatch_BracketKeys(t *testing.T) {
+	patch, err := ParsePatch([]byte(`.foo["bar.baz"]['quux'] = 1`))
+	require.NoError(t, err)
+	require.Equal(t, tree.Keypath("foo/bar.baz/quux"), patch.Keypath)
+	require.Equal(t, float64(1), patch.Val)
+
+	patch, err = ParsePatch([]byte(`.a["it's \"quoted\" \\ \n"]['\'']["\]"] = 1`))
+	require.NoError(t, err)
+	require.Equal(t, tree.Keypath(`a/it's "quoted" \ \n/'/\]`), patch.Keypath)
+
+	patch, err = ParsePatch([]byte(`.a[""][''].b = 1`))
+	require.NoError(t, err)
+	require.Equal(t, tree.Keypath("a///b"), patch.Keypath)
+}
+
+func TestPatch_StringRoundTripsKeys(t *testing.T) {
+	keypaths := []tree.Keypath{
+		tree.Keypath(`mixed "double" and 'single'`),
+		tree.Keypath(`a/both"'.[/b`),
+		tree.Keypath(`back\slash.and "quote"\`),
+		tree.Keypath(`a//b`),
+		tree.Keypath(`/a`),
+		tree.Keypath(`a/`),
+	}
+	for _, keypath := range keypaths {
+		keypath := keypath
+		t.Run(string(keypath), func(t *testing.T) {
+			s := Patch{Keypath: keypath, Val: 1.0}.String()
+			patch, err := ParsePatch([]byte(s))
+			require.NoError(t, err, s)
+			require.Equal(t, keypath, patch.Keypath, s)
+
+			_, path, _, err := ParsePatchPath([]byte(s))
+			require.NoError(t, err, s)
+			require.Equal(t, keypath, path, s)
+		})
+	}
+}
+
+func TestParsePatch_ByteValues(t *testing.T) {
+	patch, err := ParsePatch([]byte(`.foo[1:2] = b64"AP8="`))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0xff}, patch.Val)
+
+	patch, err = ParsePatch([]byte(` .foo = { "a" : [ b64"" , "b64\"AA==\"", 1e3, null ] } `))
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"a": []interface{}{[]byte{}, `b64"AA=="`, float64(1000), nil}}, patch.Val)
+}
+
+func TestParsePatch_Ranges(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected tree.Range
+	}{
+		{`.list[2:5] = []`, tree.Range{Start: 2, End: 5}},
+		{`.list[2:] = []`, tree.Range{Start: 2, End: tree.RangeToEnd}},
+		{`.list[:5] = []`, tree.Range{Start: 0, End: 5}},
+		{`.list[:] = []`, tree.Range{Start: 0, End: tree.RangeToEnd}},
+		{`.list[-1:] = []`, tree.Range{Start: -1, End: 0}},
+		{`.list[-3:-1] = []`, tree.Range{Start: -3, End: -1}},
+		{`.list[-3:0] = []`, tree.Range{Start: -3, End: 0}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			patch, err := ParsePatch([]byte(test.input))
+			require.NoError(t, err)
+			require.Equal(t, tree.Keypath("list"), patch.Keypath)
+			require.Equal(t, &test.expected, patch.Range)
+
+			// Ranges survive a round trip through Patch.String
+			reparsed, err := ParsePatch([]byte(patch.String()))
+			require.NoError(t, err)
+			require.Equal(t, patch.Range, reparsed.Range)
+		})
+	}
+
+	badTests := []struct {
+		input  string
+		offset int
+	}{
+		{`.list[5:2] = []`, 8},
+		{`.list[-1:-3] = []`, 9},
+		{`.list[2:-1] = []`, 8},
+		{`.list[-2:1] = []`, 9},
+		{`.list[a:] = []`, 6},
+	}
+
+	for _, test := range badTests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			_, err := ParsePatch([]byte(test.input))
+			var parseErr *PatchParseError
+			require.True(t, errors.As(err, &parseErr))
+			require.Equal(t, test.offset, parseErr.Offset)
+		})
+	}
+}
+
+func TestParsePatch_RangesAreHalfOpen(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected tree.Range
+		size     uint64
+	}{
+		{`.text[0:0] = "a"`, tree.Range{Start: 0, End: 0}, 0},
+		{`.text[0:1] = "a"`, tree.Range{Start: 0, End: 1}, 1},
+		{`.text[3:3] = "a"`, tree.Range{Start: 3, End: 3}, 0},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.input, func(t *testing.T) {
+			patch, err := ParsePatch([]byte(test.input))
+			require.NoError(t, err)
+			require.Equal(t, &test.expected, patch.Range)
+			require.Equal(t, test.size, patch.Range.Size())
+		})
+	}
+}
+
+func TestParsePatch_NegativeIndicesDisabled(t *testing.T) {
+	noNegatives := PatchParseAllowNegativeIndices(false)
+
+	for _, input := range []string{`.list[-1:] = []`, `.list[-3:-1] = []`} {
+		_, err := ParsePatchWithOptions([]byte(input), noNegatives)
+		var parseErr *PatchParseError
+		require.True(t, errors.As(err, &parseErr), input)
+		require.Equal(t, 6, parseErr.Offset)
+		require.Equal(t, "a non-negative integer", parseErr.Expected)
+	}
+
+	// Appends aren't negative bounds
+	patch, err := ParsePatchWithOptions([]byte(`.list[-] = 1`), noNegatives)
+	require.NoError(t, err)
+	require.True(t, patch.Range.IsAppend())
+
+	patch, err = ParsePatchWithOptions([]byte(`.list[1:2] = []`), noNegatives)
+	require.NoError(t, err)
+	require.Equal(t, &tree.Range{Start: 1, End: 2}, patch.Range)
+}
+
+func TestParsePatch_Append(t *testing.T) {
+	for _, input := range []string{`.list[-] = 1`, `.list += 1`, `.list+= 1`} {
+		patch, err := ParsePatch([]byte(input))
+		require.NoError(t, err, input)
+		require.Equal(t, tree.Keypath("list"), patch.Keypath)
+		require.True(t, patch.Range.IsAppend())
+		require.Equal(t, float64(1), patch.Val)
+		require.Equal(t, `.list[-] = 1`, patch.String())
+	}
+
+	_, err := ParsePatch([]byte(`.list[0:1] += 1`))
+	var parseErr *PatchParseError
+	require.True(t, errors.As(err, &parseErr))
+	require.Equal(t, 11, parseErr.Offset)
+}
@@ -0,0 +1,71 @@
+package redwood
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"redwood.dev/types"
+)
+
+// blobFilter is a counting bloom filter of the sha3 hashes of the blobs in a
+// refStore.  It lets HaveObject answer "no" without touching the disk.  It
+// never gives false negatives as long as every blob that lands in the store
+// is added exactly once and every blob that's removed is removed exactly
+// once.  Counters that saturate are never decremented again, so they can only
+// cause false positives.
+type blobFilter struct {
+	mu       sync.RWMutex
+	counters []uint8
+}
+
+// Blob hashes are already uniformly distributed, so the filter's k hash
+// functions are just k slices of the hash itself.
+const blobFilterNumHashes = 4
+
+func newBlobFilter(size int) *blobFilter {
+	return &blobFilter{counters: make([]uint8, size)}
+}
+
+func (f *blobFilter) indices(sha3Hash types.Hash) [blobFilterNumHashes]uint64 {
+	var indices [blobFilterNumHashes]uint64
+	for i := range indices {
+		indices[i] = binary.BigEndian.Uint64(sha3Hash[i*8:]) % uint64(len(f.counters))
+	}
+	return indices
+}
+
+func (f *blobFilter) add(sha3Hash types.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, idx := range f.indices(sha3Hash) {
+		if f.counters[idx] < 255 {
+			f.counters[idx]++
+		}
+	}
+}
+
+func (f *blobFilter) remove(sha3Hash types.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, idx := range f.indices(sha3Hash) {
+		if f.counters[idx] > 0 && f.counters[idx] < 255 {
+			f.counters[idx]--
+		}
+	}
+}
+
+// mayContain returns false only if the hash was definitely never added (or
+// has since been removed).
+func (f *blobFilter) mayContain(sha3Hash types.Hash) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, idx := range f.indices(sha3Hash) {
+		if f.counters[idx] == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package redwood
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
+
+	"redwood.dev/crypto"
+	"redwood.dev/types"
+	"redwood.dev/utils"
+)
+
+// CopyObjectsTo copies the given blobs into dst, skipping any that dst
+// already has.  When dst is another filesystem-backed store with the same
+// encryption key, each blob file is hard-linked into it and its metadata is
+// copied over directly, so nothing is read or re-hashed.  A link shares its
+// permissions with the original file, so a blob is only linked if its mode
+// already matches dst's RefStoreFileMode.  Otherwise, or when the link fails
+// (as it does across devices), the blob is streamed out of this store into
+// dst, which checks it against its ref on the way in and gives the new file
+// dst's mode.
+func (s *refStore) CopyObjectsTo(dst RefStore, refIDs []types.RefID) (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	defer utils.Annotate(&err, "refStore.CopyObjectsTo")
+
+	dstDisk, isDisk := dst.(*refStore)
+	if isDisk && dstDisk == s {
+		return nil
+	}
+	canLink := isDisk && sameEncryptionKey(s.encryptionKey, dstDisk.encryptionKey)
+
+	for _, refID := range refIDs {
+		if canLink {
+			linked, err := s.linkObjectTo(dstDisk, refID)
+			if err != nil {
+				return err
+			} else if linked {
+				continue
+			}
+		}
+
+		have, err := dst.HaveObject(refID)
+		if err != nil {
+			return err
+		} else if have {
+			continue
+		}
+		reader, _, err := s.object(refID)
+		if err != nil {
+			return err
+		}
+		_, _, _, err = dst.StoreObjectIfAbsent(reader, &refID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkObjectTo hard-links a blob into dst and copies its metadata.  It
+// returns false if the blob couldn't be linked, in which case it has to be
+// copied some other way.
+func (s *refStore) linkObjectTo(dst *refStore, refID types.RefID) (bool, error) {
+	sha3Hash, metadata, err := s.blobMetadata(refID)
+	if err != nil {
+		return false, err
+	}
+
+	var linked bool
+	err = dst.whileWritable(func() (err error) {
+		linked, err = dst.linkObjectFrom(s.filepathForSHA3Blob(sha3Hash), sha3Hash, metadata)
+		return err
+	})
+	if linked && err == nil {
+		dst.notifyRefsSavedListeners()
+	}
+	return linked, err
+}
+
+// blobMetadata returns all of the metadata entries that describe a blob,
+// keyed by their metadata keys.
+func (s *refStore) blobMetadata(refID types.RefID) (types.Hash, map[string][]byte, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	sha1Hash, sha3Hash, err := s.hashesFor(refID)
+	if err != nil {
+		return types.Hash{}, nil, err
+	}
+
+	keys := [][]byte{
+		sha3ToSHA1Key(sha3Hash),
+		sha3ToHashVariantKey(sha3Hash),
+		sha3ToCompressedKey(sha3Hash),
+		sha3ToContentTypeKey(sha3Hash),
+	}
+	if sha1Hash != (types.Hash{}) {
+		keys = append(keys, sha1ToSHA3Key(sha1Hash))
+	}
+
+	metadata := make(map[string][]byte)
+	err = s.metadata.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			metadata[string(key)] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return types.Hash{}, nil, errors.WithStack(err)
+	}
+	return sha3Hash, metadata, nil
+}
+
+func (s *refStore) linkObjectFrom(srcPath string, sha3Hash types.Hash, metadata map[string][]byte) (bool, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	err := s.ensureRootPath()
+	if err != nil {
+		return false, err
+	}
+
+	dstPath := s.filepathForSHA3Blob(sha3Hash)
+	_, err = os.Stat(dstPath)
+	if err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+
+	// Changing the mode of a link would change the original as well
+	srcInfo, err := os.Stat(srcPath)
+	if os.IsNotExist(err) {
+		// Copying it will report that it's missing
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	} else if srcInfo.Mode().Perm() != s.fileMode {
+		s.Debugf("not linking blob %v, its mode is %v rather than %v", sha3Hash.Hex(), srcInfo.Mode().Perm(), s.fileMode)
+		return false, nil
+	}
+
+	err = os.Link(srcPath, dstPath)
+	if err != nil {
+		s.Debugf("can't link blob %v, copying it instead: %v", sha3Hash.Hex(), err)
+		return false, nil
+	}
+	if s.syncWrites {
+		err = s.syncDir(filepath.Dir(dstPath))
+		if err != nil {
+			return false, err
+		}
+	}
+	if s.blobFilter != nil {
+		s.blobFilter.add(sha3Hash)
+	}
+
+	err = s.metadata.Update(func(txn *badger.Txn) error {
+		for key, val := range metadata {
+			err := txn.Set([]byte(key), val)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "error saving metadata for ref")
+	}
+
+	refs := []types.RefID{{HashAlg: types.SHA3, Hash: sha3Hash}}
+	if sha1Bytes, exists := metadata[string(sha3ToSHA1Key(sha3Hash))]; exists {
+		var sha1Hash types.Hash
+		copy(sha1Hash[:], sha1Bytes)
+		refs = append(refs, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+	}
+	err = s.unmarkRefsAsNeeded(refs)
+	if err != nil {
+		s.Errorf("error updating list of needed refs: %v", err)
+	}
+	return true, nil
+}
+
+func sameEncryptionKey(a, b *crypto.SymmetricKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
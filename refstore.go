@@ -2,20 +2,31 @@ package redwood
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	goerrors "errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	badgeroptions "github.com/dgraph-io/badger/v2/options"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/sha3"
 
+	"redwood.dev/crypto"
 	"redwood.dev/ctx"
 	"redwood.dev/types"
 	"redwood.dev/utils"
@@ -26,50 +37,490 @@ type RefStore interface {
 	Close()
 
 	HaveObject(refID types.RefID) (bool, error)
+	HaveObjects(refIDs []types.RefID) (map[types.RefID]bool, error)
+	ResolveRefID(refID types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, have bool, err error)
 	Object(refID types.RefID) (io.ReadCloser, int64, error)
 	ObjectFilepath(refID types.RefID) (string, error)
+	WriteObjectTo(refID types.RefID, w io.Writer) (int64, error)
 	StoreObject(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, err error)
+	StoreObjectWithMetadata(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, contentType string, err error)
+	StoreObjectExpecting(reader io.ReadCloser, expected types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, err error)
+	StoreObjectIfAbsent(reader io.ReadCloser, expected *types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, stored bool, err error)
+	CopyObjectsTo(dst RefStore, refIDs []types.RefID) error
+	NewObjectWriter() (ObjectWriter, error)
+	DeleteObject(refID types.RefID) error
+	ContentTypeFor(refID types.RefID) (string, error)
 	AllHashes() ([]types.RefID, error)
+	AllHashesForAlg(alg types.HashAlg) ([]types.RefID, error)
+	IterateHashes(ctx context.Context, fn func(refID types.RefID) error) error
+	ObjectsModifiedSince(t time.Time) ([]types.RefID, error)
+	GarbageCollect() (removed int, err error)
+	SelfTest() error
 
 	RefsNeeded() ([]types.RefID, error)
+	RefsNeededPaginated(offset, limit int) ([]types.RefID, int, error)
 	MarkRefsAsNeeded(refs []types.RefID)
-	OnRefsNeeded(fn func(refs []types.RefID))
-	OnRefsSaved(fn func())
+	MarkRefsAsNeededForStateURI(stateURI string, refs []types.RefID)
+	RefsNeededForStateURI(stateURI string) ([]types.RefID, error)
+	ReconcileRefsNeeded() (removed int, err error)
+
+	// The On* methods register a listener and return a function that
+	// removes it again.
+	OnRefsNeeded(fn func(refs []types.RefID)) (unsubscribe func())
+	OnRefsNeededCount(fn func(total int)) (unsubscribe func())
+	OnRefsSaved(fn func()) (unsubscribe func())
+
+	Metrics() RefStoreMetrics
+}
+
+// writeObjectTo copies a blob from store into w, and returns the number of
+// bytes written.
+func writeObjectTo(store RefStore, refID types.RefID, w io.Writer) (int64, error) {
+	reader, _, err := store.Object(refID)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	n, err := io.Copy(w, reader)
+	if err != nil {
+		return n, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// ObjectWriter is the push-model counterpart to RefStore.StoreObject: the
+// blob is written to it, and it's stored when the writer is closed.  Hashes
+// is only valid after a successful Close.
+type ObjectWriter interface {
+	io.WriteCloser
+	Hashes() (sha1Hash types.Hash, sha3Hash types.Hash)
+}
+
+// objectWriter pipes everything written to it into StoreObject, which runs
+// in the background until Close.
+type objectWriter struct {
+	pw       *io.PipeWriter
+	chDone   chan struct{}
+	sha1Hash types.Hash
+	sha3Hash types.Hash
+	err      error
+}
+
+func newObjectWriter(store RefStore) *objectWriter {
+	pr, pw := io.Pipe()
+	w := &objectWriter{pw: pw, chDone: make(chan struct{})}
+	go func() {
+		defer close(w.chDone)
+		w.sha1Hash, w.sha3Hash, w.err = store.StoreObject(pr)
+		// Unblock any pending Write if StoreObject bailed out early
+		pr.CloseWithError(w.err)
+	}()
+	return w
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *objectWriter) Close() error {
+	w.pw.Close()
+	<-w.chDone
+	return w.err
+}
+
+func (w *objectWriter) Hashes() (sha1Hash types.Hash, sha3Hash types.Hash) {
+	return w.sha1Hash, w.sha3Hash
 }
 
 type refStore struct {
 	ctx.Logger
 
-	rootPath string
-	metadata *badger.DB
-	fileMu   sync.Mutex
+	rootPath      string
+	metadata      *badger.DB
+	fileMu        sync.Mutex
+	started       bool
+	closed        bool
+	closedMu      sync.RWMutex
+	verifyOnRead  bool
+	encryptionKey *crypto.SymmetricKey
+	hashVariant   HashVariant
+	tempDir       string
+	onMalformed   func(filename string)
+	readOnly      bool
+	maxBlobSize   int64
+	compress      bool
+	filterSize    int
+	blobFilter    *blobFilter
+	badgerOpts    RefStoreOptions
+	syncWrites    bool
+	mmap          bool
+	dirMode       os.FileMode
+	fileMode      os.FileMode
+	notifyWorkers int
+	fsync         func(f syncableFile) error
+	rename        func(src, dst string) error
+	metrics       *refStoreMetrics
+
+	refsNeededNotifier WorkQueue
+
+	refsNeededListeners        []*func(refs []types.RefID)
+	refsNeededListenersMu      sync.RWMutex
+	refsNeededCountListeners   []*func(total int)
+	refsNeededCountListenersMu sync.RWMutex
+	refsSavedListeners         []*func()
+	refsSavedListenersMu       sync.RWMutex
+}
+
+// The default for RefStoreListenerConcurrency
+const defaultNotifyWorkers = 8
+
+const (
+	defaultRefStoreDirMode  os.FileMode = 0700
+	defaultRefStoreFileMode os.FileMode = 0600
+)
+
+const (
+	refsNeededNotifyQuietPeriod = 100 * time.Millisecond
+	refsNeededNotifyMaxDelay    = 1 * time.Second
+)
+
+var (
+	ErrCorruptBlob    = errors.New("blob contents do not match their hash")
+	ErrEncryptedBlob  = errors.New("blob is encrypted on disk")
+	ErrCompressedBlob = errors.New("blob is compressed on disk")
+	ErrStoreClosed    = errors.New("store is closed")
+	ErrReadOnly       = errors.New("store is read-only")
+	ErrBlobTooLarge   = errors.New("blob is too large")
+	ErrHashMismatch   = errors.New("blob does not match the expected hash")
+)
+
+type RefStoreOption func(*refStore)
+
+// RefStoreVerifyOnRead causes the readers returned by Object to hash the blob
+// as it's read.  The final Read returns ErrCorruptBlob if the contents don't
+// match the blob's sha3 hash.
+func RefStoreVerifyOnRead(verify bool) RefStoreOption {
+	return func(s *refStore) {
+		s.verifyOnRead = verify
+	}
+}
+
+// RefStoreEncryptionKey causes blobs to be encrypted on disk with the given
+// key.  Blobs are still addressed by the hashes of their plaintext, so
+// encryption is invisible to peers.
+func RefStoreEncryptionKey(key crypto.SymmetricKey) RefStoreOption {
+	return func(s *refStore) {
+		s.encryptionKey = &key
+	}
+}
+
+// HashVariant selects the hash function that a RefStore uses for the
+// "sha3" half of a blob's identity.
+type HashVariant int
+
+const (
+	// HashVariantKeccak256 is the pre-standardization Keccak used by
+	// Ethereum (and by types.HashBytes).  It's the default.
+	HashVariantKeccak256 HashVariant = iota
+	// HashVariantSHA3_256 is FIPS-202 SHA3-256.
+	HashVariantSHA3_256
+)
+
+func (v HashVariant) String() string {
+	switch v {
+	case HashVariantKeccak256:
+		return "keccak256"
+	case HashVariantSHA3_256:
+		return "sha3-256"
+	default:
+		return fmt.Sprintf("HashVariant(%d)", int(v))
+	}
+}
+
+func (v HashVariant) newHasher() hash.Hash {
+	if v == HashVariantSHA3_256 {
+		return sha3.New256()
+	}
+	return sha3.NewLegacyKeccak256()
+}
+
+func hashVariantFromString(s string) (HashVariant, error) {
+	switch s {
+	case "keccak256":
+		return HashVariantKeccak256, nil
+	case "sha3-256":
+		return HashVariantSHA3_256, nil
+	default:
+		return 0, errors.Errorf("unknown hash variant '%v'", s)
+	}
+}
+
+// RefStoreHashVariant selects the hash function used to compute the sha3
+// hashes of newly stored blobs.  The variant is recorded alongside each blob
+// that doesn't use the default, so blobs stored under a different variant
+// remain readable (and verifiable) after the option changes.
+func RefStoreHashVariant(variant HashVariant) RefStoreOption {
+	return func(s *refStore) {
+		s.hashVariant = variant
+	}
+}
+
+// RefStoreTempDir sets the directory in which StoreObject stages blobs while
+// they're being written.  It defaults to rootPath/blobs, which is on the same
+// filesystem as the blobs themselves, so the final rename is atomic.  If dir
+// is on a different device, the staged blob is copied across instead.
+func RefStoreTempDir(dir string) RefStoreOption {
+	return func(s *refStore) {
+		s.tempDir = dir
+	}
+}
+
+// RefStoreOnMalformedBlob sets a callback that IterateHashes (and AllHashes)
+// invoke with the name of any file in the blob directory that isn't named
+// after a hash.  By default, such files are logged.
+func RefStoreOnMalformedBlob(fn func(filename string)) RefStoreOption {
+	return func(s *refStore) {
+		s.onMalformed = fn
+	}
+}
+
+// RefStoreReadOnly opens the metadata DB read-only, for replicas that serve
+// blobs from a shared filesystem but never write.  Reads work normally, and
+// anything that would modify the store fails with ErrReadOnly (or, for
+// MarkRefsAsNeeded, logs it).  The store must already exist.
+func RefStoreReadOnly(readOnly bool) RefStoreOption {
+	return func(s *refStore) {
+		s.readOnly = readOnly
+	}
+}
+
+// RefStoreMaxBlobSize limits the size of the blobs that StoreObject accepts.
+// Once a blob exceeds it, StoreObject stops reading, discards what it has
+// written so far, and returns ErrBlobTooLarge.  Zero (the default) means no
+// limit.
+func RefStoreMaxBlobSize(maxBlobSize int64) RefStoreOption {
+	return func(s *refStore) {
+		s.maxBlobSize = maxBlobSize
+	}
+}
+
+// RefStoreCompression causes newly stored blobs to be gzipped on disk (before
+// they're encrypted, if RefStoreEncryptionKey is also set).  Blobs are still
+// addressed by the hashes of their plaintext, and Object decompresses them
+// transparently.  Whether a blob is compressed is recorded per blob, so
+// toggling the option doesn't affect blobs that are already stored.
+func RefStoreCompression(compress bool) RefStoreOption {
+	return func(s *refStore) {
+		s.compress = compress
+	}
+}
+
+// RefStoreBlobFilterSize enables an in-memory bloom filter, with the given
+// number of counters, that lets HaveObject, HaveObjects, and ResolveRefID skip
+// the disk for blobs the store doesn't have.  Each counter is a byte, so
+// 1<<22 counters (4 MiB) suits millions of blobs.  Larger filters give fewer
+// false positives (which just fall through to the disk).  The filter is built
+// from the blob directory at Start and kept up to date by the store itself, so
+// it's only correct if nothing else adds blobs to the directory while the
+// store is running: blobs added out of band are reported missing until the
+// next Start.  It's disabled (zero) by default.  Read-only stores never use
+// one, since another process may be adding blobs.
+func RefStoreBlobFilterSize(size int) RefStoreOption {
+	return func(s *refStore) {
+		s.filterSize = size
+	}
+}
+
+// RefStoreSyncWrites makes StoreObject durable: the blob is fsynced before
+// it's renamed into place, its directory is fsynced after, and the metadata
+// DB is opened with badger's SyncWrites.  Without it, a blob that was
+// successfully stored can still be lost to a power failure.
+func RefStoreSyncWrites(syncWrites bool) RefStoreOption {
+	return func(s *refStore) {
+		s.syncWrites = syncWrites
+	}
+}
+
+// RefStoreMmap causes Object to serve blobs from a read-only memory mapping
+// of their files, so that hot blobs are read straight out of the OS page
+// cache.  The returned reader implements io.ReaderAt and io.Seeker (for
+// instance, for http.ServeContent).  Blobs that are encrypted or compressed
+// on disk, stores with RefStoreVerifyOnRead, and platforms without mmap fall
+// back to reading the file normally.
+func RefStoreMmap(mmap bool) RefStoreOption {
+	return func(s *refStore) {
+		s.mmap = mmap
+	}
+}
+
+// RefStoreDirMode sets the permissions of the directories that the store
+// creates for blobs (and for staging them).  The default is 0700.  As with
+// any new directory, the process's umask still applies.
+func RefStoreDirMode(mode os.FileMode) RefStoreOption {
+	return func(s *refStore) {
+		s.dirMode = mode.Perm()
+	}
+}
+
+// RefStoreFileMode sets the permissions of stored blobs.  The default is
+// 0600.  The mode is applied with chmod once the blob is in place, so the
+// umask doesn't affect it.
+func RefStoreFileMode(mode os.FileMode) RefStoreOption {
+	return func(s *refStore) {
+		s.fileMode = mode.Perm()
+	}
+}
+
+// RefStoreListenerConcurrency sets the number of goroutines used to call the
+// listeners registered with the On* methods each time there's something to
+// notify them of.  The default is 8.  One or less calls them one at a time.
+func RefStoreListenerConcurrency(n int) RefStoreOption {
+	return func(s *refStore) {
+		s.notifyWorkers = n
+	}
+}
+
+// RefStoreLogger sets the logger that the store reports through, so that an
+// application can route the store's logs into its own logging (or discard
+// them).  The default logs to the console with the label "refstore".
+func RefStoreLogger(logger ctx.Logger) RefStoreOption {
+	return func(s *refStore) {
+		if logger != nil {
+			s.Logger = logger
+		}
+	}
+}
+
+// RefStoreOptions tunes the badger DB that holds a RefStore's metadata (the
+// sha1 -> sha3 mappings, content types, and the refs-needed set).  Zero
+// fields keep badger's defaults.
+type RefStoreOptions struct {
+	// ValueLogFileSize is the maximum size of each value log file.  Badger
+	// requires it to be between 1 MiB and 2 GiB.  No single value can be
+	// larger than this, and the list of needed refs is stored as one value.
+	ValueLogFileSize int64
+	// Compression is the algorithm used to compress table blocks.  ZSTD
+	// requires cgo.
+	Compression badgeroptions.CompressionType
+	// BlockCacheSize is the number of bytes of table blocks to cache in
+	// memory.  Badger recommends a cache whenever compression is enabled.
+	BlockCacheSize int64
+	// NumVersionsToKeep is the number of versions of each key that survive
+	// compaction.
+	NumVersionsToKeep int
+}
+
+// RefStoreBadgerOptions sets the options that the metadata DB is opened with.
+func RefStoreBadgerOptions(badgerOpts RefStoreOptions) RefStoreOption {
+	return func(s *refStore) {
+		s.badgerOpts = badgerOpts
+	}
+}
 
-	refsNeededListeners   []func(refs []types.RefID)
-	refsNeededListenersMu sync.RWMutex
-	refsSavedListeners    []func()
-	refsSavedListenersMu  sync.RWMutex
+func (o RefStoreOptions) apply(opts badger.Options) badger.Options {
+	if o.ValueLogFileSize != 0 {
+		opts = opts.WithValueLogFileSize(o.ValueLogFileSize)
+	}
+	if o.Compression != badgeroptions.None {
+		opts = opts.WithCompression(o.Compression)
+	}
+	if o.BlockCacheSize != 0 {
+		opts = opts.WithBlockCacheSize(o.BlockCacheSize)
+	}
+	if o.NumVersionsToKeep != 0 {
+		opts = opts.WithNumVersionsToKeep(o.NumVersionsToKeep)
+	}
+	return opts
 }
 
-func NewRefStore(rootPath string) RefStore {
-	return &refStore{
-		Logger:   ctx.NewLogger("refstore"),
-		rootPath: rootPath,
+func NewRefStore(rootPath string, opts ...RefStoreOption) RefStore {
+	s := &refStore{
+		Logger:        ctx.NewLogger("refstore"),
+		rootPath:      rootPath,
+		dirMode:       defaultRefStoreDirMode,
+		fileMode:      defaultRefStoreFileMode,
+		notifyWorkers: defaultNotifyWorkers,
+		fsync:         func(f syncableFile) error { return f.Sync() },
+		rename:        moveFile,
+		metrics:       newRefStoreMetrics(),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// NewRefStoreWithOptions is like NewRefStore, but opens the metadata DB with
+// the given badger options instead of the defaults.
+func NewRefStoreWithOptions(rootPath string, badgerOpts RefStoreOptions, opts ...RefStoreOption) RefStore {
+	return NewRefStore(rootPath, append([]RefStoreOption{RefStoreBadgerOptions(badgerOpts)}, opts...)...)
 }
 
-func (s *refStore) Start() error {
-	opts := badger.DefaultOptions(filepath.Join(s.rootPath, "metadata"))
+// Start opens the store.  Calling it on a store that's already started does
+// nothing, and calling it after Close re-opens the store.
+func (s *refStore) Start() (err error) {
+	s.closedMu.Lock()
+	defer s.closedMu.Unlock()
+
+	if s.started {
+		return nil
+	}
+
+	opts := s.badgerOpts.apply(badger.DefaultOptions(filepath.Join(s.rootPath, "metadata")))
 	opts.Logger = nil
+	opts.ReadOnly = s.readOnly
+	if s.syncWrites {
+		opts.SyncWrites = true
+	}
 
 	db, err := badger.Open(opts)
 	if err != nil {
 		return err
 	}
 	s.metadata = db
+	defer func() {
+		if err != nil {
+			db.Close()
+			s.metadata = nil
+		}
+	}()
+
+	refsNeeded, err := s.refsNeeded()
+	if err != nil {
+		return err
+	}
+	s.metrics.setRefsNeeded(len(refsNeeded))
+
+	if s.filterSize > 0 && !s.readOnly {
+		s.blobFilter, err = s.buildBlobFilter()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Coalesce bursts of MarkRefsAsNeeded calls into a single notification
+	s.refsNeededNotifier = NewDebouncedWorkQueue(refsNeededNotifyQuietPeriod, refsNeededNotifyMaxDelay, s.notifyRefsNeeded)
+	s.started = true
+	s.closed = false
 	return nil
 }
 
 func (s *refStore) Close() {
+	if s.refsNeededNotifier != nil {
+		// Stopping runs any pending notification, so listeners see the final state
+		s.refsNeededNotifier.Stop()
+	}
+
+	// Wait for in-flight operations to finish, and turn away new ones
+	s.closedMu.Lock()
+	defer s.closedMu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.started = false
+
 	if s.metadata != nil {
 		err := s.metadata.Close()
 		if err != nil {
@@ -78,11 +529,151 @@ func (s *refStore) Close() {
 	}
 }
 
+func (s *refStore) buildBlobFilter() (*blobFilter, error) {
+	filter := newBlobFilter(s.filterSize)
+	err := s.iterateBlobFiles(context.Background(), func(sha3Hash types.Hash, info os.FileInfo) error {
+		filter.add(sha3Hash)
+		return nil
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		// The blob directory is created lazily
+		return filter, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// enter must be called (and, if it succeeds, paired with a deferred exit) by
+// every public method that touches the metadata DB.  It fails with
+// ErrStoreClosed once Close has been called, and it keeps Close from closing
+// the DB out from under the caller.  Public methods must not call each other
+// while entered, or a concurrent Close can deadlock them.
+func (s *refStore) enter() error {
+	s.closedMu.RLock()
+	if s.closed {
+		s.closedMu.RUnlock()
+		return errors.WithStack(ErrStoreClosed)
+	}
+	return nil
+}
+
+func (s *refStore) exit() {
+	s.closedMu.RUnlock()
+}
+
+// enterWritable is like enter, but also fails with ErrReadOnly if the store
+// was opened read-only.
+func (s *refStore) enterWritable() error {
+	if err := s.enter(); err != nil {
+		return err
+	} else if s.readOnly {
+		s.exit()
+		return errors.WithStack(ErrReadOnly)
+	}
+	return nil
+}
+
+// whileWritable calls fn between enterWritable and a deferred exit, so that
+// the store is exited even if fn panics.  Listeners may call back into the
+// store, so callers notify them after it returns rather than from fn.
+func (s *refStore) whileWritable(fn func() error) error {
+	if err := s.enterWritable(); err != nil {
+		return err
+	}
+	defer s.exit()
+	return fn()
+}
+
 func (s *refStore) ensureRootPath() error {
-	return os.MkdirAll(filepath.Join(s.rootPath, "blobs"), 0777|os.ModeDir)
+	if s.readOnly {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Join(s.rootPath, "blobs"), s.dirMode|os.ModeDir)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(s.tempDirPath(), s.dirMode|os.ModeDir)
+}
+
+func (s *refStore) tempDirPath() string {
+	if s.tempDir != "" {
+		return s.tempDir
+	}
+	return filepath.Join(s.rootPath, "blobs")
+}
+
+// syncableFile is the part of *os.File that RefStoreSyncWrites needs.  It
+// lets tests observe what gets synced.
+type syncableFile interface {
+	Name() string
+	Sync() error
+}
+
+func (s *refStore) syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.fsync(f)
+}
+
+// moveFile renames src to dst.  If they're on different devices, src is
+// copied into dst's directory first, so that the final rename is still
+// atomic (readers never see a partially written dst).
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	var linkErr *os.LinkError
+	if !goerrors.As(err, &linkErr) || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	staged, err := ioutil.TempFile(filepath.Dir(dst), "temp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(staged, in)
+	if err == nil {
+		err = staged.Sync()
+	}
+	closeErr := staged.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(staged.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(staged.Name())
+		return err
+	}
+	return os.Remove(src)
 }
 
 func (s *refStore) HaveObject(refID types.RefID) (bool, error) {
+	if err := s.enter(); err != nil {
+		return false, err
+	}
+	defer s.exit()
+
+	have, err := s.haveObject(refID)
+	if err == nil && !have {
+		s.metrics.recordHaveObjectMiss()
+	}
+	return have, err
+}
+
+func (s *refStore) haveObject(refID types.RefID) (bool, error) {
 	s.fileMu.Lock()
 	defer s.fileMu.Unlock()
 
@@ -104,6 +695,10 @@ func (s *refStore) HaveObject(refID types.RefID) (bool, error) {
 		return false, errors.Errorf("unknown hash type '%v'", refID.HashAlg)
 	}
 
+	if s.blobFilter != nil && !s.blobFilter.mayContain(sha3) {
+		return false, nil
+	}
+
 	_, err := os.Stat(s.filepathForSHA3Blob(sha3))
 	if os.IsNotExist(err) {
 		return false, nil
@@ -113,7 +708,132 @@ func (s *refStore) HaveObject(refID types.RefID) (bool, error) {
 	return true, nil
 }
 
+// ResolveRefID looks up both hashes of a blob given either one of them, and
+// reports whether the blob is in the store.  A hash that isn't known is
+// returned as the zero hash.
+func (s *refStore) ResolveRefID(refID types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, have bool, err error) {
+	if err := s.enter(); err != nil {
+		return types.Hash{}, types.Hash{}, false, err
+	}
+	defer s.exit()
+	return s.resolveRefID(refID)
+}
+
+func (s *refStore) resolveRefID(refID types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, have bool, err error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	sha1Hash, sha3Hash, err = s.hashesFor(refID)
+	if errors.Cause(err) == types.Err404 {
+		return types.Hash{}, types.Hash{}, false, nil
+	} else if err != nil {
+		return types.Hash{}, types.Hash{}, false, err
+	}
+
+	if s.blobFilter != nil && !s.blobFilter.mayContain(sha3Hash) {
+		return sha1Hash, sha3Hash, false, nil
+	}
+	_, err = os.Stat(s.filepathForSHA3Blob(sha3Hash))
+	if os.IsNotExist(err) {
+		return sha1Hash, sha3Hash, false, nil
+	} else if err != nil {
+		return types.Hash{}, types.Hash{}, false, errors.WithStack(err)
+	}
+	return sha1Hash, sha3Hash, true, nil
+}
+
+// HaveObjects is a bulk HaveObject.  It only takes the lock and opens a
+// metadata transaction once, so it's much cheaper for large batches.
+func (s *refStore) HaveObjects(refIDs []types.RefID) (map[types.RefID]bool, error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.exit()
+
+	have, err := s.haveObjects(refIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, exists := range have {
+		if !exists {
+			s.metrics.recordHaveObjectMiss()
+		}
+	}
+	return have, nil
+}
+
+func (s *refStore) haveObjects(refIDs []types.RefID) (map[types.RefID]bool, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	have := make(map[types.RefID]bool, len(refIDs))
+	sha3s := make(map[types.RefID]types.Hash, len(refIDs))
+
+	err := s.metadata.View(func(txn *badger.Txn) error {
+		for _, refID := range refIDs {
+			switch refID.HashAlg {
+			case types.SHA1:
+				item, err := txn.Get(sha1ToSHA3Key(refID.Hash))
+				if err == badger.ErrKeyNotFound {
+					have[refID] = false
+					continue
+				} else if err != nil {
+					return err
+				}
+				var sha3 types.Hash
+				err = item.Value(func(val []byte) error {
+					copy(sha3[:], val)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				sha3s[refID] = sha3
+
+			case types.SHA3:
+				sha3s[refID] = refID.Hash
+
+			default:
+				return errors.Errorf("unknown hash type '%v'", refID.HashAlg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for refID, sha3 := range sha3s {
+		if s.blobFilter != nil && !s.blobFilter.mayContain(sha3) {
+			have[refID] = false
+			continue
+		}
+		_, err := os.Stat(s.filepathForSHA3Blob(sha3))
+		if os.IsNotExist(err) {
+			have[refID] = false
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		} else {
+			have[refID] = true
+		}
+	}
+	return have, nil
+}
+
 func (s *refStore) Object(refID types.RefID) (io.ReadCloser, int64, error) {
+	if err := s.enter(); err != nil {
+		return nil, 0, err
+	}
+	defer s.exit()
+
+	reader, size, err := s.object(refID)
+	if errors.Cause(err) == types.Err404 {
+		s.metrics.recordObjectNotFound()
+	}
+	return reader, size, err
+}
+
+func (s *refStore) object(refID types.RefID) (io.ReadCloser, int64, error) {
 	s.fileMu.Lock()
 	defer s.fileMu.Unlock()
 
@@ -132,23 +852,47 @@ func (s *refStore) Object(refID types.RefID) (io.ReadCloser, int64, error) {
 	}
 }
 
+// WriteObjectTo copies the blob into w, and returns the number of bytes
+// written.  It returns types.Err404 if the blob isn't in the store.
+func (s *refStore) WriteObjectTo(refID types.RefID, w io.Writer) (int64, error) {
+	return writeObjectTo(s, refID, w)
+}
+
 func (s *refStore) ObjectFilepath(refID types.RefID) (string, error) {
+	if err := s.enter(); err != nil {
+		return "", err
+	}
+	defer s.exit()
+
 	s.fileMu.Lock()
 	defer s.fileMu.Unlock()
 
+	// The file on disk isn't of any use to the caller
+	if s.encryptionKey != nil {
+		return "", errors.WithStack(ErrEncryptedBlob)
+	}
+
+	var sha3Hash types.Hash
 	switch refID.HashAlg {
 	case types.SHA1:
-		sha3Hash, err := s.sha3ForSHA1(refID.Hash)
+		var err error
+		sha3Hash, err = s.sha3ForSHA1(refID.Hash)
 		if err != nil {
 			return "", err
 		}
-		return s.filepathForSHA3Blob(sha3Hash), nil
-
 	case types.SHA3:
-		return s.filepathForSHA3Blob(refID.Hash), nil
+		sha3Hash = refID.Hash
 	default:
 		return "", errors.Errorf("unknown hash type '%v'", refID.HashAlg)
 	}
+
+	_, compressed, err := s.uncompressedSizeForSHA3(sha3Hash)
+	if err != nil {
+		return "", err
+	} else if compressed {
+		return "", errors.WithStack(ErrCompressedBlob)
+	}
+	return s.filepathForSHA3Blob(sha3Hash), nil
 }
 
 func (s *refStore) objectBySHA1(hash types.Hash) (io.ReadCloser, int64, error) {
@@ -162,119 +906,976 @@ func (s *refStore) objectBySHA1(hash types.Hash) (io.ReadCloser, int64, error) {
 func (s *refStore) objectBySHA3(sha3Hash types.Hash) (io.ReadCloser, int64, error) {
 	filename := s.filepathForSHA3Blob(sha3Hash)
 	stat, err := os.Stat(filename)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return nil, 0, types.Err404
+	} else if err != nil {
 		return nil, 0, err
 	}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, 0, err
+	if s.mmap && s.encryptionKey == nil && !s.verifyOnRead {
+		_, compressed, err := s.uncompressedSizeForSHA3(sha3Hash)
+		if err != nil {
+			return nil, 0, err
+		} else if !compressed {
+			reader, err := openMmapReader(filename)
+			if err == nil {
+				return reader, stat.Size(), nil
+			}
+			s.Debugf("can't mmap %v, falling back to reading it: %v", filename, err)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		reader io.ReadCloser = f
+		size                 = stat.Size()
+	)
+	if s.encryptionKey != nil {
+		reader = &decryptingReader{Reader: crypto.NewSymmetricDecryptingReader(*s.encryptionKey, f), Closer: f}
+		size = crypto.SymmetricStreamPlaintextSize(size)
+	}
+
+	uncompressedSize, compressed, err := s.uncompressedSizeForSHA3(sha3Hash)
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	} else if compressed {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			reader.Close()
+			return nil, 0, errors.WithStack(err)
+		}
+		reader = &decompressingReader{Reader: gzipReader, underlying: reader}
+		size = uncompressedSize
+	}
+
+	if s.verifyOnRead {
+		variant, err := s.hashVariantForSHA3(sha3Hash)
+		if err != nil {
+			reader.Close()
+			return nil, 0, err
+		}
+		reader = &verifyingReader{ReadCloser: reader, hasher: variant.newHasher(), expected: sha3Hash}
+	}
+	return reader, size, nil
+}
+
+type decryptingReader struct {
+	io.Reader
+	io.Closer
+}
+
+type decompressingReader struct {
+	*gzip.Reader
+	underlying io.ReadCloser
+}
+
+func (r *decompressingReader) Close() error {
+	r.Reader.Close()
+	return r.underlying.Close()
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	hasher   hash.Hash
+	expected types.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF {
+		var actual types.Hash
+		copy(actual[:], r.hasher.Sum(nil))
+		if actual != r.expected {
+			return n, errors.WithStack(ErrCorruptBlob)
+		}
+	}
+	return n, err
+}
+
+func (s *refStore) StoreObject(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, err error) {
+	sha1Hash, sha3Hash, _, err = s.StoreObjectWithMetadata(reader)
+	return sha1Hash, sha3Hash, err
+}
+
+// StoreObjectWithMetadata stores the blob just like StoreObject, but also
+// sniffs its content type from the first 512 bytes as it streams past.  The
+// content type is recorded alongside the blob (see ContentTypeFor) and
+// returned.
+func (s *refStore) StoreObjectWithMetadata(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, contentType string, err error) {
+	err = s.whileWritable(func() (err error) {
+		sha1Hash, sha3Hash, contentType, _, err = s.storeObjectWithMetadata(reader, nil, false)
+		return err
+	})
+	if err == nil {
+		s.notifyRefsSavedListeners()
+	}
+	return sha1Hash, sha3Hash, contentType, err
+}
+
+// StoreObjectExpecting stores the blob just like StoreObject, but only if it
+// matches the expected hash (which may be either a sha1 or a sha3), as when
+// fetching a blob from an untrusted peer.  If it doesn't match, nothing is
+// stored, and ErrHashMismatch is returned along with the hashes of what was
+// actually received.
+func (s *refStore) StoreObjectExpecting(reader io.ReadCloser, expected types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, err error) {
+	err = s.whileWritable(func() (err error) {
+		sha1Hash, sha3Hash, _, _, err = s.storeObjectWithMetadata(reader, &expected, false)
+		return err
+	})
+	if err == nil {
+		s.notifyRefsSavedListeners()
+	}
+	return sha1Hash, sha3Hash, err
+}
+
+// checkExpectedHash returns ErrHashMismatch unless the hash of the same
+// algorithm as expected matches it.
+func checkExpectedHash(expected types.RefID, sha1Hash, sha3Hash types.Hash) error {
+	var actual types.RefID
+	switch expected.HashAlg {
+	case types.SHA1:
+		actual = types.RefID{HashAlg: types.SHA1, Hash: sha1Hash}
+	case types.SHA3:
+		actual = types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+	default:
+		return errors.Errorf("unknown hash type '%v'", expected.HashAlg)
+	}
+	if actual != expected {
+		return errors.Wrapf(ErrHashMismatch, "expected %v, got %v", expected, actual)
+	}
+	return nil
+}
+
+// StoreObjectIfAbsent stores the blob just like StoreObject, but avoids
+// rewriting a blob that's already in the store, which is common when syncing.
+// If expected is non-nil and that blob is present, the reader is closed
+// without being read at all.  Otherwise, if the reader is an io.Seeker, it's
+// hashed first and only rewound and stored if the blob is missing.  Either
+// way, a blob that turns out to be present once it's been copied isn't
+// renamed over the existing one.  stored reports whether the blob was
+// written.  As with StoreObjectExpecting, a non-nil expected hash must match.
+func (s *refStore) StoreObjectIfAbsent(reader io.ReadCloser, expected *types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, stored bool, err error) {
+	defer reader.Close()
+
+	err = s.whileWritable(func() (err error) {
+		sha1Hash, sha3Hash, stored, err = s.storeObjectIfAbsent(reader, expected)
+		return err
+	})
+	if err == nil && stored {
+		s.notifyRefsSavedListeners()
+	}
+	return sha1Hash, sha3Hash, stored, err
+}
+
+func (s *refStore) storeObjectIfAbsent(reader io.ReadCloser, expected *types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, stored bool, err error) {
+	defer utils.Annotate(&err, "refStore.StoreObjectIfAbsent")
+
+	if expected != nil {
+		sha1Hash, sha3Hash, have, err := s.resolveRefID(*expected)
+		if err != nil {
+			return types.Hash{}, types.Hash{}, false, err
+		} else if have {
+			return sha1Hash, sha3Hash, false, nil
+		}
+
+	} else if seeker, isSeeker := reader.(io.Seeker); isSeeker {
+		sha3Hasher := s.hashVariant.newHasher()
+		_, err := io.Copy(sha3Hasher, reader)
+		if err != nil {
+			return types.Hash{}, types.Hash{}, false, errors.WithStack(err)
+		}
+		copy(sha3Hash[:], sha3Hasher.Sum(nil))
+
+		sha1Hash, _, have, err := s.resolveRefID(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		if err != nil {
+			return types.Hash{}, types.Hash{}, false, err
+		} else if have {
+			return sha1Hash, sha3Hash, false, nil
+		}
+
+		_, err = seeker.Seek(0, io.SeekStart)
+		if err != nil {
+			return types.Hash{}, types.Hash{}, false, errors.WithStack(err)
+		}
+	}
+
+	sha1Hash, sha3Hash, _, stored, err = s.storeObjectWithMetadata(reader, expected, true)
+	return sha1Hash, sha3Hash, stored, err
+}
+
+// storeObjectWithMetadata stores a blob.  If expected is non-nil, the blob is
+// discarded unless it matches.  If ifAbsent is true and the blob is already
+// present, the copy is discarded instead of being renamed over it, and stored
+// is false.
+func (s *refStore) storeObjectWithMetadata(reader io.ReadCloser, expected *types.RefID, ifAbsent bool) (sha1Hash types.Hash, sha3Hash types.Hash, contentType string, stored bool, err error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	defer utils.Annotate(&err, "refStore.StoreObject")
+
+	start := time.Now()
+
+	err = s.ensureRootPath()
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, err
+	}
+
+	contentType, sniffed, err := SniffAndReturn("", reader)
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, err
+	}
+
+	tmpFile, err := ioutil.TempFile(s.tempDirPath(), "temp-")
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, err
+	}
+	defer func() {
+		closeErr := tmpFile.Close()
+		if closeErr != nil && !goerrors.Is(closeErr, os.ErrClosed) {
+			err = closeErr
+		}
+		if err != nil {
+			// Don't leave partial blobs lying around
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if s.maxBlobSize > 0 {
+		sniffed = &maxSizeReader{r: sniffed, remaining: s.maxBlobSize}
+	}
+
+	sha1Hasher := sha1.New()
+	sha3Hasher := s.hashVariant.newHasher()
+	tee := io.TeeReader(io.TeeReader(sniffed, sha1Hasher), sha3Hasher)
+
+	// The plaintext is hashed on its way into the writer chain, which
+	// compresses and then encrypts it as configured.  The writers are closed
+	// (flushed) innermost first.
+	var (
+		w       io.Writer = tmpFile
+		writers []io.WriteCloser
+	)
+	if s.encryptionKey != nil {
+		encryptingWriter, err := crypto.NewSymmetricEncryptingWriter(*s.encryptionKey, w)
+		if err != nil {
+			return types.Hash{}, types.Hash{}, "", false, err
+		}
+		w = encryptingWriter
+		writers = append(writers, encryptingWriter)
+	}
+	if s.compress {
+		gzipWriter := gzip.NewWriter(w)
+		w = gzipWriter
+		writers = append(writers, gzipWriter)
+	}
+
+	bytesWritten, err := io.Copy(w, tee)
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, err
+	}
+	for i := len(writers) - 1; i >= 0; i-- {
+		err = writers[i].Close()
+		if err != nil {
+			return types.Hash{}, types.Hash{}, "", false, err
+		}
+	}
+
+	bs := sha1Hasher.Sum(nil)
+	copy(sha1Hash[:], bs)
+
+	bs = sha3Hasher.Sum(nil)
+	copy(sha3Hash[:], bs)
+
+	if s.syncWrites {
+		err = s.fsync(tmpFile)
+		if err != nil {
+			return types.Hash{}, types.Hash{}, "", false, err
+		}
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, err
+	}
+
+	if expected != nil {
+		err = checkExpectedHash(*expected, sha1Hash, sha3Hash)
+		if err != nil {
+			return sha1Hash, sha3Hash, "", false, err
+		}
+	}
+
+	// The filter must count each blob once, even if it's stored again
+	var alreadyStored bool
+	if s.blobFilter != nil || ifAbsent {
+		_, err = os.Stat(s.filepathForSHA3Blob(sha3Hash))
+		alreadyStored = err == nil
+	}
+	if ifAbsent && alreadyStored {
+		err = os.Remove(tmpFile.Name())
+		if err != nil {
+			return sha1Hash, sha3Hash, "", false, errors.WithStack(err)
+		}
+		return sha1Hash, sha3Hash, contentType, false, nil
+	}
+
+	err = s.rename(tmpFile.Name(), s.filepathForSHA3Blob(sha3Hash))
+	if err != nil {
+		return sha1Hash, sha3Hash, "", false, err
+	}
+	// The blob may have been copied across devices, so set its mode here
+	// rather than on the temp file
+	err = os.Chmod(s.filepathForSHA3Blob(sha3Hash), s.fileMode)
+	if err != nil {
+		return sha1Hash, sha3Hash, "", false, errors.WithStack(err)
+	}
+	if s.syncWrites {
+		// Make the rename itself durable
+		err = s.syncDir(filepath.Dir(s.filepathForSHA3Blob(sha3Hash)))
+		if err != nil {
+			return sha1Hash, sha3Hash, "", false, err
+		}
+	}
+	if s.blobFilter != nil && !alreadyStored {
+		s.blobFilter.add(sha3Hash)
+	}
+
+	err = s.metadata.Update(func(txn *badger.Txn) error {
+		err := txn.Set(sha1ToSHA3Key(sha1Hash), sha3Hash[:])
+		if err != nil {
+			return err
+		}
+		err = txn.Set(sha3ToSHA1Key(sha3Hash), sha1Hash[:20])
+		if err != nil {
+			return err
+		}
+		// Blobs without a recorded variant are assumed to be Keccak256, which
+		// is what every blob used before the variant was configurable
+		if s.hashVariant != HashVariantKeccak256 {
+			err = txn.Set(sha3ToHashVariantKey(sha3Hash), []byte(s.hashVariant.String()))
+			if err != nil {
+				return err
+			}
+		}
+		// The blob may have been stored before with different settings
+		if s.compress {
+			err = txn.Set(sha3ToCompressedKey(sha3Hash), []byte(strconv.FormatInt(bytesWritten, 10)))
+		} else {
+			err = txn.Delete(sha3ToCompressedKey(sha3Hash))
+		}
+		if err != nil {
+			return err
+		}
+		return txn.Set(sha3ToContentTypeKey(sha3Hash), []byte(contentType))
+	})
+	if err != nil {
+		return sha1Hash, sha3Hash, "", false, errors.Wrap(err, "error saving metadata for ref")
+	}
+
+	s.Successf("saved ref (sha1: %v, sha3: %v)", sha1Hash.Hex(), sha3Hash.Hex())
+
+	err = s.unmarkRefsAsNeeded([]types.RefID{
+		{HashAlg: types.SHA1, Hash: sha1Hash},
+		{HashAlg: types.SHA3, Hash: sha3Hash},
+	})
+	if err != nil {
+		s.Errorf("error updating list of needed refs: %v", err)
+	}
+	s.metrics.recordStoreObject(bytesWritten, time.Since(start))
+
+	return sha1Hash, sha3Hash, contentType, true, nil
+}
+
+// maxSizeReader fails with ErrBlobTooLarge as soon as more than `remaining`
+// bytes have been read from it.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, errors.WithStack(ErrBlobTooLarge)
+	}
+	// Read at most one byte past the limit, which is enough to know it's been
+	// exceeded.  (Written so as not to overflow when remaining is huge.)
+	if int64(len(p))-1 > r.remaining {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, errors.WithStack(ErrBlobTooLarge)
+	}
+	return n, err
+}
+
+func (s *refStore) NewObjectWriter() (ObjectWriter, error) {
+	if err := s.enterWritable(); err != nil {
+		return nil, err
+	}
+	defer s.exit()
+
+	return newObjectWriter(s), nil
+}
+
+// DeleteObject removes a blob along with its metadata.  Deleting a blob that
+// isn't stored is not an error.
+func (s *refStore) DeleteObject(refID types.RefID) (err error) {
+	if err := s.enterWritable(); err != nil {
+		return err
+	}
+	defer s.exit()
+	defer utils.Annotate(&err, "refStore.DeleteObject")
+	return s.deleteObject(refID)
+}
+
+func (s *refStore) deleteObject(refID types.RefID) (err error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	var sha3Hash types.Hash
+	switch refID.HashAlg {
+	case types.SHA1:
+		sha3Hash, err = s.sha3ForSHA1(refID.Hash)
+		if err == types.Err404 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	case types.SHA3:
+		sha3Hash = refID.Hash
+	default:
+		return errors.Errorf("unknown hash type '%v'", refID.HashAlg)
+	}
+
+	err = os.Remove(s.filepathForSHA3Blob(sha3Hash))
+	if err == nil && s.blobFilter != nil {
+		s.blobFilter.remove(sha3Hash)
+	} else if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	keys := [][]byte{
+		sha3ToSHA1Key(sha3Hash),
+		sha3ToContentTypeKey(sha3Hash),
+		sha3ToHashVariantKey(sha3Hash),
+		sha3ToCompressedKey(sha3Hash),
+	}
+	sha1Hash, err := s.sha1ForSHA3(sha3Hash)
+	if err == nil {
+		keys = append(keys, sha1ToSHA3Key(sha1Hash))
+	} else if err != types.Err404 {
+		return err
+	}
+
+	return s.metadata.Update(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			err := txn.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SelfTest checks that the store is usable: that the metadata DB can be
+// written to and read from, and that a blob can be stored, read back intact,
+// and deleted.  The blob is random, so existing blobs are never touched, and
+// nothing is left behind.  Read-only stores only check that the metadata DB
+// and blob directory are readable.
+func (s *refStore) SelfTest() (err error) {
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.exit()
+	defer utils.Annotate(&err, "refStore.SelfTest")
+
+	if s.readOnly {
+		err = s.metadata.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("selftest"))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadDir(filepath.Join(s.rootPath, "blobs"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+
+	key := []byte("selftest:" + types.RandomID().Hex())
+	val := types.RandomID().Bytes()
+	err = s.metadata.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.metadata.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(readVal []byte) error {
+			if !bytes.Equal(readVal, val) {
+				return errors.New("metadata DB returned the wrong value")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	err = s.metadata.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	data := types.RandomID().Bytes()
+	_, sha3Hash, _, _, err := s.storeObjectWithMetadata(ioutil.NopCloser(bytes.NewReader(data)), nil, false)
+	if err != nil {
+		return err
+	}
+	refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+	defer func() {
+		deleteErr := s.deleteObject(refID)
+		if err == nil {
+			err = deleteErr
+		}
+	}()
+
+	reader, _, err := s.object(refID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	readData, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hasher := s.hashVariant.newHasher()
+	hasher.Write(readData)
+	var readHash types.Hash
+	copy(readHash[:], hasher.Sum(nil))
+	if !bytes.Equal(readData, data) || readHash != sha3Hash {
+		return errors.WithStack(ErrCorruptBlob)
+	}
+	return nil
+}
+
+// ContentTypeFor returns the content type that was sniffed when the given
+// blob was stored.
+func (s *refStore) ContentTypeFor(refID types.RefID) (string, error) {
+	if err := s.enter(); err != nil {
+		return "", err
+	}
+	defer s.exit()
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	var sha3Hash types.Hash
+	switch refID.HashAlg {
+	case types.SHA1:
+		var err error
+		sha3Hash, err = s.sha3ForSHA1(refID.Hash)
+		if err != nil {
+			return "", err
+		}
+	case types.SHA3:
+		sha3Hash = refID.Hash
+	default:
+		return "", errors.Errorf("unknown hash type '%v'", refID.HashAlg)
+	}
+
+	var contentType string
+	err := s.metadata.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(sha3ToContentTypeKey(sha3Hash))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			contentType = string(val)
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return "", types.Err404
+	}
+	return contentType, err
+}
+
+// GarbageCollect removes metadata for blobs whose files no longer exist on
+// disk (for example, because they were deleted out-of-band), and then runs
+// badger's value log GC.  It returns the number of metadata entries removed.
+func (s *refStore) GarbageCollect() (removed int, err error) {
+	if err := s.enterWritable(); err != nil {
+		return 0, err
+	}
+	defer s.exit()
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	defer utils.Annotate(&err, "refStore.GarbageCollect")
+
+	blobExists := func(sha3Hash types.Hash) (bool, error) {
+		_, err := os.Stat(s.filepathForSHA3Blob(sha3Hash))
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, errors.WithStack(err)
+		}
+		return true, nil
+	}
+
+	var dangling [][]byte
+	err = s.metadata.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Item().KeyCopy(nil)
+
+			var sha3Hash types.Hash
+			switch {
+			case bytes.HasSuffix(key, []byte(":sha3")):
+				err := iter.Item().Value(func(val []byte) error {
+					copy(sha3Hash[:], val)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			case bytes.HasSuffix(key, []byte(":sha1")):
+				copy(sha3Hash[:], key[:len(key)-len(":sha1")])
+			case bytes.HasSuffix(key, []byte(":contentType")):
+				copy(sha3Hash[:], key[:len(key)-len(":contentType")])
+			case bytes.HasSuffix(key, []byte(":hashVariant")):
+				copy(sha3Hash[:], key[:len(key)-len(":hashVariant")])
+			case bytes.HasSuffix(key, []byte(":compressed")):
+				copy(sha3Hash[:], key[:len(key)-len(":compressed")])
+			default:
+				continue
+			}
+
+			exists, err := blobExists(sha3Hash)
+			if err != nil {
+				return err
+			} else if !exists {
+				dangling = append(dangling, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(dangling) > 0 {
+		err = s.metadata.Update(func(txn *badger.Txn) error {
+			for _, key := range dangling {
+				err := txn.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// RunValueLogGC rewrites at most one file per call, so keep going until
+	// there's nothing left to rewrite
+	for {
+		err := s.metadata.RunValueLogGC(0.5)
+		if err == badger.ErrNoRewrite {
+			break
+		} else if err != nil {
+			return len(dangling), err
+		}
+	}
+	return len(dangling), nil
+}
+
+// AllHashes collects the output of IterateHashes.  Prefer IterateHashes for
+// large stores.
+func (s *refStore) AllHashes() ([]types.RefID, error) {
+	var refIDs []types.RefID
+	err := s.IterateHashes(context.Background(), func(refID types.RefID) error {
+		refIDs = append(refIDs, refID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refIDs, nil
+}
+
+// AllHashesForAlg is like AllHashes, but only returns the refs that use the
+// given hash algorithm.  Asking for types.SHA3 alone skips the metadata DB
+// entirely, since the blob files are named by their sha3 hashes.
+func (s *refStore) AllHashesForAlg(alg types.HashAlg) ([]types.RefID, error) {
+	if alg != types.SHA1 && alg != types.SHA3 {
+		return nil, errors.Errorf("unsupported hash algorithm %v", alg)
+	}
+
+	var refIDs []types.RefID
+	err := s.iterateHashes(context.Background(), alg == types.SHA1, alg == types.SHA3, func(refID types.RefID) error {
+		refIDs = append(refIDs, refID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refIDs, nil
+}
+
+const iterateHashesBatchSize = 1000
+
+// IterateHashes calls fn once for each stored blob's sha3 hash, followed by
+// its sha1 hash if that's known.  The blob directory is read in batches, so
+// the full list is never held in memory.  Iteration stops at the first error
+// returned by fn, or when ctx is canceled.  fn is called between batches,
+// without the store held open, so it may call back into the store (even
+// Close, which stops the iteration with ErrStoreClosed).  Blobs that are
+// stored or removed while iterating may or may not be visited.
+func (s *refStore) IterateHashes(ctx context.Context, fn func(refID types.RefID) error) error {
+	return s.iterateHashes(ctx, true, true, fn)
+}
+
+func (s *refStore) iterateHashes(ctx context.Context, withSHA1, withSHA3 bool, fn func(refID types.RefID) error) error {
+	var dir *os.File
+	err := func() (err error) {
+		if err := s.enter(); err != nil {
+			return err
+		}
+		defer s.exit()
+
+		s.fileMu.Lock()
+		err = s.ensureRootPath()
+		s.fileMu.Unlock()
+		if err != nil {
+			return err
+		}
+		dir, err = s.openBlobDir()
+		return err
+	}()
+	if dir == nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		// Snapshot a batch of hashes, then let go of the store before handing
+		// them to fn
+		var (
+			batch []types.RefID
+			done  bool
+		)
+		err := func() (err error) {
+			if err := s.enter(); err != nil {
+				return err
+			}
+			defer s.exit()
+
+			done, err = s.readBlobDirBatch(ctx, dir, func(sha3Hash types.Hash, info os.FileInfo) error {
+				if withSHA3 {
+					batch = append(batch, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				}
+				if !withSHA1 {
+					return nil
+				}
+
+				sha1Hash, err := s.sha1ForSHA3(sha3Hash)
+				if errors.Cause(err) == types.Err404 {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				batch = append(batch, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+				return nil
+			})
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+
+		for _, refID := range batch {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			err := fn(refID)
+			if err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// ObjectsModifiedSince returns the sha3 refs of the blobs whose files were
+// modified after t.  Blobs are immutable once they've been written, so this is
+// when they landed in the store, which is what an incremental backup needs.
+func (s *refStore) ObjectsModifiedSince(t time.Time) ([]types.RefID, error) {
+	if err := s.enter(); err != nil {
+		return nil, err
 	}
+	defer s.exit()
 
-	return f, stat.Size(), nil
-}
-
-func (s *refStore) StoreObject(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, err error) {
 	s.fileMu.Lock()
-	defer s.fileMu.Unlock()
-	defer utils.Annotate(&err, "refStore.StoreObject")
-
-	err = s.ensureRootPath()
+	err := s.ensureRootPath()
+	s.fileMu.Unlock()
 	if err != nil {
-		return types.Hash{}, types.Hash{}, err
+		return nil, err
 	}
 
-	tmpFile, err := ioutil.TempFile(s.rootPath, "temp-")
-	if err != nil {
-		return types.Hash{}, types.Hash{}, err
-	}
-	defer func() {
-		closeErr := tmpFile.Close()
-		if closeErr != nil && !goerrors.Is(closeErr, os.ErrClosed) {
-			err = closeErr
+	var refIDs []types.RefID
+	err = s.iterateBlobFiles(context.Background(), func(sha3Hash types.Hash, info os.FileInfo) error {
+		if info.ModTime().After(t) {
+			refIDs = append(refIDs, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
 		}
-	}()
-
-	sha1Hasher := sha1.New()
-	sha3Hasher := sha3.NewLegacyKeccak256()
-	tee := io.TeeReader(io.TeeReader(reader, sha1Hasher), sha3Hasher)
-
-	_, err = io.Copy(tmpFile, tee)
+		return nil
+	})
 	if err != nil {
-		return types.Hash{}, types.Hash{}, err
+		return nil, err
 	}
+	return refIDs, nil
+}
 
-	bs := sha1Hasher.Sum(nil)
-	copy(sha1Hash[:], bs)
+// iterateBlobFiles calls fn for each well-formed file in the blob directory,
+// reading the directory in batches.  Staging files are skipped, and malformed
+// filenames are reported.
+func (s *refStore) iterateBlobFiles(ctx context.Context, fn func(sha3Hash types.Hash, info os.FileInfo) error) error {
+	dir, err := s.openBlobDir()
+	if dir == nil {
+		return err
+	}
+	defer dir.Close()
 
-	bs = sha3Hasher.Sum(nil)
-	copy(sha3Hash[:], bs)
+	for {
+		done, err := s.readBlobDirBatch(ctx, dir, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+}
 
-	err = tmpFile.Close()
-	if err != nil {
-		return types.Hash{}, types.Hash{}, err
+// openBlobDir opens the blob directory for reading.  It returns a nil file
+// and no error if a read-only store has no blob directory.
+func (s *refStore) openBlobDir() (*os.File, error) {
+	dir, err := os.Open(filepath.Join(s.rootPath, "blobs"))
+	if os.IsNotExist(err) && s.readOnly {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
 	}
+	return dir, nil
+}
 
-	err = os.Rename(tmpFile.Name(), s.filepathForSHA3Blob(sha3Hash))
-	if err != nil {
-		return sha1Hash, sha3Hash, err
+// readBlobDirBatch is iterateBlobFiles for a single batch of directory
+// entries.  It returns true once the directory has been read to the end.
+func (s *refStore) readBlobDirBatch(ctx context.Context, dir *os.File, fn func(sha3Hash types.Hash, info os.FileInfo) error) (bool, error) {
+	infos, err := dir.Readdir(iterateHashesBatchSize)
+	if err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
 	}
 
-	err = s.metadata.Update(func(txn *badger.Txn) error {
-		err := txn.Set(append(sha1Hash[:20], []byte(":sha3")...), sha3Hash[:])
-		if err != nil {
-			return err
+	for _, info := range infos {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		default:
 		}
-		return txn.Set(append(sha3Hash[:], []byte(":sha1")...), sha1Hash[:20])
-	})
-	if err != nil {
-		return sha1Hash, sha3Hash, errors.Wrap(err, "error saving sha1<->sha3 mapping for ref")
-	}
 
-	s.Successf("saved ref (sha1: %v, sha3: %v)", sha1Hash.Hex(), sha3Hash.Hex())
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, "temp-") {
+			// Staging area for blobs that are still being written
+			continue
+		}
 
-	s.unmarkRefsAsNeeded([]types.RefID{
-		{HashAlg: types.SHA1, Hash: sha1Hash},
-		{HashAlg: types.SHA3, Hash: sha3Hash},
-	})
-	s.notifyRefsSavedListeners()
+		sha3Hash, err := types.HashFromHex(name)
+		if err != nil || len(name) != 2*len(sha3Hash) {
+			s.reportMalformedBlob(name)
+			continue
+		}
 
-	return sha1Hash, sha3Hash, nil
+		err = fn(sha3Hash, info)
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
 }
 
-func (s *refStore) AllHashes() ([]types.RefID, error) {
-	s.fileMu.Lock()
-	defer s.fileMu.Unlock()
+func (s *refStore) reportMalformedBlob(filename string) {
+	if s.onMalformed != nil {
+		s.onMalformed(filename)
+	} else {
+		s.Warnf("ignoring malformed filename in blob directory: %v", filename)
+	}
+}
 
-	err := s.ensureRootPath()
-	if err != nil {
+func (s *refStore) RefsNeeded() ([]types.RefID, error) {
+	if err := s.enter(); err != nil {
 		return nil, err
 	}
+	defer s.exit()
 
-	matches, err := filepath.Glob(filepath.Join(s.rootPath, "blobs", "*"))
-	if err != nil {
+	return s.refsNeeded()
+}
+
+func (s *refStore) refsNeeded() ([]types.RefID, error) {
+	return s.refsNeededMatching(func(neededBy interface{}) bool { return true })
+}
+
+// RefsNeededForStateURI returns the needed refs that were marked with
+// MarkRefsAsNeededForStateURI for the given state URI.
+func (s *refStore) RefsNeededForStateURI(stateURI string) ([]types.RefID, error) {
+	if err := s.enter(); err != nil {
 		return nil, err
 	}
+	defer s.exit()
 
-	var refIDs []types.RefID
-	for _, match := range matches {
-		sha3Hash, err := types.HashFromHex(filepath.Base(match))
-		if err != nil {
-			// ignore (@@TODO: delete?  notify?)
-			continue
-		}
-		refIDs = append(refIDs, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
-
-		sha1Hash, err := s.sha1ForSHA3(sha3Hash)
-		if err != nil {
-			continue
+	return s.refsNeededMatching(func(neededBy interface{}) bool {
+		stateURIs, _ := neededBy.([]interface{})
+		for _, x := range stateURIs {
+			if x == stateURI {
+				return true
+			}
 		}
-		refIDs = append(refIDs, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
-	}
-	return refIDs, nil
+		return false
+	})
 }
 
-func (s *refStore) RefsNeeded() ([]types.RefID, error) {
+// refsNeededMatching returns the needed refs whose entries in the
+// "missing-refs" map satisfy the predicate.  Each entry is either nil or a
+// list of the state URIs that the ref is needed by.
+func (s *refStore) refsNeededMatching(predicate func(neededBy interface{}) bool) ([]types.RefID, error) {
 	var missingRefs map[string]interface{}
 	err := s.metadata.View(func(txn *badger.Txn) error {
 		// @@TODO: super hacky
@@ -297,7 +1898,10 @@ func (s *refStore) RefsNeeded() ([]types.RefID, error) {
 	}
 
 	var missingRefsSlice []types.RefID
-	for refIDStr := range missingRefs {
+	for refIDStr, neededBy := range missingRefs {
+		if !predicate(neededBy) {
+			continue
+		}
 		var refID types.RefID
 		err := refID.UnmarshalText([]byte(refIDStr))
 		if err != nil {
@@ -309,20 +1913,79 @@ func (s *refStore) RefsNeeded() ([]types.RefID, error) {
 	return missingRefsSlice, nil
 }
 
+// RefsNeededPaginated returns a page of the needed refs (ordered by their
+// string representation) along with the total number of needed refs.  A
+// limit of zero or less returns everything from offset onward, and a
+// negative offset is an error.
+func (s *refStore) RefsNeededPaginated(offset, limit int) ([]types.RefID, int, error) {
+	if err := s.enter(); err != nil {
+		return nil, 0, err
+	}
+	defer s.exit()
+
+	refs, err := s.refsNeeded()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return paginateRefIDs(refs, offset, limit)
+}
+
+// paginateRefIDs sorts the given refs by their string representation and
+// returns the requested page along with the total count.
+func paginateRefIDs(refs []types.RefID, offset, limit int) ([]types.RefID, int, error) {
+	if offset < 0 {
+		return nil, 0, errors.Errorf("invalid offset %v", offset)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].String() < refs[j].String()
+	})
+
+	total := len(refs)
+	if offset >= total {
+		return nil, total, nil
+	}
+	end := total
+	if limit > 0 && limit < total-offset {
+		end = offset + limit
+	}
+	return refs[offset:end], total, nil
+}
+
 func (s *refStore) MarkRefsAsNeeded(refs []types.RefID) {
+	s.markRefsAsNeeded("", refs)
+}
+
+// MarkRefsAsNeededForStateURI is like MarkRefsAsNeeded, but also records
+// that the refs are needed by the given state URI (see
+// RefsNeededForStateURI).  A ref can be needed by several state URIs, and
+// all of the associations go away once it's stored.
+func (s *refStore) MarkRefsAsNeededForStateURI(stateURI string, refs []types.RefID) {
+	s.markRefsAsNeeded(stateURI, refs)
+}
+
+func (s *refStore) markRefsAsNeeded(stateURI string, refs []types.RefID) {
+	if err := s.enterWritable(); err != nil {
+		s.Errorf("can't mark refs as needed: %v", err)
+		return
+	}
+	defer s.exit()
+
+	have, err := s.haveObjects(refs)
+	if err != nil {
+		s.Errorf("error checking ref store for refs: %v", err)
+		return
+	}
+
 	var actuallyNeeded []types.RefID
 	for _, refID := range refs {
-		have, err := s.HaveObject(refID)
-		if err != nil {
-			s.Errorf("error checking ref store for ref %v: %v", refID, err)
-			continue
-		}
-		if !have {
+		if !have[refID] {
 			actuallyNeeded = append(actuallyNeeded, refID)
 		}
 	}
 
-	err := s.metadata.Update(func(txn *badger.Txn) error {
+	var numNeeded int
+	err = s.metadata.Update(func(txn *badger.Txn) error {
 		// @@TODO: super hacky
 
 		var missingRefs map[string]interface{}
@@ -350,7 +2013,7 @@ func (s *refStore) MarkRefsAsNeeded(refs []types.RefID) {
 				s.Errorf("can't marshal refID %+v to string: %v", refID, err)
 				continue
 			}
-			missingRefs[string(refIDStr)] = nil
+			missingRefs[string(refIDStr)] = addNeededBy(missingRefs[string(refIDStr)], stateURI)
 		}
 
 		bs, err := json.Marshal(missingRefs)
@@ -358,13 +2021,35 @@ func (s *refStore) MarkRefsAsNeeded(refs []types.RefID) {
 			return err
 		}
 
+		numNeeded = len(missingRefs)
 		return txn.Set([]byte("missing-refs"), bs)
 	})
 	if err != nil {
 		s.Errorf("error updating list of needed refs: %v", err)
 		// don't error out
+	} else {
+		s.metrics.setRefsNeeded(numNeeded)
+	}
+
+	s.refsNeededNotifier.Enqueue()
+}
+
+// addNeededBy adds stateURI to a "missing-refs" entry (see
+// refsNeededMatching).  An empty stateURI leaves the entry as it is.
+func addNeededBy(neededBy interface{}, stateURI string) interface{} {
+	if stateURI == "" {
+		return neededBy
+	}
+	stateURIs, _ := neededBy.([]interface{})
+	for _, x := range stateURIs {
+		if x == stateURI {
+			return stateURIs
+		}
 	}
+	return append(stateURIs, stateURI)
+}
 
+func (s *refStore) notifyRefsNeeded() {
 	allNeeded, err := s.RefsNeeded()
 	if err != nil {
 		s.Errorf("error fetching list of needed refs: %v", err)
@@ -372,9 +2057,76 @@ func (s *refStore) MarkRefsAsNeeded(refs []types.RefID) {
 	}
 
 	s.notifyRefsNeededListeners(allNeeded)
+	s.notifyRefsNeededCountListeners(len(allNeeded))
+}
+
+// ReconcileRefsNeeded repairs drift between the needed refs and the blobs
+// that are actually in the store (for instance, blobs that were copied into
+// the store out-of-band) by unmarking every needed ref that's present.  Blob
+// files are checked directly, bypassing the blob filter (which doesn't know
+// about out-of-band blobs), and any that the filter was missing are added to
+// it.  A sha1 ref can only be reconciled if its sha3 is known.  It returns the
+// number of refs that were unmarked.
+func (s *refStore) ReconcileRefsNeeded() (removed int, err error) {
+	if err := s.enterWritable(); err != nil {
+		return 0, err
+	}
+	defer s.exit()
+	defer utils.Annotate(&err, "refStore.ReconcileRefsNeeded")
+
+	needed, err := s.refsNeeded()
+	if err != nil {
+		return 0, err
+	}
+
+	present, err := s.blobFilesPresent(needed)
+	if err != nil {
+		return 0, err
+	}
+	if len(present) == 0 {
+		return 0, nil
+	}
+
+	err = s.unmarkRefsAsNeeded(present)
+	if err != nil {
+		return 0, err
+	}
+	s.refsNeededNotifier.Enqueue()
+	return len(present), nil
+}
+
+// blobFilesPresent returns the refs whose blob files exist, checking the
+// disk for every one of them.
+func (s *refStore) blobFilesPresent(refIDs []types.RefID) ([]types.RefID, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	var present []types.RefID
+	for _, refID := range refIDs {
+		_, sha3Hash, err := s.hashesFor(refID)
+		if errors.Cause(err) == types.Err404 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		_, err = os.Stat(s.filepathForSHA3Blob(sha3Hash))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		present = append(present, refID)
+
+		if s.blobFilter != nil && !s.blobFilter.mayContain(sha3Hash) {
+			s.blobFilter.add(sha3Hash)
+		}
+	}
+	return present, nil
 }
 
-func (s *refStore) unmarkRefsAsNeeded(refs []types.RefID) {
+func (s *refStore) unmarkRefsAsNeeded(refs []types.RefID) error {
+	var numNeeded int
 	err := s.metadata.Update(func(txn *badger.Txn) error {
 		// @@TODO: super hacky
 
@@ -411,64 +2163,108 @@ func (s *refStore) unmarkRefsAsNeeded(refs []types.RefID) {
 			return err
 		}
 
+		numNeeded = len(missingRefs)
 		return txn.Set([]byte("missing-refs"), bs)
 	})
 	if err != nil {
-		s.Errorf("error updating list of needed refs: %v", err)
+		return err
 	}
+	s.metrics.setRefsNeeded(numNeeded)
+	return nil
+}
+
+func (s *refStore) Metrics() RefStoreMetrics {
+	return s.metrics.snapshot()
 }
 
-func (s *refStore) OnRefsNeeded(fn func(refs []types.RefID)) {
+func (s *refStore) OnRefsNeeded(fn func(refs []types.RefID)) (unsubscribe func()) {
 	s.refsNeededListenersMu.Lock()
 	defer s.refsNeededListenersMu.Unlock()
-	s.refsNeededListeners = append(s.refsNeededListeners, fn)
+	listener := &fn
+	s.refsNeededListeners = append(s.refsNeededListeners, listener)
+	return func() {
+		s.refsNeededListenersMu.Lock()
+		defer s.refsNeededListenersMu.Unlock()
+		for i := range s.refsNeededListeners {
+			if s.refsNeededListeners[i] == listener {
+				s.refsNeededListeners = append(s.refsNeededListeners[:i:i], s.refsNeededListeners[i+1:]...)
+				return
+			}
+		}
+	}
 }
 
 func (s *refStore) notifyRefsNeededListeners(refs []types.RefID) {
 	s.refsNeededListenersMu.RLock()
 	defer s.refsNeededListenersMu.RUnlock()
 
-	var wg sync.WaitGroup
-	wg.Add(len(s.refsNeededListeners))
+	fanOut(len(s.refsNeededListeners), s.notifyWorkers, func(i int) {
+		(*s.refsNeededListeners[i])(refs)
+	}, func(recovered interface{}, stack []byte) {
+		s.Errorf("refs needed listener panicked: %v\n%s", recovered, stack)
+	})
+}
 
-	for _, handler := range s.refsNeededListeners {
-		handler := handler
-		go func() {
-			defer wg.Done()
-			handler(refs)
-		}()
+func (s *refStore) OnRefsNeededCount(fn func(total int)) (unsubscribe func()) {
+	s.refsNeededCountListenersMu.Lock()
+	defer s.refsNeededCountListenersMu.Unlock()
+	listener := &fn
+	s.refsNeededCountListeners = append(s.refsNeededCountListeners, listener)
+	return func() {
+		s.refsNeededCountListenersMu.Lock()
+		defer s.refsNeededCountListenersMu.Unlock()
+		for i := range s.refsNeededCountListeners {
+			if s.refsNeededCountListeners[i] == listener {
+				s.refsNeededCountListeners = append(s.refsNeededCountListeners[:i:i], s.refsNeededCountListeners[i+1:]...)
+				return
+			}
+		}
 	}
-	wg.Wait()
 }
 
-func (s *refStore) OnRefsSaved(fn func()) {
+func (s *refStore) notifyRefsNeededCountListeners(total int) {
+	s.refsNeededCountListenersMu.RLock()
+	defer s.refsNeededCountListenersMu.RUnlock()
+
+	fanOut(len(s.refsNeededCountListeners), s.notifyWorkers, func(i int) {
+		(*s.refsNeededCountListeners[i])(total)
+	}, func(recovered interface{}, stack []byte) {
+		s.Errorf("refs needed count listener panicked: %v\n%s", recovered, stack)
+	})
+}
+
+func (s *refStore) OnRefsSaved(fn func()) (unsubscribe func()) {
 	s.refsSavedListenersMu.Lock()
 	defer s.refsSavedListenersMu.Unlock()
-	s.refsSavedListeners = append(s.refsSavedListeners, fn)
+	listener := &fn
+	s.refsSavedListeners = append(s.refsSavedListeners, listener)
+	return func() {
+		s.refsSavedListenersMu.Lock()
+		defer s.refsSavedListenersMu.Unlock()
+		for i := range s.refsSavedListeners {
+			if s.refsSavedListeners[i] == listener {
+				s.refsSavedListeners = append(s.refsSavedListeners[:i:i], s.refsSavedListeners[i+1:]...)
+				return
+			}
+		}
+	}
 }
 
 func (s *refStore) notifyRefsSavedListeners() {
 	s.refsSavedListenersMu.RLock()
 	defer s.refsSavedListenersMu.RUnlock()
 
-	var wg sync.WaitGroup
-	wg.Add(len(s.refsSavedListeners))
-
-	for _, handler := range s.refsSavedListeners {
-		handler := handler
-		go func() {
-			defer wg.Done()
-			handler()
-		}()
-	}
-	wg.Wait()
+	fanOut(len(s.refsSavedListeners), s.notifyWorkers, func(i int) {
+		(*s.refsSavedListeners[i])()
+	}, func(recovered interface{}, stack []byte) {
+		s.Errorf("refs saved listener panicked: %v\n%s", recovered, stack)
+	})
 }
 
 func (s *refStore) sha3ForSHA1(hash types.Hash) (types.Hash, error) {
-	sha1 := hash[:20]
 	var sha3 types.Hash
 	err := s.metadata.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(append(sha1, []byte(":sha3")...))
+		item, err := txn.Get(sha1ToSHA3Key(hash))
 		if err != nil {
 			return err
 		}
@@ -483,11 +2279,55 @@ func (s *refStore) sha3ForSHA1(hash types.Hash) (types.Hash, error) {
 	return sha3, err
 }
 
+// hashesFor resolves both of a blob's hashes from either one in a single
+// metadata transaction.  It returns types.Err404 for an unknown sha1.  An
+// unknown sha3 may still belong to a blob whose sha1 was never recorded, so
+// it's returned with a zero sha1.
+func (s *refStore) hashesFor(refID types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, err error) {
+	err = s.metadata.View(func(txn *badger.Txn) error {
+		switch refID.HashAlg {
+		case types.SHA1:
+			sha1Hash = refID.Hash
+			item, err := txn.Get(sha1ToSHA3Key(sha1Hash))
+			if err == badger.ErrKeyNotFound {
+				return types.Err404
+			} else if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				copy(sha3Hash[:], val)
+				return nil
+			})
+
+		case types.SHA3:
+			sha3Hash = refID.Hash
+			item, err := txn.Get(sha3ToSHA1Key(sha3Hash))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				copy(sha1Hash[:], val)
+				return nil
+			})
+
+		default:
+			return errors.Errorf("unknown hash type '%v'", refID.HashAlg)
+		}
+	})
+	if err != nil {
+		return types.Hash{}, types.Hash{}, err
+	}
+	return sha1Hash, sha3Hash, nil
+}
+
 func (s *refStore) sha1ForSHA3(hash types.Hash) (types.Hash, error) {
-	sha3 := hash[:]
+	s.metrics.recordSHA1Lookup()
+
 	var sha1 types.Hash
 	err := s.metadata.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(append(sha3, []byte(":sha1")...))
+		item, err := txn.Get(sha3ToSHA1Key(hash))
 		if err != nil {
 			return err
 		}
@@ -502,31 +2342,193 @@ func (s *refStore) sha1ForSHA3(hash types.Hash) (types.Hash, error) {
 	return sha1, err
 }
 
+func (s *refStore) hashVariantForSHA3(hash types.Hash) (HashVariant, error) {
+	var variant HashVariant
+	err := s.metadata.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(sha3ToHashVariantKey(hash))
+		if err == badger.ErrKeyNotFound {
+			variant = HashVariantKeccak256
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			variant, err = hashVariantFromString(string(val))
+			return err
+		})
+	})
+	return variant, err
+}
+
+// uncompressedSizeForSHA3 returns the plaintext size of a blob that was
+// compressed on disk, and false if it wasn't compressed.
+func (s *refStore) uncompressedSizeForSHA3(hash types.Hash) (size int64, compressed bool, _ error) {
+	err := s.metadata.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(sha3ToCompressedKey(hash))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		compressed = true
+		return item.Value(func(val []byte) error {
+			size, err = strconv.ParseInt(string(val), 10, 64)
+			return errors.WithStack(err)
+		})
+	})
+	return size, compressed, err
+}
+
+// The keys are built in fresh slices.  Appending directly to hash[:20] would
+// write into the remainder of the hash's backing array.
+func sha1ToSHA3Key(sha1Hash types.Hash) []byte {
+	key := make([]byte, 0, 20+len(":sha3"))
+	key = append(key, sha1Hash[:20]...)
+	return append(key, ":sha3"...)
+}
+
+func sha3ToSHA1Key(sha3Hash types.Hash) []byte {
+	key := make([]byte, 0, len(sha3Hash)+len(":sha1"))
+	key = append(key, sha3Hash[:]...)
+	return append(key, ":sha1"...)
+}
+
+func sha3ToHashVariantKey(sha3Hash types.Hash) []byte {
+	key := make([]byte, 0, len(sha3Hash)+len(":hashVariant"))
+	key = append(key, sha3Hash[:]...)
+	return append(key, ":hashVariant"...)
+}
+
+func sha3ToContentTypeKey(sha3Hash types.Hash) []byte {
+	key := make([]byte, 0, len(sha3Hash)+len(":contentType"))
+	key = append(key, sha3Hash[:]...)
+	return append(key, ":contentType"...)
+}
+
+func sha3ToCompressedKey(sha3Hash types.Hash) []byte {
+	key := make([]byte, 0, len(sha3Hash)+len(":compressed"))
+	key = append(key, sha3Hash[:]...)
+	return append(key, ":compressed"...)
+}
+
 func (s *refStore) filepathForSHA3Blob(sha3Hash types.Hash) string {
 	return filepath.Join(s.rootPath, "blobs", sha3Hash.Hex())
 }
 
-func (s *refStore) DebugPrint() {
+type RefMetadataKind string
+
+const (
+	RefMetadataSHA1ToSHA3  RefMetadataKind = "sha1->sha3"
+	RefMetadataSHA3ToSHA1  RefMetadataKind = "sha3->sha1"
+	RefMetadataContentType RefMetadataKind = "contentType"
+	RefMetadataHashVariant RefMetadataKind = "hashVariant"
+	RefMetadataCompressed  RefMetadataKind = "compressed"
+	RefMetadataRefNeeded   RefMetadataKind = "refNeeded"
+)
+
+// RefMetadataEntry is a single piece of metadata from the ref store's badger
+// DB.  RefID is the ref that the entry describes.  Value is the hex-encoded
+// mapped hash for the two mapping kinds, the content type for
+// RefMetadataContentType, the variant's name for RefMetadataHashVariant, the
+// uncompressed size for RefMetadataCompressed, and empty for
+// RefMetadataRefNeeded.
+type RefMetadataEntry struct {
+	Kind  RefMetadataKind
+	RefID types.RefID
+	Value string
+}
+
+func (e RefMetadataEntry) String() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%v %v", e.Kind, e.RefID)
+	}
+	return fmt.Sprintf("%v %v = %v", e.Kind, e.RefID, e.Value)
+}
+
+// DumpMetadata returns everything stored in the ref store's metadata DB.
+func (s *refStore) DumpMetadata() ([]RefMetadataEntry, error) {
+	if err := s.enter(); err != nil {
+		return nil, err
+	}
+	defer s.exit()
+
+	var entries []RefMetadataEntry
 	err := s.metadata.View(func(txn *badger.Txn) error {
 		iter := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer iter.Close()
+
 		for iter.Rewind(); iter.Valid(); iter.Next() {
 			key := iter.Item().Key()
 			val, err := iter.Item().ValueCopy(nil)
 			if err != nil {
 				return err
 			}
-			var keyStr string
-			if bytes.HasSuffix(key, []byte(":sha3")) {
-				keyStr = fmt.Sprintf("%0x:sha3", key[:len(key)-5])
-			} else if bytes.HasSuffix(key, []byte(":sha1")) {
-				keyStr = fmt.Sprintf("%0x:sha1", key[:len(key)-5])
+
+			switch {
+			case bytes.Equal(key, []byte("missing-refs")):
+				var missingRefs map[string]interface{}
+				err := json.Unmarshal(val, &missingRefs)
+				if err != nil {
+					return err
+				}
+				for refIDStr := range missingRefs {
+					var refID types.RefID
+					err := refID.UnmarshalText([]byte(refIDStr))
+					if err != nil {
+						return err
+					}
+					entries = append(entries, RefMetadataEntry{Kind: RefMetadataRefNeeded, RefID: refID})
+				}
+
+			case bytes.HasSuffix(key, []byte(":sha3")):
+				var refID types.RefID
+				refID.HashAlg = types.SHA1
+				copy(refID.Hash[:], key[:len(key)-len(":sha3")])
+				entries = append(entries, RefMetadataEntry{Kind: RefMetadataSHA1ToSHA3, RefID: refID, Value: hex.EncodeToString(val)})
+
+			case bytes.HasSuffix(key, []byte(":sha1")):
+				var refID types.RefID
+				refID.HashAlg = types.SHA3
+				copy(refID.Hash[:], key[:len(key)-len(":sha1")])
+				entries = append(entries, RefMetadataEntry{Kind: RefMetadataSHA3ToSHA1, RefID: refID, Value: hex.EncodeToString(val)})
+
+			case bytes.HasSuffix(key, []byte(":contentType")):
+				var refID types.RefID
+				refID.HashAlg = types.SHA3
+				copy(refID.Hash[:], key[:len(key)-len(":contentType")])
+				entries = append(entries, RefMetadataEntry{Kind: RefMetadataContentType, RefID: refID, Value: string(val)})
+
+			case bytes.HasSuffix(key, []byte(":hashVariant")):
+				var refID types.RefID
+				refID.HashAlg = types.SHA3
+				copy(refID.Hash[:], key[:len(key)-len(":hashVariant")])
+				entries = append(entries, RefMetadataEntry{Kind: RefMetadataHashVariant, RefID: refID, Value: string(val)})
+
+			case bytes.HasSuffix(key, []byte(":compressed")):
+				var refID types.RefID
+				refID.HashAlg = types.SHA3
+				copy(refID.Hash[:], key[:len(key)-len(":compressed")])
+				entries = append(entries, RefMetadataEntry{Kind: RefMetadataCompressed, RefID: refID, Value: string(val)})
+
+			default:
+				s.Warnf("unknown refstore metadata key %0x", key)
 			}
-			s.Debugf("%s = %0x", keyStr, val)
 		}
 		return nil
 	})
 	if err != nil {
-		panic(err)
+		return nil, errors.WithStack(err)
+	}
+	return entries, nil
+}
+
+func (s *refStore) DebugPrint() {
+	entries, err := s.DumpMetadata()
+	if err != nil {
+		s.Errorf("error dumping refstore metadata: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		s.Debugf("%v", entry)
 	}
 }
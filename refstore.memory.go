@@ -0,0 +1,605 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/sha3"
+
+	"redwood.dev/types"
+)
+
+// memoryRefStore is a RefStore that keeps blobs and metadata entirely in
+// memory.  It's mainly useful for tests.
+type memoryRefStore struct {
+	mu          sync.RWMutex
+	blobs       map[types.Hash][]byte               // sha3 -> blob
+	sha3ForSHA1 map[types.Hash]types.Hash           // sha1 -> sha3
+	sha1ForSHA3 map[types.Hash]types.Hash           // sha3 -> sha1
+	contentType map[types.Hash]string               // sha3 -> content type
+	storedAt    map[types.Hash]time.Time            // sha3 -> when it was last stored
+	refsNeeded  map[types.RefID]map[string]struct{} // ref -> state URIs that need it
+	metrics     *refStoreMetrics
+	started     bool
+
+	refsNeededNotifier WorkQueue
+
+	refsNeededListeners        []*func(refs []types.RefID)
+	refsNeededListenersMu      sync.RWMutex
+	refsNeededCountListeners   []*func(total int)
+	refsNeededCountListenersMu sync.RWMutex
+	refsSavedListeners         []*func()
+	refsSavedListenersMu       sync.RWMutex
+}
+
+var _ RefStore = (*memoryRefStore)(nil)
+
+func NewMemoryRefStore() RefStore {
+	return &memoryRefStore{
+		blobs:       make(map[types.Hash][]byte),
+		sha3ForSHA1: make(map[types.Hash]types.Hash),
+		sha1ForSHA3: make(map[types.Hash]types.Hash),
+		contentType: make(map[types.Hash]string),
+		storedAt:    make(map[types.Hash]time.Time),
+		refsNeeded:  make(map[types.RefID]map[string]struct{}),
+		metrics:     newRefStoreMetrics(),
+	}
+}
+
+func (s *memoryRefStore) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return nil
+	}
+	s.refsNeededNotifier = NewDebouncedWorkQueue(refsNeededNotifyQuietPeriod, refsNeededNotifyMaxDelay, s.notifyRefsNeeded)
+	s.started = true
+	return nil
+}
+
+func (s *memoryRefStore) Close() {
+	s.mu.Lock()
+	notifier := s.refsNeededNotifier
+	s.started = false
+	s.mu.Unlock()
+
+	if notifier != nil {
+		// Outside the lock, since stopping runs any pending notification
+		notifier.Stop()
+	}
+}
+
+// sha3For must be called while holding s.mu
+func (s *memoryRefStore) sha3For(refID types.RefID) (types.Hash, error) {
+	switch refID.HashAlg {
+	case types.SHA1:
+		sha3Hash, exists := s.sha3ForSHA1[refID.Hash]
+		if !exists {
+			return types.Hash{}, types.Err404
+		}
+		return sha3Hash, nil
+	case types.SHA3:
+		return refID.Hash, nil
+	default:
+		return types.Hash{}, errors.Errorf("unknown hash type '%v'", refID.HashAlg)
+	}
+}
+
+func (s *memoryRefStore) HaveObject(refID types.RefID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sha3Hash, err := s.sha3For(refID)
+	if err == types.Err404 {
+		s.metrics.recordHaveObjectMiss()
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, exists := s.blobs[sha3Hash]
+	if !exists {
+		s.metrics.recordHaveObjectMiss()
+	}
+	return exists, nil
+}
+
+func (s *memoryRefStore) ResolveRefID(refID types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, have bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sha3Hash, err = s.sha3For(refID)
+	if err == types.Err404 {
+		return types.Hash{}, types.Hash{}, false, nil
+	} else if err != nil {
+		return types.Hash{}, types.Hash{}, false, err
+	}
+	sha1Hash = s.sha1ForSHA3[sha3Hash]
+	_, have = s.blobs[sha3Hash]
+	return sha1Hash, sha3Hash, have, nil
+}
+
+func (s *memoryRefStore) HaveObjects(refIDs []types.RefID) (map[types.RefID]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	have := make(map[types.RefID]bool, len(refIDs))
+	for _, refID := range refIDs {
+		sha3Hash, err := s.sha3For(refID)
+		if err == types.Err404 {
+			have[refID] = false
+		} else if err != nil {
+			return nil, err
+		} else {
+			_, have[refID] = s.blobs[sha3Hash]
+		}
+		if !have[refID] {
+			s.metrics.recordHaveObjectMiss()
+		}
+	}
+	return have, nil
+}
+
+func (s *memoryRefStore) Object(refID types.RefID) (io.ReadCloser, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sha3Hash, err := s.sha3For(refID)
+	if err == types.Err404 {
+		s.metrics.recordObjectNotFound()
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, err
+	}
+	blob, exists := s.blobs[sha3Hash]
+	if !exists {
+		s.metrics.recordObjectNotFound()
+		return nil, 0, types.Err404
+	}
+	return ioutil.NopCloser(bytes.NewReader(blob)), int64(len(blob)), nil
+}
+
+func (s *memoryRefStore) WriteObjectTo(refID types.RefID, w io.Writer) (int64, error) {
+	return writeObjectTo(s, refID, w)
+}
+
+func (s *memoryRefStore) ObjectFilepath(refID types.RefID) (string, error) {
+	return "", errors.Wrap(types.ErrUnimplemented, "memoryRefStore has no files")
+}
+
+func (s *memoryRefStore) StoreObject(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, err error) {
+	sha1Hash, sha3Hash, _, err = s.StoreObjectWithMetadata(reader)
+	return sha1Hash, sha3Hash, err
+}
+
+func (s *memoryRefStore) StoreObjectWithMetadata(reader io.ReadCloser) (sha1Hash types.Hash, sha3Hash types.Hash, contentType string, err error) {
+	sha1Hash, sha3Hash, contentType, _, err = s.storeObject(reader, nil, false)
+	return sha1Hash, sha3Hash, contentType, err
+}
+
+func (s *memoryRefStore) StoreObjectExpecting(reader io.ReadCloser, expected types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, err error) {
+	sha1Hash, sha3Hash, _, _, err = s.storeObject(reader, &expected, false)
+	return sha1Hash, sha3Hash, err
+}
+
+func (s *memoryRefStore) StoreObjectIfAbsent(reader io.ReadCloser, expected *types.RefID) (sha1Hash types.Hash, sha3Hash types.Hash, stored bool, err error) {
+	if expected != nil {
+		sha1Hash, sha3Hash, have, err := s.ResolveRefID(*expected)
+		if err != nil {
+			reader.Close()
+			return types.Hash{}, types.Hash{}, false, err
+		} else if have {
+			reader.Close()
+			return sha1Hash, sha3Hash, false, nil
+		}
+	}
+	// Blobs are hashed in memory anyway, so a seekable reader doesn't save
+	// anything here
+	sha1Hash, sha3Hash, _, stored, err = s.storeObject(reader, expected, true)
+	return sha1Hash, sha3Hash, stored, err
+}
+
+// CopyObjectsTo streams each of the given blobs into dst, skipping any that
+// dst already has.
+func (s *memoryRefStore) CopyObjectsTo(dst RefStore, refIDs []types.RefID) error {
+	if dst == RefStore(s) {
+		return nil
+	}
+	for _, refID := range refIDs {
+		have, err := dst.HaveObject(refID)
+		if err != nil {
+			return err
+		} else if have {
+			continue
+		}
+		reader, _, err := s.Object(refID)
+		if err != nil {
+			return err
+		}
+		_, _, _, err = dst.StoreObjectIfAbsent(reader, &refID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeObject stores a blob.  If expected is non-nil, the blob is discarded
+// unless it matches.  If ifAbsent is true and the blob is already present,
+// it's left alone and stored is false.
+func (s *memoryRefStore) storeObject(reader io.ReadCloser, expected *types.RefID, ifAbsent bool) (sha1Hash types.Hash, sha3Hash types.Hash, contentType string, stored bool, err error) {
+	defer reader.Close()
+
+	start := time.Now()
+
+	blob, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, errors.WithStack(err)
+	}
+
+	contentType, err = SniffContentType("", bytes.NewReader(blob))
+	if err != nil {
+		return types.Hash{}, types.Hash{}, "", false, err
+	}
+
+	sha1Bytes := sha1.Sum(blob)
+	copy(sha1Hash[:], sha1Bytes[:])
+
+	sha3Hasher := sha3.NewLegacyKeccak256()
+	sha3Hasher.Write(blob)
+	copy(sha3Hash[:], sha3Hasher.Sum(nil))
+
+	if expected != nil {
+		err = checkExpectedHash(*expected, sha1Hash, sha3Hash)
+		if err != nil {
+			return sha1Hash, sha3Hash, "", false, err
+		}
+	}
+
+	s.mu.Lock()
+	if _, exists := s.blobs[sha3Hash]; exists && ifAbsent {
+		s.mu.Unlock()
+		return sha1Hash, sha3Hash, contentType, false, nil
+	}
+	s.blobs[sha3Hash] = blob
+	s.sha3ForSHA1[sha1Hash] = sha3Hash
+	s.sha1ForSHA3[sha3Hash] = sha1Hash
+	s.contentType[sha3Hash] = contentType
+	s.storedAt[sha3Hash] = time.Now()
+	delete(s.refsNeeded, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+	delete(s.refsNeeded, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+	s.metrics.setRefsNeeded(len(s.refsNeeded))
+	s.mu.Unlock()
+
+	s.notifyRefsSavedListeners()
+	s.metrics.recordStoreObject(int64(len(blob)), time.Since(start))
+
+	return sha1Hash, sha3Hash, contentType, true, nil
+}
+
+func (s *memoryRefStore) NewObjectWriter() (ObjectWriter, error) {
+	return newObjectWriter(s), nil
+}
+
+func (s *memoryRefStore) ContentTypeFor(refID types.RefID) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sha3Hash, err := s.sha3For(refID)
+	if err != nil {
+		return "", err
+	}
+	contentType, exists := s.contentType[sha3Hash]
+	if !exists {
+		return "", types.Err404
+	}
+	return contentType, nil
+}
+
+func (s *memoryRefStore) DeleteObject(refID types.RefID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sha3Hash types.Hash
+	switch refID.HashAlg {
+	case types.SHA1:
+		var exists bool
+		sha3Hash, exists = s.sha3ForSHA1[refID.Hash]
+		if !exists {
+			return nil
+		}
+	case types.SHA3:
+		sha3Hash = refID.Hash
+	default:
+		return errors.Errorf("unknown hash type '%v'", refID.HashAlg)
+	}
+
+	if sha1Hash, exists := s.sha1ForSHA3[sha3Hash]; exists {
+		delete(s.sha3ForSHA1, sha1Hash)
+	}
+	delete(s.sha1ForSHA3, sha3Hash)
+	delete(s.contentType, sha3Hash)
+	delete(s.storedAt, sha3Hash)
+	delete(s.blobs, sha3Hash)
+	return nil
+}
+
+// SelfTest always succeeds, since there's nothing that can fail.
+func (s *memoryRefStore) SelfTest() error {
+	return nil
+}
+
+func (s *memoryRefStore) GarbageCollect() (removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sha1Hash, sha3Hash := range s.sha3ForSHA1 {
+		if _, exists := s.blobs[sha3Hash]; !exists {
+			delete(s.sha3ForSHA1, sha1Hash)
+			removed++
+		}
+	}
+	for sha3Hash := range s.sha1ForSHA3 {
+		if _, exists := s.blobs[sha3Hash]; !exists {
+			delete(s.sha1ForSHA3, sha3Hash)
+			removed++
+		}
+	}
+	for sha3Hash := range s.contentType {
+		if _, exists := s.blobs[sha3Hash]; !exists {
+			delete(s.contentType, sha3Hash)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *memoryRefStore) AllHashes() ([]types.RefID, error) {
+	var refIDs []types.RefID
+	err := s.IterateHashes(context.Background(), func(refID types.RefID) error {
+		refIDs = append(refIDs, refID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refIDs, nil
+}
+
+func (s *memoryRefStore) AllHashesForAlg(alg types.HashAlg) ([]types.RefID, error) {
+	if alg != types.SHA1 && alg != types.SHA3 {
+		return nil, errors.Errorf("unsupported hash algorithm %v", alg)
+	}
+
+	var refIDs []types.RefID
+	err := s.IterateHashes(context.Background(), func(refID types.RefID) error {
+		if refID.HashAlg == alg {
+			refIDs = append(refIDs, refID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refIDs, nil
+}
+
+func (s *memoryRefStore) ObjectsModifiedSince(t time.Time) ([]types.RefID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var refIDs []types.RefID
+	for sha3Hash, storedAt := range s.storedAt {
+		if storedAt.After(t) {
+			refIDs = append(refIDs, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		}
+	}
+	return refIDs, nil
+}
+
+func (s *memoryRefStore) IterateHashes(ctx context.Context, fn func(refID types.RefID) error) error {
+	// Copy the hashes out so that fn is free to call back into the store
+	s.mu.RLock()
+	refIDs := make([]types.RefID, 0, 2*len(s.blobs))
+	for sha3Hash := range s.blobs {
+		refIDs = append(refIDs, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		if sha1Hash, exists := s.sha1ForSHA3[sha3Hash]; exists {
+			refIDs = append(refIDs, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, refID := range refIDs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		err := fn(refID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryRefStore) RefsNeeded() ([]types.RefID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var refs []types.RefID
+	for refID := range s.refsNeeded {
+		refs = append(refs, refID)
+	}
+	return refs, nil
+}
+
+func (s *memoryRefStore) RefsNeededForStateURI(stateURI string) ([]types.RefID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var refs []types.RefID
+	for refID, stateURIs := range s.refsNeeded {
+		if _, exists := stateURIs[stateURI]; exists {
+			refs = append(refs, refID)
+		}
+	}
+	return refs, nil
+}
+
+func (s *memoryRefStore) RefsNeededPaginated(offset, limit int) ([]types.RefID, int, error) {
+	refs, err := s.RefsNeeded()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return paginateRefIDs(refs, offset, limit)
+}
+
+func (s *memoryRefStore) MarkRefsAsNeeded(refs []types.RefID) {
+	s.MarkRefsAsNeededForStateURI("", refs)
+}
+
+func (s *memoryRefStore) MarkRefsAsNeededForStateURI(stateURI string, refs []types.RefID) {
+	s.mu.Lock()
+	for _, refID := range refs {
+		sha3Hash, err := s.sha3For(refID)
+		if err == nil {
+			if _, exists := s.blobs[sha3Hash]; exists {
+				continue
+			}
+		}
+		if s.refsNeeded[refID] == nil {
+			s.refsNeeded[refID] = make(map[string]struct{})
+		}
+		if stateURI != "" {
+			s.refsNeeded[refID][stateURI] = struct{}{}
+		}
+	}
+	s.metrics.setRefsNeeded(len(s.refsNeeded))
+	s.mu.Unlock()
+
+	s.refsNeededNotifier.Enqueue()
+}
+
+func (s *memoryRefStore) ReconcileRefsNeeded() (removed int, err error) {
+	s.mu.Lock()
+	for refID := range s.refsNeeded {
+		sha3Hash, err := s.sha3For(refID)
+		if err != nil {
+			continue
+		}
+		if _, exists := s.blobs[sha3Hash]; exists {
+			delete(s.refsNeeded, refID)
+			removed++
+		}
+	}
+	s.metrics.setRefsNeeded(len(s.refsNeeded))
+	s.mu.Unlock()
+
+	if removed > 0 {
+		s.refsNeededNotifier.Enqueue()
+	}
+	return removed, nil
+}
+
+func (s *memoryRefStore) notifyRefsNeeded() {
+	allNeeded, _ := s.RefsNeeded()
+	s.notifyRefsNeededListeners(allNeeded)
+	s.notifyRefsNeededCountListeners(len(allNeeded))
+}
+
+func (s *memoryRefStore) Metrics() RefStoreMetrics {
+	return s.metrics.snapshot()
+}
+
+func (s *memoryRefStore) OnRefsNeeded(fn func(refs []types.RefID)) (unsubscribe func()) {
+	s.refsNeededListenersMu.Lock()
+	defer s.refsNeededListenersMu.Unlock()
+	listener := &fn
+	s.refsNeededListeners = append(s.refsNeededListeners, listener)
+	return func() {
+		s.refsNeededListenersMu.Lock()
+		defer s.refsNeededListenersMu.Unlock()
+		for i := range s.refsNeededListeners {
+			if s.refsNeededListeners[i] == listener {
+				s.refsNeededListeners = append(s.refsNeededListeners[:i:i], s.refsNeededListeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (s *memoryRefStore) notifyRefsNeededListeners(refs []types.RefID) {
+	s.refsNeededListenersMu.RLock()
+	defer s.refsNeededListenersMu.RUnlock()
+
+	fanOut(len(s.refsNeededListeners), defaultNotifyWorkers, func(i int) {
+		(*s.refsNeededListeners[i])(refs)
+	}, func(recovered interface{}, stack []byte) {
+		log.Errorf("refs needed listener panicked: %v\n%s", recovered, stack)
+	})
+}
+
+func (s *memoryRefStore) OnRefsNeededCount(fn func(total int)) (unsubscribe func()) {
+	s.refsNeededCountListenersMu.Lock()
+	defer s.refsNeededCountListenersMu.Unlock()
+	listener := &fn
+	s.refsNeededCountListeners = append(s.refsNeededCountListeners, listener)
+	return func() {
+		s.refsNeededCountListenersMu.Lock()
+		defer s.refsNeededCountListenersMu.Unlock()
+		for i := range s.refsNeededCountListeners {
+			if s.refsNeededCountListeners[i] == listener {
+				s.refsNeededCountListeners = append(s.refsNeededCountListeners[:i:i], s.refsNeededCountListeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (s *memoryRefStore) notifyRefsNeededCountListeners(total int) {
+	s.refsNeededCountListenersMu.RLock()
+	defer s.refsNeededCountListenersMu.RUnlock()
+
+	fanOut(len(s.refsNeededCountListeners), defaultNotifyWorkers, func(i int) {
+		(*s.refsNeededCountListeners[i])(total)
+	}, func(recovered interface{}, stack []byte) {
+		log.Errorf("refs needed count listener panicked: %v\n%s", recovered, stack)
+	})
+}
+
+func (s *memoryRefStore) OnRefsSaved(fn func()) (unsubscribe func()) {
+	s.refsSavedListenersMu.Lock()
+	defer s.refsSavedListenersMu.Unlock()
+	listener := &fn
+	s.refsSavedListeners = append(s.refsSavedListeners, listener)
+	return func() {
+		s.refsSavedListenersMu.Lock()
+		defer s.refsSavedListenersMu.Unlock()
+		for i := range s.refsSavedListeners {
+			if s.refsSavedListeners[i] == listener {
+				s.refsSavedListeners = append(s.refsSavedListeners[:i:i], s.refsSavedListeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (s *memoryRefStore) notifyRefsSavedListeners() {
+	s.refsSavedListenersMu.RLock()
+	defer s.refsSavedListenersMu.RUnlock()
+
+	fanOut(len(s.refsSavedListeners), defaultNotifyWorkers, func(i int) {
+		(*s.refsSavedListeners[i])()
+	}, func(recovered interface{}, stack []byte) {
+		log.Errorf("refs saved listener panicked: %v\n%s", recovered, stack)
+	})
+}
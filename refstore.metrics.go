@@ -0,0 +1,70 @@
+package redwood
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RefStoreMetrics is a snapshot of a RefStore's activity.  The fields are
+// plain values so that callers can bridge them to whatever metrics system
+// they use (a prometheus.Collector, for instance) without this package
+// depending on it.
+type RefStoreMetrics struct {
+	BlobsStored         uint64        // successful StoreObject calls
+	BytesWritten        uint64        // plaintext bytes stored by StoreObject
+	StoreObjectDuration time.Duration // total time spent in successful StoreObject calls
+	ObjectNotFound      uint64        // Object calls that returned types.Err404
+	HaveObjectMisses    uint64        // HaveObject calls that returned false
+	RefsNeeded          int64         // current number of refs marked as needed
+	SHA1Lookups         uint64        // sha3 -> sha1 lookups in the metadata DB
+}
+
+// refStoreMetrics must be allocated on its own (rather than embedded in
+// another struct) so that its fields are 64-bit aligned for sync/atomic.
+type refStoreMetrics struct {
+	blobsStored         uint64
+	bytesWritten        uint64
+	storeObjectDuration int64
+	objectNotFound      uint64
+	haveObjectMisses    uint64
+	refsNeeded          int64
+	sha1Lookups         uint64
+}
+
+func newRefStoreMetrics() *refStoreMetrics {
+	return &refStoreMetrics{}
+}
+
+func (m *refStoreMetrics) recordStoreObject(bytesWritten int64, elapsed time.Duration) {
+	atomic.AddUint64(&m.blobsStored, 1)
+	atomic.AddUint64(&m.bytesWritten, uint64(bytesWritten))
+	atomic.AddInt64(&m.storeObjectDuration, int64(elapsed))
+}
+
+func (m *refStoreMetrics) recordObjectNotFound() {
+	atomic.AddUint64(&m.objectNotFound, 1)
+}
+
+func (m *refStoreMetrics) recordHaveObjectMiss() {
+	atomic.AddUint64(&m.haveObjectMisses, 1)
+}
+
+func (m *refStoreMetrics) recordSHA1Lookup() {
+	atomic.AddUint64(&m.sha1Lookups, 1)
+}
+
+func (m *refStoreMetrics) setRefsNeeded(n int) {
+	atomic.StoreInt64(&m.refsNeeded, int64(n))
+}
+
+func (m *refStoreMetrics) snapshot() RefStoreMetrics {
+	return RefStoreMetrics{
+		BlobsStored:         atomic.LoadUint64(&m.blobsStored),
+		BytesWritten:        atomic.LoadUint64(&m.bytesWritten),
+		StoreObjectDuration: time.Duration(atomic.LoadInt64(&m.storeObjectDuration)),
+		ObjectNotFound:      atomic.LoadUint64(&m.objectNotFound),
+		HaveObjectMisses:    atomic.LoadUint64(&m.haveObjectMisses),
+		RefsNeeded:          atomic.LoadInt64(&m.refsNeeded),
+		SHA1Lookups:         atomic.LoadUint64(&m.sha1Lookups),
+	}
+}
@@ -0,0 +1,59 @@
+package redwood
+
+import (
+	"bytes"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var errMmapUnsupported = errors.New("mmap isn't supported on this platform")
+
+// mmapReader serves a blob out of a read-only memory mapping of its file, so
+// repeated reads of hot blobs are served from the OS page cache without being
+// copied through a read buffer first.  Besides io.ReadCloser, it implements
+// io.ReaderAt and io.Seeker, which is what http.ServeContent needs for range
+// requests.  ReadAt is safe for concurrent use, but none of its methods may
+// be called concurrently with (or after) Close.
+type mmapReader struct {
+	*bytes.Reader
+	data      []byte
+	closeOnce sync.Once
+}
+
+// openMmapReader maps the file at filename.  The file descriptor is closed
+// before it returns; the mapping stays valid until the reader is closed.
+func openMmapReader(filename string) (*mmapReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	} else if stat.Size() == 0 {
+		// Empty mappings aren't allowed
+		return nil, errors.New("can't map an empty file")
+	} else if int64(int(stat.Size())) != stat.Size() {
+		return nil, errors.New("file is too large to map")
+	}
+
+	data, err := mmapFile(f, int(stat.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReader{Reader: bytes.NewReader(data), data: data}, nil
+}
+
+func (r *mmapReader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.Reader = bytes.NewReader(nil)
+		err = munmapFile(r.data)
+		r.data = nil
+	})
+	return err
+}
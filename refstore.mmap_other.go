@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package redwood
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.WithStack(errMmapUnsupported)
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,2280 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	badgeroptions "github.com/dgraph-io/badger/v2/options"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+
+	"redwood.dev/crypto"
+	"redwood.dev/ctx"
+	"redwood.dev/types"
+)
+
+func setupRefStore(t testing.TB) (*refStore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+
+	s := NewRefStore(dir).(*refStore)
+	err = s.Start()
+	require.NoError(t, err)
+
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func randomRefIDs(n int) []types.RefID {
+	refs := make([]types.RefID, n)
+	for i := range refs {
+		refs[i] = types.RefID{HashAlg: types.SHA3, Hash: types.Hash(types.RandomID())}
+	}
+	return refs
+}
+
+func TestRefStore_RefsNeededPaginated(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	var (
+		mu     sync.Mutex
+		counts []int
+	)
+	s.OnRefsNeededCount(func(total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts = append(counts, total)
+	})
+
+	refs := randomRefIDs(5000)
+	s.MarkRefsAsNeeded(refs)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(counts) == 1 && counts[0] == 5000
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var paged []types.RefID
+	for offset := 0; ; offset += 300 {
+		page, total, err := s.RefsNeededPaginated(offset, 300)
+		require.NoError(t, err)
+		require.Equal(t, 5000, total)
+		if len(page) == 0 {
+			break
+		}
+		require.True(t, len(page) <= 300)
+		paged = append(paged, page...)
+	}
+	require.Len(t, paged, 5000)
+	require.ElementsMatch(t, refs, paged)
+
+	page, total, err := s.RefsNeededPaginated(4990, 300)
+	require.NoError(t, err)
+	require.Equal(t, 5000, total)
+	require.Len(t, page, 10)
+
+	page, total, err = s.RefsNeededPaginated(4990, math.MaxInt64)
+	require.NoError(t, err)
+	require.Equal(t, 5000, total)
+	require.Len(t, page, 10)
+
+	_, _, err = s.RefsNeededPaginated(-1, 300)
+	require.Error(t, err)
+}
+
+func TestRefStore_RefsNeededNotificationsAreCoalesced(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	var (
+		calls     int32
+		lastCount int32
+	)
+	s.OnRefsNeeded(func(refs []types.RefID) {
+		atomic.AddInt32(&calls, 1)
+		atomic.StoreInt32(&lastCount, int32(len(refs)))
+	})
+
+	for _, ref := range randomRefIDs(1000) {
+		s.MarkRefsAsNeeded([]types.RefID{ref})
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&lastCount) == 1000
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, atomic.LoadInt32(&calls) < 100)
+}
+
+func TestRefStore_VerifyOnRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewRefStore(dir, RefStoreVerifyOnRead(true)).(*refStore)
+	err = s.Start()
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+
+	// An intact blob reads cleanly
+	r, _, err := s.Object(refID)
+	require.NoError(t, err)
+	bs, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, bs)
+	r.Close()
+
+	// A truncated blob fails verification
+	err = os.Truncate(s.filepathForSHA3Blob(sha3Hash), 10)
+	require.NoError(t, err)
+
+	r, _, err = s.Object(refID)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	require.Equal(t, ErrCorruptBlob, errors.Cause(err))
+}
+
+func TestRefStore_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := crypto.GenerateSymmetricKey()
+	require.NoError(t, err)
+
+	s := NewRefStore(dir, RefStoreEncryptionKey(key), RefStoreVerifyOnRead(true)).(*refStore)
+	err = s.Start()
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 5000)
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	// The blob is still addressed by the hash of its plaintext
+	plaintextStore, cleanup := setupRefStore(t)
+	defer cleanup()
+	_, plaintextSHA3, err := plaintextStore.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, plaintextSHA3, sha3Hash)
+
+	// The file on disk doesn't contain the plaintext
+	onDisk, err := ioutil.ReadFile(s.filepathForSHA3Blob(sha3Hash))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(onDisk, []byte("quick brown fox")))
+
+	refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+	r, size, err := s.Object(refID)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, int64(len(data)), size)
+	bs, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, bs)
+
+	_, err = s.ObjectFilepath(refID)
+	require.Equal(t, ErrEncryptedBlob, errors.Cause(err))
+}
+
+func TestRefStore_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	open := func(opts ...RefStoreOption) *refStore {
+		s := NewRefStore(dir, append(opts, RefStoreVerifyOnRead(true))...).(*refStore)
+		err := s.Start()
+		require.NoError(t, err)
+		return s
+	}
+
+	readBlob := func(s *refStore, refID types.RefID) []byte {
+		r, size, err := s.Object(refID)
+		require.NoError(t, err)
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(bs)), size)
+		return bs
+	}
+
+	data := bytes.Repeat([]byte(`{"the quick brown fox": "jumps over the lazy dog"}`), 5000)
+	uncompressedData := []byte("stored before compression was turned on")
+
+	s := open()
+	_, uncompressedSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(uncompressedData)))
+	require.NoError(t, err)
+	s.Close()
+
+	s = open(RefStoreCompression(true))
+	defer s.Close()
+
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, types.HashBytes(data), sha3Hash)
+
+	// The file on disk is much smaller than the plaintext
+	stat, err := os.Stat(s.filepathForSHA3Blob(sha3Hash))
+	require.NoError(t, err)
+	require.True(t, stat.Size() < int64(len(data))/10, "%v", stat.Size())
+
+	refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+	require.Equal(t, data, readBlob(s, refID))
+
+	_, err = s.ObjectFilepath(refID)
+	require.Equal(t, ErrCompressedBlob, errors.Cause(err))
+
+	// Blobs stored without compression are still readable
+	uncompressedRefID := types.RefID{HashAlg: types.SHA3, Hash: uncompressedSHA3}
+	require.Equal(t, uncompressedData, readBlob(s, uncompressedRefID))
+	_, err = s.ObjectFilepath(uncompressedRefID)
+	require.NoError(t, err)
+
+	t.Run("with encryption", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		key, err := crypto.GenerateSymmetricKey()
+		require.NoError(t, err)
+
+		s := NewRefStore(dir, RefStoreCompression(true), RefStoreEncryptionKey(key), RefStoreVerifyOnRead(true)).(*refStore)
+		err = s.Start()
+		require.NoError(t, err)
+		defer s.Close()
+
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+		require.NoError(t, err)
+		require.Equal(t, data, readBlob(s, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}))
+	})
+}
+
+func TestRefStore_HashVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	open := func(variant HashVariant) *refStore {
+		s := NewRefStore(dir, RefStoreHashVariant(variant), RefStoreVerifyOnRead(true)).(*refStore)
+		err := s.Start()
+		require.NoError(t, err)
+		return s
+	}
+
+	readBlob := func(s *refStore, sha3Hash types.Hash) []byte {
+		refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+		have, err := s.HaveObject(refID)
+		require.NoError(t, err)
+		require.True(t, have)
+
+		r, _, err := s.Object(refID)
+		require.NoError(t, err)
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return bs
+	}
+
+	keccakData := []byte("stored with keccak")
+	sha3Data := []byte("stored with sha3-256")
+
+	// Store one blob under each variant in the same directory
+	s := open(HashVariantKeccak256)
+	_, keccakHash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(keccakData)))
+	require.NoError(t, err)
+	require.Equal(t, types.HashBytes(keccakData), keccakHash)
+	s.Close()
+
+	s = open(HashVariantSHA3_256)
+	defer s.Close()
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(sha3Data)))
+	require.NoError(t, err)
+	require.Equal(t, types.Hash(sha3.Sum256(sha3Data)), sha3Hash)
+
+	// The same input produces distinct IDs under the two variants
+	_, sameInputHash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(keccakData)))
+	require.NoError(t, err)
+	require.NotEqual(t, keccakHash, sameInputHash)
+
+	// Both blobs verify against the variant they were stored with
+	require.Equal(t, keccakData, readBlob(s, keccakHash))
+	require.Equal(t, sha3Data, readBlob(s, sha3Hash))
+
+	entries, err := s.DumpMetadata()
+	require.NoError(t, err)
+	require.Contains(t, entries, RefMetadataEntry{
+		Kind:  RefMetadataHashVariant,
+		RefID: types.RefID{HashAlg: types.SHA3, Hash: sha3Hash},
+		Value: "sha3-256",
+	})
+}
+
+func TestRefStore_Closed(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("stored before close"))))
+	require.NoError(t, err)
+	refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+
+	s.Close()
+	s.Close() // Closing twice is harmless
+
+	requireClosed := func(err error) {
+		t.Helper()
+		require.True(t, errors.Is(err, ErrStoreClosed), "expected ErrStoreClosed, got %v", err)
+	}
+
+	_, err = s.HaveObject(refID)
+	requireClosed(err)
+	_, err = s.HaveObjects([]types.RefID{refID})
+	requireClosed(err)
+	_, _, err = s.Object(refID)
+	requireClosed(err)
+	_, err = s.ObjectFilepath(refID)
+	requireClosed(err)
+	_, _, err = s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("too late"))))
+	requireClosed(err)
+	_, _, _, err = s.StoreObjectWithMetadata(ioutil.NopCloser(bytes.NewReader([]byte("too late"))))
+	requireClosed(err)
+	_, err = s.NewObjectWriter()
+	requireClosed(err)
+	_, err = s.ContentTypeFor(refID)
+	requireClosed(err)
+	err = s.DeleteObject(refID)
+	requireClosed(err)
+	_, err = s.AllHashes()
+	requireClosed(err)
+	_, err = s.GarbageCollect()
+	requireClosed(err)
+	_, err = s.RefsNeeded()
+	requireClosed(err)
+	_, _, err = s.RefsNeededPaginated(0, 10)
+	requireClosed(err)
+	_, err = s.DumpMetadata()
+	requireClosed(err)
+
+	// These have no error to return, but mustn't panic
+	s.MarkRefsAsNeeded(randomRefIDs(2))
+	s.DebugPrint()
+}
+
+func TestRefStore_Restart(t *testing.T) {
+	for name, newStore := range refStoreImpls {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			t.Run("start twice", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				// The store is already started, so this is a no-op rather than
+				// a second attempt to open (and lock) the metadata DB
+				err := s.Start()
+				require.NoError(t, err)
+
+				_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("still works"))))
+				require.NoError(t, err)
+				have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				require.NoError(t, err)
+				require.True(t, have)
+			})
+
+			t.Run("start, close, start", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := []byte("survives a restart")
+				_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+				refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+				missing := randomRefIDs(2)
+				s.MarkRefsAsNeeded(missing)
+
+				s.Close()
+				err = s.Start()
+				require.NoError(t, err)
+
+				r, _, err := s.Object(refID)
+				require.NoError(t, err)
+				bs, err := ioutil.ReadAll(r)
+				r.Close()
+				require.NoError(t, err)
+				require.Equal(t, data, bs)
+
+				needed, err := s.RefsNeeded()
+				require.NoError(t, err)
+				require.ElementsMatch(t, missing, needed)
+
+				// And it's writable again
+				_, _, err = s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("after the restart"))))
+				require.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestRefStore_TempDir(t *testing.T) {
+	storeAndCheck := func(t *testing.T, s *refStore) {
+		t.Helper()
+
+		data := bytes.Repeat([]byte("staged somewhere "), 1000)
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+		require.NoError(t, err)
+
+		bs, err := ioutil.ReadFile(s.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		require.Equal(t, data, bs)
+
+		// Nothing is left behind in the staging directory or the blobs directory
+		for _, dir := range []string{s.tempDirPath(), filepath.Join(s.rootPath, "blobs")} {
+			entries, err := ioutil.ReadDir(dir)
+			require.NoError(t, err)
+			for _, entry := range entries {
+				require.Equal(t, sha3Hash.Hex(), entry.Name())
+			}
+		}
+	}
+
+	t.Run("defaults to the blobs directory", func(t *testing.T) {
+		s, cleanup := setupRefStore(t)
+		defer cleanup()
+
+		require.Equal(t, filepath.Join(s.rootPath, "blobs"), s.tempDirPath())
+		storeAndCheck(t, s)
+	})
+
+	t.Run("custom directory", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir("", "refstore-staging-")
+		require.NoError(t, err)
+		defer os.RemoveAll(tempDir)
+
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s := NewRefStore(dir, RefStoreTempDir(tempDir)).(*refStore)
+		require.NoError(t, s.Start())
+		defer s.Close()
+
+		storeAndCheck(t, s)
+	})
+
+	t.Run("across devices", func(t *testing.T) {
+		// /dev/shm is usually a tmpfs, so it's on a different device from
+		// the usual temp directory
+		if _, err := os.Stat("/dev/shm"); err != nil {
+			t.Skip("no /dev/shm")
+		}
+		tempDir, err := ioutil.TempDir("/dev/shm", "refstore-staging-")
+		if err != nil {
+			t.Skip("can't write to /dev/shm")
+		}
+		defer os.RemoveAll(tempDir)
+
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s := NewRefStore(dir, RefStoreTempDir(tempDir)).(*refStore)
+		require.NoError(t, s.Start())
+		defer s.Close()
+
+		storeAndCheck(t, s)
+	})
+}
+
+func TestRefStore_FileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+
+	tests := []struct {
+		name              string
+		opts              []RefStoreOption
+		dirMode, blobMode os.FileMode
+	}{
+		{"defaults", nil, 0700, 0600},
+		// Both survive the usual umasks (022 and 027)
+		{"custom", []RefStoreOption{RefStoreDirMode(0750), RefStoreFileMode(0640)}, 0750, 0640},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "refstore-test-")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			tempDir := filepath.Join(dir, "staging")
+			s := NewRefStore(dir, append(test.opts, RefStoreTempDir(tempDir))...).(*refStore)
+			err = s.Start()
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("mode bits"))))
+			require.NoError(t, err)
+
+			for _, path := range []string{filepath.Join(dir, "blobs"), tempDir} {
+				stat, err := os.Stat(path)
+				require.NoError(t, err)
+				require.True(t, stat.IsDir())
+				require.Equal(t, test.dirMode, stat.Mode().Perm(), path)
+			}
+
+			stat, err := os.Stat(s.filepathForSHA3Blob(sha3Hash))
+			require.NoError(t, err)
+			require.Equal(t, test.blobMode, stat.Mode().Perm())
+		})
+	}
+}
+
+func TestRefStore_IterateHashesMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var malformed []string
+	s := NewRefStore(dir, RefStoreOnMalformedBlob(func(filename string) {
+		malformed = append(malformed, filename)
+	})).(*refStore)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("well-formed"))))
+	require.NoError(t, err)
+
+	blobsDir := filepath.Join(s.rootPath, "blobs")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(blobsDir, "not-a-hash"), []byte("junk"), 0666))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(blobsDir, "abcd"), []byte("junk"), 0666))
+	// In-progress uploads aren't malformed
+	require.NoError(t, ioutil.WriteFile(filepath.Join(blobsDir, "temp-12345"), []byte("partial"), 0666))
+
+	var sha3s []types.Hash
+	err = s.IterateHashes(context.Background(), func(refID types.RefID) error {
+		if refID.HashAlg == types.SHA3 {
+			sha3s = append(sha3s, refID.Hash)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []types.Hash{sha3Hash}, sha3s)
+	require.ElementsMatch(t, []string{"not-a-hash", "abcd"}, malformed)
+}
+
+func TestRefStore_IterateHashesCallingBack(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("first"))))
+	require.NoError(t, err)
+
+	// fn runs without the store held open, so it can store more blobs, and
+	// even close the store, without deadlocking
+	done := make(chan error)
+	go func() {
+		done <- s.IterateHashes(context.Background(), func(refID types.RefID) error {
+			_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("second"))))
+			if err != nil {
+				return err
+			}
+			s.Close()
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		require.True(t, errors.Is(err, ErrStoreClosed), "%+v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("IterateHashes deadlocked")
+	}
+}
+
+func TestRefStore_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Populate the store, then close it so that replicas can open it
+	data := []byte("served by replicas")
+	neededRef := randomRefIDs(1)[0]
+
+	s := NewRefStore(dir)
+	require.NoError(t, s.Start())
+	sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	s.MarkRefsAsNeeded([]types.RefID{neededRef})
+	s.Close()
+
+	// Several read-only stores can share the directory
+	replica1 := NewRefStore(dir, RefStoreReadOnly(true))
+	require.NoError(t, replica1.Start())
+	defer replica1.Close()
+	replica2 := NewRefStore(dir, RefStoreReadOnly(true))
+	require.NoError(t, replica2.Start())
+	defer replica2.Close()
+
+	sha1Ref := types.RefID{HashAlg: types.SHA1, Hash: sha1Hash}
+	sha3Ref := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+
+	t.Run("reads work", func(t *testing.T) {
+		for _, replica := range []RefStore{replica1, replica2} {
+			require.NoError(t, replica.SelfTest())
+
+			have, err := replica.HaveObject(sha1Ref)
+			require.NoError(t, err)
+			require.True(t, have)
+
+			r, _, err := replica.Object(sha3Ref)
+			require.NoError(t, err)
+			bs, err := ioutil.ReadAll(r)
+			r.Close()
+			require.NoError(t, err)
+			require.Equal(t, data, bs)
+
+			allHashes, err := replica.AllHashes()
+			require.NoError(t, err)
+			require.ElementsMatch(t, []types.RefID{sha1Ref, sha3Ref}, allHashes)
+
+			needed, err := replica.RefsNeeded()
+			require.NoError(t, err)
+			require.Equal(t, []types.RefID{neededRef}, needed)
+		}
+	})
+
+	t.Run("writes fail", func(t *testing.T) {
+		requireReadOnly := func(err error) {
+			t.Helper()
+			require.True(t, errors.Is(err, ErrReadOnly), "expected ErrReadOnly, got %v", err)
+		}
+
+		_, _, err := replica1.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("nope"))))
+		requireReadOnly(err)
+		_, err = replica1.NewObjectWriter()
+		requireReadOnly(err)
+		err = replica1.DeleteObject(sha3Ref)
+		requireReadOnly(err)
+		_, err = replica1.GarbageCollect()
+		requireReadOnly(err)
+
+		replica1.MarkRefsAsNeeded(randomRefIDs(1))
+		needed, err := replica1.RefsNeeded()
+		require.NoError(t, err)
+		require.Equal(t, []types.RefID{neededRef}, needed)
+
+		// The blob is still there
+		have, err := replica1.HaveObject(sha3Ref)
+		require.NoError(t, err)
+		require.True(t, have)
+	})
+}
+
+func TestRefStore_SelfTest(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		s, cleanup := setupRefStore(t)
+		defer cleanup()
+
+		require.NoError(t, s.SelfTest())
+
+		// Nothing is left behind
+		hashes, err := s.AllHashes()
+		require.NoError(t, err)
+		require.Len(t, hashes, 0)
+		entries, err := s.DumpMetadata()
+		require.NoError(t, err)
+		require.Len(t, entries, 0)
+	})
+
+	t.Run("blob directory isn't writable", func(t *testing.T) {
+		s, cleanup := setupRefStore(t)
+		defer cleanup()
+
+		// A file where the blob directory should be can't be written to,
+		// even by root
+		blobsDir := filepath.Join(s.rootPath, "blobs")
+		require.NoError(t, os.RemoveAll(blobsDir))
+		require.NoError(t, ioutil.WriteFile(blobsDir, nil, 0444))
+
+		require.Error(t, s.SelfTest())
+	})
+
+	t.Run("root path is read-only", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root ignores file permissions")
+		}
+		s, cleanup := setupRefStore(t)
+		defer cleanup()
+
+		blobsDir := filepath.Join(s.rootPath, "blobs")
+		require.NoError(t, os.MkdirAll(blobsDir, 0777))
+		require.NoError(t, os.Chmod(blobsDir, 0555))
+		defer os.Chmod(blobsDir, 0777)
+
+		require.Error(t, s.SelfTest())
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s, cleanup := setupRefStore(t)
+		defer cleanup()
+		s.Close()
+
+		require.Equal(t, ErrStoreClosed, errors.Cause(s.SelfTest()))
+	})
+}
+
+func TestRefStore_MaxBlobSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewRefStore(dir, RefStoreMaxBlobSize(1024)).(*refStore)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	requireNoTempFiles := func(t *testing.T) {
+		t.Helper()
+		entries, err := ioutil.ReadDir(s.tempDirPath())
+		require.NoError(t, err)
+		for _, entry := range entries {
+			require.False(t, strings.HasPrefix(entry.Name(), "temp-"), "temp file left behind: %v", entry.Name())
+		}
+	}
+
+	t.Run("too large", func(t *testing.T) {
+		tooLarge := bytes.Repeat([]byte("x"), 2048)
+		_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(tooLarge)))
+		require.True(t, errors.Is(err, ErrBlobTooLarge), "%+v", err)
+		requireNoTempFiles(t)
+
+		allHashes, err := s.AllHashes()
+		require.NoError(t, err)
+		require.Len(t, allHashes, 0)
+	})
+
+	t.Run("exactly at the limit", func(t *testing.T) {
+		data := bytes.Repeat([]byte("y"), 1024)
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+		require.NoError(t, err)
+		requireNoTempFiles(t)
+
+		have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		require.True(t, have)
+	})
+
+	t.Run("no effective limit", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s := NewRefStore(dir, RefStoreMaxBlobSize(math.MaxInt64))
+		require.NoError(t, s.Start())
+		defer s.Close()
+
+		_, _, err = s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("hello"))))
+		require.NoError(t, err)
+	})
+}
+
+type panickingReader struct{}
+
+func (panickingReader) Read(p []byte) (int, error) { panic("boom") }
+func (panickingReader) Close() error               { return nil }
+
+func TestRefStore_PanicDuringStoreDoesntBlockClose(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	stores := map[string]func(){
+		"StoreObject":             func() { s.StoreObject(panickingReader{}) },
+		"StoreObjectWithMetadata": func() { s.StoreObjectWithMetadata(panickingReader{}) },
+		"StoreObjectExpecting": func() {
+			s.StoreObjectExpecting(panickingReader{}, types.RefID{HashAlg: types.SHA3})
+		},
+		"StoreObjectIfAbsent": func() { s.StoreObjectIfAbsent(panickingReader{}, nil) },
+	}
+	for name, store := range stores {
+		require.Panics(t, store, name)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		s.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked after a panic")
+	}
+}
+
+func TestRefStore_BlobFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A tiny filter, so that lots of blobs share counters
+	open := func() *refStore {
+		s := NewRefStore(dir, RefStoreBlobFilterSize(16)).(*refStore)
+		require.NoError(t, s.Start())
+		require.NotNil(t, s.blobFilter)
+		return s
+	}
+	s := open()
+
+	present := map[types.Hash]bool{}
+	requireNoFalseNegatives := func(s *refStore) {
+		t.Helper()
+		for sha3Hash, isPresent := range present {
+			refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+			have, err := s.HaveObject(refID)
+			require.NoError(t, err)
+			require.Equal(t, isPresent, have)
+			if isPresent {
+				require.True(t, s.blobFilter.mayContain(sha3Hash))
+			}
+		}
+	}
+
+	for cycle := 0; cycle < 5; cycle++ {
+		for i := 0; i < 20; i++ {
+			_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("blob %v", i)))))
+			require.NoError(t, err)
+			present[sha3Hash] = true
+		}
+		requireNoFalseNegatives(s)
+
+		var deleted int
+		for sha3Hash := range present {
+			if deleted%2 == 0 {
+				require.NoError(t, s.DeleteObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}))
+				present[sha3Hash] = false
+			}
+			deleted++
+		}
+		requireNoFalseNegatives(s)
+	}
+
+	// The filter is rebuilt from the blob directory on startup
+	s.Close()
+	s = open()
+	defer s.Close()
+	requireNoFalseNegatives(s)
+
+	t.Run("negatives skip the disk", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s := NewRefStore(dir, RefStoreBlobFilterSize(1<<10)).(*refStore)
+		require.NoError(t, s.Start())
+		defer s.Close()
+
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("a blob"))))
+		require.NoError(t, err)
+		require.True(t, s.blobFilter.mayContain(sha3Hash))
+
+		require.NoError(t, s.DeleteObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}))
+		require.False(t, s.blobFilter.mayContain(sha3Hash))
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		s, cleanup := setupRefStore(t)
+		defer cleanup()
+		require.Nil(t, s.blobFilter)
+
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("a blob"))))
+		require.NoError(t, err)
+		have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		require.True(t, have)
+
+		// Blobs that are added to the directory out of band are still seen
+		data := []byte("added behind the store's back")
+		sha3Hash = types.HashBytes(data)
+		err = ioutil.WriteFile(s.filepathForSHA3Blob(sha3Hash), data, 0600)
+		require.NoError(t, err)
+
+		refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+		have, err = s.HaveObject(refID)
+		require.NoError(t, err)
+		require.True(t, have)
+		haves, err := s.HaveObjects([]types.RefID{refID})
+		require.NoError(t, err)
+		require.True(t, haves[refID])
+		_, _, have, err = s.ResolveRefID(refID)
+		require.NoError(t, err)
+		require.True(t, have)
+	})
+}
+
+func TestRefStore_DumpMetadata(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	data := []byte("<html><body>hello</body></html>")
+	sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	missing := randomRefIDs(1)[0]
+	s.MarkRefsAsNeeded([]types.RefID{missing})
+
+	entries, err := s.DumpMetadata()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []RefMetadataEntry{
+		{Kind: RefMetadataSHA1ToSHA3, RefID: types.RefID{HashAlg: types.SHA1, Hash: sha1Hash}, Value: sha3Hash.Hex()},
+		{Kind: RefMetadataSHA3ToSHA1, RefID: types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}, Value: hex.EncodeToString(sha1Hash[:20])},
+		{Kind: RefMetadataContentType, RefID: types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}, Value: "text/html; charset=utf-8"},
+		{Kind: RefMetadataRefNeeded, RefID: missing},
+	}, entries)
+}
+
+func TestRefStore_GarbageCollect(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	_, keptSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("keep me"))))
+	require.NoError(t, err)
+	deletedSHA1, deletedSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("delete me"))))
+	require.NoError(t, err)
+
+	err = os.Remove(s.filepathForSHA3Blob(deletedSHA3))
+	require.NoError(t, err)
+
+	removed, err := s.GarbageCollect()
+	require.NoError(t, err)
+	require.Equal(t, 3, removed)
+
+	_, err = s.sha3ForSHA1(deletedSHA1)
+	require.Equal(t, types.Err404, errors.Cause(err))
+	_, err = s.sha1ForSHA3(deletedSHA3)
+	require.Equal(t, types.Err404, errors.Cause(err))
+
+	entries, err := s.DumpMetadata()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		if entry.RefID.HashAlg == types.SHA3 {
+			require.Equal(t, keptSHA3, entry.RefID.Hash)
+		}
+	}
+
+	// Running it again finds nothing to do
+	removed, err = s.GarbageCollect()
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+}
+
+var refStoreImpls = map[string]func(t testing.TB) (RefStore, func()){
+	"disk": func(t testing.TB) (RefStore, func()) {
+		return setupRefStore(t)
+	},
+	"memory": func(t testing.TB) (RefStore, func()) {
+		s := NewMemoryRefStore()
+		err := s.Start()
+		require.NoError(t, err)
+		return s, s.Close
+	},
+}
+
+// TestRefStore_Conformance runs the same behavioral checks against every
+// RefStore implementation so that they can't drift apart.
+func TestRefStore_Conformance(t *testing.T) {
+	for name, newStore := range refStoreImpls {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			t.Run("store and retrieve objects", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := []byte("hello, redwood")
+				sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+
+				for _, refID := range []types.RefID{
+					{HashAlg: types.SHA1, Hash: sha1Hash},
+					{HashAlg: types.SHA3, Hash: sha3Hash},
+				} {
+					have, err := s.HaveObject(refID)
+					require.NoError(t, err)
+					require.True(t, have)
+
+					r, size, err := s.Object(refID)
+					require.NoError(t, err)
+					require.Equal(t, int64(len(data)), size)
+					bs, err := ioutil.ReadAll(r)
+					require.NoError(t, err)
+					r.Close()
+					require.Equal(t, data, bs)
+				}
+
+				allHashes, err := s.AllHashes()
+				require.NoError(t, err)
+				require.ElementsMatch(t, []types.RefID{
+					{HashAlg: types.SHA1, Hash: sha1Hash},
+					{HashAlg: types.SHA3, Hash: sha3Hash},
+				}, allHashes)
+			})
+
+			t.Run("object writer", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := bytes.Repeat([]byte("pushed in pieces "), 1000)
+
+				w, err := s.NewObjectWriter()
+				require.NoError(t, err)
+				for chunk := data; len(chunk) > 0; {
+					n := 1234
+					if n > len(chunk) {
+						n = len(chunk)
+					}
+					written, err := w.Write(chunk[:n])
+					require.NoError(t, err)
+					require.Equal(t, n, written)
+					chunk = chunk[n:]
+				}
+				require.NoError(t, w.Close())
+				sha1Hash, sha3Hash := w.Hashes()
+
+				expectedSHA1, expectedSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+				require.Equal(t, expectedSHA1, sha1Hash)
+				require.Equal(t, expectedSHA3, sha3Hash)
+
+				r, _, err := s.Object(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				require.NoError(t, err)
+				defer r.Close()
+				bs, err := ioutil.ReadAll(r)
+				require.NoError(t, err)
+				require.Equal(t, data, bs)
+			})
+
+			t.Run("resolve ref ID", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("resolve me"))))
+				require.NoError(t, err)
+
+				for _, refID := range []types.RefID{
+					{HashAlg: types.SHA1, Hash: sha1Hash},
+					{HashAlg: types.SHA3, Hash: sha3Hash},
+				} {
+					gotSHA1, gotSHA3, have, err := s.ResolveRefID(refID)
+					require.NoError(t, err)
+					require.True(t, have)
+					require.Equal(t, sha1Hash, gotSHA1)
+					require.Equal(t, sha3Hash, gotSHA3)
+				}
+
+				missing := randomRefIDs(1)[0]
+				_, _, have, err := s.ResolveRefID(missing)
+				require.NoError(t, err)
+				require.False(t, have)
+
+				missing.HashAlg = types.SHA1
+				gotSHA1, gotSHA3, have, err := s.ResolveRefID(missing)
+				require.NoError(t, err)
+				require.False(t, have)
+				require.Equal(t, types.Hash{}, gotSHA1)
+				require.Equal(t, types.Hash{}, gotSHA3)
+
+				// Once deleted, neither hash resolves to a blob
+				require.NoError(t, s.DeleteObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}))
+				_, _, have, err = s.ResolveRefID(types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+				require.NoError(t, err)
+				require.False(t, have)
+				_, _, have, err = s.ResolveRefID(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				require.NoError(t, err)
+				require.False(t, have)
+			})
+
+			t.Run("store object expecting a hash", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := []byte("the blob we asked for")
+				other := []byte("something else entirely")
+				expectedSHA3 := types.HashBytes(data)
+
+				// A mismatch stores nothing
+				_, sha3Hash, err := s.StoreObjectExpecting(ioutil.NopCloser(bytes.NewReader(other)), types.RefID{HashAlg: types.SHA3, Hash: expectedSHA3})
+				require.True(t, errors.Is(err, ErrHashMismatch), "%v", err)
+				require.Equal(t, types.HashBytes(other), sha3Hash)
+
+				have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				require.NoError(t, err)
+				require.False(t, have)
+				allHashes, err := s.AllHashes()
+				require.NoError(t, err)
+				require.Empty(t, allHashes)
+				if diskStore, is := s.(*refStore); is {
+					// Not even a staged temp file is left behind
+					files, err := ioutil.ReadDir(filepath.Join(diskStore.rootPath, "blobs"))
+					require.NoError(t, err)
+					require.Empty(t, files)
+				}
+
+				// A match is stored as usual, whichever hash is expected
+				sha1Hash, sha3Hash, err := s.StoreObjectExpecting(ioutil.NopCloser(bytes.NewReader(data)), types.RefID{HashAlg: types.SHA3, Hash: expectedSHA3})
+				require.NoError(t, err)
+				require.Equal(t, expectedSHA3, sha3Hash)
+
+				_, _, err = s.StoreObjectExpecting(ioutil.NopCloser(bytes.NewReader(data)), types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+				require.NoError(t, err)
+
+				have, err = s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: expectedSHA3})
+				require.NoError(t, err)
+				require.True(t, have)
+			})
+
+			t.Run("store object if absent", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := []byte("stored once")
+				sha1Hash, sha3Hash, stored, err := s.StoreObjectIfAbsent(ioutil.NopCloser(bytes.NewReader(data)), nil)
+				require.NoError(t, err)
+				require.True(t, stored)
+
+				_, _, stored, err = s.StoreObjectIfAbsent(ioutil.NopCloser(bytes.NewReader(data)), nil)
+				require.NoError(t, err)
+				require.False(t, stored)
+
+				expected := types.RefID{HashAlg: types.SHA1, Hash: sha1Hash}
+				gotSHA1, gotSHA3, stored, err := s.StoreObjectIfAbsent(ioutil.NopCloser(bytes.NewReader(data)), &expected)
+				require.NoError(t, err)
+				require.False(t, stored)
+				require.Equal(t, sha1Hash, gotSHA1)
+				require.Equal(t, sha3Hash, gotSHA3)
+
+				allHashes, err := s.AllHashesForAlg(types.SHA3)
+				require.NoError(t, err)
+				require.Len(t, allHashes, 1)
+			})
+
+			t.Run("write object to", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := bytes.Repeat([]byte("copied somewhere else "), 1000)
+				sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+
+				for _, refID := range []types.RefID{
+					{HashAlg: types.SHA1, Hash: sha1Hash},
+					{HashAlg: types.SHA3, Hash: sha3Hash},
+				} {
+					var buf bytes.Buffer
+					n, err := s.WriteObjectTo(refID, &buf)
+					require.NoError(t, err)
+					require.Equal(t, int64(len(data)), n)
+					require.Equal(t, data, buf.Bytes())
+				}
+
+				var buf bytes.Buffer
+				_, err = s.WriteObjectTo(randomRefIDs(1)[0], &buf)
+				require.Equal(t, types.Err404, errors.Cause(err))
+				require.Zero(t, buf.Len())
+			})
+
+			t.Run("content type", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				html := []byte("<html><body>hello</body></html>")
+				sha1Hash, sha3Hash, contentType, err := s.StoreObjectWithMetadata(ioutil.NopCloser(bytes.NewReader(html)))
+				require.NoError(t, err)
+				require.Equal(t, "text/html; charset=utf-8", contentType)
+
+				for _, refID := range []types.RefID{
+					{HashAlg: types.SHA1, Hash: sha1Hash},
+					{HashAlg: types.SHA3, Hash: sha3Hash},
+				} {
+					contentType, err := s.ContentTypeFor(refID)
+					require.NoError(t, err)
+					require.Equal(t, "text/html; charset=utf-8", contentType)
+
+					// The sniffed bytes are still part of the stored blob
+					r, _, err := s.Object(refID)
+					require.NoError(t, err)
+					bs, err := ioutil.ReadAll(r)
+					require.NoError(t, err)
+					r.Close()
+					require.Equal(t, html, bs)
+				}
+
+				_, err = s.ContentTypeFor(types.RefID{HashAlg: types.SHA3, Hash: types.Hash(types.RandomID())})
+				require.Equal(t, types.Err404, errors.Cause(err))
+			})
+
+			t.Run("metrics", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				require.Equal(t, RefStoreMetrics{}, s.Metrics())
+
+				data := []byte("hello, redwood")
+				_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+
+				metrics := s.Metrics()
+				require.Equal(t, uint64(1), metrics.BlobsStored)
+				require.Equal(t, uint64(len(data)), metrics.BytesWritten)
+				require.True(t, metrics.StoreObjectDuration > 0)
+
+				missing := randomRefIDs(2)
+				s.MarkRefsAsNeeded(missing)
+				require.Equal(t, int64(2), s.Metrics().RefsNeeded)
+
+				_, _, err = s.Object(missing[0])
+				require.Equal(t, types.Err404, errors.Cause(err))
+				have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				require.NoError(t, err)
+				require.True(t, have)
+
+				metrics = s.Metrics()
+				require.Equal(t, uint64(1), metrics.ObjectNotFound)
+
+				// Storing a needed ref unmarks it
+				missingData := []byte("now we have it")
+				_, missingSHA3, err := NewMemoryRefStore().StoreObject(ioutil.NopCloser(bytes.NewReader(missingData)))
+				require.NoError(t, err)
+				s.MarkRefsAsNeeded([]types.RefID{{HashAlg: types.SHA3, Hash: missingSHA3}})
+				require.Equal(t, int64(3), s.Metrics().RefsNeeded)
+
+				_, _, err = s.StoreObject(ioutil.NopCloser(bytes.NewReader(missingData)))
+				require.NoError(t, err)
+				require.Equal(t, int64(2), s.Metrics().RefsNeeded)
+				require.Equal(t, uint64(2), s.Metrics().BlobsStored)
+			})
+
+			t.Run("missing objects", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				for _, refID := range []types.RefID{
+					{HashAlg: types.SHA1, Hash: types.Hash(types.RandomID())},
+					{HashAlg: types.SHA3, Hash: types.Hash(types.RandomID())},
+				} {
+					have, err := s.HaveObject(refID)
+					require.NoError(t, err)
+					require.False(t, have)
+
+					_, _, err = s.Object(refID)
+					require.Equal(t, types.Err404, errors.Cause(err))
+				}
+			})
+
+			t.Run("have objects", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("present"))))
+				require.NoError(t, err)
+
+				present := []types.RefID{
+					{HashAlg: types.SHA1, Hash: sha1Hash},
+					{HashAlg: types.SHA3, Hash: sha3Hash},
+				}
+				absent := []types.RefID{
+					{HashAlg: types.SHA1, Hash: types.Hash(types.RandomID())},
+					{HashAlg: types.SHA3, Hash: types.Hash(types.RandomID())},
+				}
+
+				have, err := s.HaveObjects(append(append([]types.RefID{}, present...), absent...))
+				require.NoError(t, err)
+				require.Equal(t, map[types.RefID]bool{
+					present[0]: true,
+					present[1]: true,
+					absent[0]:  false,
+					absent[1]:  false,
+				}, have)
+
+				_, err = s.HaveObjects([]types.RefID{{HashAlg: types.HashAlgUnknown}})
+				require.Error(t, err)
+			})
+
+			t.Run("delete object", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("doomed"))))
+				require.NoError(t, err)
+				_, keptSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("kept"))))
+				require.NoError(t, err)
+
+				err = s.DeleteObject(types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+				require.NoError(t, err)
+
+				for _, refID := range []types.RefID{{HashAlg: types.SHA1, Hash: sha1Hash}, {HashAlg: types.SHA3, Hash: sha3Hash}} {
+					have, err := s.HaveObject(refID)
+					require.NoError(t, err)
+					require.False(t, have)
+				}
+				have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: keptSHA3})
+				require.NoError(t, err)
+				require.True(t, have)
+
+				// Deleting it again is a no-op
+				err = s.DeleteObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				require.NoError(t, err)
+				err = s.DeleteObject(types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+				require.NoError(t, err)
+
+				allHashes, err := s.AllHashes()
+				require.NoError(t, err)
+				require.NotContains(t, allHashes, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+				require.NotContains(t, allHashes, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+			})
+
+			t.Run("iterate hashes", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				var expected []types.RefID
+				for i := 0; i < 5; i++ {
+					sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("blob %v", i)))))
+					require.NoError(t, err)
+					expected = append(expected,
+						types.RefID{HashAlg: types.SHA1, Hash: sha1Hash},
+						types.RefID{HashAlg: types.SHA3, Hash: sha3Hash},
+					)
+				}
+
+				var iterated []types.RefID
+				err := s.IterateHashes(context.Background(), func(refID types.RefID) error {
+					iterated = append(iterated, refID)
+					return nil
+				})
+				require.NoError(t, err)
+				require.ElementsMatch(t, expected, iterated)
+
+				// Canceling the context stops the iteration
+				ctx, cancel := context.WithCancel(context.Background())
+				var calls int
+				err = s.IterateHashes(ctx, func(refID types.RefID) error {
+					calls++
+					cancel()
+					return nil
+				})
+				require.Equal(t, context.Canceled, err)
+				require.True(t, calls < len(expected))
+
+				// So does an error from fn
+				errStop := errors.New("stop")
+				calls = 0
+				err = s.IterateHashes(context.Background(), func(refID types.RefID) error {
+					calls++
+					return errStop
+				})
+				require.Equal(t, errStop, err)
+				require.Equal(t, 1, calls)
+			})
+
+			t.Run("all hashes for alg", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				var sha1s, sha3s []types.RefID
+				for i := 0; i < 5; i++ {
+					sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("blob %v", i)))))
+					require.NoError(t, err)
+					sha1s = append(sha1s, types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+					sha3s = append(sha3s, types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+				}
+
+				refIDs, err := s.AllHashesForAlg(types.SHA1)
+				require.NoError(t, err)
+				require.ElementsMatch(t, sha1s, refIDs)
+
+				refIDs, err = s.AllHashesForAlg(types.SHA3)
+				require.NoError(t, err)
+				require.ElementsMatch(t, sha3s, refIDs)
+
+				_, err = s.AllHashesForAlg(types.HashAlgUnknown)
+				require.Error(t, err)
+			})
+
+			t.Run("objects modified since", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("older blob"))))
+				require.NoError(t, err)
+
+				time.Sleep(50 * time.Millisecond)
+				cutoff := time.Now()
+				time.Sleep(50 * time.Millisecond)
+
+				_, newerSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("newer blob"))))
+				require.NoError(t, err)
+
+				refIDs, err := s.ObjectsModifiedSince(cutoff)
+				require.NoError(t, err)
+				require.Equal(t, []types.RefID{{HashAlg: types.SHA3, Hash: newerSHA3}}, refIDs)
+
+				refIDs, err = s.ObjectsModifiedSince(time.Now())
+				require.NoError(t, err)
+				require.Empty(t, refIDs)
+			})
+
+			t.Run("refs needed", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				var saved int32
+				s.OnRefsSaved(func() { atomic.AddInt32(&saved, 1) })
+
+				var (
+					mu       sync.Mutex
+					notified []types.RefID
+				)
+				s.OnRefsNeeded(func(refs []types.RefID) {
+					mu.Lock()
+					defer mu.Unlock()
+					notified = refs
+				})
+
+				data := []byte("already have this one")
+				_, presentSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+				present := types.RefID{HashAlg: types.SHA3, Hash: presentSHA3}
+
+				missing := randomRefIDs(3)
+				s.MarkRefsAsNeeded(append([]types.RefID{present}, missing...))
+
+				needed, err := s.RefsNeeded()
+				require.NoError(t, err)
+				require.ElementsMatch(t, missing, needed)
+
+				page, total, err := s.RefsNeededPaginated(1, 1)
+				require.NoError(t, err)
+				require.Equal(t, 3, total)
+				require.Len(t, page, 1)
+
+				require.Eventually(t, func() bool {
+					mu.Lock()
+					defer mu.Unlock()
+					return len(notified) == 3
+				}, 5*time.Second, 10*time.Millisecond)
+
+				// Storing an object removes it from the needed set
+				otherData := []byte("now we have this one too")
+				_, otherSHA3, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(otherData)))
+				require.NoError(t, err)
+				s.MarkRefsAsNeeded([]types.RefID{{HashAlg: types.SHA3, Hash: otherSHA3}})
+
+				needed, err = s.RefsNeeded()
+				require.NoError(t, err)
+				require.ElementsMatch(t, missing, needed)
+				require.Equal(t, int32(2), atomic.LoadInt32(&saved))
+			})
+
+			t.Run("refs needed by state URI", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				data := []byte("needed by two state URIs")
+				shared := types.RefID{HashAlg: types.SHA3, Hash: types.HashBytes(data)}
+				onlyA := randomRefIDs(1)[0]
+				unassociated := randomRefIDs(1)[0]
+
+				s.MarkRefsAsNeededForStateURI("a.com/1", []types.RefID{shared, onlyA})
+				s.MarkRefsAsNeededForStateURI("b.com/1", []types.RefID{shared})
+				s.MarkRefsAsNeededForStateURI("b.com/1", []types.RefID{shared})
+				s.MarkRefsAsNeeded([]types.RefID{unassociated})
+
+				needed, err := s.RefsNeededForStateURI("a.com/1")
+				require.NoError(t, err)
+				require.ElementsMatch(t, []types.RefID{shared, onlyA}, needed)
+
+				needed, err = s.RefsNeededForStateURI("b.com/1")
+				require.NoError(t, err)
+				require.ElementsMatch(t, []types.RefID{shared}, needed)
+
+				needed, err = s.RefsNeeded()
+				require.NoError(t, err)
+				require.ElementsMatch(t, []types.RefID{shared, onlyA, unassociated}, needed)
+
+				// Once the ref is saved, it's no longer needed by either
+				_, _, err = s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+				require.NoError(t, err)
+
+				needed, err = s.RefsNeededForStateURI("a.com/1")
+				require.NoError(t, err)
+				require.ElementsMatch(t, []types.RefID{onlyA}, needed)
+
+				needed, err = s.RefsNeededForStateURI("b.com/1")
+				require.NoError(t, err)
+				require.Len(t, needed, 0)
+			})
+
+			t.Run("unsubscribe listeners", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				var keptSaved, removedSaved, keptNeeded, removedNeeded int32
+				s.OnRefsSaved(func() { atomic.AddInt32(&keptSaved, 1) })
+				unsubscribe := s.OnRefsSaved(func() { atomic.AddInt32(&removedSaved, 1) })
+				unsubscribe()
+				unsubscribe() // no-op
+
+				s.OnRefsNeeded(func(refs []types.RefID) { atomic.AddInt32(&keptNeeded, 1) })
+				unsubscribe = s.OnRefsNeeded(func(refs []types.RefID) { atomic.AddInt32(&removedNeeded, 1) })
+				unsubscribe()
+
+				_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("some data"))))
+				require.NoError(t, err)
+				require.Equal(t, int32(1), atomic.LoadInt32(&keptSaved))
+				require.Equal(t, int32(0), atomic.LoadInt32(&removedSaved))
+
+				s.MarkRefsAsNeeded(randomRefIDs(1))
+				require.Eventually(t, func() bool {
+					return atomic.LoadInt32(&keptNeeded) > 0
+				}, 5*time.Second, 10*time.Millisecond)
+				require.Equal(t, int32(0), atomic.LoadInt32(&removedNeeded))
+			})
+
+			t.Run("panicking listeners", func(t *testing.T) {
+				s, cleanup := newStore(t)
+				defer cleanup()
+
+				var saved, needed int32
+				for i := 0; i < 20; i++ {
+					i := i
+					s.OnRefsSaved(func() {
+						if i == 5 {
+							panic("bad listener")
+						}
+						atomic.AddInt32(&saved, 1)
+					})
+					s.OnRefsNeeded(func(refs []types.RefID) {
+						if i == 5 {
+							panic("bad listener")
+						}
+						atomic.AddInt32(&needed, 1)
+					})
+				}
+
+				_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("still notifies"))))
+				require.NoError(t, err)
+				require.Equal(t, int32(19), atomic.LoadInt32(&saved))
+
+				s.MarkRefsAsNeeded(randomRefIDs(1))
+				require.Eventually(t, func() bool {
+					return atomic.LoadInt32(&needed) == 19
+				}, 5*time.Second, 10*time.Millisecond)
+
+				// The store carries on as usual
+				_, _, err = s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte("and again"))))
+				require.NoError(t, err)
+				require.Equal(t, int32(38), atomic.LoadInt32(&saved))
+			})
+		})
+	}
+}
+
+func BenchmarkRefStore_HaveObject(b *testing.B) {
+	s, cleanup := setupRefStore(b)
+	defer cleanup()
+
+	// Half of the refs are SHA1s, which need a metadata lookup
+	refs := randomRefIDs(5000)
+	for i := range refs {
+		if i%2 == 0 {
+			refs[i].HashAlg = types.SHA1
+		}
+	}
+	for i := 0; i < 50; i++ {
+		sha1Hash, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(types.RandomID().Bytes())))
+		require.NoError(b, err)
+		refs[i*100] = types.RefID{HashAlg: types.SHA1, Hash: sha1Hash}
+	}
+
+	b.Run("one at a time", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, refID := range refs {
+				_, err := s.HaveObject(refID)
+				require.NoError(b, err)
+			}
+		}
+	})
+
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := s.HaveObjects(refs)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestRefStore_BadgerOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The smallest value log that badger allows, so that the metadata below
+	// spills across several of them
+	badgerOpts := RefStoreOptions{
+		ValueLogFileSize:  1 << 20,
+		Compression:       badgeroptions.Snappy,
+		BlockCacheSize:    1 << 20,
+		NumVersionsToKeep: 1,
+	}
+	open := func() *refStore {
+		s := NewRefStoreWithOptions(dir, badgerOpts).(*refStore)
+		require.NoError(t, s.Start())
+		return s
+	}
+	s := open()
+
+	blobs := map[types.Hash][]byte{}
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("blob %v", i))
+		sha1Hash, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+		require.NoError(t, err)
+		blobs[sha1Hash] = data
+	}
+
+	// Each call rewrites the whole list of needed refs, so this writes a few
+	// MiB in total, although the list itself stays well under 1 MiB
+	var needed []types.RefID
+	for i := 0; i < 20; i++ {
+		refs := randomRefIDs(250)
+		s.MarkRefsAsNeeded(refs)
+		needed = append(needed, refs...)
+	}
+
+	vlogs, err := filepath.Glob(filepath.Join(dir, "metadata", "*.vlog"))
+	require.NoError(t, err)
+	require.True(t, len(vlogs) > 1, "%v", len(vlogs))
+
+	s.Close()
+	s = open()
+	defer s.Close()
+
+	for sha1Hash, data := range blobs {
+		r, _, err := s.Object(types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+		require.NoError(t, err)
+		bs, err := ioutil.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		require.Equal(t, data, bs)
+	}
+
+	refsNeeded, err := s.RefsNeeded()
+	require.NoError(t, err)
+	require.ElementsMatch(t, needed, refsNeeded)
+
+	t.Run("value log size out of range", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s := NewRefStoreWithOptions(dir, RefStoreOptions{ValueLogFileSize: 1 << 10})
+		require.Error(t, s.Start())
+	})
+}
+
+func TestRefStore_SyncWrites(t *testing.T) {
+	setup := func(t *testing.T, syncWrites bool) (*refStore, *[]string, func()) {
+		t.Helper()
+
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+
+		s := NewRefStore(dir, RefStoreSyncWrites(syncWrites)).(*refStore)
+		require.NoError(t, s.Start())
+
+		var synced []string
+		s.fsync = func(f syncableFile) error {
+			synced = append(synced, f.Name())
+			return f.Sync()
+		}
+		return s, &synced, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		s, synced, cleanup := setup(t, true)
+		defer cleanup()
+
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(strings.NewReader("hello")))
+		require.NoError(t, err)
+
+		// The temp file, and then the directory it was renamed into
+		blobPath := s.filepathForSHA3Blob(sha3Hash)
+		require.Len(t, *synced, 2)
+		require.True(t, strings.HasPrefix(filepath.Base((*synced)[0]), "temp-"), (*synced)[0])
+		require.Equal(t, filepath.Dir(blobPath), (*synced)[1])
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s, synced, cleanup := setup(t, false)
+		defer cleanup()
+
+		_, _, err := s.StoreObject(ioutil.NopCloser(strings.NewReader("hello")))
+		require.NoError(t, err)
+		require.Empty(t, *synced)
+	})
+
+	t.Run("sync failure", func(t *testing.T) {
+		s, _, cleanup := setup(t, true)
+		defer cleanup()
+
+		syncErr := errors.New("disk on fire")
+		s.fsync = func(f syncableFile) error { return syncErr }
+
+		_, _, err := s.StoreObject(ioutil.NopCloser(strings.NewReader("hello")))
+		require.True(t, errors.Is(err, syncErr))
+
+		// The unsynced blob isn't left behind
+		entries, err := ioutil.ReadDir(s.tempDirPath())
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+}
+
+func TestRefStore_AllHashesForAlgLookups(t *testing.T) {
+	s, cleanup := setupRefStore(t)
+	defer cleanup()
+
+	const numBlobs = 10
+	for i := 0; i < numBlobs; i++ {
+		_, _, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf("blob %v", i)))))
+		require.NoError(t, err)
+	}
+
+	lookups := func(fn func() ([]types.RefID, error)) (int, uint64) {
+		t.Helper()
+		before := s.Metrics().SHA1Lookups
+		refIDs, err := fn()
+		require.NoError(t, err)
+		return len(refIDs), s.Metrics().SHA1Lookups - before
+	}
+
+	// Every blob costs a metadata read to find its sha1...
+	n, reads := lookups(s.AllHashes)
+	require.Equal(t, 2*numBlobs, n)
+	require.Equal(t, uint64(numBlobs), reads)
+
+	n, reads = lookups(func() ([]types.RefID, error) { return s.AllHashesForAlg(types.SHA1) })
+	require.Equal(t, numBlobs, n)
+	require.Equal(t, uint64(numBlobs), reads)
+
+	// ...but the sha3 hashes come straight from the filenames
+	n, reads = lookups(func() ([]types.RefID, error) { return s.AllHashesForAlg(types.SHA3) })
+	require.Equal(t, numBlobs, n)
+	require.Equal(t, uint64(0), reads)
+}
+
+func TestRefStore_ReconcileRefsNeeded(t *testing.T) {
+	// Each store gets a blob added behind its back, and needed refs that have
+	// drifted from what it has
+	newDiskStore := func(opts ...RefStoreOption) func(t *testing.T) (RefStore, func()) {
+		return func(t *testing.T) (RefStore, func()) {
+			dir, err := ioutil.TempDir("", "refstore-test-")
+			require.NoError(t, err)
+			s := NewRefStore(dir, opts...)
+			require.NoError(t, s.Start())
+			return s, func() {
+				s.Close()
+				os.RemoveAll(dir)
+			}
+		}
+	}
+	diskOutOfBand := func(t *testing.T, s RefStore, data []byte) {
+		disk := s.(*refStore)
+		require.NoError(t, disk.ensureRootPath())
+		err := ioutil.WriteFile(disk.filepathForSHA3Blob(types.HashBytes(data)), data, 0600)
+		require.NoError(t, err)
+	}
+	diskForceNeeded := func(t *testing.T, s RefStore, refs []types.RefID) {
+		missingRefs := make(map[string]interface{})
+		for _, refID := range refs {
+			missingRefs[refID.String()] = nil
+		}
+		bs, err := json.Marshal(missingRefs)
+		require.NoError(t, err)
+		err = s.(*refStore).metadata.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("missing-refs"), bs)
+		})
+		require.NoError(t, err)
+	}
+
+	impls := map[string]struct {
+		newStore    func(t *testing.T) (RefStore, func())
+		outOfBand   func(t *testing.T, s RefStore, data []byte)
+		forceNeeded func(t *testing.T, s RefStore, refs []types.RefID)
+	}{
+		"disk":                  {newDiskStore(), diskOutOfBand, diskForceNeeded},
+		"disk with blob filter": {newDiskStore(RefStoreBlobFilterSize(1 << 10)), diskOutOfBand, diskForceNeeded},
+		"memory": {
+			func(t *testing.T) (RefStore, func()) {
+				s := NewMemoryRefStore()
+				require.NoError(t, s.Start())
+				return s, s.Close
+			},
+			func(t *testing.T, s RefStore, data []byte) {
+				mem := s.(*memoryRefStore)
+				mem.mu.Lock()
+				defer mem.mu.Unlock()
+				mem.blobs[types.HashBytes(data)] = data
+			},
+			func(t *testing.T, s RefStore, refs []types.RefID) {
+				mem := s.(*memoryRefStore)
+				mem.mu.Lock()
+				defer mem.mu.Unlock()
+				for _, refID := range refs {
+					mem.refsNeeded[refID] = make(map[string]struct{})
+				}
+			},
+		},
+	}
+
+	for name, impl := range impls {
+		impl := impl
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := impl.newStore(t)
+			defer cleanup()
+
+			// Both stores refuse to mark a ref as needed if they already have
+			// it, so the drift has to be injected behind their backs too
+			data := []byte("stored out-of-band")
+			impl.outOfBand(t, s, data)
+			present := types.RefID{HashAlg: types.SHA3, Hash: types.HashBytes(data)}
+			missing := randomRefIDs(2)
+
+			impl.forceNeeded(t, s, append([]types.RefID{present}, missing...))
+
+			needed, err := s.RefsNeeded()
+			require.NoError(t, err)
+			require.Len(t, needed, 3)
+
+			removed, err := s.ReconcileRefsNeeded()
+			require.NoError(t, err)
+			require.Equal(t, 1, removed)
+
+			needed, err = s.RefsNeeded()
+			require.NoError(t, err)
+			require.ElementsMatch(t, missing, needed)
+			require.Equal(t, int64(2), s.Metrics().RefsNeeded)
+
+			// The blob is now known to be there
+			have, err := s.HaveObject(present)
+			require.NoError(t, err)
+			require.True(t, have)
+
+			// Running it again finds nothing to do
+			removed, err = s.ReconcileRefsNeeded()
+			require.NoError(t, err)
+			require.Equal(t, 0, removed)
+		})
+	}
+}
+
+func TestRefStore_Mmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewRefStore(dir, RefStoreMmap(true)).(*refStore)
+	err = s.Start()
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	refID := types.RefID{HashAlg: types.SHA3, Hash: sha3Hash}
+
+	t.Run("ReadAt arbitrary offsets", func(t *testing.T) {
+		r, size, err := s.Object(refID)
+		require.NoError(t, err)
+		defer r.Close()
+		require.Equal(t, int64(len(data)), size)
+		if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+			require.IsType(t, &mmapReader{}, r)
+		}
+
+		readerAt, ok := r.(io.ReaderAt)
+		require.True(t, ok)
+
+		rng := rand.New(rand.NewSource(2))
+		for i := 0; i < 100; i++ {
+			offset := rng.Intn(len(data))
+			buf := make([]byte, rng.Intn(4096)+1)
+			n, err := readerAt.ReadAt(buf, int64(offset))
+			if offset+len(buf) > len(data) {
+				require.Equal(t, io.EOF, err)
+				require.Equal(t, len(data)-offset, n)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, len(buf), n)
+			}
+			require.Equal(t, data[offset:offset+n], buf[:n])
+		}
+
+		// ReadAt doesn't disturb sequential reads
+		bs, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, bs)
+	})
+
+	t.Run("range requests", func(t *testing.T) {
+		r, _, err := s.Object(refID)
+		require.NoError(t, err)
+		defer r.Close()
+
+		req := httptest.NewRequest("GET", "/blob", nil)
+		req.Header.Set("Range", "bytes=1000-1999")
+		resp := httptest.NewRecorder()
+		http.ServeContent(resp, req, "blob", time.Time{}, r.(io.ReadSeeker))
+
+		require.Equal(t, http.StatusPartialContent, resp.Code)
+		require.Equal(t, data[1000:2000], resp.Body.Bytes())
+	})
+
+	t.Run("close is idempotent", func(t *testing.T) {
+		r, _, err := s.Object(refID)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.NoError(t, r.Close())
+	})
+
+	t.Run("falls back for compressed blobs", func(t *testing.T) {
+		s.compress = true
+		defer func() { s.compress = false }()
+
+		compressible := bytes.Repeat([]byte("compress me "), 1000)
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(compressible)))
+		require.NoError(t, err)
+
+		r, _, err := s.Object(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		defer r.Close()
+		require.IsType(t, &decompressingReader{}, r)
+
+		bs, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, compressible, bs)
+	})
+
+	t.Run("falls back for empty blobs", func(t *testing.T) {
+		_, sha3Hash, err := s.StoreObject(ioutil.NopCloser(bytes.NewReader(nil)))
+		require.NoError(t, err)
+
+		r, size, err := s.Object(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		defer r.Close()
+		require.Equal(t, int64(0), size)
+
+		bs, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Len(t, bs, 0)
+	})
+}
+
+type seekableReadCloser struct {
+	*strings.Reader
+	reads int
+}
+
+func (r *seekableReadCloser) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func (r *seekableReadCloser) Close() error { return nil }
+
+func TestRefStore_StoreObjectIfAbsent(t *testing.T) {
+	setup := func(t *testing.T) (*refStore, *int, func()) {
+		t.Helper()
+
+		s, cleanup := setupRefStore(t)
+		var renames int
+		s.rename = func(src, dst string) error {
+			renames++
+			return moveFile(src, dst)
+		}
+		return s, &renames, cleanup
+	}
+
+	t.Run("unseekable reader", func(t *testing.T) {
+		s, renames, cleanup := setup(t)
+		defer cleanup()
+
+		sha1Hash, sha3Hash, stored, err := s.StoreObjectIfAbsent(ioutil.NopCloser(strings.NewReader("hello")), nil)
+		require.NoError(t, err)
+		require.True(t, stored)
+		require.Equal(t, 1, *renames)
+
+		sha1Hash2, sha3Hash2, stored, err := s.StoreObjectIfAbsent(ioutil.NopCloser(strings.NewReader("hello")), nil)
+		require.NoError(t, err)
+		require.False(t, stored)
+		require.Equal(t, 1, *renames)
+		require.Equal(t, sha1Hash, sha1Hash2)
+		require.Equal(t, sha3Hash, sha3Hash2)
+
+		// The discarded copy isn't left behind
+		entries, err := ioutil.ReadDir(s.tempDirPath())
+		require.NoError(t, err)
+		for _, entry := range entries {
+			require.False(t, strings.HasPrefix(entry.Name(), "temp-"), entry.Name())
+		}
+
+		reader, _, err := s.Object(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		defer reader.Close()
+		bs, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(bs))
+	})
+
+	t.Run("seekable reader", func(t *testing.T) {
+		s, renames, cleanup := setup(t)
+		defer cleanup()
+
+		_, sha3Hash, stored, err := s.StoreObjectIfAbsent(&seekableReadCloser{Reader: strings.NewReader("hello")}, nil)
+		require.NoError(t, err)
+		require.True(t, stored)
+		require.Equal(t, 1, *renames)
+
+		have, err := s.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		require.True(t, have)
+
+		_, sha3Hash2, stored, err := s.StoreObjectIfAbsent(&seekableReadCloser{Reader: strings.NewReader("hello")}, nil)
+		require.NoError(t, err)
+		require.False(t, stored)
+		require.Equal(t, 1, *renames)
+		require.Equal(t, sha3Hash, sha3Hash2)
+	})
+
+	t.Run("expected hash", func(t *testing.T) {
+		s, renames, cleanup := setup(t)
+		defer cleanup()
+
+		sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(strings.NewReader("hello")))
+		require.NoError(t, err)
+		require.Equal(t, 1, *renames)
+
+		for _, expected := range []types.RefID{
+			{HashAlg: types.SHA1, Hash: sha1Hash},
+			{HashAlg: types.SHA3, Hash: sha3Hash},
+		} {
+			expected := expected
+			reader := &seekableReadCloser{Reader: strings.NewReader("hello")}
+			gotSHA1, gotSHA3, stored, err := s.StoreObjectIfAbsent(reader, &expected)
+			require.NoError(t, err)
+			require.False(t, stored)
+			require.Equal(t, 0, reader.reads)
+			require.Equal(t, sha1Hash, gotSHA1)
+			require.Equal(t, sha3Hash, gotSHA3)
+		}
+		require.Equal(t, 1, *renames)
+
+		// A missing blob is still checked against the expected hash
+		expected := types.RefID{HashAlg: types.SHA1, Hash: types.HashBytes([]byte("hi"))}
+		_, _, stored, err := s.StoreObjectIfAbsent(ioutil.NopCloser(strings.NewReader("goodbye")), &expected)
+		require.True(t, errors.Is(err, ErrHashMismatch))
+		require.False(t, stored)
+		require.Equal(t, 1, *renames)
+	})
+}
+
+// capturingLogger records what's logged at the success level and passes
+// everything else through.
+type capturingLogger struct {
+	ctx.Logger
+	mu        sync.Mutex
+	successes []string
+}
+
+func (l *capturingLogger) Successf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.successes = append(l.successes, fmt.Sprintf(format, args...))
+}
+
+func TestRefStore_Logger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &capturingLogger{Logger: ctx.NewLogger("test")}
+	s := NewRefStore(dir, RefStoreLogger(logger))
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	sha1Hash, sha3Hash, err := s.StoreObject(ioutil.NopCloser(strings.NewReader("hello")))
+	require.NoError(t, err)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Equal(t, []string{fmt.Sprintf("saved ref (sha1: %v, sha3: %v)", sha1Hash.Hex(), sha3Hash.Hex())}, logger.successes)
+}
+
+func TestRefStore_CopyObjectsTo(t *testing.T) {
+	data := bytes.Repeat([]byte("<html><body>copy me</body></html>"), 100)
+
+	// The source compresses its blobs, so the destination can only read the
+	// linked file if the blob's metadata came along with it
+	srcDir, err := ioutil.TempDir("", "refstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(srcDir)
+	src := NewRefStore(srcDir, RefStoreCompression(true)).(*refStore)
+	require.NoError(t, src.Start())
+	defer src.Close()
+
+	sha1Hash, sha3Hash, err := src.StoreObject(ioutil.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	refIDs := []types.RefID{{HashAlg: types.SHA1, Hash: sha1Hash}}
+
+	requireCopied := func(t *testing.T, dst RefStore) {
+		t.Helper()
+
+		gotSHA1, gotSHA3, have, err := dst.ResolveRefID(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		require.True(t, have)
+		require.Equal(t, sha1Hash, gotSHA1)
+		require.Equal(t, sha3Hash, gotSHA3)
+
+		r, _, err := dst.Object(types.RefID{HashAlg: types.SHA1, Hash: sha1Hash})
+		require.NoError(t, err)
+		defer r.Close()
+		bs, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, bs)
+
+		contentType, err := dst.ContentTypeFor(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(contentType, "text/html"), contentType)
+	}
+
+	t.Run("same filesystem", func(t *testing.T) {
+		dst, cleanup := setupRefStore(t)
+		defer cleanup()
+
+		err := src.CopyObjectsTo(dst, refIDs)
+		require.NoError(t, err)
+		requireCopied(t, dst)
+
+		// The blob was linked rather than rewritten
+		srcInfo, err := os.Stat(src.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		dstInfo, err := os.Stat(dst.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(srcInfo, dstInfo))
+
+		// Copying again is a no-op
+		err = src.CopyObjectsTo(dst, refIDs)
+		require.NoError(t, err)
+	})
+
+	t.Run("different encryption keys", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		key, err := crypto.GenerateSymmetricKey()
+		require.NoError(t, err)
+		dst := NewRefStore(dir, RefStoreEncryptionKey(key)).(*refStore)
+		require.NoError(t, dst.Start())
+		defer dst.Close()
+
+		err = src.CopyObjectsTo(dst, refIDs)
+		require.NoError(t, err)
+		requireCopied(t, dst)
+
+		srcInfo, err := os.Stat(src.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		dstInfo, err := os.Stat(dst.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		require.False(t, os.SameFile(srcInfo, dstInfo))
+	})
+
+	t.Run("different file modes", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "refstore-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		dst := NewRefStore(dir, RefStoreFileMode(0640)).(*refStore)
+		require.NoError(t, dst.Start())
+		defer dst.Close()
+
+		err = src.CopyObjectsTo(dst, refIDs)
+		require.NoError(t, err)
+		requireCopied(t, dst)
+
+		// Linking would have left the copy with the source's mode (or changed
+		// the source's), so the blob was copied instead
+		srcInfo, err := os.Stat(src.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		dstInfo, err := os.Stat(dst.filepathForSHA3Blob(sha3Hash))
+		require.NoError(t, err)
+		require.False(t, os.SameFile(srcInfo, dstInfo))
+		require.Equal(t, defaultRefStoreFileMode, srcInfo.Mode().Perm())
+		require.Equal(t, os.FileMode(0640), dstInfo.Mode().Perm())
+	})
+
+	t.Run("memory store", func(t *testing.T) {
+		dst := NewMemoryRefStore()
+		require.NoError(t, dst.Start())
+		defer dst.Close()
+
+		err := src.CopyObjectsTo(dst, refIDs)
+		require.NoError(t, err)
+		requireCopied(t, dst)
+
+		back, cleanup := setupRefStore(t)
+		defer cleanup()
+		err = dst.CopyObjectsTo(back, refIDs)
+		require.NoError(t, err)
+		requireCopied(t, back)
+	})
+
+	t.Run("missing blob", func(t *testing.T) {
+		dst, cleanup := setupRefStore(t)
+		defer cleanup()
+
+		err := src.CopyObjectsTo(dst, []types.RefID{{HashAlg: types.SHA3, Hash: types.HashBytes([]byte("not in the store"))}})
+		require.Equal(t, types.Err404, errors.Cause(err))
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"sync"
 
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
@@ -22,6 +23,9 @@ type client struct {
 	client     RemoteStoreClient
 	conn       *grpc.ClientConn
 	jwt        string
+
+	validators   []redwood.AddTxValidator
+	validatorsMu sync.RWMutex
 }
 
 // client should conform to redwood.TxStore
@@ -112,6 +116,11 @@ func (c *client) Authenticate() error {
 }
 
 func (c *client) AddTx(tx *redwood.Tx) error {
+	err := c.validateTx(tx)
+	if err != nil {
+		return err
+	}
+
 	// @@TODO: don't use json
 	txBytes, err := json.Marshal(tx)
 	if err != nil {
@@ -132,7 +141,25 @@ func (c *client) AddTx(tx *redwood.Tx) error {
 	return nil
 }
 
-func (c *client) AllTxsForStateURI(stateURI string, fromTxID types.ID) redwood.TxIterator {
+func (c *client) SetTxValidator(validators ...redwood.AddTxValidator) {
+	c.validatorsMu.Lock()
+	defer c.validatorsMu.Unlock()
+	c.validators = append([]redwood.AddTxValidator(nil), validators...)
+}
+
+func (c *client) validateTx(tx *redwood.Tx) error {
+	c.validatorsMu.RLock()
+	defer c.validatorsMu.RUnlock()
+	for _, validator := range c.validators {
+		err := validator(types.StateURI(tx.StateURI), tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) AllTxsForStateURI(stateURI types.StateURI, fromTxID types.ID) redwood.TxIterator {
 	txIter := &txIterator{
 		ch:       make(chan *redwood.Tx),
 		chCancel: make(chan struct{}),
@@ -168,13 +195,32 @@ func (c *client) AllTxsForStateURI(stateURI string, fromTxID types.ID) redwood.T
 	return txIter
 }
 
-func (c *client) FetchTx(stateURI string, txID types.ID) (*redwood.Tx, error) { panic("unimplemented") }
-func (c *client) TxExists(stateURI string, txID types.ID) (bool, error)       { panic("unimplemented") }
-func (c *client) RemoveTx(stateURI string, txID types.ID) error               { panic("unimplemented") }
-func (c *client) KnownStateURIs() ([]string, error)                           { panic("unimplemented") }
-func (c *client) MarkLeaf(stateURI string, txID types.ID) error               { panic("unimplemented") }
-func (c *client) UnmarkLeaf(stateURI string, txID types.ID) error             { panic("unimplemented") }
-func (c *client) Leaves(stateURI string) ([]types.ID, error)                  { panic("unimplemented") }
+func (c *client) FetchTx(stateURI types.StateURI, txID types.ID) (*redwood.Tx, error) {
+	panic("unimplemented")
+}
+func (c *client) TxExists(stateURI types.StateURI, txID types.ID) (bool, error) {
+	panic("unimplemented")
+}
+func (c *client) RemoveTx(stateURI types.StateURI, txID types.ID) error   { panic("unimplemented") }
+func (c *client) KnownStateURIs() ([]types.StateURI, error)               { panic("unimplemented") }
+func (c *client) MarkLeaf(stateURI types.StateURI, txID types.ID) error   { panic("unimplemented") }
+func (c *client) UnmarkLeaf(stateURI types.StateURI, txID types.ID) error { panic("unimplemented") }
+func (c *client) Leaves(stateURI types.StateURI) ([]types.ID, error)      { panic("unimplemented") }
+func (c *client) LeavesHash(stateURI types.StateURI) (types.Hash, error)  { panic("unimplemented") }
+func (c *client) ReplaceLeaf(stateURI types.StateURI, oldLeaf, newLeaf types.ID) error {
+	panic("unimplemented")
+}
+func (c *client) DiskUsageByStateURI() (map[types.StateURI]int64, error) { panic("unimplemented") }
+func (c *client) ExportAllTxs(ctx context.Context) redwood.TxIterator    { panic("unimplemented") }
+func (c *client) ImportTxs(iter redwood.TxIterator) error                { panic("unimplemented") }
+func (c *client) KnownStateURIsByPrefix(prefix string, offset, limit int) ([]types.StateURI, error) {
+	panic("unimplemented")
+}
+func (c *client) TxsBySender(stateURI types.StateURI, sender types.Address) redwood.TxIterator {
+	panic("unimplemented")
+}
+func (c *client) OnTxAdded(fn func(stateURI types.StateURI, tx *redwood.Tx))  { panic("unimplemented") }
+func (c *client) OnTxRemoved(fn func(stateURI types.StateURI, txID types.ID)) { panic("unimplemented") }
 
 func (c *client) decodeTx(txBytes []byte) (*redwood.Tx, error) {
 	var tx redwood.Tx
@@ -186,9 +232,27 @@ type txIterator struct {
 	ch       chan *redwood.Tx
 	chCancel chan struct{}
 	err      error
+	peeked   *redwood.Tx
+	hasPeek  bool
 }
 
 func (i *txIterator) Next() *redwood.Tx {
+	if i.hasPeek {
+		tx := i.peeked
+		i.peeked, i.hasPeek = nil, false
+		return tx
+	}
+	return i.receive()
+}
+
+func (i *txIterator) Peek() *redwood.Tx {
+	if !i.hasPeek {
+		i.peeked, i.hasPeek = i.receive(), true
+	}
+	return i.peeked
+}
+
+func (i *txIterator) receive() *redwood.Tx {
 	select {
 	case tx := <-i.ch:
 		return tx
@@ -1,6 +1,8 @@
 package redwood
 
 import (
+	"github.com/pkg/errors"
+
 	"redwood.dev/tree"
 	"redwood.dev/types"
 )
@@ -17,7 +19,9 @@ func (r *dumbResolver) InternalState() map[string]interface{} {
 
 func (r *dumbResolver) ResolveState(state tree.Node, refStore RefStore, sender types.Address, txID types.ID, parents []types.ID, ps []Patch) (err error) {
 	for _, p := range ps {
-		if p.Val != nil {
+		if p.Range.IsAppend() {
+			err = appendAtKeypath(state, p.Keypath, p.Val)
+		} else if p.Val != nil {
 			err = state.Set(p.Keypath, p.Range, p.Val)
 		} else {
 			err = state.Delete(p.Keypath, p.Range)
@@ -28,3 +32,29 @@ func (r *dumbResolver) ResolveState(state tree.Node, refStore RefStore, sender t
 	}
 	return nil
 }
+
+// appendAtKeypath pushes val onto the end of the slice (or string) at
+// keypath.  If nothing exists at keypath yet, it's created as a
+// single-element slice.  Not every tree.Node supports ranged Sets, so this
+// reads the existing value and writes back the whole thing.
+func appendAtKeypath(state tree.Node, keypath tree.Keypath, val interface{}) error {
+	existing, exists, err := state.Value(keypath, nil)
+	if err != nil {
+		return err
+	} else if !exists {
+		return state.Set(keypath, nil, []interface{}{val})
+	}
+
+	switch existing := existing.(type) {
+	case []interface{}:
+		return state.Set(keypath, nil, append(existing, val))
+	case string:
+		s, isString := val.(string)
+		if !isString {
+			return errors.Errorf("can't append a %T to the string at %v", val, keypath)
+		}
+		return state.Set(keypath, nil, existing+s)
+	default:
+		return errors.WithStack(tree.ErrRangeOverNonSlice)
+	}
+}
@@ -0,0 +1,78 @@
+package redwood
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"redwood.dev/testutils"
+	"redwood.dev/tree"
+	"redwood.dev/types"
+)
+
+func TestDumbResolver_Append(t *testing.T) {
+	mustParsePatches := func(t *testing.T, strs ...string) []Patch {
+		t.Helper()
+		var patches []Patch
+		for _, s := range strs {
+			patch, err := ParsePatch([]byte(s))
+			require.NoError(t, err)
+			patches = append(patches, patch)
+		}
+		return patches
+	}
+
+	initial := map[string]interface{}{
+		"list": []interface{}{"a"},
+		"text": "hello",
+	}
+	patches := mustParsePatches(t,
+		`.list[-] = "b"`,
+		`.list += {"author": "bob"}`,
+		`.newList[-] = 123`,
+		`.text += " world"`,
+	)
+	expected := map[string]interface{}{
+		"list":    []interface{}{"a", "b", map[string]interface{}{"author": "bob"}},
+		"newList": []interface{}{float64(123)},
+		"text":    "hello world",
+	}
+
+	resolver, err := NewDumbResolver(nil, nil)
+	require.NoError(t, err)
+
+	t.Run("memory", func(t *testing.T) {
+		state := tree.NewMemoryNode()
+		err := state.Set(nil, nil, initial)
+		require.NoError(t, err)
+
+		err = resolver.ResolveState(state, nil, types.Address{}, types.RandomID(), nil, patches)
+		require.NoError(t, err)
+
+		val, exists, err := state.Value(nil, nil)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.True(t, DeepEqualJSValue(expected, val))
+	})
+
+	t.Run("badger", func(t *testing.T) {
+		db := testutils.SetupVersionedDBTreeWithValue(t, nil, initial)
+		defer db.DeleteDB()
+
+		state := db.StateAtVersion(nil, true)
+		defer state.Close()
+
+		err = resolver.ResolveState(state, nil, types.Address{}, types.RandomID(), nil, patches)
+		require.NoError(t, err)
+		err = state.Save()
+		require.NoError(t, err)
+
+		node := db.StateAtVersion(nil, false)
+		defer node.Close()
+
+		val, exists, err := node.Value(nil, nil)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.True(t, DeepEqualJSValue(expected, val))
+	})
+}
@@ -3,6 +3,7 @@ package redwood
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"crypto/tls"
@@ -243,6 +244,20 @@ func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Clients may gzip large request bodies (see HTTPClientGzip)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gzipReader.Close()
+
+		r.Body = gzipReader
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+	}
+
 	sessionID, err := t.ensureSessionIDCookie(w, r)
 	if err != nil {
 		t.Errorf("error reading sessionID cookie: %v", err)
@@ -264,7 +279,16 @@ func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "HEAD":
-		// This is mainly used to poll for new peers
+		// This is mainly used to poll for new peers, but clients also use it
+		// to check whether we already have a ref or tx, or to fetch a state
+		// URI's leaves, without transferring a body
+		if r.Header.Get("Ref") == "true" {
+			t.serveHeadRef(w, r)
+		} else if strings.HasPrefix(r.URL.Path, "/__tx/") {
+			t.serveHeadTx(w, r)
+		} else if r.Header.Get("Leaves") == "true" {
+			t.serveHeadLeaves(w, r)
+		}
 
 	case "OPTIONS":
 		// w.Header().Set("Access-Control-Allow-Headers", "State-URI")
@@ -474,7 +498,11 @@ func (t *httpTransport) serveSubscription(w http.ResponseWriter, r *http.Request
 		w.Header().Set("Connection", "keep-alive")
 		w.Header().Set("Transfer-Encoding", "chunked")
 
-		httpWriteSub := &httpWritableSubscription{t.makePeer(w, f, "", address), subscriptionType}
+		httpWriteSub := &httpWritableSubscription{
+			httpPeer:  t.makePeer(w, f, "", address),
+			typ:       subscriptionType,
+			txKeypath: tree.Keypath(r.Header.Get("Subscribe-Keypath")),
+		}
 		innerWriteSub = httpWriteSub
 
 		// Listen to the closing of the http connection via the CloseNotifier
@@ -533,6 +561,59 @@ func (t *httpTransport) serveGetTx(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, tx)
 }
 
+// serveHeadTx responds with a 200 if we have the requested tx, and a 404 if
+// we don't.
+func (t *httpTransport) serveHeadTx(w http.ResponseWriter, r *http.Request) {
+	stateURI := r.Header.Get("State-URI")
+	if stateURI == "" {
+		http.Error(w, "missing State-URI header", http.StatusBadRequest)
+		return
+	}
+
+	txID, err := types.IDFromHex(strings.TrimPrefix(r.URL.Path, "/__tx/"))
+	if err != nil {
+		http.Error(w, "bad tx id", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := t.controllerHub.HaveTx(stateURI, txID)
+	if err != nil {
+		t.Errorf("error checking for tx: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	} else if !exists {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveHeadLeaves responds with the state URI's current leaves in the
+// "Leaves" header as comma-separated hex IDs.  The header is always present,
+// even when there are no leaves, so that clients can tell an empty set apart
+// from a server that doesn't understand the request.
+func (t *httpTransport) serveHeadLeaves(w http.ResponseWriter, r *http.Request) {
+	stateURI := r.Header.Get("State-URI")
+	if stateURI == "" {
+		http.Error(w, "missing State-URI header", http.StatusBadRequest)
+		return
+	}
+
+	leaves, err := t.controllerHub.Leaves(stateURI)
+	if errors.Cause(err) == types.Err404 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		t.Errorf("error fetching leaves: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	leafStrs := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		leafStrs[i] = leaf.Hex()
+	}
+	w.Header().Set("Leaves", strings.Join(leafStrs, ","))
+}
+
 func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 
 	keypathStrs := filterEmptyStrings(strings.Split(r.URL.Path[1:], "/"))
@@ -632,6 +713,22 @@ func (t *httpTransport) serveGetState(w http.ResponseWriter, r *http.Request) {
 		} else {
 			w.Header().Add("Parents", "")
 		}
+
+		// The ETag is the version being served, which lets polling clients
+		// skip re-downloading a state that hasn't changed
+		var etag string
+		if version != nil {
+			etag = versionsETag([]types.ID{*version})
+		} else if len(leaves) > 0 {
+			etag = versionsETag(leaves)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 	}
 
 	indexName, indexArg := parseIndexParams(r)
@@ -847,7 +944,31 @@ type StoreRefResponse struct {
 	SHA3 types.Hash `json:"sha3"`
 }
 
+// serveHeadRef tells the client whether we already have the ref named by the
+// Ref-SHA3 header.  Partial uploads aren't retained, so we never advertise
+// Accept-Ranges.
+func (t *httpTransport) serveHeadRef(w http.ResponseWriter, r *http.Request) {
+	sha3Hash, err := types.HashFromHex(r.Header.Get("Ref-SHA3"))
+	if err != nil {
+		http.Error(w, "bad Ref-SHA3 header", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := t.refStore.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: sha3Hash})
+	if err != nil {
+		t.Errorf("error checking for ref: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Ref-Exists", strconv.FormatBool(exists))
+}
+
 func (t *httpTransport) servePostRef(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Ref-Batch") == "true" {
+		t.servePostRefs(w, r)
+		return
+	}
+
 	t.Infof(0, "incoming ref")
 
 	err := r.ParseForm()
@@ -864,7 +985,10 @@ func (t *httpTransport) servePostRef(w http.ResponseWriter, r *http.Request) {
 	defer file.Close()
 
 	sha1Hash, sha3Hash, err := t.refStore.StoreObject(file)
-	if err != nil {
+	if errors.Cause(err) == ErrBlobTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		t.Errorf("error storing ref: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
@@ -872,6 +996,46 @@ func (t *httpTransport) servePostRef(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, StoreRefResponse{SHA1: sha1Hash, SHA3: sha3Hash})
 }
 
+// servePostRefs stores every "ref" part of a multipart request, in order, and
+// responds with an array of StoreRefResponses.  Parts are streamed rather
+// than buffered by ParseMultipartForm.
+func (t *httpTransport) servePostRefs(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responses := []StoreRefResponse{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if part.FormName() != "ref" {
+			part.Close()
+			continue
+		}
+
+		t.Infof(0, "incoming ref (%v)", part.FileName())
+
+		sha1Hash, sha3Hash, err := t.refStore.StoreObject(part)
+		part.Close()
+		if errors.Cause(err) == ErrBlobTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			t.Errorf("error storing ref: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		responses = append(responses, StoreRefResponse{SHA1: sha1Hash, SHA3: sha3Hash})
+	}
+	respondJSON(w, responses)
+}
+
 func (t *httpTransport) servePostTx(w http.ResponseWriter, r *http.Request, address types.Address) {
 	t.Infof(0, "incoming tx")
 
@@ -926,6 +1090,23 @@ func (t *httpTransport) servePostTx(w http.ResponseWriter, r *http.Request, addr
 		stateURI = t.defaultStateURI
 	}
 
+	// If-Parents makes the put conditional on the state's current leaves.
+	// The controller checks them when the tx is added, below.
+	var expectedLeaves []types.ID
+	if _, exists := r.Header[http.CanonicalHeaderKey("If-Parents")]; exists {
+		expectedLeaves = []types.ID{}
+		if ifParentsStr := r.Header.Get("If-Parents"); ifParentsStr != "" {
+			for _, pstr := range strings.Split(ifParentsStr, ",") {
+				parentID, err := types.IDFromHex(strings.TrimSpace(pstr))
+				if err != nil {
+					http.Error(w, "bad If-Parents header", http.StatusBadRequest)
+					return
+				}
+				expectedLeaves = append(expectedLeaves, parentID)
+			}
+		}
+	}
+
 	var attachment []byte
 	var patchReader io.Reader
 
@@ -1000,6 +1181,19 @@ func (t *httpTransport) servePostTx(w http.ResponseWriter, r *http.Request, addr
 	tx.From = pubkey.Address()
 	////////////////////////////////
 
+	// A conditional put is added here, so that a conflict can be reported.
+	// HandleTxReceived then finds that it already has the tx.
+	if expectedLeaves != nil {
+		err := t.controllerHub.AddTx(&tx, false, expectedLeaves)
+		if errors.Cause(err) == ErrConflict {
+			http.Error(w, "state has moved past If-Parents", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("error adding tx: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
 	peer := t.makePeer(w, nil, "", address)
 	go t.host.HandleTxReceived(tx, peer)
 }
@@ -1563,7 +1757,8 @@ func (c *httpReadableSubscription) Close() error {
 
 type httpWritableSubscription struct {
 	*httpPeer
-	typ SubscriptionType
+	typ       SubscriptionType
+	txKeypath tree.Keypath // only txs touching this keypath are sent (see Tx.TouchesKeypath)
 }
 
 var _ WritableSubscriptionImpl = (*httpWritableSubscription)(nil)
@@ -1571,6 +1766,13 @@ var _ WritableSubscriptionImpl = (*httpWritableSubscription)(nil)
 func (sub *httpWritableSubscription) Put(ctx context.Context, tx *Tx, state tree.Node, leaves []types.ID) (err error) {
 	defer func() { sub.UpdateConnStats(err == nil) }()
 
+	if tx != nil && !tx.TouchesKeypath(sub.txKeypath) {
+		if state == nil {
+			return nil
+		}
+		tx = nil
+	}
+
 	var msg *SubscriptionMsg
 	if tx != nil && tx.IsPrivate() {
 		marshalledTx, err := json.Marshal(tx)
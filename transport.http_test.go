@@ -0,0 +1,210 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"redwood.dev/crypto"
+	"redwood.dev/ctx"
+	"redwood.dev/tree"
+	"redwood.dev/types"
+)
+
+func TestHTTPTransport_StoreRefs(t *testing.T) {
+	refStore := NewMemoryRefStore()
+	transport := &httpTransport{
+		Logger:   ctx.NewLogger("http"),
+		refStore: refStore,
+	}
+	server := httptest.NewServer(http.HandlerFunc(transport.servePostRef))
+	defer server.Close()
+
+	c, err := NewHTTPClient(server.URL, nil, nil, false)
+	require.NoError(t, err)
+
+	contents := map[string][]byte{
+		"a.txt":  []byte("the first file"),
+		"b.html": []byte("<html><body>the second file</body></html>"),
+		"c.bin":  {0x00, 0x01, 0x02, 0x03},
+	}
+	files := map[string]io.Reader{}
+	for name, content := range contents {
+		files[name] = bytes.NewReader(content)
+	}
+
+	resps, err := c.StoreRefs(files)
+	require.NoError(t, err)
+	require.Len(t, resps, 3)
+
+	for i, name := range []string{"a.txt", "b.html", "c.bin"} {
+		require.Equal(t, types.HashBytes(contents[name]), resps[i].SHA3)
+
+		reader, _, err := refStore.Object(types.RefID{HashAlg: types.SHA3, Hash: resps[i].SHA3})
+		require.NoError(t, err)
+		bs, err := ioutil.ReadAll(reader)
+		reader.Close()
+		require.NoError(t, err)
+		require.Equal(t, contents[name], bs)
+	}
+
+	contentType, err := refStore.ContentTypeFor(types.RefID{HashAlg: types.SHA3, Hash: resps[1].SHA3})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(contentType, "text/html"))
+}
+
+func TestHTTPTransport_StoreRefPrecheck(t *testing.T) {
+	content := []byte("a blob that the server may or may not already have")
+
+	setup := func(t *testing.T) (RefStore, *HTTPClient, *int64, func()) {
+		t.Helper()
+
+		refStore := NewMemoryRefStore()
+		transport := &httpTransport{
+			Logger:   ctx.NewLogger("http"),
+			refStore: refStore,
+		}
+
+		var uploaded int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "HEAD":
+				transport.serveHeadRef(w, r)
+			case "POST":
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				uploaded += int64(len(body))
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				transport.servePostRef(w, r)
+			}
+		}))
+
+		c, err := NewHTTPClient(server.URL, nil, nil, false)
+		require.NoError(t, err)
+		return refStore, c, &uploaded, server.Close
+	}
+
+	t.Run("server already has the ref", func(t *testing.T) {
+		refStore, c, uploaded, cleanup := setup(t)
+		defer cleanup()
+
+		sha1Hash, sha3Hash, err := refStore.StoreObject(ioutil.NopCloser(bytes.NewReader(content)))
+		require.NoError(t, err)
+
+		resp, err := c.StoreRef(bytes.NewReader(content))
+		require.NoError(t, err)
+		require.Equal(t, sha1Hash, resp.SHA1)
+		require.Equal(t, sha3Hash, resp.SHA3)
+		require.Equal(t, int64(0), *uploaded)
+	})
+
+	t.Run("server doesn't have the ref", func(t *testing.T) {
+		refStore, c, uploaded, cleanup := setup(t)
+		defer cleanup()
+
+		// Not an io.ReadSeeker, so the client has to spool it
+		resp, err := c.StoreRef(ioutil.NopCloser(bytes.NewReader(content)))
+		require.NoError(t, err)
+		require.Equal(t, types.HashBytes(content), resp.SHA3)
+		require.True(t, *uploaded > int64(len(content)))
+
+		have, err := refStore.HaveObject(types.RefID{HashAlg: types.SHA3, Hash: resp.SHA3})
+		require.NoError(t, err)
+		require.True(t, have)
+	})
+}
+
+// putTxHost is just enough of a Host for servePostTx's unconditional path
+type putTxHost struct{ Host }
+
+func (putTxHost) HandleTxReceived(tx Tx, peer Peer) {}
+
+func TestHTTPTransport_PutIfParents(t *testing.T) {
+	const stateURI = "foo.bar/blah"
+
+	setup := func(t *testing.T) (*HTTPClient, *crypto.SigningKeypair, func()) {
+		t.Helper()
+
+		txStore := NewMemoryTxStore()
+		require.NoError(t, txStore.Start())
+		genesis := &Tx{ID: GenesisTxID, StateURI: stateURI, Status: TxStatusValid}
+		require.NoError(t, txStore.AddTx(genesis))
+		require.NoError(t, txStore.MarkLeaf(stateURI, genesis.ID))
+
+		dir, err := ioutil.TempDir("", "transport-test-")
+		require.NoError(t, err)
+		controllerHub := NewControllerHub(dir, txStore, NewMemoryRefStore())
+
+		transport := &httpTransport{
+			Logger:        ctx.NewLogger("http"),
+			host:          putTxHost{},
+			controllerHub: controllerHub,
+		}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			transport.servePostTx(w, r, types.Address{})
+		}))
+
+		sigkeys, err := crypto.GenerateSigningKeypair()
+		require.NoError(t, err)
+		c, err := NewHTTPClient(server.URL, sigkeys, nil, false)
+		require.NoError(t, err)
+
+		return c, sigkeys, func() {
+			server.Close()
+			controllerHub.Close()
+			txStore.Close()
+			os.RemoveAll(dir)
+		}
+	}
+
+	newTx := func(sigkeys *crypto.SigningKeypair) *Tx {
+		return &Tx{
+			ID:       types.RandomID(),
+			StateURI: stateURI,
+			From:     sigkeys.Address(),
+			Parents:  []types.ID{GenesisTxID},
+			Patches:  []Patch{{Keypath: tree.Keypath("foo"), Val: "bar"}},
+		}
+	}
+
+	t.Run("stale leaves", func(t *testing.T) {
+		c, sigkeys, cleanup := setup(t)
+		defer cleanup()
+
+		err := c.PutIfParents(context.Background(), newTx(sigkeys), []types.ID{types.RandomID()}, types.Address{}, nil)
+		require.True(t, errors.Is(err, ErrConflict), "%v", err)
+	})
+
+	t.Run("concurrent puts against the same leaves", func(t *testing.T) {
+		c, sigkeys, cleanup := setup(t)
+		defer cleanup()
+
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			tx := newTx(sigkeys)
+			go func() {
+				errs <- c.PutIfParents(context.Background(), tx, []types.ID{GenesisTxID}, types.Address{}, nil)
+			}()
+		}
+
+		var conflicts int
+		for i := 0; i < 2; i++ {
+			err := <-errs
+			if errors.Is(err, ErrConflict) {
+				conflicts++
+			} else {
+				require.NoError(t, err)
+			}
+		}
+		require.Equal(t, 1, conflicts)
+	})
+}
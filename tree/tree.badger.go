@@ -304,13 +304,13 @@ func (tx *DBNode) Value(relKeypath Keypath, rng *Range) (_ interface{}, _ bool,
 
 	if rootNodeType == NodeTypeMap {
 		if rng != nil {
-			goParents[""] = make(map[string]interface{}, rng.Size())
+			goParents[""] = make(map[string]interface{}, rng.SizeForLength(length))
 		} else {
 			goParents[""] = make(map[string]interface{}, length)
 		}
 	} else if rootNodeType == NodeTypeSlice {
 		if rng != nil {
-			goParents[""] = make([]interface{}, rng.Size())
+			goParents[""] = make([]interface{}, rng.SizeForLength(length))
 			startIdx, _ = rng.IndicesForLength(length)
 		} else {
 			goParents[""] = make([]interface{}, length)
@@ -829,7 +829,7 @@ func (tx *DBNode) setRangeBytes(absKeypath Keypath, rng *Range, encodedVal []byt
 
 	startIdx, endIdx := rng.IndicesForLength(length)
 	oldVal := data
-	newLen := 2 + length - rng.Size() + uint64(len(spliceVal))
+	newLen := 2 + length - rng.SizeForLength(length) + uint64(len(spliceVal))
 	newVal := make([]byte, newLen)
 	newVal[0] = 'v'
 	if valueType == ValueTypeString {
@@ -857,7 +857,7 @@ func (tx *DBNode) setRangeSlice(absKeypath Keypath, rng *Range, encodedVal []byt
 
 	absKeypath = tx.addKeyPrefix(absKeypath)
 
-	newLen := oldLen - rng.Size() + uint64(len(spliceVal))
+	newLen := oldLen - rng.SizeForLength(oldLen) + uint64(len(spliceVal))
 	shrink := newLen < oldLen
 	startIdx, endIdx := rng.IndicesForLength(oldLen)
 
@@ -1231,7 +1231,7 @@ func (tx *DBNode) Delete(relKeypath Keypath, rng *Range) (err error) {
 		// Re-number the trailing entries if the root node is a slice
 		if rootNodeType == NodeTypeSlice && endIdx < length {
 			renumberRange := &Range{int64(endIdx), int64(length)}
-			delta := -int64(rng.Size())
+			delta := -int64(rng.SizeForLength(length))
 
 			err := tx.scanChildrenForward(NodeTypeSlice, relKeypath, renumberRange, length, true, func(absKeypath Keypath, item *badger.Item) error {
 				valueBuf, err := item.ValueCopy(nil)
@@ -1259,7 +1259,7 @@ func (tx *DBNode) Delete(relKeypath Keypath, rng *Range) (err error) {
 
 		// Set new length
 		if rootNodeType == NodeTypeSlice || rootNodeType == NodeTypeMap {
-			newLen := length - rng.Size()
+			newLen := length - rng.SizeForLength(length)
 			encoded, err := encodeNode(rootNodeType, ValueTypeInvalid, newLen, nil)
 			if err != nil {
 				return err
@@ -1342,13 +1342,13 @@ func (tx *DBNode) CopyToMemory(relKeypath Keypath, rng *Range) (n Node, err erro
 
 	if rootNodeType == NodeTypeMap {
 		if rng != nil {
-			mNode.contentLengths[""] = rng.Size()
+			mNode.contentLengths[""] = rng.SizeForLength(length)
 		} else {
 			mNode.contentLengths[""] = length
 		}
 	} else if rootNodeType == NodeTypeSlice {
 		if rng != nil {
-			mNode.contentLengths[""] = rng.Size()
+			mNode.contentLengths[""] = rng.SizeForLength(length)
 			startIdx, _ = rng.IndicesForLength(length)
 		} else {
 			mNode.contentLengths[""] = length
@@ -1663,7 +1663,7 @@ func (n *DBNode) scanChildrenForward(
 		if rng != nil {
 			if !rng.ValidForLength(length) {
 				return ErrInvalidRange
-			} else if rng.Size() == 0 {
+			} else if rng.SizeForLength(length) == 0 {
 				return nil
 			}
 			var startIdx uint64
@@ -1682,7 +1682,7 @@ func (n *DBNode) scanChildrenForward(
 		if rng != nil {
 			if !rng.ValidForLength(length) {
 				return ErrInvalidRange
-			} else if rng.Size() == 0 {
+			} else if rng.SizeForLength(length) == 0 {
 				return nil
 			}
 			startIdx, endIdx := rng.IndicesForLength(length)
@@ -2000,7 +2000,7 @@ func decodeGoValue(nodeType NodeType, valueType ValueType, length uint64, rng *R
 			if !rng.ValidForLength(length) {
 				return nil, errors.WithStack(ErrInvalidRange)
 			}
-			length = rng.Size()
+			length = rng.SizeForLength(length)
 		}
 		return make(map[string]interface{}), nil
 
@@ -2009,7 +2009,7 @@ func decodeGoValue(nodeType NodeType, valueType ValueType, length uint64, rng *R
 			if !rng.ValidForLength(length) {
 				return nil, errors.WithStack(ErrInvalidRange)
 			}
-			length = rng.Size()
+			length = rng.SizeForLength(length)
 		}
 		return make([]interface{}, length), nil
 
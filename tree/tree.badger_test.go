@@ -465,6 +465,12 @@ func TestVersionedDBTree_Set_Range_Slice(t *testing.T) {
 			S{testVal1, testVal5}},
 		{"end append", tree.Keypath("foo/slice"), &tree.Range{4, 4}, S{testVal5, testVal6, testVal7, testVal8},
 			S{testVal1, testVal2, testVal3, testVal4, testVal5, testVal6, testVal7, testVal8}},
+		{"open-ended", tree.Keypath("foo/slice"), &tree.Range{2, tree.RangeToEnd}, S{testVal5},
+			S{testVal1, testVal2, testVal5}},
+		{"whole", tree.Keypath("foo/slice"), &tree.Range{0, tree.RangeToEnd}, S{testVal5, testVal6},
+			S{testVal5, testVal6}},
+		{"negative", tree.Keypath("foo/slice"), &tree.Range{-1, 0}, S{testVal5, testVal6},
+			S{testVal1, testVal2, testVal3, testVal5, testVal6}},
 	}
 
 	for _, test := range tests {
@@ -1,6 +1,8 @@
 package tree
 
 import (
+	"math"
+
 	"github.com/pkg/errors"
 
 	"redwood.dev/types"
@@ -116,11 +118,29 @@ func (vt ValueType) String() string {
 	}
 }
 
+// Range describes the half-open span [Start, End) of a slice or string, so
+// {0, 0} is the empty span at the beginning.  A negative Start counts
+// from the end, in which case End must be <= 0 and is also relative to the
+// end (so {-1, 0} is the last element).  An End of RangeToEnd extends a
+// non-negative Start through the end, and a Start and End of RangeToEnd is
+// the empty span just past the end (see AppendRange).
 type Range struct {
 	Start int64
 	End   int64
 }
 
+// RangeToEnd is a sentinel End value meaning "through the end".
+const RangeToEnd = math.MaxInt64
+
+// AppendRange returns a Range that splices onto the end of a slice or string.
+func AppendRange() *Range {
+	return &Range{Start: RangeToEnd, End: RangeToEnd}
+}
+
+func (rng *Range) IsAppend() bool {
+	return rng != nil && rng.Start == RangeToEnd && rng.End == RangeToEnd
+}
+
 func (rng *Range) Copy() *Range {
 	if rng == nil {
 		return nil
@@ -138,6 +158,9 @@ func (rng *Range) Valid() bool {
 	return true
 }
 
+// Size returns the number of elements covered by the range.  It's only
+// meaningful for ranges that don't end at RangeToEnd; use SizeForLength for
+// those.
 func (rng *Range) Size() uint64 {
 	if rng.Start < 0 {
 		return uint64(-(rng.Start - rng.End))
@@ -145,16 +168,29 @@ func (rng *Range) Size() uint64 {
 	return uint64(rng.End - rng.Start)
 }
 
+func (rng *Range) SizeForLength(length uint64) uint64 {
+	startIdx, endIdx := rng.IndicesForLength(length)
+	return endIdx - startIdx
+}
+
 func (rng *Range) ValidForLength(length uint64) bool {
-	if rng.Start < 0 {
+	if rng.IsAppend() {
+		return true
+	} else if rng.Start < 0 {
 		return uint64(-rng.Start) <= length
+	} else if rng.End == RangeToEnd {
+		return uint64(rng.Start) <= length
 	}
 	return uint64(rng.End) <= length
 }
 
 func (rng *Range) IndicesForLength(length uint64) (uint64, uint64) {
-	if rng.Start < 0 {
+	if rng.IsAppend() {
+		return length, length
+	} else if rng.Start < 0 {
 		return uint64(int64(length) + rng.Start), uint64(int64(length) + rng.End)
+	} else if rng.End == RangeToEnd {
+		return uint64(rng.Start), length
 	}
 	return uint64(rng.Start), uint64(rng.End)
 }
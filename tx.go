@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	proto "github.com/golang/protobuf/proto"
 	any "github.com/golang/protobuf/ptypes/any"
+	"github.com/pkg/errors"
 
+	"redwood.dev/crypto"
 	"redwood.dev/pb"
 	"redwood.dev/tree"
 	"redwood.dev/types"
@@ -38,6 +42,11 @@ type Tx struct {
 
 	Status TxStatus   `json:"status"`
 	hash   types.Hash `json:"-"`
+
+	// exportedLeaf is set on the txs that ExportAllTxs streams if they're
+	// leaves, so that ImportTxs can restore the leaves exactly.  Copy doesn't
+	// carry it over.
+	exportedLeaf bool
 }
 
 type TxStatus string
@@ -49,6 +58,39 @@ const (
 	TxStatusValid     TxStatus = "valid"
 )
 
+// NewGenesisTx builds the first tx of a new state URI, which sets the entire
+// state to initialState.  By convention, a state URI's genesis tx is the only
+// tx with no parents, and its ID is always GenesisTxID.  Every later tx must
+// name at least one parent.  The returned tx is unsigned; From and Sig are
+// left to the caller.
+func NewGenesisTx(stateURI string, initialState interface{}) (*Tx, error) {
+	_, err := types.ParseStateURI(stateURI)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round-trip through JSON so that the patch holds the same plain maps and
+	// slices that it will after being sent over the wire
+	bs, err := json.Marshal(initialState)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode initial state")
+	}
+	var val interface{}
+	err = json.Unmarshal(bs, &val)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't encode initial state")
+	}
+
+	return &Tx{
+		ID:       GenesisTxID,
+		StateURI: stateURI,
+		Patches:  []Patch{{Keypath: nil, Val: val}},
+	}, nil
+}
+
+// Hash is what a tx's sender signs.  It covers, in order: the ID, the parents
+// in the order given, the state URI, each patch in its wire form (see
+// Patch.String), and the recipients.
 func (tx Tx) Hash() types.Hash {
 	if tx.hash == types.EmptyHash {
 		var txBytes []byte
@@ -79,6 +121,21 @@ func (tx Tx) IsPrivate() bool {
 	return len(tx.Recipients) > 0
 }
 
+// TouchesKeypath returns true if any of the tx's patches could change the
+// state at or below keypath, which includes patches to keypath's ancestors.
+// An empty keypath is touched by every tx.
+func (tx Tx) TouchesKeypath(keypath tree.Keypath) bool {
+	if len(keypath) == 0 || keypath.Equals(tree.KeypathSeparator) {
+		return true
+	}
+	for _, patch := range tx.Patches {
+		if patch.Keypath.StartsWith(keypath) || keypath.StartsWith(patch.Keypath) {
+			return true
+		}
+	}
+	return false
+}
+
 func (tx *Tx) Copy() *Tx {
 	var parents []types.ID
 	if len(tx.Parents) > 0 {
@@ -147,6 +204,160 @@ func (tx Tx) PrivateRootKey() string {
 	return PrivateRootKeyForRecipients(tx.Recipients)
 }
 
+// VerifyTx checks that tx.Sig is a valid signature over tx.Hash() by the
+// sender named in tx.From, and returns the signer's address.  Any failure
+// is reported as ErrInvalidSignature.
+func VerifyTx(tx *Tx) (types.Address, error) {
+	if len(tx.Sig) == 0 {
+		return types.Address{}, errors.Wrap(ErrInvalidSignature, "tx is unsigned")
+	}
+
+	hash := tx.Hash()
+	sigPubKey, err := crypto.RecoverSigningPubkey(hash, tx.Sig)
+	if err != nil {
+		return types.Address{}, errors.Wrap(ErrInvalidSignature, err.Error())
+	} else if !sigPubKey.VerifySignature(hash, tx.Sig) {
+		return types.Address{}, errors.WithStack(ErrInvalidSignature)
+	} else if sigPubKey.Address() != tx.From {
+		return types.Address{}, errors.Wrapf(ErrInvalidSignature, "address doesn't match (expected=%v received=%v)", tx.From.Hex(), sigPubKey.Address().Hex())
+	}
+	return sigPubKey.Address(), nil
+}
+
+// txJSON is the wire format of a Tx.  IDs, addresses, and the signature are
+// hex strings, patches are in the text form accepted by ParsePatch, and the
+// attachment is base64 (encoding/json's usual encoding for []byte).  Nil and
+// empty slices are kept distinct so that a decoded tx re-encodes to the same
+// bytes.
+type txJSON struct {
+	ID         string   `json:"id"`
+	Parents    []string `json:"parents"`
+	Children   []string `json:"children"`
+	From       string   `json:"from"`
+	Sig        string   `json:"sig,omitempty"`
+	StateURI   string   `json:"stateURI"`
+	Patches    []string `json:"patches"`
+	Recipients []string `json:"recipients,omitempty"`
+	Checkpoint bool     `json:"checkpoint"`
+	Attachment []byte   `json:"attachment,omitempty"`
+	Status     TxStatus `json:"status"`
+}
+
+func (tx Tx) MarshalJSON() ([]byte, error) {
+	var patches []string
+	if tx.Patches != nil {
+		patches = make([]string, len(tx.Patches))
+		for i, patch := range tx.Patches {
+			patches[i] = patch.String()
+		}
+	}
+
+	var recipients []string
+	if tx.Recipients != nil {
+		recipients = make([]string, len(tx.Recipients))
+		for i, recipient := range tx.Recipients {
+			recipients[i] = recipient.Hex()
+		}
+	}
+
+	return json.Marshal(txJSON{
+		ID:         tx.ID.Hex(),
+		Parents:    idsToHex(tx.Parents),
+		Children:   idsToHex(tx.Children),
+		From:       tx.From.Hex(),
+		Sig:        tx.Sig.Hex(),
+		StateURI:   tx.StateURI,
+		Patches:    patches,
+		Recipients: recipients,
+		Checkpoint: tx.Checkpoint,
+		Attachment: tx.Attachment,
+		Status:     tx.Status,
+	})
+}
+
+func (tx *Tx) UnmarshalJSON(bs []byte) error {
+	var wire txJSON
+	err := json.Unmarshal(bs, &wire)
+	if err != nil {
+		return err
+	}
+
+	var decoded Tx
+	decoded.ID, err = types.IDFromHex(wire.ID)
+	if err != nil {
+		return errors.Wrap(err, "bad tx id")
+	}
+	decoded.Parents, err = idsFromHex(wire.Parents)
+	if err != nil {
+		return errors.Wrap(err, "bad tx parent")
+	}
+	decoded.Children, err = idsFromHex(wire.Children)
+	if err != nil {
+		return errors.Wrap(err, "bad tx child")
+	}
+	decoded.From, err = types.AddressFromHex(wire.From)
+	if err != nil {
+		return errors.Wrap(err, "bad tx sender")
+	}
+	if wire.Sig != "" {
+		decoded.Sig, err = types.SignatureFromHex(wire.Sig)
+		if err != nil {
+			return errors.Wrap(err, "bad tx signature")
+		}
+	}
+	if wire.Patches != nil {
+		decoded.Patches = make([]Patch, len(wire.Patches))
+		for i, patchStr := range wire.Patches {
+			decoded.Patches[i], err = ParsePatch([]byte(patchStr))
+			if err != nil {
+				return errors.Wrapf(err, "bad tx patch %v", i)
+			}
+		}
+	}
+	if wire.Recipients != nil {
+		decoded.Recipients = make([]types.Address, len(wire.Recipients))
+		for i, recipient := range wire.Recipients {
+			decoded.Recipients[i], err = types.AddressFromHex(recipient)
+			if err != nil {
+				return errors.Wrap(err, "bad tx recipient")
+			}
+		}
+	}
+	decoded.StateURI = wire.StateURI
+	decoded.Checkpoint = wire.Checkpoint
+	decoded.Attachment = wire.Attachment
+	decoded.Status = wire.Status
+
+	*tx = decoded
+	return nil
+}
+
+func idsToHex(ids []types.ID) []string {
+	if ids == nil {
+		return nil
+	}
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.Hex()
+	}
+	return strs
+}
+
+func idsFromHex(strs []string) ([]types.ID, error) {
+	if strs == nil {
+		return nil, nil
+	}
+	ids := make([]types.ID, len(strs))
+	for i, str := range strs {
+		id, err := types.IDFromHex(str)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
 func (tx Tx) MarshalProto() ([]byte, error) {
 	parents := make([][]byte, len(tx.Parents))
 	for i, parent := range tx.Parents {
@@ -165,7 +376,7 @@ func (tx Tx) MarshalProto() ([]byte, error) {
 			rng = &pb.Range{Start: patch.Range.Start, End: patch.Range.End}
 		}
 
-		valueBytes, err := json.Marshal(patch.Val)
+		valueBytes, err := canonicalJSON(patch.Val)
 		if err != nil {
 			return nil, err
 		}
@@ -229,7 +440,8 @@ func (tx *Tx) UnmarshalProto(bs []byte) error {
 				End:   patch.Range.End,
 			}
 		}
-		err := json.Unmarshal(patch.Value.Value, &tx.Patches[i].Val)
+		var err error
+		tx.Patches[i].Val, err = decodePatchValue(patch.Value.Value)
 		if err != nil {
 			return err
 		}
@@ -257,12 +469,25 @@ type Range struct {
 	End   int64
 }
 
+// String serializes the patch in the grammar that ParsePatch understands.
+// The value is encoded canonically (see canonicalJSON): object keys are
+// sorted, so a struct and the map it decodes into serialize identically, and
+// numbers are written exactly.  []byte values are written as b64"..." tokens
+// rather than as strings, so they come back out of ParsePatch as []byte.
 func (p Patch) String() string {
 	parts := p.Keypath.Parts()
 	var keypathParts []string
 	for _, key := range parts {
-		if bytes.IndexByte(key, '.') > -1 {
-			keypathParts = append(keypathParts, `["`+string(key)+`"]`)
+		// Keys that are empty or contain any of the patch grammar's delimiters
+		// have to be bracketed, or they won't survive ParsePatch.  Backslashes
+		// and the quote are escaped inside the brackets (see parseBracketKey).
+		if len(key) == 0 || bytes.ContainsAny(key, ".[ =+") {
+			quote := `"`
+			if bytes.Contains(key, []byte(`"`)) && !bytes.Contains(key, []byte(`'`)) {
+				quote = `'`
+			}
+			escaped := strings.NewReplacer(`\`, `\\`, quote, `\`+quote).Replace(string(key))
+			keypathParts = append(keypathParts, "["+quote+escaped+quote+"]")
 		} else {
 			keypathParts = append(keypathParts, KeypathSeparator+string(key))
 		}
@@ -270,10 +495,16 @@ func (p Patch) String() string {
 	s := strings.Join(keypathParts, "")
 
 	if p.Range != nil {
-		s += fmt.Sprintf("[%v:%v]", p.Range.Start, p.Range.End)
+		if p.Range.IsAppend() {
+			s += "[-]"
+		} else if p.Range.End == tree.RangeToEnd {
+			s += fmt.Sprintf("[%v:]", p.Range.Start)
+		} else {
+			s += fmt.Sprintf("[%v:%v]", p.Range.Start, p.Range.End)
+		}
 	}
 
-	val, err := json.Marshal(p.Val)
+	val, err := canonicalJSON(p.Val)
 	if err != nil {
 		panic(err)
 	}
@@ -291,6 +522,240 @@ func (p Patch) Copy() Patch {
 	}
 }
 
+// ApplyPatch applies a patch to a tree of plain JS values (maps, slices,
+// strings, etc.) and returns the new state.  Maps and slices in state may be
+// modified in place, but the result can be a different value than state (for
+// instance, when the patch replaces the root), so always use the result.
+//
+// Patches mean the same thing here as they do to the dumb resolver: a nil Val
+// deletes, an append range pushes Val onto the end of a slice or string, and
+// any other range splices Val (a slice, or a string) over that span.
+//
+// String ranges are in bytes, not runes, as they are in tree.Node, but a range
+// whose start or end falls inside a multibyte UTF-8 sequence is rejected with
+// ErrInvalidRange so that a splice can never leave a string with a broken
+// character in it.  A []byte value is treated as binary: ranges over it are
+// in bytes with no such restriction, and Val may be a []byte or a string.
+// A []byte Val survives the wire as a []byte (see Patch.String), so peers
+// splice the same bytes.
+//
+// Keypath parts that land on a slice are parsed as indices into it, so
+// `.items.2.tags[0:1]` splices the tags of the third item.
+func ApplyPatch(state interface{}, patch Patch) (interface{}, error) {
+	var keypath []string
+	for _, part := range patch.Keypath.Parts() {
+		keypath = append(keypath, string(part))
+	}
+
+	if patch.Range != nil {
+		existing, exists := getValue(state, keypath)
+		if (!exists || existing == nil) && patch.Range.IsAppend() {
+			return replaceValueAtKeypath(state, keypath, []interface{}{patch.Val})
+		} else if !exists {
+			return nil, errors.Wrapf(tree.ErrInvalidRange, "nothing at keypath %v", patch.Keypath)
+		}
+
+		spliced, err := spliceJSValue(existing, patch.Range, patch.Val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "keypath %v", patch.Keypath)
+		}
+		return replaceValueAtKeypath(state, keypath, spliced)
+
+	} else if patch.Val == nil {
+		if len(keypath) == 0 {
+			return nil, nil
+		}
+		deleteValueAtKeypath(state, keypath)
+		return state, nil
+	}
+	return replaceValueAtKeypath(state, keypath, patch.Val)
+}
+
+// ValidatePatch checks whether ApplyPatch would be able to apply patch to
+// state (that the keypath can be resolved, that ranges are in bounds, and
+// that the types involved are compatible) without modifying state.
+func ValidatePatch(state interface{}, patch Patch) error {
+	var keypath []string
+	for _, part := range patch.Keypath.Parts() {
+		keypath = append(keypath, string(part))
+	}
+
+	if patch.Range != nil {
+		existing, exists := getValue(state, keypath)
+		if (!exists || existing == nil) && patch.Range.IsAppend() {
+			return validateSetValueAtKeypath(state, keypath)
+		} else if !exists {
+			return errors.Wrapf(tree.ErrInvalidRange, "nothing at keypath %v", patch.Keypath)
+		}
+
+		err := validateSplice(existing, patch.Range, patch.Val)
+		if err != nil {
+			return errors.Wrapf(err, "keypath %v", patch.Keypath)
+		}
+		return nil
+
+	} else if patch.Val == nil {
+		// Deleting something that isn't there is a no-op
+		return nil
+	}
+	return validateSetValueAtKeypath(state, keypath)
+}
+
+// validateSetValueAtKeypath checks whether replaceValueAtKeypath would
+// succeed.  It walks the same path that setValueAtKeypath does, stopping as
+// soon as the rest of the path would be created from scratch.
+func validateSetValueAtKeypath(state interface{}, keypath []string) error {
+	if len(keypath) == 0 || state == nil {
+		return nil
+	}
+
+	cur := state
+	for i, key := range keypath {
+		switch parent := cur.(type) {
+		case map[string]interface{}:
+			child, exists := parent[key]
+			if !exists || i == len(keypath)-1 {
+				return nil
+			}
+			cur = child
+
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 {
+				return errors.Errorf("bad slice index '%v'", key)
+			} else if idx >= len(parent) {
+				if i == 0 {
+					return errors.New("cannot grow top-level slice")
+				}
+				return nil
+			} else if i == len(keypath)-1 || parent[idx] == nil {
+				return nil
+			}
+			cur = parent[idx]
+
+		default:
+			return errors.Errorf("can't set key '%v' on a %T", key, cur)
+		}
+	}
+	return nil
+}
+
+func replaceValueAtKeypath(state interface{}, keypath []string, val interface{}) (interface{}, error) {
+	if len(keypath) == 0 {
+		return val, nil
+	} else if state == nil {
+		state = make(map[string]interface{})
+	}
+	err := setValueAtKeypath(state, keypath, val, true)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// validateSplice checks whether spliceJSValue would succeed.
+func validateSplice(existing interface{}, rng *tree.Range, val interface{}) error {
+	if !rng.Valid() {
+		return errors.WithStack(tree.ErrInvalidRange)
+	}
+
+	switch existing := existing.(type) {
+	case string:
+		switch val.(type) {
+		case string, nil:
+		default:
+			return errors.Errorf("can't splice a %T into a string", val)
+		}
+		if !rng.ValidForLength(uint64(len(existing))) {
+			return errors.Wrapf(tree.ErrInvalidRange, "%v is out of bounds for a string of length %v", *rng, len(existing))
+		}
+		start, end := rng.IndicesForLength(uint64(len(existing)))
+		if !isRuneBoundary(existing, start) || !isRuneBoundary(existing, end) {
+			return errors.Wrapf(tree.ErrInvalidRange, "%v splits a multibyte character", *rng)
+		}
+		return nil
+
+	case []byte:
+		switch val.(type) {
+		case []byte, string, nil:
+		default:
+			return errors.Errorf("can't splice a %T into a byte slice", val)
+		}
+		if !rng.ValidForLength(uint64(len(existing))) {
+			return errors.Wrapf(tree.ErrInvalidRange, "%v is out of bounds for a byte slice of length %v", *rng, len(existing))
+		}
+		return nil
+
+	case []interface{}:
+		if !rng.IsAppend() {
+			switch val.(type) {
+			case []interface{}, nil:
+			default:
+				return errors.Errorf("can't splice a %T into a slice", val)
+			}
+		}
+		if !rng.ValidForLength(uint64(len(existing))) {
+			return errors.Wrapf(tree.ErrInvalidRange, "%v is out of bounds for a slice of length %v", *rng, len(existing))
+		}
+		return nil
+
+	default:
+		return errors.WithStack(tree.ErrRangeOverNonSlice)
+	}
+}
+
+// isRuneBoundary reports whether the byte offset idx into s is not in the
+// middle of a UTF-8 sequence.
+func isRuneBoundary(s string, idx uint64) bool {
+	return idx >= uint64(len(s)) || utf8.RuneStart(s[idx])
+}
+
+func spliceJSValue(existing interface{}, rng *tree.Range, val interface{}) (interface{}, error) {
+	err := validateSplice(existing, rng, val)
+	if err != nil {
+		return nil, err
+	}
+
+	switch existing := existing.(type) {
+	case string:
+		spliceVal, _ := val.(string)
+		start, end := rng.IndicesForLength(uint64(len(existing)))
+		return existing[:start] + spliceVal + existing[end:], nil
+
+	case []byte:
+		var spliceVal []byte
+		switch val := val.(type) {
+		case []byte:
+			spliceVal = val
+		case string:
+			spliceVal = []byte(val)
+		}
+		start, end := rng.IndicesForLength(uint64(len(existing)))
+		spliced := make([]byte, 0, uint64(len(existing))-(end-start)+uint64(len(spliceVal)))
+		spliced = append(spliced, existing[:start]...)
+		spliced = append(spliced, spliceVal...)
+		spliced = append(spliced, existing[end:]...)
+		return spliced, nil
+
+	case []interface{}:
+		var spliceVal []interface{}
+		if rng.IsAppend() {
+			spliceVal = []interface{}{val}
+		} else {
+			spliceVal, _ = val.([]interface{})
+		}
+		start, end := rng.IndicesForLength(uint64(len(existing)))
+		spliced := make([]interface{}, 0, uint64(len(existing))-(end-start)+uint64(len(spliceVal)))
+		spliced = append(spliced, existing[:start]...)
+		spliced = append(spliced, spliceVal...)
+		spliced = append(spliced, existing[end:]...)
+		return spliced, nil
+
+	default:
+		return nil, errors.WithStack(tree.ErrRangeOverNonSlice)
+	}
+}
+
 func (p *Patch) UnmarshalJSON(bs []byte) error {
 	var err error
 	var s string
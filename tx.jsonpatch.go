@@ -0,0 +1,167 @@
+package redwood
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"redwood.dev/tree"
+)
+
+// ErrUnsupportedJSONPatch is returned when a patch can't be translated to or
+// from an RFC 6902 JSON Patch operation.
+var ErrUnsupportedJSONPatch = errors.New("patch can't be represented as a JSON Patch operation")
+
+// PatchFromJSONPatch translates a single RFC 6902 JSON Patch operation into a
+// Patch.  Only the operations that redwood's patches can express are
+// supported:
+//
+//   - "add" to a path ending in "-" appends to the array at the parent path
+//   - "add" to a path ending in a number inserts into the array at the parent
+//     path (a numeric final segment is always taken to be an array index)
+//   - any other "add", and "replace", set the value at the path
+//   - "remove" at a path ending in a number removes that element from the
+//     array at the parent path; any other "remove" deletes the value
+//
+// "move", "copy", and "test" aren't supported, and neither is adding or
+// replacing with null, since a patch with a nil Val is a delete.
+func PatchFromJSONPatch(op map[string]interface{}) (Patch, error) {
+	opName, _ := op["op"].(string)
+	pathStr, ok := op["path"].(string)
+	if !ok {
+		return Patch{}, errors.Wrap(ErrUnsupportedJSONPatch, "missing path")
+	}
+	parts, err := parseJSONPointer(pathStr)
+	if err != nil {
+		return Patch{}, err
+	}
+
+	switch opName {
+	case "add", "replace":
+		val, exists := op["value"]
+		if !exists {
+			return Patch{}, errors.Wrapf(ErrUnsupportedJSONPatch, "%v without a value", opName)
+		} else if val == nil {
+			return Patch{}, errors.Wrapf(ErrUnsupportedJSONPatch, "%v with a null value", opName)
+		}
+		val = DeepCopyJSValue(val)
+
+		if opName == "add" && len(parts) > 0 {
+			parent, last := jsonPointerKeypath(parts[:len(parts)-1]), parts[len(parts)-1]
+			if last == "-" {
+				return Patch{Keypath: parent, Range: tree.AppendRange(), Val: val}, nil
+			} else if idx, isIndex := parseJSONPointerIndex(last); isIndex {
+				return Patch{Keypath: parent, Range: &tree.Range{Start: idx, End: idx}, Val: []interface{}{val}}, nil
+			}
+		}
+		return Patch{Keypath: jsonPointerKeypath(parts), Val: val}, nil
+
+	case "remove":
+		if len(parts) > 0 {
+			parent, last := jsonPointerKeypath(parts[:len(parts)-1]), parts[len(parts)-1]
+			if idx, isIndex := parseJSONPointerIndex(last); isIndex {
+				return Patch{Keypath: parent, Range: &tree.Range{Start: idx, End: idx + 1}}, nil
+			}
+		}
+		return Patch{Keypath: jsonPointerKeypath(parts)}, nil
+
+	default:
+		return Patch{}, errors.Wrapf(ErrUnsupportedJSONPatch, "unsupported op '%v'", opName)
+	}
+}
+
+// ToJSONPatch is the inverse of PatchFromJSONPatch.  Sets become "add"
+// operations (which, for an object member, mean the same thing), except that
+// a set whose final keypath part is a number becomes a "replace", since it
+// replaces an array element.  The only ranges that can be represented are
+// appends, single-element inserts ([n:n] = [val]), and single-element deletes
+// ([n:n+1] = null), all with non-negative indices.
+func (p Patch) ToJSONPatch() (map[string]interface{}, error) {
+	path := jsonPointerFromKeypath(p.Keypath)
+
+	if p.Range == nil {
+		if p.Val == nil {
+			return map[string]interface{}{"op": "remove", "path": path}, nil
+		}
+		op := "add"
+		if _, isIndex := parseJSONPointerIndex(string(p.Keypath.Part(-1))); isIndex {
+			op = "replace"
+		}
+		return map[string]interface{}{"op": op, "path": path, "value": DeepCopyJSValue(p.Val)}, nil
+	}
+
+	rng := *p.Range
+	if rng.IsAppend() && p.Val != nil {
+		return map[string]interface{}{"op": "add", "path": path + "/-", "value": DeepCopyJSValue(p.Val)}, nil
+
+	} else if rng.Start >= 0 && rng.End >= 0 {
+		indexPath := path + "/" + strconv.FormatInt(rng.Start, 10)
+		vals, isSlice := p.Val.([]interface{})
+		if rng.Start == rng.End && isSlice && len(vals) == 1 && vals[0] != nil {
+			return map[string]interface{}{"op": "add", "path": indexPath, "value": DeepCopyJSValue(vals[0])}, nil
+		} else if rng.End == rng.Start+1 && p.Val == nil {
+			return map[string]interface{}{"op": "remove", "path": indexPath}, nil
+		}
+	}
+	return nil, errors.Wrapf(ErrUnsupportedJSONPatch, "range %v", rng)
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its unescaped
+// reference tokens.  Empty tokens and tokens containing a '/' can't be keypath
+// parts.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	} else if pointer[0] != '/' {
+		return nil, errors.Wrapf(ErrUnsupportedJSONPatch, "bad path '%v'", pointer)
+	}
+
+	parts := strings.Split(pointer[1:], "/")
+	for i, part := range parts {
+		part = strings.Replace(part, "~1", "/", -1)
+		part = strings.Replace(part, "~0", "~", -1)
+		if part == "" {
+			return nil, errors.Wrapf(ErrUnsupportedJSONPatch, "path '%v' has an empty key", pointer)
+		} else if strings.Contains(part, "/") {
+			return nil, errors.Wrapf(ErrUnsupportedJSONPatch, "path '%v' has a key containing '/'", pointer)
+		}
+		parts[i] = part
+	}
+	return parts, nil
+}
+
+func jsonPointerKeypath(parts []string) tree.Keypath {
+	var keypath tree.Keypath
+	for _, part := range parts {
+		keypath = keypath.Pushs(part)
+	}
+	return keypath
+}
+
+func jsonPointerFromKeypath(keypath tree.Keypath) string {
+	var sb strings.Builder
+	for _, part := range keypath.PartStrings() {
+		sb.WriteString("/")
+		sb.WriteString(strings.Replace(part, "~", "~0", -1))
+	}
+	return sb.String()
+}
+
+// parseJSONPointerIndex parses an array index as RFC 6901 spells them: a
+// non-negative decimal integer with no leading zeros.
+func parseJSONPointerIndex(part string) (int64, bool) {
+	if part == "" || (len(part) > 1 && part[0] == '0') {
+		return 0, false
+	}
+	for _, r := range part {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+	}
+	idx, err := strconv.ParseInt(part, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return idx, true
+}
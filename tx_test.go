@@ -0,0 +1,824 @@
+package redwood_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"redwood.dev"
+	"redwood.dev/crypto"
+	"redwood.dev/testutils"
+	"redwood.dev/tree"
+	"redwood.dev/types"
+)
+
+func TestVerifyTx(t *testing.T) {
+	signedTx := func(t *testing.T, sigkeys *crypto.SigningKeypair) *redwood.Tx {
+		t.Helper()
+		tx := &redwood.Tx{
+			ID:       types.RandomID(),
+			Parents:  []types.ID{redwood.GenesisTxID},
+			From:     sigkeys.Address(),
+			StateURI: "foo.bar/blah",
+			Patches: []redwood.Patch{
+				{Keypath: tree.Keypath("text"), Val: "hello"},
+			},
+		}
+		sig, err := sigkeys.SignHash(tx.Hash())
+		require.NoError(t, err)
+		tx.Sig = sig
+		return tx
+	}
+
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+	otherSigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	t.Run("correctly signed", func(t *testing.T) {
+		tx := signedTx(t, sigkeys)
+
+		addr, err := redwood.VerifyTx(tx)
+		require.NoError(t, err)
+		require.Equal(t, sigkeys.Address(), addr)
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		tx := signedTx(t, sigkeys)
+		tx.Patches[0].Val = "goodbye"
+
+		_, err := redwood.VerifyTx(tx)
+		require.True(t, errors.Is(err, redwood.ErrInvalidSignature))
+	})
+
+	t.Run("swapped signature", func(t *testing.T) {
+		tx := signedTx(t, sigkeys)
+		otherTx := signedTx(t, otherSigkeys)
+		tx.Sig = otherTx.Sig
+
+		_, err := redwood.VerifyTx(tx)
+		require.True(t, errors.Is(err, redwood.ErrInvalidSignature))
+	})
+
+	t.Run("signed by someone other than the sender", func(t *testing.T) {
+		tx := signedTx(t, sigkeys)
+		tx.From = otherSigkeys.Address()
+
+		_, err := redwood.VerifyTx(tx)
+		require.True(t, errors.Is(err, redwood.ErrInvalidSignature))
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		tx := signedTx(t, sigkeys)
+		tx.Sig = nil
+
+		_, err := redwood.VerifyTx(tx)
+		require.True(t, errors.Is(err, redwood.ErrInvalidSignature))
+	})
+}
+
+func TestTx_JSONRoundTrip(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+	recipient, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	tx := redwood.Tx{
+		ID:       types.RandomID(),
+		Parents:  []types.ID{redwood.GenesisTxID, types.RandomID()},
+		Children: []types.ID{},
+		From:     sigkeys.Address(),
+		StateURI: "foo.bar/blah",
+		Patches: []redwood.Patch{
+			{Keypath: tree.Keypath("text/value"), Range: &tree.Range{Start: 3, End: 5}, Val: "xyzzy"},
+			{Keypath: tree.Keypath("list"), Range: tree.AppendRange(), Val: 123.0},
+			{Keypath: tree.Keypath("has.dot/has space/has=equals/has[bracket/has+=append"), Val: true},
+			{Keypath: tree.Keypath(`has"quote`), Val: nil},
+			{Keypath: nil, Val: map[string]interface{}{"root": []interface{}{"a", "b"}}},
+		},
+		Recipients: []types.Address{recipient.Address()},
+		Checkpoint: true,
+		Attachment: []byte{0x00, 0xff, 0x10},
+		Status:     redwood.TxStatusValid,
+	}
+	sig, err := sigkeys.SignHash(tx.Hash())
+	require.NoError(t, err)
+	tx.Sig = sig
+
+	bs, err := json.Marshal(tx)
+	require.NoError(t, err)
+
+	var decoded redwood.Tx
+	err = json.Unmarshal(bs, &decoded)
+	require.NoError(t, err)
+
+	require.Equal(t, tx.ID, decoded.ID)
+	require.Equal(t, tx.Parents, decoded.Parents)
+	require.Equal(t, tx.Children, decoded.Children)
+	require.Equal(t, tx.From, decoded.From)
+	require.Equal(t, tx.Sig, decoded.Sig)
+	require.Equal(t, tx.StateURI, decoded.StateURI)
+	require.Equal(t, tx.Patches, decoded.Patches)
+	require.Equal(t, tx.Recipients, decoded.Recipients)
+	require.Equal(t, tx.Checkpoint, decoded.Checkpoint)
+	require.Equal(t, tx.Attachment, decoded.Attachment)
+	require.Equal(t, tx.Status, decoded.Status)
+	require.Equal(t, tx.Hash(), decoded.Hash())
+
+	bs2, err := json.Marshal(decoded)
+	require.NoError(t, err)
+	require.Equal(t, string(bs), string(bs2))
+
+	_, err = redwood.VerifyTx(&decoded)
+	require.NoError(t, err)
+}
+
+func TestTx_HashIsCanonical(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+	recipient1, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+	recipient2, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	type M = map[string]interface{}
+	type profile struct {
+		Zeta  string  `json:"zeta"`
+		Alpha float64 `json:"alpha"`
+		Inner struct {
+			Y []int `json:"y"`
+			X bool  `json:"x"`
+		} `json:"inner"`
+	}
+
+	txID := types.RandomID()
+	parent1, parent2 := types.RandomID(), types.RandomID()
+
+	// Built in Go, with a struct value...
+	var val profile
+	val.Zeta = "z"
+	val.Alpha = 1
+	val.Inner.Y = []int{1, 2}
+	val.Inner.X = true
+	tx1 := &redwood.Tx{
+		ID:         txID,
+		Parents:    []types.ID{parent1, parent2},
+		From:       sigkeys.Address(),
+		StateURI:   "foo.bar/blah",
+		Patches:    []redwood.Patch{{Keypath: tree.Keypath("profile"), Val: val}},
+		Recipients: []types.Address{recipient1.Address(), recipient2.Address()},
+	}
+
+	// ...and as another node might see it, with a map value
+	tx2 := &redwood.Tx{
+		ID:       txID,
+		Parents:  []types.ID{parent1, parent2},
+		From:     sigkeys.Address(),
+		StateURI: "foo.bar/blah",
+		Patches: []redwood.Patch{{Keypath: tree.Keypath("profile"), Val: M{
+			"inner": M{"x": true, "y": []interface{}{1.0, 2.0}},
+			"alpha": 1.0,
+			"zeta":  "z",
+		}}},
+		Recipients: []types.Address{recipient1.Address(), recipient2.Address()},
+	}
+	require.Equal(t, tx1.Hash(), tx2.Hash())
+	require.Equal(t, tx1.Patches[0].String(), tx2.Patches[0].String())
+
+	// A signature over one verifies against the other, including after the
+	// trip over the wire
+	sig, err := sigkeys.SignHash(tx1.Hash())
+	require.NoError(t, err)
+	tx2.Sig = sig
+	_, err = redwood.VerifyTx(tx2)
+	require.NoError(t, err)
+
+	tx1.Sig = sig
+	bs, err := json.Marshal(tx1)
+	require.NoError(t, err)
+	var decoded redwood.Tx
+	require.NoError(t, json.Unmarshal(bs, &decoded))
+	require.Equal(t, tx1.Hash(), decoded.Hash())
+	_, err = redwood.VerifyTx(&decoded)
+	require.NoError(t, err)
+
+	// Actual differences still change the hash
+	tx2.Patches[0].Val.(M)["alpha"] = 2.0
+	require.NotEqual(t, tx1.Hash(), tx2.Hash())
+}
+
+func TestTx_HashIsUnambiguous(t *testing.T) {
+	txID := types.RandomID()
+	hashOf := func(val interface{}) types.Hash {
+		tx := redwood.Tx{ID: txID, StateURI: "foo.bar/blah", Patches: []redwood.Patch{{Keypath: tree.Keypath("x"), Val: val}}}
+		return tx.Hash()
+	}
+
+	// Integers beyond float64's precision stay distinct, on the wire too
+	require.NotEqual(t, hashOf(int64(9007199254740993)), hashOf(int64(9007199254740992)))
+	require.Equal(t, `.x = 9007199254740993`, redwood.Patch{Keypath: tree.Keypath("x"), Val: int64(9007199254740993)}.String())
+
+	// Bytes don't hash like their base64 encoding
+	require.NotEqual(t, hashOf([]byte("hi")), hashOf("aGk="))
+	require.NotEqual(t, hashOf(map[string]interface{}{"a": []byte("hi")}), hashOf(map[string]interface{}{"a": "aGk="}))
+}
+
+func TestTx_BytesVerifyAfterTheWire(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	tx := redwood.Tx{
+		ID:       types.RandomID(),
+		Parents:  []types.ID{redwood.GenesisTxID},
+		From:     sigkeys.Address(),
+		StateURI: "foo.bar/blah",
+		Patches: []redwood.Patch{
+			{Keypath: tree.Keypath("blob"), Val: []byte("hi")},
+			{Keypath: tree.Keypath("nested"), Val: map[string]interface{}{"a": []interface{}{[]byte{0x00, 0xff}}}},
+		},
+	}
+	sig, err := sigkeys.SignHash(tx.Hash())
+	require.NoError(t, err)
+	tx.Sig = sig
+
+	bs, err := json.Marshal(tx)
+	require.NoError(t, err)
+	var fromJSON redwood.Tx
+	require.NoError(t, json.Unmarshal(bs, &fromJSON))
+	_, err = redwood.VerifyTx(&fromJSON)
+	require.NoError(t, err)
+
+	bs, err = tx.MarshalProto()
+	require.NoError(t, err)
+	var fromProto redwood.Tx
+	require.NoError(t, fromProto.UnmarshalProto(bs))
+	_, err = redwood.VerifyTx(&fromProto)
+	require.NoError(t, err)
+}
+
+func TestTx_HashLayout(t *testing.T) {
+	type M = map[string]interface{}
+
+	// A tx with plain JSON values hashes its fields in order, with each
+	// patch's value as json.Marshal writes it
+	tx := redwood.Tx{
+		ID:         types.RandomID(),
+		Parents:    []types.ID{types.RandomID(), types.RandomID()},
+		StateURI:   "foo.bar/blah",
+		Recipients: []types.Address{testutils.RandomAddress(t), testutils.RandomAddress(t)},
+		Patches: []redwood.Patch{
+			{Keypath: tree.Keypath("a"), Val: M{"z": 1.5, "b": []interface{}{"<html>", true, nil}, "n": 1e21}},
+			{Keypath: tree.Keypath("b"), Range: &tree.Range{Start: 1, End: 2}, Val: []interface{}{"x"}},
+		},
+	}
+
+	var expected []byte
+	expected = append(expected, tx.ID[:]...)
+	for _, parent := range tx.Parents {
+		expected = append(expected, parent[:]...)
+	}
+	expected = append(expected, tx.StateURI...)
+	for _, patch := range tx.Patches {
+		val, err := json.Marshal(patch.Val)
+		require.NoError(t, err)
+		s := "." + string(patch.Keypath)
+		if patch.Range != nil {
+			s += fmt.Sprintf("[%v:%v]", patch.Range.Start, patch.Range.End)
+		}
+		expected = append(expected, s+" = "+string(val)...)
+	}
+	for _, recipient := range tx.Recipients {
+		expected = append(expected, recipient[:]...)
+	}
+	require.Equal(t, types.HashBytes(expected), tx.Hash())
+}
+
+func TestNewGenesisTx(t *testing.T) {
+	sigkeys, err := crypto.GenerateSigningKeypair()
+	require.NoError(t, err)
+
+	type M = map[string]interface{}
+	initialState := struct {
+		Name  string   `json:"name"`
+		Items []string `json:"items"`
+	}{"blah", []string{"a", "b"}}
+
+	genesis, err := redwood.NewGenesisTx("foo.bar/blah", initialState)
+	require.NoError(t, err)
+	require.Equal(t, redwood.GenesisTxID, genesis.ID)
+	require.Empty(t, genesis.Parents)
+	require.Equal(t, "foo.bar/blah", genesis.StateURI)
+	require.Len(t, genesis.Patches, 1)
+	require.Equal(t, tree.Keypath(nil), genesis.Patches[0].Keypath)
+	require.Equal(t, M{"name": "blah", "items": []interface{}{"a", "b"}}, genesis.Patches[0].Val)
+	require.Empty(t, genesis.Sig)
+
+	genesis.From = sigkeys.Address()
+	genesis.Sig, err = sigkeys.SignHash(genesis.Hash())
+	require.NoError(t, err)
+	_, err = redwood.VerifyTx(genesis)
+	require.NoError(t, err)
+
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := setup(t)
+			defer cleanup()
+
+			require.NoError(t, redwood.ValidateTxDAG(s, genesis))
+			require.NoError(t, s.AddTx(genesis))
+
+			// Nothing else may be a root
+			root := &redwood.Tx{ID: types.RandomID(), StateURI: genesis.StateURI}
+			err := redwood.ValidateTxDAG(s, root)
+			require.True(t, errors.Is(err, redwood.ErrTxMissingParents))
+
+			child := &redwood.Tx{ID: types.RandomID(), StateURI: genesis.StateURI, Parents: []types.ID{genesis.ID}}
+			require.NoError(t, redwood.ValidateTxDAG(s, child))
+		})
+	}
+
+	t.Run("malformed state URI", func(t *testing.T) {
+		_, err := redwood.NewGenesisTx("foo.bar", M{})
+		require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+	})
+
+	t.Run("unencodable initial state", func(t *testing.T) {
+		_, err := redwood.NewGenesisTx("foo.bar/blah", M{"ch": make(chan int)})
+		require.Error(t, err)
+	})
+}
+
+func TestApplyPatch(t *testing.T) {
+	mustParse := func(t *testing.T, s string) redwood.Patch {
+		t.Helper()
+		patch, err := redwood.ParsePatch([]byte(s))
+		require.NoError(t, err)
+		return patch
+	}
+
+	newState := func() interface{} {
+		return map[string]interface{}{
+			"text": map[string]interface{}{
+				"value": "hello world",
+			},
+			"list":  []interface{}{"a", "b", "c", "d"},
+			"count": 1.0,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		patch    string
+		keypath  string
+		expected interface{}
+	}{
+		{"string range insert", `.text.value[0:0] = "a"`, "text/value", "ahello world"},
+		{"string range replace", `.text.value[6:11] = "there"`, "text/value", "hello there"},
+		{"string range delete", `.text.value[5:] = null`, "text/value", "hello"},
+		{"string append", `.text.value += "!"`, "text/value", "hello world!"},
+		{"slice range replace", `.list[1:3] = ["x", "y", "z"]`, "list", []interface{}{"a", "x", "y", "z", "d"}},
+		{"slice negative range", `.list[-2:] = ["z"]`, "list", []interface{}{"a", "b", "z"}},
+		{"slice range delete", `.list[0:2] = null`, "list", []interface{}{"c", "d"}},
+		{"slice append", `.list += "e"`, "list", []interface{}{"a", "b", "c", "d", "e"}},
+		{"append creates a slice", `.newList += 1`, "newList", []interface{}{1.0}},
+		{"whole-key set", `.count = 2`, "count", 2.0},
+		{"set creates intermediate maps", `.a.b.c = true`, "a/b/c", true},
+		{"set replaces a subtree", `.text = {"other": 1}`, "text", map[string]interface{}{"other": 1.0}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			state, err := redwood.ApplyPatch(newState(), mustParse(t, test.patch))
+			require.NoError(t, err)
+
+			m := state.(map[string]interface{})
+			var val interface{} = m
+			for _, key := range strings.Split(test.keypath, "/") {
+				val = val.(map[string]interface{})[key]
+			}
+			require.Equal(t, test.expected, val)
+		})
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		state, err := redwood.ApplyPatch(newState(), mustParse(t, `.text = null`))
+		require.NoError(t, err)
+		require.NotContains(t, state, "text")
+		require.Contains(t, state, "list")
+	})
+
+	t.Run("root set", func(t *testing.T) {
+		state, err := redwood.ApplyPatch(newState(), redwood.Patch{Val: "replaced"})
+		require.NoError(t, err)
+		require.Equal(t, "replaced", state)
+
+		state, err = redwood.ApplyPatch(nil, mustParse(t, `.foo = 1`))
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"foo": 1.0}, state)
+	})
+
+	t.Run("out-of-bounds range", func(t *testing.T) {
+		for _, patch := range []string{
+			`.text.value[5:20] = "x"`,
+			`.text.value[20:] = "x"`,
+			`.list[-5:] = []`,
+			`.list[3:9] = []`,
+			`.missing[0:1] = []`,
+		} {
+			_, err := redwood.ApplyPatch(newState(), mustParse(t, patch))
+			require.True(t, errors.Is(err, tree.ErrInvalidRange), "%v: %v", patch, err)
+		}
+	})
+
+	t.Run("range over a non-slice", func(t *testing.T) {
+		_, err := redwood.ApplyPatch(newState(), mustParse(t, `.count[0:1] = []`))
+		require.True(t, errors.Is(err, tree.ErrRangeOverNonSlice))
+	})
+}
+
+func TestPatch_JSONPatch(t *testing.T) {
+	type M = map[string]interface{}
+
+	newState := func() interface{} {
+		return map[string]interface{}{
+			"a":    map[string]interface{}{"b": "c", "~tilde": 1.0},
+			"list": []interface{}{"x", "y", "z"},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		jsonPatch map[string]interface{}
+		patch     string
+		expected  interface{}
+	}{
+		{
+			"add an object member",
+			M{"op": "add", "path": "/a/d", "value": M{"e": true}},
+			`.a.d = {"e": true}`,
+			M{"a": M{"b": "c", "~tilde": 1.0, "d": M{"e": true}}, "list": []interface{}{"x", "y", "z"}},
+		},
+		{
+			"add to the end of an array",
+			M{"op": "add", "path": "/list/-", "value": "w"},
+			`.list += "w"`,
+			M{"a": M{"b": "c", "~tilde": 1.0}, "list": []interface{}{"x", "y", "z", "w"}},
+		},
+		{
+			"add inside an array",
+			M{"op": "add", "path": "/list/1", "value": "w"},
+			`.list[1:1] = ["w"]`,
+			M{"a": M{"b": "c", "~tilde": 1.0}, "list": []interface{}{"x", "w", "y", "z"}},
+		},
+		{
+			"replace an array element",
+			M{"op": "replace", "path": "/list/2", "value": 3.0},
+			`.list.2 = 3`,
+			M{"a": M{"b": "c", "~tilde": 1.0}, "list": []interface{}{"x", "y", 3.0}},
+		},
+		{
+			"replace with an escaped key",
+			M{"op": "add", "path": "/a/~0tilde", "value": 2.0},
+			`.a["~tilde"] = 2`,
+			M{"a": M{"b": "c", "~tilde": 2.0}, "list": []interface{}{"x", "y", "z"}},
+		},
+		{
+			"remove an object member",
+			M{"op": "remove", "path": "/a/b"},
+			`.a.b = null`,
+			M{"a": M{"~tilde": 1.0}, "list": []interface{}{"x", "y", "z"}},
+		},
+		{
+			"remove an array element",
+			M{"op": "remove", "path": "/list/0"},
+			`.list[0:1] = null`,
+			M{"a": M{"b": "c", "~tilde": 1.0}, "list": []interface{}{"y", "z"}},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			expectedPatch, err := redwood.ParsePatch([]byte(test.patch))
+			require.NoError(t, err)
+
+			patch, err := redwood.PatchFromJSONPatch(test.jsonPatch)
+			require.NoError(t, err)
+			require.Equal(t, expectedPatch.String(), patch.String())
+
+			state, err := redwood.ApplyPatch(newState(), patch)
+			require.NoError(t, err)
+			require.True(t, redwood.DeepEqualJSValue(test.expected, state), "%v", state)
+
+			jsonPatch, err := patch.ToJSONPatch()
+			require.NoError(t, err)
+			require.True(t, redwood.DeepEqualJSValue(test.jsonPatch, jsonPatch), "%v", jsonPatch)
+		})
+	}
+
+	t.Run("replace of an object member round-trips as add", func(t *testing.T) {
+		patch, err := redwood.PatchFromJSONPatch(M{"op": "replace", "path": "/a/b", "value": "d"})
+		require.NoError(t, err)
+		require.Equal(t, `.a.b = "d"`, patch.String())
+
+		jsonPatch, err := patch.ToJSONPatch()
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"op": "add", "path": "/a/b", "value": "d"}, jsonPatch)
+	})
+
+	t.Run("unsupported operations", func(t *testing.T) {
+		for _, op := range []M{
+			{"op": "move", "from": "/a/b", "path": "/a/c"},
+			{"op": "copy", "from": "/a/b", "path": "/a/c"},
+			{"op": "test", "path": "/a/b", "value": "c"},
+			{"op": "add", "path": "/a/b"},
+			{"op": "add", "path": "/a/b", "value": nil},
+			{"op": "add", "path": "a/b", "value": 1.0},
+			{"op": "add", "path": "/a//b", "value": 1.0},
+			{"op": "add", "path": "/a~1b", "value": 1.0},
+			{"op": "remove"},
+		} {
+			_, err := redwood.PatchFromJSONPatch(op)
+			require.True(t, errors.Is(err, redwood.ErrUnsupportedJSONPatch), "%v: %v", op, err)
+		}
+	})
+
+	t.Run("unrepresentable ranges", func(t *testing.T) {
+		for _, s := range []string{
+			`.list[0:2] = ["a", "b"]`,
+			`.list[1:1] = ["a", "b"]`,
+			`.list[0:2] = null`,
+			`.list[-1:] = null`,
+			`.a.b[0:1] = "x"`,
+		} {
+			patch, err := redwood.ParsePatch([]byte(s))
+			require.NoError(t, err)
+			_, err = patch.ToJSONPatch()
+			require.True(t, errors.Is(err, redwood.ErrUnsupportedJSONPatch), "%v: %v", s, err)
+		}
+	})
+}
+
+func TestApplyPatch_StringRangesAreInBytes(t *testing.T) {
+	// "héllo wörld": é and ö are two bytes each
+	newState := func() interface{} {
+		return map[string]interface{}{"text": "héllo wörld"}
+	}
+
+	tests := []struct {
+		name     string
+		rng      tree.Range
+		val      interface{}
+		expected string
+	}{
+		{"replace a multibyte character", tree.Range{Start: 1, End: 3}, "e", "hello wörld"},
+		{"insert after a multibyte character", tree.Range{Start: 3, End: 3}, "-", "hé-llo wörld"},
+		{"replace a span containing multibyte characters", tree.Range{Start: 0, End: 13}, "ü", "ü"},
+		{"delete from the end", tree.Range{Start: -7, End: 0}, nil, "héllo"},
+		{"insert a multibyte character", tree.Range{Start: 0, End: 0}, "✓ ", "✓ héllo wörld"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			rng := test.rng
+			patch := redwood.Patch{Keypath: tree.Keypath("text"), Range: &rng, Val: test.val}
+			require.NoError(t, redwood.ValidatePatch(newState(), patch))
+
+			state, err := redwood.ApplyPatch(newState(), patch)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, state.(map[string]interface{})["text"])
+		})
+	}
+
+	t.Run("ranges that split a multibyte character are rejected", func(t *testing.T) {
+		for _, rng := range []tree.Range{
+			{Start: 2, End: 3},
+			{Start: 0, End: 2},
+			{Start: 9, End: 9},
+			{Start: -4, End: 0},
+		} {
+			rng := rng
+			patch := redwood.Patch{Keypath: tree.Keypath("text"), Range: &rng, Val: "x"}
+
+			err := redwood.ValidatePatch(newState(), patch)
+			require.True(t, errors.Is(err, tree.ErrInvalidRange), "%v: %v", rng, err)
+
+			_, err = redwood.ApplyPatch(newState(), patch)
+			require.True(t, errors.Is(err, tree.ErrInvalidRange), "%v: %v", rng, err)
+		}
+	})
+}
+
+func TestApplyPatch_ByteSliceRanges(t *testing.T) {
+	newState := func() interface{} {
+		return map[string]interface{}{
+			"blob": []byte{0x00, 0xc3, 0xa9, 0xff, 0x10},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		rng      *tree.Range
+		val      interface{}
+		expected []byte
+	}{
+		{"splice bytes", &tree.Range{Start: 1, End: 2}, []byte{0xaa, 0xbb}, []byte{0x00, 0xaa, 0xbb, 0xa9, 0xff, 0x10}},
+		{"splice a string's bytes", &tree.Range{Start: 0, End: 1}, "é", []byte{0xc3, 0xa9, 0xc3, 0xa9, 0xff, 0x10}},
+		{"delete", &tree.Range{Start: 1, End: 4}, nil, []byte{0x00, 0x10}},
+		{"negative range", &tree.Range{Start: -2, End: 0}, []byte{0x01}, []byte{0x00, 0xc3, 0xa9, 0x01}},
+		{"append", tree.AppendRange(), []byte{0x20, 0x30}, []byte{0x00, 0xc3, 0xa9, 0xff, 0x10, 0x20, 0x30}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			patch := redwood.Patch{Keypath: tree.Keypath("blob"), Range: test.rng, Val: test.val}
+			require.NoError(t, redwood.ValidatePatch(newState(), patch))
+
+			state, err := redwood.ApplyPatch(newState(), patch)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, state.(map[string]interface{})["blob"])
+		})
+	}
+
+	t.Run("ranges don't care about UTF-8 boundaries", func(t *testing.T) {
+		// Byte 2 is the middle of what would be "é" in a string
+		patch := redwood.Patch{Keypath: tree.Keypath("blob"), Range: &tree.Range{Start: 2, End: 3}, Val: []byte{0x00}}
+		state, err := redwood.ApplyPatch(newState(), patch)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x00, 0xc3, 0x00, 0xff, 0x10}, state.(map[string]interface{})["blob"])
+	})
+
+	t.Run("out of bounds", func(t *testing.T) {
+		patch := redwood.Patch{Keypath: tree.Keypath("blob"), Range: &tree.Range{Start: 3, End: 9}, Val: []byte{0x00}}
+		_, err := redwood.ApplyPatch(newState(), patch)
+		require.True(t, errors.Is(err, tree.ErrInvalidRange))
+	})
+
+	t.Run("binary splices survive the wire", func(t *testing.T) {
+		tx := redwood.Tx{
+			ID:       types.RandomID(),
+			Parents:  []types.ID{redwood.GenesisTxID},
+			StateURI: "foo.bar/blah",
+			Patches: []redwood.Patch{
+				{Keypath: tree.Keypath("blob"), Range: &tree.Range{Start: 1, End: 2}, Val: []byte{0xaa, 0x22, 0xbb}},
+				{Keypath: tree.Keypath("nested"), Val: map[string]interface{}{"bytes": []byte{0x00}, "list": []interface{}{[]byte{}, "b64\"AA==\""}}},
+			},
+		}
+
+		bs, err := json.Marshal(tx)
+		require.NoError(t, err)
+		var decoded redwood.Tx
+		err = json.Unmarshal(bs, &decoded)
+		require.NoError(t, err)
+
+		require.Equal(t, tx.Patches, decoded.Patches)
+		require.Equal(t, tx.Hash(), decoded.Hash())
+
+		state, err := redwood.ApplyPatch(newState(), decoded.Patches[0])
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x00, 0xaa, 0x22, 0xbb, 0xa9, 0xff, 0x10}, state.(map[string]interface{})["blob"])
+	})
+
+	t.Run("wrong value type", func(t *testing.T) {
+		patch := redwood.Patch{Keypath: tree.Keypath("blob"), Range: &tree.Range{Start: 0, End: 1}, Val: []interface{}{1.0}}
+		require.Error(t, redwood.ValidatePatch(newState(), patch))
+		_, err := redwood.ApplyPatch(newState(), patch)
+		require.Error(t, err)
+	})
+}
+
+func TestApplyPatch_RangesThroughSliceIndices(t *testing.T) {
+	newState := func() interface{} {
+		return map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{"tags": []interface{}{"a"}},
+				map[string]interface{}{
+					"tags": []interface{}{"x", "y", "z"},
+					"grid": []interface{}{
+						[]interface{}{1.0, 2.0},
+						[]interface{}{3.0, 4.0},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		patch    string
+		keypath  []string
+		expected interface{}
+	}{
+		{"range in a slice of maps", `.items.1.tags[0:1] = ["q"]`, []string{"items", "1", "tags"}, []interface{}{"q", "y", "z"}},
+		{"range two slices deep", `.items.1.grid.1[0:1] = [9, 8]`, []string{"items", "1", "grid", "1"}, []interface{}{9.0, 8.0, 4.0}},
+		{"append two slices deep", `.items.1.grid.0 += 5`, []string{"items", "1", "grid", "0"}, []interface{}{1.0, 2.0, 5.0}},
+		{"string range in a slice", `.items.1.tags.2[0:0] = "z"`, []string{"items", "1", "tags", "2"}, "zz"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := redwood.ParsePatch([]byte(test.patch))
+			require.NoError(t, err)
+			require.NoError(t, redwood.ValidatePatch(newState(), patch))
+
+			state, err := redwood.ApplyPatch(newState(), patch)
+			require.NoError(t, err)
+
+			val := state
+			for _, key := range test.keypath {
+				switch v := val.(type) {
+				case map[string]interface{}:
+					val = v[key]
+				case []interface{}:
+					idx, err := strconv.Atoi(key)
+					require.NoError(t, err)
+					val = v[idx]
+				}
+			}
+			require.Equal(t, test.expected, val)
+
+			// The sibling item is untouched
+			require.Equal(t, newState().(map[string]interface{})["items"].([]interface{})[0], state.(map[string]interface{})["items"].([]interface{})[0])
+		})
+	}
+
+	t.Run("index out of range", func(t *testing.T) {
+		for _, s := range []string{
+			`.items.5.tags[0:1] = []`,
+			`.items.-1.tags[0:1] = []`,
+			`.items.1.grid.2[0:1] = []`,
+		} {
+			patch, err := redwood.ParsePatch([]byte(s))
+			require.NoError(t, err)
+
+			_, err = redwood.ApplyPatch(newState(), patch)
+			require.True(t, errors.Is(err, tree.ErrInvalidRange), "%v: %v", s, err)
+			err = redwood.ValidatePatch(newState(), patch)
+			require.True(t, errors.Is(err, tree.ErrInvalidRange), "%v: %v", s, err)
+		}
+	})
+}
+
+func TestValidatePatch(t *testing.T) {
+	newState := func() interface{} {
+		return map[string]interface{}{
+			"text": map[string]interface{}{
+				"value": "hello world",
+			},
+			"list":  []interface{}{"a", "b", "c", "d"},
+			"count": 1.0,
+		}
+	}
+	state := newState()
+
+	tests := []struct {
+		name    string
+		patch   string
+		valid   bool
+		wantErr error
+	}{
+		{"valid range", `.text.value[0:5] = "howdy"`, true, nil},
+		{"valid append", `.list += "e"`, true, nil},
+		{"valid set", `.text.other = 1`, true, nil},
+		{"valid delete", `.count = null`, true, nil},
+		{"creates intermediate maps", `.a.b.c = true`, true, nil},
+		{"out-of-range range", `.list[3:9] = []`, false, tree.ErrInvalidRange},
+		{"range over a map", `.text[0:1] = []`, false, tree.ErrRangeOverNonSlice},
+		{"string spliced into a slice", `.list[0:1] = "x"`, false, nil},
+		{"key set on a number", `.count.foo = 1`, false, nil},
+		{"bad slice index", `.list.foo = 1`, false, nil},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := redwood.ParsePatch([]byte(test.patch))
+			require.NoError(t, err)
+
+			err = redwood.ValidatePatch(state, patch)
+			_, applyErr := redwood.ApplyPatch(newState(), patch)
+
+			if test.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			if test.wantErr != nil {
+				require.True(t, errors.Is(err, test.wantErr), "%v", err)
+			}
+			// ValidatePatch fails exactly when ApplyPatch would
+			require.Equal(t, applyErr == nil, err == nil, "validate: %v, apply: %v", err, applyErr)
+			require.Equal(t, newState(), state)
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package redwood
 
 import (
+	"context"
+	"sync"
+
 	"github.com/dgraph-io/badger/v2"
 	"github.com/pkg/errors"
 
@@ -13,6 +16,12 @@ type badgerTxStore struct {
 	ctx.Logger
 	db         *badger.DB
 	dbFilename string
+	txValidators
+
+	txAddedListeners     []func(stateURI types.StateURI, tx *Tx)
+	txAddedListenersMu   sync.RWMutex
+	txRemovedListeners   []func(stateURI types.StateURI, txID types.ID)
+	txRemovedListenersMu sync.RWMutex
 }
 
 func NewBadgerTxStore(dbFilename string) TxStore {
@@ -48,18 +57,29 @@ func makeTxKey(stateURI string, txID types.ID) []byte {
 	return append([]byte("tx:"+stateURI+":"), txID[:]...)
 }
 
+func makeSenderIndexPrefix(stateURI string, sender types.Address) []byte {
+	return append([]byte("sender:"+stateURI+":"), sender[:]...)
+}
+
+func makeSenderIndexKey(stateURI string, sender types.Address, txID types.ID) []byte {
+	return append(makeSenderIndexPrefix(stateURI, sender), txID[:]...)
+}
+
 func (p *badgerTxStore) AddTx(tx *Tx) (err error) {
 	defer utils.Annotate(&err, "badgerTxStore#AddTx")
 
+	err = p.validateTx(tx)
+	if err != nil {
+		return err
+	}
+
 	bs, err := tx.MarshalProto()
 	if err != nil {
 		return err
 	}
 
-	key := makeTxKey(tx.StateURI, tx.ID)
 	err = p.db.Update(func(txn *badger.Txn) error {
-		// Add the tx to the DB
-		err := txn.Set(key, []byte(bs))
+		err := setTx(txn, tx, bs)
 		if err != nil {
 			return err
 		}
@@ -68,7 +88,9 @@ func (p *badgerTxStore) AddTx(tx *Tx) (err error) {
 		if tx.Status == TxStatusValid {
 			for _, parentID := range tx.Parents {
 				item, err := txn.Get(makeTxKey(tx.StateURI, parentID))
-				if err != nil {
+				if err == badger.ErrKeyNotFound {
+					return errors.Wrapf(types.Err404, "can't find parent %v of tx %v", parentID, tx.ID)
+				} else if err != nil {
 					return errors.Wrapf(err, "can't find parent %v of tx %v", parentID, tx.ID)
 				}
 				var parentTx Tx
@@ -92,12 +114,6 @@ func (p *badgerTxStore) AddTx(tx *Tx) (err error) {
 				}
 			}
 		}
-
-		// We need to keep track of all of the state URIs we know about
-		err = txn.Set([]byte("stateuri:"+tx.StateURI), nil)
-		if err != nil {
-			return err
-		}
 		return nil
 	})
 	if err != nil {
@@ -105,18 +121,72 @@ func (p *badgerTxStore) AddTx(tx *Tx) (err error) {
 		return err
 	}
 	p.Infof(0, "wrote tx %v (status: %v)", tx.ID.Pretty(), tx.Status)
+
+	p.notifyTxAddedListeners(types.StateURI(tx.StateURI), tx)
 	return nil
 }
 
-func (p *badgerTxStore) RemoveTx(stateURI string, txID types.ID) error {
-	key := makeTxKey(stateURI, txID)
-	return p.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(key)
+// setTx writes a tx (already encoded as bs) and its index entries.
+func setTx(txn *badger.Txn, tx *Tx, bs []byte) error {
+	// Add the tx to the DB
+	err := txn.Set(makeTxKey(tx.StateURI, tx.ID), bs)
+	if err != nil {
+		return err
+	}
+
+	// Index the tx by its sender so that we can answer TxsBySender queries
+	err = txn.Set(makeSenderIndexKey(tx.StateURI, tx.From, tx.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	// We need to keep track of all of the state URIs we know about
+	return txn.Set([]byte("stateuri:"+tx.StateURI), nil)
+}
+
+func (p *badgerTxStore) RemoveTx(stateURI types.StateURI, txID types.ID) error {
+	key := makeTxKey(string(stateURI), txID)
+
+	var removed bool
+	err := p.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var tx Tx
+		err = item.Value(func(val []byte) error {
+			return tx.UnmarshalProto(val)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = txn.Delete(makeSenderIndexKey(string(stateURI), tx.From, txID))
+		if err != nil {
+			return err
+		}
+		err = txn.Delete(key)
+		if err != nil {
+			return err
+		}
+		removed = true
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if removed {
+		p.notifyTxRemovedListeners(stateURI, txID)
+	}
+	return nil
 }
 
-func (p *badgerTxStore) TxExists(stateURI string, txID types.ID) (bool, error) {
-	key := makeTxKey(stateURI, txID)
+func (p *badgerTxStore) TxExists(stateURI types.StateURI, txID types.ID) (bool, error) {
+	key := makeTxKey(string(stateURI), txID)
 
 	var exists bool
 	err := p.db.View(func(txn *badger.Txn) error {
@@ -134,10 +204,10 @@ func (p *badgerTxStore) TxExists(stateURI string, txID types.ID) (bool, error) {
 	return exists, err
 }
 
-func (p *badgerTxStore) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
+func (p *badgerTxStore) FetchTx(stateURI types.StateURI, txID types.ID) (*Tx, error) {
 	var bs []byte
 	err := p.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(makeTxKey(stateURI, txID))
+		item, err := txn.Get(makeTxKey(string(stateURI), txID))
 		if err == badger.ErrKeyNotFound {
 			return errors.WithStack(types.Err404)
 		} else if err != nil {
@@ -158,7 +228,7 @@ func (p *badgerTxStore) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
 	return &tx, err
 }
 
-func (p *badgerTxStore) AllTxsForStateURI(stateURI string, fromTxID types.ID) TxIterator {
+func (p *badgerTxStore) AllTxsForStateURI(stateURI types.StateURI, fromTxID types.ID) TxIterator {
 	if fromTxID == (types.ID{}) {
 		fromTxID = GenesisTxID
 	}
@@ -183,8 +253,10 @@ func (p *badgerTxStore) AllTxsForStateURI(stateURI string, fromTxID types.ID) Tx
 					continue
 				}
 
-				item, err := txn.Get(makeTxKey(stateURI, txID))
-				if err != nil {
+				item, err := txn.Get(makeTxKey(string(stateURI), txID))
+				if err == badger.ErrKeyNotFound {
+					return errors.WithStack(types.Err404)
+				} else if err != nil {
 					return err
 				}
 
@@ -219,8 +291,126 @@ func (p *badgerTxStore) AllTxsForStateURI(stateURI string, fromTxID types.ID) Tx
 	return txIter
 }
 
-func (s *badgerTxStore) KnownStateURIs() ([]string, error) {
-	var stateURIs []string
+func (p *badgerTxStore) TxsBySender(stateURI types.StateURI, sender types.Address) TxIterator {
+	txIter := &txIterator{
+		ch:       make(chan *Tx),
+		chCancel: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(txIter.ch)
+
+		txIter.err = p.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			iter := txn.NewIterator(opts)
+			defer iter.Close()
+
+			prefix := makeSenderIndexPrefix(string(stateURI), sender)
+
+			for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+				txID := types.IDFromBytes(iter.Item().Key()[len(prefix):])
+
+				item, err := txn.Get(makeTxKey(string(stateURI), txID))
+				if err == badger.ErrKeyNotFound {
+					return errors.WithStack(types.Err404)
+				} else if err != nil {
+					return err
+				}
+
+				var tx Tx
+				err = item.Value(func(val []byte) error {
+					return tx.UnmarshalProto(val)
+				})
+				if err != nil {
+					return err
+				}
+
+				select {
+				case <-txIter.chCancel:
+					return nil
+				case txIter.ch <- &tx:
+				}
+			}
+			return nil
+		})
+	}()
+
+	return txIter
+}
+
+// ExportAllTxs streams the txs in key order, which groups them by state URI.
+func (p *badgerTxStore) ExportAllTxs(ctx context.Context) TxIterator {
+	txIter := &txIterator{
+		ch:       make(chan *Tx),
+		chCancel: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(txIter.ch)
+
+		// A single read transaction is a consistent snapshot
+		txIter.err = p.db.View(func(txn *badger.Txn) error {
+			iter := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer iter.Close()
+
+			prefix := []byte("tx:")
+			for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+				var tx Tx
+				err := iter.Item().Value(func(val []byte) error {
+					return tx.UnmarshalProto(val)
+				})
+				if err != nil {
+					return err
+				}
+
+				_, err = txn.Get(append([]byte("leaf:"+tx.StateURI+":"), tx.ID[:]...))
+				if err == nil {
+					tx.exportedLeaf = true
+				} else if err != badger.ErrKeyNotFound {
+					return err
+				}
+
+				// Checked first, since select picks at random among ready cases
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				select {
+				case <-txIter.chCancel:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				case txIter.ch <- &tx:
+				}
+			}
+			return nil
+		})
+	}()
+
+	return txIter
+}
+
+func (p *badgerTxStore) ImportTxs(iter TxIterator) error {
+	return importTxs(iter, p.importTx, p.MarkLeaf)
+}
+
+func (p *badgerTxStore) importTx(tx *Tx) error {
+	bs, err := tx.MarshalProto()
+	if err != nil {
+		return err
+	}
+	err = p.db.Update(func(txn *badger.Txn) error {
+		return setTx(txn, tx, bs)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "can't import tx %v", tx.ID.Pretty())
+	}
+	p.notifyTxAddedListeners(types.StateURI(tx.StateURI), tx)
+	return nil
+}
+
+func (s *badgerTxStore) KnownStateURIs() ([]types.StateURI, error) {
+	var stateURIs []types.StateURI
 	err := s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
@@ -230,26 +420,79 @@ func (s *badgerTxStore) KnownStateURIs() ([]string, error) {
 		prefix := []byte("stateuri:")
 
 		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
-			stateURIs = append(stateURIs, string(iter.Item().Key()[len("stateuri:"):]))
+			stateURIs = append(stateURIs, types.StateURI(iter.Item().Key()[len("stateuri:"):]))
 		}
 		return nil
 	})
 	return stateURIs, err
 }
 
-func (s *badgerTxStore) MarkLeaf(stateURI string, txID types.ID) error {
+// KnownStateURIsByPrefix returns the known state URIs that start with
+// prefix, in lexical order, skipping the first offset of them.  A limit <= 0
+// means no limit.
+func (s *badgerTxStore) KnownStateURIsByPrefix(prefix string, offset, limit int) ([]types.StateURI, error) {
+	var stateURIs []types.StateURI
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		keyPrefix := []byte("stateuri:" + prefix)
+
+		var skipped int
+		for iter.Seek(keyPrefix); iter.ValidForPrefix(keyPrefix); iter.Next() {
+			if skipped < offset {
+				skipped++
+				continue
+			} else if limit > 0 && len(stateURIs) == limit {
+				break
+			}
+			stateURIs = append(stateURIs, types.StateURI(iter.Item().Key()[len("stateuri:"):]))
+		}
+		return nil
+	})
+	return stateURIs, err
+}
+
+func (s *badgerTxStore) MarkLeaf(stateURI types.StateURI, txID types.ID) error {
 	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(append([]byte("leaf:"+stateURI+":"), txID[:]...), nil)
+		return txn.Set(append([]byte("leaf:"+string(stateURI)+":"), txID[:]...), nil)
 	})
 }
 
-func (s *badgerTxStore) UnmarkLeaf(stateURI string, txID types.ID) error {
+func (s *badgerTxStore) UnmarkLeaf(stateURI types.StateURI, txID types.ID) error {
 	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(append([]byte("leaf:"+stateURI+":"), txID[:]...))
+		return txn.Delete(append([]byte("leaf:"+string(stateURI)+":"), txID[:]...))
 	})
 }
 
-func (s *badgerTxStore) Leaves(stateURI string) ([]types.ID, error) {
+// ReplaceLeaf atomically swaps oldLeaf for newLeaf.  It returns
+// ErrLeafConflict if oldLeaf isn't currently a leaf, including when a
+// concurrent ReplaceLeaf wins the race.
+func (s *badgerTxStore) ReplaceLeaf(stateURI types.StateURI, oldLeaf, newLeaf types.ID) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		oldKey := append([]byte("leaf:"+string(stateURI)+":"), oldLeaf[:]...)
+		_, err := txn.Get(oldKey)
+		if err == badger.ErrKeyNotFound {
+			return errors.Wrapf(ErrLeafConflict, "%v is not a leaf", oldLeaf.Pretty())
+		} else if err != nil {
+			return err
+		}
+
+		err = txn.Delete(oldKey)
+		if err != nil {
+			return err
+		}
+		return txn.Set(append([]byte("leaf:"+string(stateURI)+":"), newLeaf[:]...), nil)
+	})
+	if err == badger.ErrConflict {
+		return errors.Wrapf(ErrLeafConflict, "%v was replaced concurrently", oldLeaf.Pretty())
+	}
+	return err
+}
+
+func (s *badgerTxStore) Leaves(stateURI types.StateURI) ([]types.ID, error) {
 	var leaves []types.ID
 	err := s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
@@ -260,10 +503,103 @@ func (s *badgerTxStore) Leaves(stateURI string) ([]types.ID, error) {
 		prefix := []byte("leaf:" + stateURI + ":")
 
 		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
-			txID := types.IDFromBytes(iter.Item().Key()[len("leaf:"+stateURI+":"):])
+			txID := types.IDFromBytes(iter.Item().Key()[len("leaf:"+string(stateURI)+":"):])
 			leaves = append(leaves, txID)
 		}
 		return nil
 	})
 	return leaves, err
 }
+
+func (s *badgerTxStore) LeavesHash(stateURI types.StateURI) (types.Hash, error) {
+	leaves, err := s.Leaves(stateURI)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	return leavesHash(leaves), nil
+}
+
+// DiskUsageByStateURI sums the estimated key and value sizes of each state
+// URI's tx records.  Only keys are read, so txs aren't deserialized.
+func (s *badgerTxStore) DiskUsageByStateURI() (map[types.StateURI]int64, error) {
+	usage := make(map[types.StateURI]int64)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+
+		prefix := []byte("tx:")
+
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			item := iter.Item()
+			key := item.Key()
+			// tx:<stateURI>:<txID>
+			if len(key) < len(prefix)+1+len(types.ID{}) {
+				continue
+			}
+			stateURI := types.StateURI(key[len(prefix) : len(key)-1-len(types.ID{})])
+			usage[stateURI] += item.EstimatedSize()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (s *badgerTxStore) OnTxAdded(fn func(stateURI types.StateURI, tx *Tx)) {
+	s.txAddedListenersMu.Lock()
+	defer s.txAddedListenersMu.Unlock()
+	s.txAddedListeners = append(s.txAddedListeners, fn)
+}
+
+func (s *badgerTxStore) notifyTxAddedListeners(stateURI types.StateURI, tx *Tx) {
+	s.txAddedListenersMu.RLock()
+	defer s.txAddedListenersMu.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.txAddedListeners))
+
+	for _, handler := range s.txAddedListeners {
+		handler := handler
+		go func() {
+			defer wg.Done()
+			defer s.recoverListenerPanic("tx added")
+			handler(stateURI, tx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *badgerTxStore) OnTxRemoved(fn func(stateURI types.StateURI, txID types.ID)) {
+	s.txRemovedListenersMu.Lock()
+	defer s.txRemovedListenersMu.Unlock()
+	s.txRemovedListeners = append(s.txRemovedListeners, fn)
+}
+
+func (s *badgerTxStore) notifyTxRemovedListeners(stateURI types.StateURI, txID types.ID) {
+	s.txRemovedListenersMu.RLock()
+	defer s.txRemovedListenersMu.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.txRemovedListeners))
+
+	for _, handler := range s.txRemovedListeners {
+		handler := handler
+		go func() {
+			defer wg.Done()
+			defer s.recoverListenerPanic("tx removed")
+			handler(stateURI, txID)
+		}()
+	}
+	wg.Wait()
+}
+
+// A misbehaving listener shouldn't be able to take down the store.
+func (s *badgerTxStore) recoverListenerPanic(event string) {
+	if perr := recover(); perr != nil {
+		s.Errorf("panic in %v listener: %v", event, perr)
+	}
+}
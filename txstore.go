@@ -1,26 +1,307 @@
 package redwood
 
 import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
 	"redwood.dev/types"
 )
 
+var (
+	// ErrLeafConflict is returned by ReplaceLeaf when the leaf being replaced
+	// is no longer a leaf (usually because another writer got there first).
+	ErrLeafConflict = errors.New("leaf conflict")
+
+	// ErrTxCycle is returned by ValidateTxDAG when a tx would be its own
+	// ancestor.
+	ErrTxCycle = errors.New("tx would create a cycle")
+)
+
+// TxStore persists txs, grouped by state URI.  State URIs are typed here,
+// but Tx.StateURI and the controller layer above the store still carry
+// plain strings.  Those are validated once, when a tx comes in through
+// ControllerHub.AddTx, and converted as they are after that.  Code that
+// hasn't moved to types.StateURI can use StringTxStore.
 type TxStore interface {
 	Start() error
 	Close()
 
 	AddTx(tx *Tx) error
-	RemoveTx(stateURI string, txID types.ID) error
-	TxExists(stateURI string, txID types.ID) (bool, error)
-	FetchTx(stateURI string, txID types.ID) (*Tx, error)
-	AllTxsForStateURI(stateURI string, fromTxID types.ID) TxIterator
-	KnownStateURIs() ([]string, error)
-	MarkLeaf(stateURI string, txID types.ID) error
-	UnmarkLeaf(stateURI string, txID types.ID) error
-	Leaves(stateURI string) ([]types.ID, error)
+	RemoveTx(stateURI types.StateURI, txID types.ID) error
+	TxExists(stateURI types.StateURI, txID types.ID) (bool, error)
+	FetchTx(stateURI types.StateURI, txID types.ID) (*Tx, error)
+	AllTxsForStateURI(stateURI types.StateURI, fromTxID types.ID) TxIterator
+	TxsBySender(stateURI types.StateURI, sender types.Address) TxIterator
+	KnownStateURIs() ([]types.StateURI, error)
+	KnownStateURIsByPrefix(prefix string, offset, limit int) ([]types.StateURI, error)
+	MarkLeaf(stateURI types.StateURI, txID types.ID) error
+	UnmarkLeaf(stateURI types.StateURI, txID types.ID) error
+	ReplaceLeaf(stateURI types.StateURI, oldLeaf, newLeaf types.ID) error
+	Leaves(stateURI types.StateURI) ([]types.ID, error)
+	// LeavesHash returns a digest of the state URI's leaves that doesn't
+	// depend on the order they're stored in, so two stores can cheaply check
+	// whether they agree on the current leaves.
+	LeavesHash(stateURI types.StateURI) (types.Hash, error)
+
+	// DiskUsageByStateURI returns the approximate number of bytes that each
+	// state URI's txs occupy in the store.
+	DiskUsageByStateURI() (map[types.StateURI]int64, error)
+
+	// ExportAllTxs streams every tx in the store, across all state URIs,
+	// grouped by state URI and in an order that's stable for a given set of
+	// txs.  It reflects a consistent snapshot of the store, including which
+	// txs are leaves.  The iterator stops early (with ctx.Err()) if ctx is
+	// canceled.
+	ExportAllTxs(ctx context.Context) TxIterator
+	// ImportTxs adds the txs from an ExportAllTxs stream, in any order, as
+	// they are: their statuses and children are kept, and the validators
+	// aren't run, since the exporting store already accepted them.  The txs
+	// that were leaves in the exporting store are marked as leaves.  If it
+	// fails partway, it cancels iter.
+	ImportTxs(iter TxIterator) error
+
+	OnTxAdded(fn func(stateURI types.StateURI, tx *Tx))
+	OnTxRemoved(fn func(stateURI types.StateURI, txID types.ID))
+
+	// SetTxValidator replaces the store's validators, which AddTx runs (in
+	// order) before persisting a tx.
+	SetTxValidator(validators ...AddTxValidator)
+}
+
+// AddTxValidator decides whether a tx may be added to the given state URI
+// (for instance, by checking that its sender is allowed to write there).  A
+// non-nil error vetoes the tx, and is returned from AddTx.
+type AddTxValidator func(stateURI types.StateURI, tx *Tx) error
+
+type txValidators struct {
+	validators   []AddTxValidator
+	validatorsMu sync.RWMutex
+}
+
+func (v *txValidators) SetTxValidator(validators ...AddTxValidator) {
+	v.validatorsMu.Lock()
+	defer v.validatorsMu.Unlock()
+	v.validators = append([]AddTxValidator(nil), validators...)
+}
+
+// validateTx runs the validators, stopping at the first one that fails.
+func (v *txValidators) validateTx(tx *Tx) error {
+	v.validatorsMu.RLock()
+	defer v.validatorsMu.RUnlock()
+	for _, validator := range v.validators {
+		err := validator(types.StateURI(tx.StateURI), tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StringTxStore wraps a TxStore with the string-based state URI signatures
+// that it had before types.StateURI, for compatibility.  Like a plain
+// conversion, it doesn't validate the strings.
+type StringTxStore struct {
+	TxStore
+}
+
+func (s StringTxStore) RemoveTx(stateURI string, txID types.ID) error {
+	return s.TxStore.RemoveTx(types.StateURI(stateURI), txID)
+}
+
+func (s StringTxStore) TxExists(stateURI string, txID types.ID) (bool, error) {
+	return s.TxStore.TxExists(types.StateURI(stateURI), txID)
+}
+
+func (s StringTxStore) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
+	return s.TxStore.FetchTx(types.StateURI(stateURI), txID)
+}
+
+func (s StringTxStore) AllTxsForStateURI(stateURI string, fromTxID types.ID) TxIterator {
+	return s.TxStore.AllTxsForStateURI(types.StateURI(stateURI), fromTxID)
+}
+
+func (s StringTxStore) TxsBySender(stateURI string, sender types.Address) TxIterator {
+	return s.TxStore.TxsBySender(types.StateURI(stateURI), sender)
+}
+
+func (s StringTxStore) KnownStateURIs() ([]string, error) {
+	stateURIs, err := s.TxStore.KnownStateURIs()
+	if err != nil {
+		return nil, err
+	}
+	return stateURIStrings(stateURIs), nil
+}
+
+func (s StringTxStore) KnownStateURIsByPrefix(prefix string, offset, limit int) ([]string, error) {
+	stateURIs, err := s.TxStore.KnownStateURIsByPrefix(prefix, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return stateURIStrings(stateURIs), nil
+}
+
+func (s StringTxStore) MarkLeaf(stateURI string, txID types.ID) error {
+	return s.TxStore.MarkLeaf(types.StateURI(stateURI), txID)
+}
+
+func (s StringTxStore) UnmarkLeaf(stateURI string, txID types.ID) error {
+	return s.TxStore.UnmarkLeaf(types.StateURI(stateURI), txID)
+}
+
+func (s StringTxStore) ReplaceLeaf(stateURI string, oldLeaf, newLeaf types.ID) error {
+	return s.TxStore.ReplaceLeaf(types.StateURI(stateURI), oldLeaf, newLeaf)
+}
+
+func (s StringTxStore) Leaves(stateURI string) ([]types.ID, error) {
+	return s.TxStore.Leaves(types.StateURI(stateURI))
+}
+
+func (s StringTxStore) LeavesHash(stateURI string) (types.Hash, error) {
+	return s.TxStore.LeavesHash(types.StateURI(stateURI))
+}
+
+func (s StringTxStore) DiskUsageByStateURI() (map[string]int64, error) {
+	usage, err := s.TxStore.DiskUsageByStateURI()
+	if err != nil {
+		return nil, err
+	}
+	converted := make(map[string]int64, len(usage))
+	for stateURI, n := range usage {
+		converted[string(stateURI)] = n
+	}
+	return converted, nil
+}
+
+func (s StringTxStore) OnTxAdded(fn func(stateURI string, tx *Tx)) {
+	s.TxStore.OnTxAdded(func(stateURI types.StateURI, tx *Tx) { fn(string(stateURI), tx) })
+}
+
+func (s StringTxStore) OnTxRemoved(fn func(stateURI string, txID types.ID)) {
+	s.TxStore.OnTxRemoved(func(stateURI types.StateURI, txID types.ID) { fn(string(stateURI), txID) })
+}
+
+func stateURIStrings(stateURIs []types.StateURI) []string {
+	if stateURIs == nil {
+		return nil
+	}
+	strs := make([]string, len(stateURIs))
+	for i, stateURI := range stateURIs {
+		strs[i] = string(stateURI)
+	}
+	return strs
+}
+
+// ValidateTxDAG checks that adding tx to store would leave a well-formed DAG:
+// only the genesis tx may be a root (otherwise ErrTxMissingParents is
+// returned), every one of tx's parents must already exist (otherwise
+// ErrNoParentYet is returned, and the caller should fetch the parent and
+// retry), and tx must not already be an ancestor of any of its parents
+// (otherwise ErrTxCycle is returned, and the tx should be rejected).
+func ValidateTxDAG(store TxStore, tx *Tx) error {
+	if len(tx.Parents) == 0 && tx.ID != GenesisTxID {
+		return ErrTxMissingParents
+	}
+
+	for _, parentID := range tx.Parents {
+		if parentID == tx.ID {
+			return errors.Wrapf(ErrTxCycle, "tx %v is its own parent", tx.ID.Pretty())
+		}
+		exists, err := store.TxExists(types.StateURI(tx.StateURI), parentID)
+		if err != nil {
+			return err
+		} else if !exists {
+			return errors.Wrapf(ErrNoParentYet, "parent=%v", parentID.Pretty())
+		}
+	}
+
+	// Walk up from the parents, looking for tx
+	queue := append([]types.ID{}, tx.Parents...)
+	visited := make(map[types.ID]struct{})
+	for len(queue) > 0 {
+		txID := queue[0]
+		queue = queue[1:]
+
+		if _, seen := visited[txID]; seen {
+			continue
+		}
+		visited[txID] = struct{}{}
+
+		ancestor, err := store.FetchTx(types.StateURI(tx.StateURI), txID)
+		if errors.Cause(err) == types.Err404 {
+			// A missing ancestor further up is the ancestor's problem, not tx's
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, parentID := range ancestor.Parents {
+			if parentID == tx.ID {
+				return errors.Wrapf(ErrTxCycle, "tx %v is an ancestor of %v", tx.ID.Pretty(), ancestor.ID.Pretty())
+			}
+			queue = append(queue, parentID)
+		}
+	}
+	return nil
+}
+
+// leavesHash implements TxStore.LeavesHash: it hashes the concatenation of
+// the leaf IDs in ascending order.
+func leavesHash(leaves []types.ID) types.Hash {
+	sorted := make([]types.ID, len(leaves))
+	copy(sorted, leaves)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+
+	bs := make([]byte, 0, len(sorted)*len(types.ID{}))
+	for _, leaf := range sorted {
+		bs = append(bs, leaf[:]...)
+	}
+	return types.HashBytes(bs)
+}
+
+// importTxs implements TxStore.ImportTxs on top of a store's functions for
+// writing a single tx as it is and for marking a leaf.
+func importTxs(iter TxIterator, importTx func(tx *Tx) error, markLeaf func(stateURI types.StateURI, txID types.ID) error) error {
+	var leaves []*Tx
+	for {
+		tx := iter.Next()
+		if tx == nil {
+			break
+		}
+
+		err := importTx(tx)
+		if err != nil {
+			iter.Cancel()
+			return err
+		}
+
+		if tx.exportedLeaf {
+			leaves = append(leaves, tx)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for _, tx := range leaves {
+		err := markLeaf(types.StateURI(tx.StateURI), tx.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type TxIterator interface {
 	Next() *Tx
+	// Peek returns the tx that the next call to Next will return, without
+	// consuming it, or nil at the end of the stream.
+	Peek() *Tx
 	Cancel()
 	Error() error
 }
@@ -29,9 +310,27 @@ type txIterator struct {
 	ch       chan *Tx
 	chCancel chan struct{}
 	err      error
+	peeked   *Tx
+	hasPeek  bool
 }
 
 func (i *txIterator) Next() *Tx {
+	if i.hasPeek {
+		tx := i.peeked
+		i.peeked, i.hasPeek = nil, false
+		return tx
+	}
+	return i.receive()
+}
+
+func (i *txIterator) Peek() *Tx {
+	if !i.hasPeek {
+		i.peeked, i.hasPeek = i.receive(), true
+	}
+	return i.peeked
+}
+
+func (i *txIterator) receive() *Tx {
 	select {
 	case tx := <-i.ch:
 		return tx
@@ -47,3 +346,37 @@ func (i *txIterator) Cancel() {
 func (i *txIterator) Error() error {
 	return i.err
 }
+
+// NewTxSliceIterator returns a TxIterator over txs, for feeding txs that are
+// already in memory to something like ImportTxs.
+func NewTxSliceIterator(txs []*Tx) TxIterator {
+	return &txSliceIterator{txs: txs}
+}
+
+type txSliceIterator struct {
+	txs []*Tx
+}
+
+func (i *txSliceIterator) Next() *Tx {
+	if len(i.txs) == 0 {
+		return nil
+	}
+	tx := i.txs[0]
+	i.txs = i.txs[1:]
+	return tx
+}
+
+func (i *txSliceIterator) Peek() *Tx {
+	if len(i.txs) == 0 {
+		return nil
+	}
+	return i.txs[0]
+}
+
+func (i *txSliceIterator) Cancel() {
+	i.txs = nil
+}
+
+func (i *txSliceIterator) Error() error {
+	return nil
+}
@@ -1,123 +1,426 @@
 package redwood
 
-// import (
-// 	"sync"
-
-// 	"redwood.dev/ctx"
-// 	"redwood.dev/types"
-// )
-
-// type memoryTxStore struct {
-// 	sync.RWMutex
-// 	txs map[string]map[types.ID]*Tx
-// }
-
-// func NewMemoryTxStore() TxStore {
-// 	return &memoryTxStore{
-// 		txs: make(map[string]map[types.ID]*Tx),
-// 	}
-// }
-
-// func (s memoryTxStore) Ctx() *ctx.Context {
-// 	return nil
-// }
-
-// func (s memoryTxStore) Start() error {
-// 	return nil
-// }
-
-// func (s memoryTxStore) AddTx(tx *Tx) error {
-// 	s.Lock()
-// 	defer s.Unlock()
-// 	if _, exists := s.txs[tx.StateURI]; !exists {
-// 		s.txs[tx.StateURI] = make(map[types.ID]*Tx)
-// 	}
-// 	s.txs[tx.StateURI][tx.ID] = tx
-// 	return nil
-// }
-
-// func (s memoryTxStore) RemoveTx(stateURI string, txID types.ID) error {
-// 	s.Lock()
-// 	defer s.Unlock()
-// 	if _, exists := s.txs[stateURI]; !exists {
-// 		return nil
-// 	}
-// 	delete(s.txs[stateURI], txID)
-// 	if len(s.txs[stateURI]) == 0 {
-// 		delete(s.txs, stateURI)
-// 	}
-// 	return nil
-// }
-
-// func (s memoryTxStore) TxExists(stateURI string, txID types.ID) (bool, error) {
-// 	s.RLock()
-// 	defer s.RUnlock()
-// 	if _, exists := s.txs[stateURI]; !exists {
-// 		return false, nil
-// 	}
-// 	_, exists := s.txs[stateURI][txID]
-// 	return exists, nil
-// }
-
-// func (s memoryTxStore) FetchTx(stateURI string, txID types.ID) (*Tx, error) {
-// 	s.RLock()
-// 	defer s.RUnlock()
-// 	if _, exists := s.txs[stateURI]; !exists {
-// 		return nil, types.Err404
-// 	}
-// 	tx, exists := s.txs[stateURI][txID]
-// 	if !exists {
-// 		return nil, types.Err404
-// 	}
-// 	return tx, nil
-// }
-
-// func (s memoryTxStore) AllTxs() TxIterator {
-// 	s.RLock()
-// 	defer s.RUnlock()
-
-// 	txIter := &txIterator{
-// 		ch:       make(chan *Tx),
-// 		chCancel: make(chan struct{}),
-// 	}
-
-// 	go func() {
-// 		defer close(txIter.ch)
-
-// 		for stateURI := range s.txs {
-// 			for _, tx := range s.txs[stateURI] {
-// 				select {
-// 				case <-txIter.chCancel:
-// 					return
-// 				case txIter.ch <- tx:
-// 				}
-// 			}
-// 		}
-// 	}()
-
-// 	return txIter
-// }
-
-// func (s memoryTxStore) AllTxsForStateURI(stateURI string) TxIterator {
-// 	s.RLock()
-// 	defer s.RUnlock()
-
-// 	txIter := &txIterator{
-// 		ch:       make(chan *Tx),
-// 		chCancel: make(chan struct{}),
-// 	}
-
-// 	go func() {
-// 		defer close(txIter.ch)
-
-// 		for _, tx := range s.txs[stateURI] {
-// 			select {
-// 			case <-txIter.chCancel:
-// 				return
-// 			case txIter.ch <- tx:
-// 			}
-// 		}
-// 	}()
-
-// 	return txIter
-// }
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"redwood.dev/ctx"
+	"redwood.dev/types"
+	"redwood.dev/utils"
+)
+
+// memoryTxStore is a TxStore that keeps everything in memory.  It's mainly
+// useful for tests.  Txs are copied on the way in and on the way out, so
+// callers can't mutate stored txs (just as with the badger store).
+type memoryTxStore struct {
+	ctx.Logger
+	mu        sync.RWMutex
+	txs       map[types.StateURI]map[types.ID]*Tx
+	leaves    map[types.StateURI]map[types.ID]struct{}
+	stateURIs map[types.StateURI]struct{}
+	txValidators
+
+	txAddedListeners     []func(stateURI types.StateURI, tx *Tx)
+	txAddedListenersMu   sync.RWMutex
+	txRemovedListeners   []func(stateURI types.StateURI, txID types.ID)
+	txRemovedListenersMu sync.RWMutex
+}
+
+var _ TxStore = (*memoryTxStore)(nil)
+
+func NewMemoryTxStore() TxStore {
+	return &memoryTxStore{
+		Logger:    ctx.NewLogger("txstore"),
+		txs:       make(map[types.StateURI]map[types.ID]*Tx),
+		leaves:    make(map[types.StateURI]map[types.ID]struct{}),
+		stateURIs: make(map[types.StateURI]struct{}),
+	}
+}
+
+func (s *memoryTxStore) Start() error {
+	return nil
+}
+
+func (s *memoryTxStore) Close() {}
+
+func (s *memoryTxStore) AddTx(tx *Tx) (err error) {
+	defer utils.Annotate(&err, "memoryTxStore#AddTx")
+
+	// Validators run outside of the lock so that they can query the store
+	err = s.validateTx(tx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer func() {
+		s.mu.Unlock()
+		if err == nil {
+			s.notifyTxAddedListeners(types.StateURI(tx.StateURI), tx.Copy())
+		}
+	}()
+
+	txs := s.txs[types.StateURI(tx.StateURI)]
+
+	// Add the new tx to the `.Children` slice on each of its parents
+	if tx.Status == TxStatusValid {
+		for _, parentID := range tx.Parents {
+			if _, exists := txs[parentID]; !exists {
+				return errors.Wrapf(types.Err404, "can't find parent %v of tx %v", parentID, tx.ID)
+			}
+		}
+		for _, parentID := range tx.Parents {
+			parent := txs[parentID]
+			parent.Children = utils.NewIDSet(parent.Children).Add(tx.ID).Slice()
+		}
+	}
+
+	if txs == nil {
+		txs = make(map[types.ID]*Tx)
+		s.txs[types.StateURI(tx.StateURI)] = txs
+	}
+	txs[tx.ID] = tx.Copy()
+	s.stateURIs[types.StateURI(tx.StateURI)] = struct{}{}
+	return nil
+}
+
+func (s *memoryTxStore) RemoveTx(stateURI types.StateURI, txID types.ID) error {
+	s.mu.Lock()
+	_, exists := s.txs[stateURI][txID]
+	if exists {
+		delete(s.txs[stateURI], txID)
+	}
+	s.mu.Unlock()
+
+	if exists {
+		s.notifyTxRemovedListeners(stateURI, txID)
+	}
+	return nil
+}
+
+func (s *memoryTxStore) TxExists(stateURI types.StateURI, txID types.ID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.txs[stateURI][txID]
+	return exists, nil
+}
+
+func (s *memoryTxStore) FetchTx(stateURI types.StateURI, txID types.ID) (*Tx, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tx, exists := s.txs[stateURI][txID]
+	if !exists {
+		return nil, errors.WithStack(types.Err404)
+	}
+	return tx.Copy(), nil
+}
+
+func (s *memoryTxStore) AllTxsForStateURI(stateURI types.StateURI, fromTxID types.ID) TxIterator {
+	if fromTxID == (types.ID{}) {
+		fromTxID = GenesisTxID
+	}
+
+	txIter := &txIterator{
+		ch:       make(chan *Tx),
+		chCancel: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(txIter.ch)
+
+		stack := []types.ID{fromTxID}
+		sent := make(map[types.ID]struct{})
+
+		for len(stack) > 0 {
+			txID := stack[0]
+			stack = stack[1:]
+
+			if _, wasSent := sent[txID]; wasSent {
+				continue
+			}
+
+			tx, err := s.FetchTx(stateURI, txID)
+			if err != nil {
+				txIter.err = err
+				return
+			}
+
+			select {
+			case <-txIter.chCancel:
+				return
+			case txIter.ch <- tx:
+			}
+
+			sent[txID] = struct{}{}
+			stack = append(stack, tx.Children...)
+		}
+	}()
+
+	return txIter
+}
+
+func (s *memoryTxStore) TxsBySender(stateURI types.StateURI, sender types.Address) TxIterator {
+	s.mu.RLock()
+	var txs []*Tx
+	for _, tx := range s.txs[stateURI] {
+		if tx.From == sender {
+			txs = append(txs, tx.Copy())
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(txs, func(i, j int) bool {
+		return bytes.Compare(txs[i].ID[:], txs[j].ID[:]) < 0
+	})
+	return newTxIteratorFromSlice(txs)
+}
+
+func newTxIteratorFromSlice(txs []*Tx) *txIterator {
+	txIter := &txIterator{
+		ch:       make(chan *Tx),
+		chCancel: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(txIter.ch)
+		for _, tx := range txs {
+			select {
+			case <-txIter.chCancel:
+				return
+			case txIter.ch <- tx:
+			}
+		}
+	}()
+
+	return txIter
+}
+
+// ExportAllTxs streams copies of the txs, sorted by state URI and then by ID.
+func (s *memoryTxStore) ExportAllTxs(ctx context.Context) TxIterator {
+	// Copy the txs out up front, which is the memory store's snapshot
+	s.mu.RLock()
+	var txs []*Tx
+	for stateURI, txsForURI := range s.txs {
+		for _, tx := range txsForURI {
+			txCopy := tx.Copy()
+			_, txCopy.exportedLeaf = s.leaves[stateURI][tx.ID]
+			txs = append(txs, txCopy)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].StateURI != txs[j].StateURI {
+			return txs[i].StateURI < txs[j].StateURI
+		}
+		return bytes.Compare(txs[i].ID[:], txs[j].ID[:]) < 0
+	})
+
+	txIter := &txIterator{
+		ch:       make(chan *Tx),
+		chCancel: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(txIter.ch)
+
+		for _, tx := range txs {
+			// Checked first, since select picks at random among ready cases
+			if ctx.Err() != nil {
+				txIter.err = ctx.Err()
+				return
+			}
+			select {
+			case <-txIter.chCancel:
+				return
+			case <-ctx.Done():
+				txIter.err = ctx.Err()
+				return
+			case txIter.ch <- tx:
+			}
+		}
+	}()
+
+	return txIter
+}
+
+func (s *memoryTxStore) ImportTxs(iter TxIterator) error {
+	return importTxs(iter, s.importTx, s.MarkLeaf)
+}
+
+func (s *memoryTxStore) importTx(tx *Tx) error {
+	s.mu.Lock()
+	stateURI := types.StateURI(tx.StateURI)
+	if s.txs[stateURI] == nil {
+		s.txs[stateURI] = make(map[types.ID]*Tx)
+	}
+	s.txs[stateURI][tx.ID] = tx.Copy()
+	s.stateURIs[types.StateURI(tx.StateURI)] = struct{}{}
+	s.mu.Unlock()
+
+	s.notifyTxAddedListeners(types.StateURI(tx.StateURI), tx.Copy())
+	return nil
+}
+
+func (s *memoryTxStore) KnownStateURIs() ([]types.StateURI, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stateURIs []types.StateURI
+	for stateURI := range s.stateURIs {
+		stateURIs = append(stateURIs, stateURI)
+	}
+	sort.Slice(stateURIs, func(i, j int) bool { return stateURIs[i] < stateURIs[j] })
+	return stateURIs, nil
+}
+
+// DiskUsageByStateURI reports the size that each state URI's txs would take
+// up if they were serialized, since nothing is actually on disk.
+func (s *memoryTxStore) DiskUsageByStateURI() (map[types.StateURI]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usage := make(map[types.StateURI]int64)
+	for stateURI, txs := range s.txs {
+		for _, tx := range txs {
+			bs, err := tx.MarshalProto()
+			if err != nil {
+				return nil, err
+			}
+			usage[stateURI] += int64(len(bs))
+		}
+	}
+	return usage, nil
+}
+
+func (s *memoryTxStore) KnownStateURIsByPrefix(prefix string, offset, limit int) ([]types.StateURI, error) {
+	all, err := s.KnownStateURIs()
+	if err != nil {
+		return nil, err
+	}
+
+	var stateURIs []types.StateURI
+	for _, stateURI := range all {
+		if !strings.HasPrefix(string(stateURI), prefix) {
+			continue
+		} else if offset > 0 {
+			offset--
+			continue
+		} else if limit > 0 && len(stateURIs) == limit {
+			break
+		}
+		stateURIs = append(stateURIs, stateURI)
+	}
+	return stateURIs, nil
+}
+
+func (s *memoryTxStore) MarkLeaf(stateURI types.StateURI, txID types.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leaves[stateURI] == nil {
+		s.leaves[stateURI] = make(map[types.ID]struct{})
+	}
+	s.leaves[stateURI][txID] = struct{}{}
+	return nil
+}
+
+func (s *memoryTxStore) UnmarkLeaf(stateURI types.StateURI, txID types.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leaves[stateURI], txID)
+	return nil
+}
+
+func (s *memoryTxStore) ReplaceLeaf(stateURI types.StateURI, oldLeaf, newLeaf types.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, isLeaf := s.leaves[stateURI][oldLeaf]; !isLeaf {
+		return errors.Wrapf(ErrLeafConflict, "%v is not a leaf", oldLeaf.Pretty())
+	}
+	delete(s.leaves[stateURI], oldLeaf)
+	s.leaves[stateURI][newLeaf] = struct{}{}
+	return nil
+}
+
+func (s *memoryTxStore) Leaves(stateURI types.StateURI) ([]types.ID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var leaves []types.ID
+	for txID := range s.leaves[stateURI] {
+		leaves = append(leaves, txID)
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		return bytes.Compare(leaves[i][:], leaves[j][:]) < 0
+	})
+	return leaves, nil
+}
+
+func (s *memoryTxStore) LeavesHash(stateURI types.StateURI) (types.Hash, error) {
+	leaves, err := s.Leaves(stateURI)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	return leavesHash(leaves), nil
+}
+
+func (s *memoryTxStore) OnTxAdded(fn func(stateURI types.StateURI, tx *Tx)) {
+	s.txAddedListenersMu.Lock()
+	defer s.txAddedListenersMu.Unlock()
+	s.txAddedListeners = append(s.txAddedListeners, fn)
+}
+
+func (s *memoryTxStore) notifyTxAddedListeners(stateURI types.StateURI, tx *Tx) {
+	s.txAddedListenersMu.RLock()
+	defer s.txAddedListenersMu.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.txAddedListeners))
+
+	for _, handler := range s.txAddedListeners {
+		handler := handler
+		go func() {
+			defer wg.Done()
+			defer s.recoverListenerPanic("tx added")
+			handler(stateURI, tx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *memoryTxStore) OnTxRemoved(fn func(stateURI types.StateURI, txID types.ID)) {
+	s.txRemovedListenersMu.Lock()
+	defer s.txRemovedListenersMu.Unlock()
+	s.txRemovedListeners = append(s.txRemovedListeners, fn)
+}
+
+func (s *memoryTxStore) notifyTxRemovedListeners(stateURI types.StateURI, txID types.ID) {
+	s.txRemovedListenersMu.RLock()
+	defer s.txRemovedListenersMu.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.txRemovedListeners))
+
+	for _, handler := range s.txRemovedListeners {
+		handler := handler
+		go func() {
+			defer wg.Done()
+			defer s.recoverListenerPanic("tx removed")
+			handler(stateURI, txID)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *memoryTxStore) recoverListenerPanic(event string) {
+	if perr := recover(); perr != nil {
+		s.Errorf("panic in %v listener: %v", event, perr)
+	}
+}
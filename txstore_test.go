@@ -0,0 +1,699 @@
+package redwood_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"redwood.dev"
+	"redwood.dev/testutils"
+	"redwood.dev/types"
+)
+
+func setupBadgerTxStore(t *testing.T) (redwood.TxStore, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "txstore-test-")
+	require.NoError(t, err)
+
+	s := redwood.NewBadgerTxStore(dir)
+	err = s.Start()
+	require.NoError(t, err)
+
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func setupMemoryTxStore(t *testing.T) (redwood.TxStore, func()) {
+	t.Helper()
+
+	s := redwood.NewMemoryTxStore()
+	err := s.Start()
+	require.NoError(t, err)
+
+	return s, s.Close
+}
+
+// txStoreImpls lists every TxStore implementation so that the tests below
+// can be run against all of them.
+var txStoreImpls = map[string]func(t *testing.T) (redwood.TxStore, func()){
+	"badger": setupBadgerTxStore,
+	"memory": setupMemoryTxStore,
+}
+
+func collectTxIDs(t *testing.T, iter redwood.TxIterator) []types.ID {
+	t.Helper()
+
+	var ids []types.ID
+	for {
+		tx := iter.Next()
+		if tx == nil {
+			break
+		}
+		ids = append(ids, tx.ID)
+	}
+	require.NoError(t, iter.Error())
+	return ids
+}
+
+func TestTxStore_TxsBySender(t *testing.T) {
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := setup(t)
+			defer cleanup()
+			testTxStoreTxsBySender(t, s)
+		})
+	}
+}
+
+func testTxStoreTxsBySender(t *testing.T, s redwood.TxStore) {
+
+	const stateURI = "foo.bar/blah"
+	senders := []types.Address{
+		testutils.RandomAddress(t),
+		testutils.RandomAddress(t),
+		testutils.RandomAddress(t),
+	}
+
+	expected := make(map[types.Address][]types.ID)
+	for i, sender := range senders {
+		for j := 0; j <= i; j++ {
+			tx := &redwood.Tx{ID: types.RandomID(), From: sender, StateURI: stateURI}
+			err := s.AddTx(tx)
+			require.NoError(t, err)
+			expected[sender] = append(expected[sender], tx.ID)
+		}
+	}
+
+	for _, sender := range senders {
+		ids := collectTxIDs(t, s.TxsBySender(stateURI, sender))
+		require.ElementsMatch(t, expected[sender], ids)
+	}
+
+	// Other state URIs are not included
+	ids := collectTxIDs(t, s.TxsBySender("some.other/uri", senders[0]))
+	require.Len(t, ids, 0)
+
+	// Removing a tx also removes it from the index
+	removed := expected[senders[2]][0]
+	err := s.RemoveTx(stateURI, removed)
+	require.NoError(t, err)
+
+	ids = collectTxIDs(t, s.TxsBySender(stateURI, senders[2]))
+	require.ElementsMatch(t, expected[senders[2]][1:], ids)
+}
+
+func TestTxStore_TxListeners(t *testing.T) {
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := setup(t)
+			defer cleanup()
+			testTxStoreTxListeners(t, s)
+		})
+	}
+}
+
+func testTxStoreTxListeners(t *testing.T, s redwood.TxStore) {
+
+	var (
+		mu      sync.Mutex
+		added   []types.ID
+		removed []types.ID
+	)
+	s.OnTxAdded(func(stateURI types.StateURI, tx *redwood.Tx) {
+		panic("this listener is broken")
+	})
+	s.OnTxAdded(func(stateURI types.StateURI, tx *redwood.Tx) {
+		mu.Lock()
+		defer mu.Unlock()
+		added = append(added, tx.ID)
+	})
+	s.OnTxRemoved(func(stateURI types.StateURI, txID types.ID) {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, txID)
+	})
+
+	const stateURI = "foo.bar/blah"
+	tx1 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI}
+	tx2 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI}
+
+	err := s.AddTx(tx1)
+	require.NoError(t, err)
+	err = s.AddTx(tx2)
+	require.NoError(t, err)
+	err = s.RemoveTx(stateURI, tx1.ID)
+	require.NoError(t, err)
+
+	// Removing a tx that doesn't exist doesn't notify anyone
+	err = s.RemoveTx(stateURI, types.RandomID())
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []types.ID{tx1.ID, tx2.ID}, added)
+	require.Equal(t, []types.ID{tx1.ID}, removed)
+}
+
+func TestTxStore_Conformance(t *testing.T) {
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			t.Run("fetch and exists", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				const stateURI = "foo.bar/blah"
+				tx := &redwood.Tx{ID: types.RandomID(), StateURI: string(stateURI), From: testutils.RandomAddress(t)}
+
+				exists, err := s.TxExists(stateURI, tx.ID)
+				require.NoError(t, err)
+				require.False(t, exists)
+
+				_, err = s.FetchTx(stateURI, tx.ID)
+				require.Equal(t, types.Err404, errors.Cause(err))
+
+				err = s.AddTx(tx)
+				require.NoError(t, err)
+
+				exists, err = s.TxExists(stateURI, tx.ID)
+				require.NoError(t, err)
+				require.True(t, exists)
+
+				fetched, err := s.FetchTx(stateURI, tx.ID)
+				require.NoError(t, err)
+				require.Equal(t, tx.ID, fetched.ID)
+				require.Equal(t, tx.From, fetched.From)
+
+				// Mutating a fetched tx doesn't affect the store
+				fetched.Children = append(fetched.Children, types.RandomID())
+				refetched, err := s.FetchTx(stateURI, tx.ID)
+				require.NoError(t, err)
+				require.Len(t, refetched.Children, 0)
+
+				// Txs are scoped to their state URI
+				_, err = s.FetchTx("some.other/uri", tx.ID)
+				require.Equal(t, types.Err404, errors.Cause(err))
+			})
+
+			t.Run("children and iteration", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				const stateURI = "foo.bar/blah"
+				genesis := &redwood.Tx{ID: redwood.GenesisTxID, StateURI: stateURI, Status: redwood.TxStatusValid}
+				tx1 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Status: redwood.TxStatusValid, Parents: []types.ID{genesis.ID}}
+				tx2 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Status: redwood.TxStatusValid, Parents: []types.ID{tx1.ID}}
+				for _, tx := range []*redwood.Tx{genesis, tx1, tx2} {
+					err := s.AddTx(tx)
+					require.NoError(t, err)
+				}
+
+				fetched, err := s.FetchTx(stateURI, tx1.ID)
+				require.NoError(t, err)
+				require.Equal(t, []types.ID{tx2.ID}, fetched.Children)
+
+				ids := collectTxIDs(t, s.AllTxsForStateURI(stateURI, types.ID{}))
+				require.Equal(t, []types.ID{genesis.ID, tx1.ID, tx2.ID}, ids)
+
+				ids = collectTxIDs(t, s.AllTxsForStateURI(stateURI, tx1.ID))
+				require.Equal(t, []types.ID{tx1.ID, tx2.ID}, ids)
+
+				// A valid tx whose parent is missing is rejected
+				orphan := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Status: redwood.TxStatusValid, Parents: []types.ID{types.RandomID()}}
+				err = s.AddTx(orphan)
+				require.Equal(t, types.Err404, errors.Cause(err))
+
+				// Iterating from a tx that doesn't exist yields an error
+				iter := s.AllTxsForStateURI("some.other/uri", types.ID{})
+				require.Nil(t, iter.Next())
+				require.Equal(t, types.Err404, errors.Cause(iter.Error()))
+			})
+
+			t.Run("peek", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				const stateURI = "foo.bar/blah"
+				genesis := &redwood.Tx{ID: redwood.GenesisTxID, StateURI: stateURI, Status: redwood.TxStatusValid}
+				tx1 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Status: redwood.TxStatusValid, Parents: []types.ID{genesis.ID}}
+				for _, tx := range []*redwood.Tx{genesis, tx1} {
+					err := s.AddTx(tx)
+					require.NoError(t, err)
+				}
+
+				iter := s.AllTxsForStateURI(stateURI, types.ID{})
+				require.Equal(t, genesis.ID, iter.Peek().ID)
+				require.Equal(t, genesis.ID, iter.Peek().ID)
+				require.Equal(t, genesis.ID, iter.Next().ID)
+				require.Equal(t, tx1.ID, iter.Next().ID)
+				require.Nil(t, iter.Peek())
+				require.Nil(t, iter.Next())
+				require.NoError(t, iter.Error())
+			})
+
+			t.Run("leaves", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				const stateURI = "foo.bar/blah"
+				leaf1, leaf2 := types.RandomID(), types.RandomID()
+
+				leaves, err := s.Leaves(stateURI)
+				require.NoError(t, err)
+				require.Len(t, leaves, 0)
+
+				require.NoError(t, s.MarkLeaf(stateURI, leaf1))
+				require.NoError(t, s.MarkLeaf(stateURI, leaf2))
+				require.NoError(t, s.MarkLeaf("some.other/uri", types.RandomID()))
+
+				leaves, err = s.Leaves(stateURI)
+				require.NoError(t, err)
+				require.ElementsMatch(t, []types.ID{leaf1, leaf2}, leaves)
+
+				require.NoError(t, s.UnmarkLeaf(stateURI, leaf1))
+				require.NoError(t, s.UnmarkLeaf(stateURI, types.RandomID()))
+
+				leaves, err = s.Leaves(stateURI)
+				require.NoError(t, err)
+				require.Equal(t, []types.ID{leaf2}, leaves)
+			})
+
+			t.Run("leaves hash", func(t *testing.T) {
+				s1, cleanup1 := setup(t)
+				defer cleanup1()
+				s2, cleanup2 := setup(t)
+				defer cleanup2()
+
+				const stateURI = "foo.bar/blah"
+				leaves := []types.ID{types.RandomID(), types.RandomID(), types.RandomID()}
+
+				empty, err := s1.LeavesHash(stateURI)
+				require.NoError(t, err)
+
+				for _, leaf := range leaves {
+					require.NoError(t, s1.MarkLeaf(stateURI, leaf))
+				}
+				for i := len(leaves) - 1; i >= 0; i-- {
+					require.NoError(t, s2.MarkLeaf(stateURI, leaves[i]))
+				}
+				require.NoError(t, s2.MarkLeaf("some.other/uri", types.RandomID()))
+
+				hash1, err := s1.LeavesHash(stateURI)
+				require.NoError(t, err)
+				hash2, err := s2.LeavesHash(stateURI)
+				require.NoError(t, err)
+				require.Equal(t, hash1, hash2)
+				require.NotEqual(t, empty, hash1)
+
+				// Any change to the leaves changes the hash
+				extra := types.RandomID()
+				require.NoError(t, s2.MarkLeaf(stateURI, extra))
+				hash2, err = s2.LeavesHash(stateURI)
+				require.NoError(t, err)
+				require.NotEqual(t, hash1, hash2)
+
+				require.NoError(t, s2.UnmarkLeaf(stateURI, extra))
+				hash2, err = s2.LeavesHash(stateURI)
+				require.NoError(t, err)
+				require.Equal(t, hash1, hash2)
+			})
+
+			t.Run("replace leaf", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				const stateURI = "foo.bar/blah"
+				leaf := types.RandomID()
+				require.NoError(t, s.MarkLeaf(stateURI, leaf))
+
+				err := s.ReplaceLeaf(stateURI, types.RandomID(), types.RandomID())
+				require.True(t, errors.Is(err, redwood.ErrLeafConflict))
+
+				// Several writers race to extend the same leaf.  Exactly one
+				// of them should win.
+				const numWriters = 8
+				var (
+					wg        sync.WaitGroup
+					mu        sync.Mutex
+					winners   []types.ID
+					conflicts int
+				)
+				for i := 0; i < numWriters; i++ {
+					newLeaf := types.RandomID()
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						err := s.ReplaceLeaf(stateURI, leaf, newLeaf)
+
+						mu.Lock()
+						defer mu.Unlock()
+						if err == nil {
+							winners = append(winners, newLeaf)
+						} else {
+							require.True(t, errors.Is(err, redwood.ErrLeafConflict))
+							conflicts++
+						}
+					}()
+				}
+				wg.Wait()
+
+				require.Len(t, winners, 1)
+				require.Equal(t, numWriters-1, conflicts)
+
+				leaves, err := s.Leaves(stateURI)
+				require.NoError(t, err)
+				require.Equal(t, winners, leaves)
+			})
+
+			t.Run("known state URIs", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				for _, stateURI := range []string{"b.com/x", "a.com/y", "b.com/x"} {
+					err := s.AddTx(&redwood.Tx{ID: types.RandomID(), StateURI: stateURI})
+					require.NoError(t, err)
+				}
+
+				stateURIs, err := s.KnownStateURIs()
+				require.NoError(t, err)
+				require.Equal(t, []types.StateURI{"a.com/y", "b.com/x"}, stateURIs)
+			})
+
+			t.Run("known state URIs by prefix", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				for _, stateURI := range []string{"b.com/3", "a.com/1", "b.com/1", "b.com/2", "a.com/2", "b.community/1"} {
+					err := s.AddTx(&redwood.Tx{ID: types.RandomID(), StateURI: stateURI})
+					require.NoError(t, err)
+				}
+
+				stateURIs, err := s.KnownStateURIsByPrefix("a.com/", 0, 0)
+				require.NoError(t, err)
+				require.Equal(t, []types.StateURI{"a.com/1", "a.com/2"}, stateURIs)
+
+				stateURIs, err = s.KnownStateURIsByPrefix("b.com/", 0, 2)
+				require.NoError(t, err)
+				require.Equal(t, []types.StateURI{"b.com/1", "b.com/2"}, stateURIs)
+
+				stateURIs, err = s.KnownStateURIsByPrefix("b.com/", 2, 2)
+				require.NoError(t, err)
+				require.Equal(t, []types.StateURI{"b.com/3"}, stateURIs)
+
+				stateURIs, err = s.KnownStateURIsByPrefix("b.com/", 5, 2)
+				require.NoError(t, err)
+				require.Len(t, stateURIs, 0)
+
+				stateURIs, err = s.KnownStateURIsByPrefix("", 1, 3)
+				require.NoError(t, err)
+				require.Equal(t, []types.StateURI{"a.com/2", "b.com/1", "b.com/2"}, stateURIs)
+			})
+
+			t.Run("disk usage by state URI", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+
+				usage, err := s.DiskUsageByStateURI()
+				require.NoError(t, err)
+				require.Len(t, usage, 0)
+
+				counts := map[types.StateURI]int{"big.com/1": 20, "small.com/1": 2}
+				for stateURI, n := range counts {
+					for i := 0; i < n; i++ {
+						tx := &redwood.Tx{ID: types.RandomID(), StateURI: string(stateURI), From: testutils.RandomAddress(t)}
+						require.NoError(t, s.AddTx(tx))
+					}
+				}
+
+				usage, err = s.DiskUsageByStateURI()
+				require.NoError(t, err)
+				require.Len(t, usage, 2)
+				require.True(t, usage["small.com/1"] > 0)
+				require.True(t, usage["big.com/1"] > usage["small.com/1"])
+			})
+
+			t.Run("string wrappers", func(t *testing.T) {
+				s, cleanup := setup(t)
+				defer cleanup()
+				wrapped := redwood.StringTxStore{TxStore: s}
+
+				var addedTo []string
+				wrapped.OnTxAdded(func(stateURI string, tx *redwood.Tx) {
+					addedTo = append(addedTo, stateURI)
+				})
+
+				stateURI := "a.com/x"
+				tx := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI}
+				require.NoError(t, wrapped.AddTx(tx))
+				require.Equal(t, []string{stateURI}, addedTo)
+
+				exists, err := wrapped.TxExists(stateURI, tx.ID)
+				require.NoError(t, err)
+				require.True(t, exists)
+
+				fetched, err := wrapped.FetchTx(stateURI, tx.ID)
+				require.NoError(t, err)
+				require.Equal(t, tx.ID, fetched.ID)
+
+				require.NoError(t, wrapped.MarkLeaf(stateURI, tx.ID))
+				leaves, err := wrapped.Leaves(stateURI)
+				require.NoError(t, err)
+				require.Equal(t, []types.ID{tx.ID}, leaves)
+
+				stateURIs, err := wrapped.KnownStateURIs()
+				require.NoError(t, err)
+				require.Equal(t, []string{stateURI}, stateURIs)
+
+				usage, err := wrapped.DiskUsageByStateURI()
+				require.NoError(t, err)
+				require.True(t, usage[stateURI] > 0)
+			})
+		})
+	}
+}
+
+func TestTxSliceIterator_Peek(t *testing.T) {
+	tx1 := &redwood.Tx{ID: types.RandomID()}
+	tx2 := &redwood.Tx{ID: types.RandomID()}
+
+	iter := redwood.NewTxSliceIterator([]*redwood.Tx{tx1, tx2})
+	require.Equal(t, tx1, iter.Peek())
+	require.Equal(t, tx1, iter.Next())
+	require.Equal(t, tx2, iter.Peek())
+	require.Equal(t, tx2, iter.Next())
+	require.Nil(t, iter.Peek())
+	require.Nil(t, iter.Next())
+}
+
+func TestTxStore_TxValidators(t *testing.T) {
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := setup(t)
+			defer cleanup()
+
+			authorized := testutils.RandomAddress(t)
+			errUnauthorized := errors.New("unauthorized")
+			var secondCalls int
+
+			s.SetTxValidator(
+				func(stateURI types.StateURI, tx *redwood.Tx) error {
+					if stateURI == "foo.bar/blah" && tx.From != authorized {
+						return errors.Wrapf(errUnauthorized, "%v may not write to %v", tx.From, stateURI)
+					}
+					return nil
+				},
+				func(stateURI types.StateURI, tx *redwood.Tx) error {
+					secondCalls++
+					return nil
+				},
+			)
+
+			tx := &redwood.Tx{ID: types.RandomID(), StateURI: "foo.bar/blah", From: testutils.RandomAddress(t)}
+			err := s.AddTx(tx)
+			require.True(t, errors.Is(err, errUnauthorized))
+			require.Equal(t, 0, secondCalls)
+
+			exists, err := s.TxExists(types.StateURI(tx.StateURI), tx.ID)
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			tx.From = authorized
+			require.NoError(t, s.AddTx(tx))
+			require.Equal(t, 1, secondCalls)
+
+			// Other state URIs aren't restricted
+			other := &redwood.Tx{ID: types.RandomID(), StateURI: "some.other/uri", From: testutils.RandomAddress(t)}
+			require.NoError(t, s.AddTx(other))
+
+			// Clearing the validators lets anything through
+			s.SetTxValidator()
+			anyone := &redwood.Tx{ID: types.RandomID(), StateURI: "foo.bar/blah", From: testutils.RandomAddress(t)}
+			require.NoError(t, s.AddTx(anyone))
+		})
+	}
+}
+
+func TestValidateTxDAG(t *testing.T) {
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			s, cleanup := setup(t)
+			defer cleanup()
+
+			const stateURI = "foo.bar/blah"
+			genesis := &redwood.Tx{ID: redwood.GenesisTxID, StateURI: stateURI, Status: redwood.TxStatusValid}
+			require.NoError(t, redwood.ValidateTxDAG(s, genesis))
+			require.NoError(t, s.AddTx(genesis))
+
+			tx1 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Parents: []types.ID{genesis.ID}, Status: redwood.TxStatusValid}
+			require.NoError(t, redwood.ValidateTxDAG(s, tx1))
+			require.NoError(t, s.AddTx(tx1))
+
+			t.Run("valid", func(t *testing.T) {
+				tx := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Parents: []types.ID{genesis.ID, tx1.ID}}
+				require.NoError(t, redwood.ValidateTxDAG(s, tx))
+			})
+
+			t.Run("missing parent", func(t *testing.T) {
+				tx := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI, Parents: []types.ID{tx1.ID, types.RandomID()}}
+				err := redwood.ValidateTxDAG(s, tx)
+				require.True(t, errors.Is(err, redwood.ErrNoParentYet))
+				require.False(t, errors.Is(err, redwood.ErrTxCycle))
+			})
+
+			t.Run("cycle", func(t *testing.T) {
+				// tx2's parent is tx3, which hasn't arrived yet.  tx3 then
+				// claims tx2 as its parent.
+				tx2ID, tx3ID := types.RandomID(), types.RandomID()
+				tx2 := &redwood.Tx{ID: tx2ID, StateURI: stateURI, Parents: []types.ID{tx1.ID, tx3ID}, Status: redwood.TxStatusInMempool}
+				require.NoError(t, s.AddTx(tx2))
+
+				tx3 := &redwood.Tx{ID: tx3ID, StateURI: stateURI, Parents: []types.ID{tx2ID}}
+				err := redwood.ValidateTxDAG(s, tx3)
+				require.True(t, errors.Is(err, redwood.ErrTxCycle))
+				require.False(t, errors.Is(err, redwood.ErrNoParentYet))
+
+				self := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI}
+				self.Parents = []types.ID{self.ID}
+				err = redwood.ValidateTxDAG(s, self)
+				require.True(t, errors.Is(err, redwood.ErrTxCycle))
+			})
+		})
+	}
+}
+
+func TestTxStore_ExportImport(t *testing.T) {
+	collectTxs := func(t *testing.T, iter redwood.TxIterator) []*redwood.Tx {
+		t.Helper()
+		var txs []*redwood.Tx
+		for {
+			tx := iter.Next()
+			if tx == nil {
+				break
+			}
+			txs = append(txs, tx)
+		}
+		require.NoError(t, iter.Error())
+		return txs
+	}
+
+	for name, setup := range txStoreImpls {
+		setup := setup
+		t.Run(name, func(t *testing.T) {
+			src, cleanupSrc := setup(t)
+			defer cleanupSrc()
+
+			const (
+				stateURI1 = "foo.bar/blah"
+				stateURI2 = "some.other/uri"
+			)
+			sender := testutils.RandomAddress(t)
+
+			genesis1 := &redwood.Tx{ID: redwood.GenesisTxID, StateURI: stateURI1, From: sender, Status: redwood.TxStatusValid}
+			tx1 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI1, From: sender, Parents: []types.ID{genesis1.ID}, Status: redwood.TxStatusValid}
+			tx2 := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI1, From: sender, Parents: []types.ID{tx1.ID}, Status: redwood.TxStatusValid}
+			pending := &redwood.Tx{ID: types.RandomID(), StateURI: stateURI1, From: sender, Parents: []types.ID{tx1.ID}, Status: redwood.TxStatusInMempool}
+			genesis2 := &redwood.Tx{ID: redwood.GenesisTxID, StateURI: stateURI2, From: sender, Status: redwood.TxStatusValid}
+			for _, tx := range []*redwood.Tx{genesis1, tx1, tx2, pending, genesis2} {
+				require.NoError(t, src.AddTx(tx))
+			}
+			// The leaves aren't the ones that the txs' statuses and children
+			// suggest (tx1 has children, and genesis2 isn't a leaf), so they
+			// can only be restored if they're exported
+			require.NoError(t, src.MarkLeaf(stateURI1, tx2.ID))
+			require.NoError(t, src.MarkLeaf(stateURI1, tx1.ID))
+
+			exported := collectTxs(t, src.ExportAllTxs(context.Background()))
+			require.Len(t, exported, 5)
+
+			// The order is stable, and grouped by state URI
+			require.Equal(t, exported, collectTxs(t, src.ExportAllTxs(context.Background())))
+			for i := 1; i < len(exported); i++ {
+				if exported[i].StateURI != exported[i-1].StateURI {
+					for _, tx := range exported[i:] {
+						require.Equal(t, exported[i].StateURI, tx.StateURI)
+					}
+					break
+				}
+			}
+
+			dst, cleanupDst := setup(t)
+			defer cleanupDst()
+
+			// Children first, to show that the order doesn't matter
+			reversed := make([]*redwood.Tx, len(exported))
+			for i, tx := range exported {
+				reversed[len(exported)-1-i] = tx
+			}
+			err := dst.ImportTxs(redwood.NewTxSliceIterator(reversed))
+			require.NoError(t, err)
+
+			require.Equal(t, exported, collectTxs(t, dst.ExportAllTxs(context.Background())))
+
+			expectedLeaves := map[types.StateURI][]types.ID{
+				stateURI1: {tx1.ID, tx2.ID},
+				stateURI2: nil,
+			}
+			for stateURI, expected := range expectedLeaves {
+				srcLeaves, err := src.Leaves(stateURI)
+				require.NoError(t, err)
+				require.ElementsMatch(t, expected, srcLeaves)
+				dstLeaves, err := dst.Leaves(stateURI)
+				require.NoError(t, err)
+				require.ElementsMatch(t, expected, dstLeaves)
+			}
+
+			stateURIs, err := dst.KnownStateURIs()
+			require.NoError(t, err)
+			require.ElementsMatch(t, []types.StateURI{stateURI1, stateURI2}, stateURIs)
+
+			require.Len(t, collectTxIDs(t, dst.TxsBySender(stateURI1, sender)), 4)
+
+			t.Run("canceled context", func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				iter := src.ExportAllTxs(ctx)
+				require.NotNil(t, iter.Next())
+				cancel()
+
+				// At most one more tx can already be on its way
+				var remaining int
+				for iter.Next() != nil {
+					remaining++
+				}
+				require.True(t, remaining <= 1)
+				require.Equal(t, context.Canceled, iter.Error())
+			})
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package types
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// StateURI names a state tree.  It has the form host/path, where host is the
+// authoritative host for the tree (a hostname, optionally with a port) and
+// path is one or more non-empty, slash-separated segments.
+//
+// A StateURI obtained from ParseStateURI or UnmarshalText is always well
+// formed.  Converting a string directly skips the checks.
+type StateURI string
+
+var ErrInvalidStateURI = errors.New("invalid state URI")
+
+func ParseStateURI(s string) (StateURI, error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return "", errors.Wrapf(ErrInvalidStateURI, "'%v' has no path", s)
+	}
+	host, path := s[:i], s[i+1:]
+
+	err := validateStateURIHost(host)
+	if err != nil {
+		return "", errors.Wrapf(err, "'%v'", s)
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			return "", errors.Wrapf(ErrInvalidStateURI, "'%v' has an empty path segment", s)
+		}
+		for _, r := range segment {
+			if unicode.IsSpace(r) || unicode.IsControl(r) {
+				return "", errors.Wrapf(ErrInvalidStateURI, "'%v' contains whitespace or control characters", s)
+			}
+		}
+	}
+	return StateURI(s), nil
+}
+
+func validateStateURIHost(host string) error {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		port := host[i+1:]
+		if port == "" {
+			return errors.Wrap(ErrInvalidStateURI, "empty port")
+		}
+		for _, r := range port {
+			if r < '0' || r > '9' {
+				return errors.Wrapf(ErrInvalidStateURI, "bad port '%v'", port)
+			}
+		}
+		host = host[:i]
+	}
+	if host == "" {
+		return errors.Wrap(ErrInvalidStateURI, "empty host")
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return errors.Wrapf(ErrInvalidStateURI, "bad host '%v'", host)
+		} else if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.Wrapf(ErrInvalidStateURI, "bad host '%v'", host)
+		}
+		for _, r := range label {
+			isAlnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+			if !isAlnum && r != '-' {
+				return errors.Wrapf(ErrInvalidStateURI, "bad host '%v'", host)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if the URI isn't well formed.
+func (u StateURI) Validate() error {
+	_, err := ParseStateURI(string(u))
+	return err
+}
+
+func (u StateURI) String() string {
+	return string(u)
+}
+
+// Host returns the host part of the URI, including the port, if any.
+func (u StateURI) Host() string {
+	return strings.SplitN(string(u), "/", 2)[0]
+}
+
+func (u StateURI) MarshalText() ([]byte, error) {
+	return []byte(u), nil
+}
+
+func (u *StateURI) UnmarshalText(text []byte) error {
+	parsed, err := ParseStateURI(string(text))
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
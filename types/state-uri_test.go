@@ -0,0 +1,86 @@
+package types_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"redwood.dev/types"
+)
+
+func TestParseStateURI(t *testing.T) {
+	valid := []string{
+		"foo.bar/blah",
+		"chat.local/servers",
+		"somegitprovider.org/gitdemo",
+		"a.com/1",
+		"localhost/x",
+		"localhost:8080/x",
+		"my-host.example.com/a/b/c",
+		"foo.bar/private-0123abcd",
+		"foo.bar/with.dots_and-dashes",
+	}
+	for _, s := range valid {
+		s := s
+		t.Run(s, func(t *testing.T) {
+			uri, err := types.ParseStateURI(s)
+			require.NoError(t, err)
+			require.Equal(t, s, uri.String())
+			require.NoError(t, uri.Validate())
+		})
+	}
+
+	invalid := []string{
+		"",
+		"foo.bar",
+		"foo.bar/",
+		"/blah",
+		"foo..bar/blah",
+		".foo.bar/blah",
+		"-foo.bar/blah",
+		"foo-.bar/blah",
+		"foo_bar.com/blah",
+		"foo.bar:/blah",
+		"foo.bar:80a/blah",
+		":8080/blah",
+		"foo.bar//blah",
+		"foo.bar/blah/",
+		"foo.bar/bl ah",
+		"foo.bar/bl\tah",
+		"foo.bar/bl\x00ah",
+		"foo bar/blah",
+		"https://foo.bar/blah",
+	}
+	for _, s := range invalid {
+		s := s
+		t.Run(s, func(t *testing.T) {
+			_, err := types.ParseStateURI(s)
+			require.True(t, errors.Is(err, types.ErrInvalidStateURI), "%v", err)
+			require.Error(t, types.StateURI(s).Validate())
+		})
+	}
+}
+
+func TestStateURI_Host(t *testing.T) {
+	require.Equal(t, "foo.bar", types.StateURI("foo.bar/blah/quux").Host())
+	require.Equal(t, "localhost:8080", types.StateURI("localhost:8080/x").Host())
+}
+
+func TestStateURI_Text(t *testing.T) {
+	type doc struct {
+		StateURI types.StateURI `json:"stateURI"`
+	}
+
+	bs, err := json.Marshal(doc{StateURI: "foo.bar/blah"})
+	require.NoError(t, err)
+	require.Equal(t, `{"stateURI":"foo.bar/blah"}`, string(bs))
+
+	var decoded doc
+	require.NoError(t, json.Unmarshal(bs, &decoded))
+	require.Equal(t, types.StateURI("foo.bar/blah"), decoded.StateURI)
+
+	err = json.Unmarshal([]byte(`{"stateURI":"foo.bar"}`), &decoded)
+	require.True(t, errors.Is(err, types.ErrInvalidStateURI))
+}
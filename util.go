@@ -1,13 +1,25 @@
 package redwood
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io"
+	"math"
+	"math/big"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// "github.com/json-iterator/go"
 	"github.com/pkg/errors"
@@ -18,16 +30,61 @@ import (
 //var json = jsoniter.ConfigFastest
 //var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-var log = ctx.NewLogger("hi")
+var log = ctx.NewLogger("redwood")
 
-func combineErrors(errs []error) string {
+// MultiError aggregates several errors into one.  errors.Is and errors.As
+// look through it at each of the errors it holds.
+type MultiError []error
+
+func (e MultiError) Error() string {
 	var errStrings []string
-	for _, err := range errs {
+	for _, err := range e {
 		errStrings = append(errStrings, err.Error())
 	}
 	return strings.Join(errStrings, "\n")
 }
 
+// Unwrap is what errors.Is and errors.As use to traverse a MultiError as of
+// Go 1.20.
+func (e MultiError) Unwrap() []error {
+	return []error(e)
+}
+
+// Is and As do the same for older versions of Go, which only follow single
+// errors returned by Unwrap.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// combineErrors returns a MultiError holding the non-nil errors in errs, or
+// nil if there aren't any.
+func combineErrors(errs []error) error {
+	var nonNil MultiError
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+	if len(nonNil) == 0 {
+		return nil
+	}
+	return nonNil
+}
+
 func getValue(x interface{}, keypath []string) (interface{}, bool) {
 	for i := 0; i < len(keypath); i++ {
 		if asMap, isMap := x.(map[string]interface{}); isMap {
@@ -41,7 +98,7 @@ func getValue(x interface{}, keypath []string) (interface{}, bool) {
 			sliceIdx, err := strconv.ParseInt(keypath[i], 10, 64)
 			if err != nil {
 				return nil, false
-			} else if sliceIdx > int64(len(asSlice)-1) {
+			} else if sliceIdx < 0 || sliceIdx > int64(len(asSlice)-1) {
 				return nil, false
 			}
 			x = asSlice[sliceIdx]
@@ -53,6 +110,17 @@ func getValue(x interface{}, keypath []string) (interface{}, bool) {
 	return x, true
 }
 
+// getSubtree returns the map at prefix.  It returns false if there's nothing
+// there, or if what's there isn't a map (a scalar or a slice).
+func getSubtree(m interface{}, prefix []string) (map[string]interface{}, bool) {
+	x, exists := getValue(m, prefix)
+	if !exists {
+		return nil, false
+	}
+	subtree, isMap := x.(map[string]interface{})
+	return subtree, isMap
+}
+
 func getString(m interface{}, keypath []string) (string, bool) {
 	x, exists := getValue(m, keypath)
 	if !exists {
@@ -65,16 +133,65 @@ func getString(m interface{}, keypath []string) (string, bool) {
 }
 
 func getInt(m interface{}, keypath []string) (int, bool) {
+	i, exists := getInt64(m, keypath)
+	if !exists || int64(int(i)) != i {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// getInt64 accepts any of the numeric types that commonly appear in a state
+// tree (including the float64s produced by json.Unmarshal), but only succeeds
+// if the number has no fractional part and fits in an int64.
+func getInt64(m interface{}, keypath []string) (int64, bool) {
 	x, exists := getValue(m, keypath)
 	if !exists {
 		return 0, false
 	}
-	if i, isInt := x.(int); isInt {
+	switch n := x.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		// NaN fails the first check and ±Inf the second.  -2^63 and 2^63 are
+		// exact as float64s, unlike math.MaxInt64.
+		if n != math.Trunc(n) || n < -(1<<63) || n >= 1<<63 {
+			return 0, false
+		}
+		return int64(n), true
+	case json.Number:
+		i, err := n.Int64()
+		if err != nil {
+			return 0, false
+		}
 		return i, true
 	}
 	return 0, false
 }
 
+func getFloat64(m interface{}, keypath []string) (float64, bool) {
+	x, exists := getValue(m, keypath)
+	if !exists {
+		return 0, false
+	}
+	switch n := x.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		if err != nil {
+			return 0, false
+		}
+		return f, true
+	}
+	return 0, false
+}
+
 func getMap(m interface{}, keypath []string) (map[string]interface{}, bool) {
 	x, exists := getValue(m, keypath)
 	if !exists {
@@ -108,43 +225,154 @@ func getBool(m interface{}, keypath []string) (bool, bool) {
 	return false, false
 }
 
-func setValueAtKeypath(x interface{}, keypath []string, val interface{}, clobber bool) {
+// setValueAtKeypath sets `val` at the given keypath.  If `clobber` is true,
+// missing intermediate maps are created and slices are grown (filling with nil)
+// as needed.  Because a slice can only be grown by replacing it in its own
+// parent, the top-level value passed as `x` can't be grown.
+func setValueAtKeypath(x interface{}, keypath []string, val interface{}, clobber bool) error {
 	if len(keypath) == 0 {
-		panic("setValueAtKeypath: len(keypath) == 0")
+		return errors.New("setValueAtKeypath: len(keypath) == 0")
+	}
+
+	updated, err := setValueAtKeypathInner(x, keypath, val, clobber)
+	if err != nil {
+		return err
+	}
+	if asSlice, isSlice := x.([]interface{}); isSlice && len(updated.([]interface{})) != len(asSlice) {
+		return errors.New("setValueAtKeypath: cannot grow top-level slice")
 	}
+	return nil
+}
 
-	var cur interface{} = x
-	for i := 0; i < len(keypath)-1; i++ {
-		key := keypath[i]
+// setValueAtKeypathInner returns `cur`, or its replacement if `cur` is a slice
+// that had to be grown.
+func setValueAtKeypathInner(cur interface{}, keypath []string, val interface{}, clobber bool) (interface{}, error) {
+	key := keypath[0]
 
-		if asMap, isMap := cur.(map[string]interface{}); isMap {
-			var exists bool
-			cur, exists = asMap[key]
-			if !exists {
-				if !clobber {
-					return
-				}
-				asMap[key] = make(map[string]interface{})
-				cur = asMap[key]
+	switch cur := cur.(type) {
+	case map[string]interface{}:
+		if len(keypath) == 1 {
+			cur[key] = val
+			return cur, nil
+		}
+
+		child, exists := cur[key]
+		if !exists {
+			if !clobber {
+				return cur, nil
 			}
+			child = make(map[string]interface{})
+		}
 
-		} else if asSlice, isSlice := cur.([]interface{}); isSlice {
-			i, err := strconv.Atoi(key)
-			if err != nil {
-				panic(err)
+		child, err := setValueAtKeypathInner(child, keypath[1:], val, clobber)
+		if err != nil {
+			return nil, err
+		}
+		cur[key] = child
+		return cur, nil
+
+	case []interface{}:
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 {
+			return nil, errors.Errorf("setValueAtKeypath: bad slice index '%v'", key)
+		}
+
+		if idx >= len(cur) {
+			if !clobber {
+				return nil, errors.Errorf("setValueAtKeypath: slice index %v out of range (length %v)", idx, len(cur))
 			}
-			cur = asSlice[i]
-		} else {
-			panic(fmt.Sprintf("setValueAtKeypath: bad type (%T)", cur))
+			grown := make([]interface{}, idx+1)
+			copy(grown, cur)
+			cur = grown
+		}
+
+		if len(keypath) == 1 {
+			cur[idx] = val
+			return cur, nil
+		}
+
+		child := cur[idx]
+		if child == nil && clobber {
+			child = make(map[string]interface{})
+		}
+
+		child, err = setValueAtKeypathInner(child, keypath[1:], val, clobber)
+		if err != nil {
+			return nil, err
 		}
+		cur[idx] = child
+		return cur, nil
+
+	default:
+		return nil, errors.Errorf("setValueAtKeypath: bad type (%T)", cur)
 	}
-	if asMap, isMap := cur.(map[string]interface{}); isMap {
-		asMap[keypath[len(keypath)-1]] = val
-	} else {
-		panic(fmt.Sprintf("setValueAtKeypath: bad final type (%T)", cur))
+}
+
+// deleteValueAtKeypath removes the value at the given keypath from its parent
+// map or slice.  Slice elements after the deleted one are shifted down.  It
+// returns false (and does nothing) if the keypath doesn't resolve.  Because a
+// slice can only be shrunk by replacing it in its own parent, the top-level
+// value passed as `x` must be a map.
+func deleteValueAtKeypath(x interface{}, keypath []string) bool {
+	if len(keypath) == 0 {
+		return false
+	}
+
+	parentKeypath := keypath[:len(keypath)-1]
+	key := keypath[len(keypath)-1]
+
+	parent, exists := getValue(x, parentKeypath)
+	if !exists {
+		return false
+	}
+
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		if _, exists := parent[key]; !exists {
+			return false
+		}
+		delete(parent, key)
+		return true
+
+	case []interface{}:
+		if len(parentKeypath) == 0 {
+			return false
+		}
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 || idx >= len(parent) {
+			return false
+		}
+
+		grandparent, _ := getValue(x, parentKeypath[:len(parentKeypath)-1])
+		parentKey := parentKeypath[len(parentKeypath)-1]
+
+		copy(parent[idx:], parent[idx+1:])
+		parent[len(parent)-1] = nil
+		shrunk := parent[:len(parent)-1]
+
+		switch grandparent := grandparent.(type) {
+		case map[string]interface{}:
+			grandparent[parentKey] = shrunk
+		case []interface{}:
+			parentIdx, _ := strconv.Atoi(parentKey)
+			grandparent[parentIdx] = shrunk
+		}
+		return true
+
+	default:
+		return false
 	}
 }
 
+var (
+	// errStopWalk can be returned from a walkTree callback to halt the walk
+	// without causing walkTree to return an error.
+	errStopWalk = errors.New("stop walk")
+	// errSkipSubtree can be returned from a walkTree callback to prevent the
+	// walk from descending into the current value's children.
+	errSkipSubtree = errors.New("skip subtree")
+)
+
 func walkTree(tree interface{}, fn func(keypath []string, val interface{}) error) error {
 	type item struct {
 		val     interface{}
@@ -159,7 +387,11 @@ func walkTree(tree interface{}, fn func(keypath []string, val interface{}) error
 		stack = stack[1:]
 
 		err := fn(current.keypath, current.val)
-		if err != nil {
+		if err == errStopWalk {
+			return nil
+		} else if err == errSkipSubtree {
+			continue
+		} else if err != nil {
 			return err
 		}
 
@@ -189,14 +421,35 @@ func walkTree(tree interface{}, fn func(keypath []string, val interface{}) error
 	return nil
 }
 
+// walkSubtree is like walkTree, but only walks the value at prefix (and its
+// descendants), without visiting the rest of the tree.  The keypaths passed
+// to fn include the prefix.  If there's nothing at prefix, fn isn't called.
+func walkSubtree(tree interface{}, prefix []string, fn func(keypath []string, val interface{}) error) error {
+	subtree, exists := getValue(tree, prefix)
+	if !exists {
+		return nil
+	}
+	return walkTree(subtree, func(relKeypath []string, val interface{}) error {
+		keypath := make([]string, len(prefix)+len(relKeypath))
+		copy(keypath, prefix)
+		copy(keypath[len(prefix):], relKeypath)
+		return fn(keypath, val)
+	})
+}
+
 func mapTree(tree interface{}, fn func(keypath []string, val interface{}) (interface{}, error)) (interface{}, error) {
+	return mapTreeAt(tree, []string{}, fn)
+}
+
+// mapTreeAt is mapTree for a subtree rooted at `rootKeypath` in some larger tree.
+func mapTreeAt(tree interface{}, rootKeypath []string, fn func(keypath []string, val interface{}) (interface{}, error)) (interface{}, error) {
 	type item struct {
 		val     interface{}
 		parent  interface{}
 		keypath []string
 	}
 
-	stack := []item{{val: tree, keypath: []string{}}}
+	stack := []item{{val: tree, keypath: rootKeypath}}
 	var current item
 	var firstLoop = true
 
@@ -252,6 +505,92 @@ func mapTree(tree interface{}, fn func(keypath []string, val interface{}) (inter
 	return tree, nil
 }
 
+// mapTreeParallel produces the same result as mapTree, but spreads the work
+// across `workers` goroutines.  It maps the top of the tree itself, a level at
+// a time, until the tree has split into at least `workers` independent
+// subtrees (or run out), and then maps those subtrees with fanOut.  That way,
+// a tree whose root has only a few children still keeps every worker busy.
+// `fn` must be safe to call concurrently.  If it panics, the panic is
+// re-raised on the calling goroutine.
+func mapTreeParallel(tree interface{}, workers int, fn func(keypath []string, val interface{}) (interface{}, error)) (interface{}, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// A subtree that hasn't been mapped yet, and how to put its result into
+	// its parent
+	type subtree struct {
+		val     interface{}
+		keypath []string
+		set     func(val interface{})
+	}
+
+	var result interface{}
+	subtrees := []subtree{{val: tree, keypath: []string{}, set: func(val interface{}) { result = val }}}
+
+	for len(subtrees) > 0 && len(subtrees) < workers {
+		var next []subtree
+		for _, st := range subtrees {
+			val, err := fn(st.keypath, st.val)
+			if err != nil {
+				return nil, err
+			}
+			st.set(val)
+
+			switch val := val.(type) {
+			case map[string]interface{}:
+				for key := range val {
+					key := key
+					next = append(next, subtree{
+						val:     val[key],
+						keypath: append(st.keypath[:len(st.keypath):len(st.keypath)], key),
+						set:     func(child interface{}) { val[key] = child },
+					})
+				}
+			case []interface{}:
+				for i := range val {
+					i := i
+					next = append(next, subtree{
+						val:     val[i],
+						keypath: append(st.keypath[:len(st.keypath):len(st.keypath)], strconv.Itoa(i)),
+						set:     func(child interface{}) { val[i] = child },
+					})
+				}
+			}
+		}
+		subtrees = next
+	}
+
+	// Subtrees can share a parent, so the workers only fill in their own
+	// slots here, and the results are put into the tree afterwards
+	results := make([]interface{}, len(subtrees))
+	errs := make([]error, len(subtrees))
+	var (
+		panicked   interface{}
+		panickedMu sync.Mutex
+	)
+	fanOut(len(subtrees), workers, func(i int) {
+		results[i], errs[i] = mapTreeAt(subtrees[i].val, subtrees[i].keypath, fn)
+	}, func(recovered interface{}, stack []byte) {
+		panickedMu.Lock()
+		defer panickedMu.Unlock()
+		if panicked == nil {
+			panicked = recovered
+		}
+	})
+	if panicked != nil {
+		panic(panicked)
+	}
+
+	for i := range subtrees {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		subtrees[i].set(results[i])
+	}
+	return result, nil
+}
+
 func walkContentTypes(state interface{}, contentTypes []string, fn func(contentType string, keypath []string, val map[string]interface{}) error) error {
 	return walkTree(state, func(keypath []string, val interface{}) error {
 		asMap, isMap := val.(map[string]interface{})
@@ -291,6 +630,107 @@ func PrettyJSON(x interface{}) string {
 	return string(j)
 }
 
+// canonicalJSON encodes val as JSON with object keys sorted.  Structs and
+// other typed values are encoded as the objects, arrays, and scalars that
+// they marshal to.  Numbers keep exactly the digits that encoding/json writes
+// for them (they're never squeezed through a float64), so distinct integers
+// can't encode the same.  For the plain values produced by decoding JSON, the
+// result is identical to json.Marshal's.
+//
+// []byte values are encoded as b64"..." tokens, which aren't valid JSON and so
+// can't collide with any other value (decodePatchValue reads them back).
+// []byte fields inside structs are encoded as encoding/json encodes them.
+func canonicalJSON(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeCanonicalJSON(&buf, val)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, val interface{}) error {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			bs, err := json.Marshal(key)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			buf.Write(bs)
+			buf.WriteByte(':')
+			err = writeCanonicalJSON(buf, v[key])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+
+	case []interface{}:
+		if v == nil {
+			buf.WriteString("null")
+			return nil
+		}
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeCanonicalJSON(buf, elem)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+
+	case []byte:
+		if v != nil {
+			buf.WriteString(`b64"`)
+			buf.WriteString(base64.StdEncoding.EncodeToString(v))
+			buf.WriteByte('"')
+			return nil
+		}
+
+	case nil, bool, string, json.Number,
+		float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+
+	default:
+		// Anything else is re-read as the generic value it marshals to, with
+		// numbers left as written
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(bs))
+		decoder.UseNumber()
+		var generic interface{}
+		err = decoder.Decode(&generic)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return writeCanonicalJSON(buf, generic)
+	}
+
+	bs, err := json.Marshal(val)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf.Write(bs)
+	return nil
+}
+
 // @@TODO: everything about this is horrible
 func DeepCopyJSValue(val interface{}) interface{} {
 	bs, err := json.Marshal(val)
@@ -305,14 +745,126 @@ func DeepCopyJSValue(val interface{}) interface{} {
 	return copied
 }
 
+// DeepEqualJSValue structurally compares two trees of the kind produced by
+// JSON decoding.  Numbers of different Go types are equal if they're
+// mathematically equal.  Any other leaves are compared with reflect.DeepEqual
+// (or bytes.Equal for []byte), so uncomparable values don't cause a panic.
+func DeepEqualJSValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, isMap := b.(map[string]interface{})
+		if !isMap || len(a) != len(b) {
+			return false
+		}
+		for key, aVal := range a {
+			bVal, exists := b[key]
+			if !exists || !DeepEqualJSValue(aVal, bVal) {
+				return false
+			}
+		}
+		return true
+
+	case []interface{}:
+		b, isSlice := b.([]interface{})
+		if !isSlice || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !DeepEqualJSValue(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+
+	case []byte:
+		b, isBytes := b.([]byte)
+		return isBytes && bytes.Equal(a, b)
+	}
+
+	if aRat, aFloat, isNum := jsNumberValue(a); isNum {
+		bRat, bFloat, isNum := jsNumberValue(b)
+		if !isNum {
+			return false
+		} else if aRat != nil && bRat != nil {
+			return aRat.Cmp(bRat) == 0
+		} else if aRat == nil && bRat == nil {
+			return aFloat == bFloat
+		}
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// jsNumberValue returns x as an exact rational, so that integers too large
+// for a float64's mantissa aren't rounded before they're compared.  Infinities
+// and NaN have no rational value, so those come back as a float64 instead.
+func jsNumberValue(x interface{}) (*big.Rat, float64, bool) {
+	switch n := x.(type) {
+	case float64:
+		if math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, n, true
+		}
+		return new(big.Rat).SetFloat64(n), 0, true
+	case float32:
+		return jsNumberValue(float64(n))
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), 0, true
+	case int32:
+		return new(big.Rat).SetInt64(int64(n)), 0, true
+	case int64:
+		return new(big.Rat).SetInt64(n), 0, true
+	case uint:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(uint64(n))), 0, true
+	case uint32:
+		return new(big.Rat).SetInt64(int64(n)), 0, true
+	case uint64:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(n)), 0, true
+	case json.Number:
+		r, ok := new(big.Rat).SetString(string(n))
+		return r, 0, ok
+	}
+	return nil, 0, false
+}
+
 func SniffContentType(filename string, data io.Reader) (string, error) {
-	// Only the first 512 bytes are used to sniff the content type.
-	buffer := make([]byte, 512)
+	contentType, _, err := sniffContentType(filename, data)
+	return contentType, err
+}
 
-	_, err := data.Read(buffer)
+// SniffContentTypeSeeker is like SniffContentType, but seeks back to the
+// beginning of the data once it's done so that the caller can read it again.
+func SniffContentTypeSeeker(filename string, data io.ReadSeeker) (string, error) {
+	contentType, _, err := sniffContentType(filename, data)
 	if err != nil {
 		return "", err
 	}
+	_, err = data.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return contentType, nil
+}
+
+// SniffAndReturn is like SniffContentType, but also returns a reader that
+// yields the full, unconsumed data (including the bytes used for sniffing).
+func SniffAndReturn(filename string, data io.Reader) (string, io.Reader, error) {
+	contentType, sniffed, err := sniffContentType(filename, data)
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, io.MultiReader(bytes.NewReader(sniffed), data), nil
+}
+
+func sniffContentType(filename string, data io.Reader) (string, []byte, error) {
+	// Only the first 512 bytes are used to sniff the content type.
+	buffer := make([]byte, 512)
+
+	// Files shorter than 512 bytes are fine, we just sniff whatever we got.
+	n, err := io.ReadFull(data, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	buffer = buffer[:n]
 
 	// Use the net/http package's handy DectectContentType function. Always returns a valid
 	// content-type by returning "application/octet-stream" if no others seemed to match.
@@ -322,27 +874,32 @@ func SniffContentType(filename string, data io.Reader) (string, error) {
 	if contentType == "application/octet-stream" {
 		contentType = GuessContentTypeFromFilename(filename)
 	}
-	return contentType, nil
+	return contentType, buffer, nil
 }
 
 func GuessContentTypeFromFilename(filename string) string {
-	parts := strings.Split(filename, ".")
-	if len(parts) > 1 {
-		ext := strings.ToLower(parts[len(parts)-1])
-		switch ext {
-		case "txt":
-			return "text/plain"
-		case "html":
-			return "text/html"
-		case "js":
-			return "application/js"
-		case "json":
-			return "application/json"
-		case "png":
-			return "image/png"
-		case "jpg", "jpeg":
-			return "image/jpeg"
-		}
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	// These entries intentionally differ from (or pin down) what the mime package returns
+	switch ext {
+	case "":
+		return "application/octet-stream"
+	case ".txt":
+		return "text/plain"
+	case ".html":
+		return "text/html"
+	case ".js":
+		return "application/javascript"
+	case ".json":
+		return "application/json"
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	}
+
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
 	}
 	return "application/octet-stream"
 }
@@ -357,9 +914,19 @@ type workQueue struct {
 	chWork   chan struct{}
 	chStop   chan struct{}
 	chDone   chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	stopped  bool
 }
 
 func NewWorkQueue(size int, callback func()) WorkQueue {
+	return NewWorkQueueWithContext(context.Background(), size, callback)
+}
+
+// NewWorkQueueWithContext is like NewWorkQueue, but the worker also exits
+// when ctx is canceled, which ties the queue to a parent's lifecycle.  Unlike
+// Stop, cancellation doesn't run the callback for work that's still pending.
+func NewWorkQueueWithContext(ctx context.Context, size int, callback func()) WorkQueue {
 	q := &workQueue{
 		callback: callback,
 		chWork:   make(chan struct{}, size),
@@ -367,27 +934,131 @@ func NewWorkQueue(size int, callback func()) WorkQueue {
 		chDone:   make(chan struct{}),
 	}
 
-	go q.workerLoop()
+	go q.workerLoop(ctx)
 
 	return q
 }
 
 func (q *workQueue) Stop() {
-	close(q.chWork)
+	q.stopOnce.Do(func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.stopped = true
+		close(q.chStop)
+	})
 	<-q.chDone
 }
 
 func (q *workQueue) Enqueue() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+
 	select {
 	case q.chWork <- struct{}{}:
 	default:
 	}
 }
 
-func (q *workQueue) workerLoop() {
-	defer func() {
-		if len(q.chWork) > 0 {
+func (q *workQueue) workerLoop(ctx context.Context) {
+	defer close(q.chDone)
+
+	for {
+		select {
+		case <-q.chWork:
 			q.callback()
+
+		case <-q.chStop:
+			// Flush anything that was enqueued before Stop
+			if len(q.chWork) > 0 {
+				q.callback()
+			}
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type debouncedWorkQueue struct {
+	callback func()
+	quiet    time.Duration
+	maxDelay time.Duration
+	chWork   chan struct{}
+	chDone   chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	stopped  bool
+}
+
+// NewDebouncedWorkQueue returns a WorkQueue that waits until no new work has
+// been enqueued for `quiet` before running its callback.  Under a continuous
+// stream of enqueues, the callback still runs at least once every `maxDelay`.
+func NewDebouncedWorkQueue(quiet, maxDelay time.Duration, callback func()) WorkQueue {
+	q := &debouncedWorkQueue{
+		callback: callback,
+		quiet:    quiet,
+		maxDelay: maxDelay,
+		chWork:   make(chan struct{}, 1),
+		chDone:   make(chan struct{}),
+	}
+
+	go q.workerLoop()
+
+	return q
+}
+
+func (q *debouncedWorkQueue) Stop() {
+	q.stopOnce.Do(func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.stopped = true
+		close(q.chWork)
+	})
+	<-q.chDone
+}
+
+func (q *debouncedWorkQueue) Enqueue() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+
+	select {
+	case q.chWork <- struct{}{}:
+	default:
+	}
+}
+
+func (q *debouncedWorkQueue) workerLoop() {
+	var (
+		pending       bool
+		quietTimer    *time.Timer
+		deadlineTimer *time.Timer
+		chQuiet       <-chan time.Time
+		chDeadline    <-chan time.Time
+	)
+
+	fire := func() {
+		if quietTimer != nil {
+			quietTimer.Stop()
+		}
+		if deadlineTimer != nil {
+			deadlineTimer.Stop()
+		}
+		chQuiet = nil
+		chDeadline = nil
+		pending = false
+		q.callback()
+	}
+
+	defer func() {
+		if pending || len(q.chWork) > 0 {
+			fire()
 		}
 		close(q.chDone)
 	}()
@@ -398,10 +1069,67 @@ func (q *workQueue) workerLoop() {
 			if !open {
 				return
 			}
-			q.callback()
 
-		case <-q.chStop:
-			return
+			if !pending {
+				pending = true
+				deadlineTimer = time.NewTimer(q.maxDelay)
+				chDeadline = deadlineTimer.C
+			}
+			if quietTimer != nil {
+				quietTimer.Stop()
+			}
+			quietTimer = time.NewTimer(q.quiet)
+			chQuiet = quietTimer.C
+
+		case <-chQuiet:
+			fire()
+
+		case <-chDeadline:
+			fire()
 		}
 	}
 }
+
+// fanOut calls fn(i) for every i in [0, n) on a pool of at most `workers`
+// goroutines, and returns once all of the calls have.  A call that panics
+// doesn't stop the others: the panic is recovered and handed to onPanic
+// (along with the panicking goroutine's stack), if it's non-nil.
+func fanOut(n, workers int, fn func(i int), onPanic func(recovered interface{}, stack []byte)) {
+	call := func(i int) {
+		defer func() {
+			if r := recover(); r != nil && onPanic != nil {
+				onPanic(r, debug.Stack())
+			}
+		}()
+		fn(i)
+	}
+
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			call(i)
+		}
+		return
+	}
+
+	var (
+		wg   sync.WaitGroup
+		next int64 = -1
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				call(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
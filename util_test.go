@@ -0,0 +1,732 @@
+package redwood
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebouncedWorkQueue(t *testing.T) {
+	t.Run("waits for a quiet period", func(t *testing.T) {
+		var calls int32
+		q := NewDebouncedWorkQueue(50*time.Millisecond, 5*time.Second, func() {
+			atomic.AddInt32(&calls, 1)
+		})
+		defer q.Stop()
+
+		for i := 0; i < 100; i++ {
+			q.Enqueue()
+		}
+		require.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+		time.Sleep(200 * time.Millisecond)
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("never waits longer than maxDelay", func(t *testing.T) {
+		var calls int32
+		q := NewDebouncedWorkQueue(50*time.Millisecond, 100*time.Millisecond, func() {
+			atomic.AddInt32(&calls, 1)
+		})
+		defer q.Stop()
+
+		start := time.Now()
+		for time.Since(start) < 550*time.Millisecond {
+			q.Enqueue()
+			time.Sleep(5 * time.Millisecond)
+		}
+		require.True(t, atomic.LoadInt32(&calls) >= 3)
+	})
+
+	t.Run("Stop drains a pending run", func(t *testing.T) {
+		var calls int32
+		q := NewDebouncedWorkQueue(time.Hour, time.Hour, func() {
+			atomic.AddInt32(&calls, 1)
+		})
+		q.Enqueue()
+		q.Stop()
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+}
+
+func TestWorkQueue_StopIsIdempotent(t *testing.T) {
+	queues := map[string]func() WorkQueue{
+		"WorkQueue":          func() WorkQueue { return NewWorkQueue(1, func() {}) },
+		"DebouncedWorkQueue": func() WorkQueue { return NewDebouncedWorkQueue(time.Millisecond, 10*time.Millisecond, func() {}) },
+	}
+
+	for name, newQueue := range queues {
+		newQueue := newQueue
+		t.Run(name, func(t *testing.T) {
+			q := newQueue()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					q.Stop()
+				}()
+				go func() {
+					defer wg.Done()
+					q.Enqueue()
+				}()
+			}
+			wg.Wait()
+
+			q.Stop()
+			q.Enqueue()
+		})
+	}
+}
+
+func TestWorkQueue_Stop(t *testing.T) {
+	var calls int32
+	chBlock := make(chan struct{})
+	q := NewWorkQueue(1, func() {
+		<-chBlock
+		atomic.AddInt32(&calls, 1)
+	})
+
+	// The first call blocks the worker so that the second stays pending
+	q.Enqueue()
+	time.Sleep(50 * time.Millisecond)
+	q.Enqueue()
+	close(chBlock)
+
+	q.Stop()
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	select {
+	case <-q.(*workQueue).chDone:
+	default:
+		t.Fatal("worker didn't exit")
+	}
+}
+
+func TestNewWorkQueueWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls int32
+	q := NewWorkQueueWithContext(ctx, 1, func() { atomic.AddInt32(&calls, 1) })
+
+	q.Enqueue()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case <-q.(*workQueue).chDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker didn't exit when the context was canceled")
+	}
+
+	// The queue is inert from now on, and Stop still returns
+	q.Enqueue()
+	q.Stop()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	} else if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestSniffContentType(t *testing.T) {
+	t.Run("short text file", func(t *testing.T) {
+		contentType, err := SniffContentType("foo", bytes.NewReader([]byte("abc")))
+		require.NoError(t, err)
+		require.Equal(t, "text/plain; charset=utf-8", contentType)
+	})
+
+	t.Run("empty reader", func(t *testing.T) {
+		contentType, err := SniffContentType("foo", bytes.NewReader(nil))
+		require.NoError(t, err)
+		require.Equal(t, "text/plain; charset=utf-8", contentType)
+	})
+
+	t.Run("reader returning one byte per Read", func(t *testing.T) {
+		html := []byte("<html><body>hello</body></html>")
+		contentType, err := SniffContentType("foo", &oneByteReader{data: html})
+		require.NoError(t, err)
+		require.Equal(t, "text/html; charset=utf-8", contentType)
+	})
+}
+
+func TestSniffContentTypeSeeker(t *testing.T) {
+	html := []byte("<html><body>hello</body></html>")
+	r := bytes.NewReader(html)
+
+	contentType, err := SniffContentTypeSeeker("foo", r)
+	require.NoError(t, err)
+	require.Equal(t, "text/html; charset=utf-8", contentType)
+
+	rest, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, html, rest)
+}
+
+func TestSniffAndReturn(t *testing.T) {
+	data := []byte(strings.Repeat("<html><body>hello</body></html>", 100))
+
+	contentType, r, err := SniffAndReturn("foo", &oneByteReader{data: data})
+	require.NoError(t, err)
+	require.Equal(t, "text/html; charset=utf-8", contentType)
+
+	all, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, all)
+}
+
+func TestGuessContentTypeFromFilename(t *testing.T) {
+	tests := []struct {
+		filename    string
+		contentType string
+	}{
+		{"index.html", "text/html"},
+		{"app.js", "application/javascript"},
+		{"photo.JPG", "image/jpeg"},
+		{"style.css", "text/css; charset=utf-8"},
+		{"logo.svg", "image/svg+xml"},
+		{"paper.pdf", "application/pdf"},
+		{"mystery.qwzx", "application/octet-stream"},
+		{"noextension", "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.contentType, GuessContentTypeFromFilename(test.filename), test.filename)
+	}
+}
+
+func TestDeleteValueAtKeypath(t *testing.T) {
+	makeState := func() map[string]interface{} {
+		return map[string]interface{}{
+			"foo": map[string]interface{}{
+				"bar": "baz",
+				"quux": map[string]interface{}{
+					"list": []interface{}{"a", "b", "c"},
+				},
+			},
+		}
+	}
+
+	t.Run("nested map key", func(t *testing.T) {
+		state := makeState()
+		require.True(t, deleteValueAtKeypath(state, []string{"foo", "bar"}))
+		_, exists := getValue(state, []string{"foo", "bar"})
+		require.False(t, exists)
+		_, exists = getValue(state, []string{"foo", "quux"})
+		require.True(t, exists)
+	})
+
+	t.Run("slice element", func(t *testing.T) {
+		state := makeState()
+		require.True(t, deleteValueAtKeypath(state, []string{"foo", "quux", "list", "1"}))
+		list, _ := getSlice(state, []string{"foo", "quux", "list"})
+		require.Equal(t, []interface{}{"a", "c"}, list)
+	})
+
+	t.Run("missing path", func(t *testing.T) {
+		state := makeState()
+		require.False(t, deleteValueAtKeypath(state, []string{"foo", "nope"}))
+		require.False(t, deleteValueAtKeypath(state, []string{"nope", "nope"}))
+		require.False(t, deleteValueAtKeypath(state, []string{"foo", "bar", "baz"}))
+		require.False(t, deleteValueAtKeypath(state, []string{"foo", "quux", "list", "3"}))
+		require.False(t, deleteValueAtKeypath(state, []string{"foo", "quux", "list", "x"}))
+		require.Equal(t, makeState(), state)
+	})
+}
+
+func TestSetValueAtKeypath(t *testing.T) {
+	t.Run("nested map, creating intermediate maps", func(t *testing.T) {
+		state := map[string]interface{}{}
+		err := setValueAtKeypath(state, []string{"foo", "bar"}, "baz", true)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"foo": map[string]interface{}{"bar": "baz"}}, state)
+	})
+
+	t.Run("appending past the end of a slice", func(t *testing.T) {
+		state := map[string]interface{}{"list": []interface{}{"a", "b"}}
+		err := setValueAtKeypath(state, []string{"list", "3"}, "x", true)
+		require.NoError(t, err)
+		require.Equal(t, []interface{}{"a", "b", nil, "x"}, state["list"])
+	})
+
+	t.Run("past the end of a slice without clobber", func(t *testing.T) {
+		state := map[string]interface{}{"list": []interface{}{"a", "b"}}
+		err := setValueAtKeypath(state, []string{"list", "3"}, "x", false)
+		require.Error(t, err)
+		require.Equal(t, []interface{}{"a", "b"}, state["list"])
+	})
+
+	t.Run("non-integer index on a slice", func(t *testing.T) {
+		state := map[string]interface{}{"list": []interface{}{"a", "b"}}
+		err := setValueAtKeypath(state, []string{"list", "foo"}, "x", true)
+		require.Error(t, err)
+	})
+
+	t.Run("through a scalar", func(t *testing.T) {
+		state := map[string]interface{}{"foo": "bar"}
+		err := setValueAtKeypath(state, []string{"foo", "bar"}, "x", true)
+		require.Error(t, err)
+	})
+}
+
+func TestWalkTree(t *testing.T) {
+	state := map[string]interface{}{
+		"foo": map[string]interface{}{
+			"bar": "baz",
+		},
+		"big": []interface{}{"a", "b", "c"},
+	}
+
+	t.Run("errSkipSubtree prunes a subtree", func(t *testing.T) {
+		var visited []string
+		err := walkTree(state, func(keypath []string, val interface{}) error {
+			visited = append(visited, strings.Join(keypath, "."))
+			if strings.Join(keypath, ".") == "big" {
+				return errSkipSubtree
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"", "foo", "foo.bar", "big"}, visited)
+	})
+
+	t.Run("errStopWalk halts without an error", func(t *testing.T) {
+		var visited []string
+		err := walkTree(state, func(keypath []string, val interface{}) error {
+			visited = append(visited, strings.Join(keypath, "."))
+			if strings.Join(keypath, ".") == "big" {
+				return errStopWalk
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		require.Contains(t, visited, "big")
+		require.NotContains(t, visited, "big.0")
+	})
+
+	t.Run("other errors are propagated", func(t *testing.T) {
+		expectedErr := errors.New("oh no")
+		err := walkTree(state, func(keypath []string, val interface{}) error {
+			return expectedErr
+		})
+		require.Equal(t, expectedErr, err)
+	})
+}
+
+func TestGetSubtree(t *testing.T) {
+	state := map[string]interface{}{
+		"messages": map[string]interface{}{
+			"general": map[string]interface{}{
+				"1": map[string]interface{}{"text": "hi"},
+				"2": map[string]interface{}{"text": "hello"},
+			},
+		},
+		"users": []interface{}{
+			map[string]interface{}{"name": "alice"},
+		},
+		"count": 2.0,
+	}
+
+	subtree, ok := getSubtree(state, []string{"messages", "general"})
+	require.True(t, ok)
+	require.Equal(t, state["messages"].(map[string]interface{})["general"], subtree)
+
+	subtree, ok = getSubtree(state, []string{"users", "0"})
+	require.True(t, ok)
+	require.Equal(t, map[string]interface{}{"name": "alice"}, subtree)
+
+	subtree, ok = getSubtree(state, nil)
+	require.True(t, ok)
+	require.Equal(t, state, subtree)
+
+	for _, prefix := range [][]string{
+		{"count"},
+		{"messages", "general", "1", "text"},
+		{"users"},
+		{"missing"},
+		{"count", "deeper"},
+	} {
+		_, ok := getSubtree(state, prefix)
+		require.False(t, ok, "%v", prefix)
+	}
+}
+
+func TestWalkSubtree(t *testing.T) {
+	state := map[string]interface{}{
+		"messages": map[string]interface{}{
+			"general": map[string]interface{}{
+				"1": map[string]interface{}{"text": "hi"},
+				"2": map[string]interface{}{"text": "hello"},
+			},
+			"random": map[string]interface{}{
+				"1": map[string]interface{}{"text": "elsewhere"},
+			},
+		},
+		"count": 2.0,
+	}
+
+	t.Run("nested prefix", func(t *testing.T) {
+		var visited []string
+		err := walkSubtree(state, []string{"messages", "general"}, func(keypath []string, val interface{}) error {
+			visited = append(visited, strings.Join(keypath, "."))
+			return nil
+		})
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{
+			"messages.general",
+			"messages.general.1",
+			"messages.general.1.text",
+			"messages.general.2",
+			"messages.general.2.text",
+		}, visited)
+	})
+
+	t.Run("scalar prefix", func(t *testing.T) {
+		var visited []string
+		err := walkSubtree(state, []string{"count"}, func(keypath []string, val interface{}) error {
+			visited = append(visited, strings.Join(keypath, "."))
+			require.Equal(t, 2.0, val)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"count"}, visited)
+	})
+
+	t.Run("missing prefix", func(t *testing.T) {
+		err := walkSubtree(state, []string{"messages", "nope"}, func(keypath []string, val interface{}) error {
+			t.Fatal("shouldn't be called")
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("errStopWalk and errors behave as in walkTree", func(t *testing.T) {
+		var n int
+		err := walkSubtree(state, []string{"messages"}, func(keypath []string, val interface{}) error {
+			n++
+			return errStopWalk
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		expectedErr := errors.New("oh no")
+		err = walkSubtree(state, []string{"messages"}, func(keypath []string, val interface{}) error {
+			return expectedErr
+		})
+		require.Equal(t, expectedErr, err)
+	})
+}
+
+func TestNumericAccessors(t *testing.T) {
+	var state interface{}
+	err := json.Unmarshal([]byte(`{"count": 3, "ratio": 0.5, "nested": {"big": 9007199254740991}}`), &state)
+	require.NoError(t, err)
+
+	i, ok := getInt(state, []string{"count"})
+	require.True(t, ok)
+	require.Equal(t, 3, i)
+
+	i64, ok := getInt64(state, []string{"nested", "big"})
+	require.True(t, ok)
+	require.Equal(t, int64(9007199254740991), i64)
+
+	_, ok = getInt64(state, []string{"ratio"})
+	require.False(t, ok)
+
+	f, ok := getFloat64(state, []string{"ratio"})
+	require.True(t, ok)
+	require.Equal(t, 0.5, f)
+
+	f, ok = getFloat64(state, []string{"count"})
+	require.True(t, ok)
+	require.Equal(t, float64(3), f)
+
+	dec := json.NewDecoder(strings.NewReader(`{"count": 42}`))
+	dec.UseNumber()
+	err = dec.Decode(&state)
+	require.NoError(t, err)
+
+	i64, ok = getInt64(state, []string{"count"})
+	require.True(t, ok)
+	require.Equal(t, int64(42), i64)
+
+	t.Run("out of range", func(t *testing.T) {
+		for _, x := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1 << 63, -(1 << 64), 1e300} {
+			_, ok := getInt64(map[string]interface{}{"x": x}, []string{"x"})
+			require.False(t, ok, "%v", x)
+		}
+
+		i64, ok := getInt64(map[string]interface{}{"x": float64(-(1 << 63))}, []string{"x"})
+		require.True(t, ok)
+		require.Equal(t, int64(math.MinInt64), i64)
+	})
+}
+
+func makeLargeTree(width, depth int) interface{} {
+	if depth == 0 {
+		return float64(width)
+	}
+	m := make(map[string]interface{}, width)
+	for i := 0; i < width; i++ {
+		if i%2 == 0 {
+			m[strconv.Itoa(i)] = makeLargeTree(width, depth-1)
+		} else {
+			m[strconv.Itoa(i)] = []interface{}{"x", makeLargeTree(width, depth-1)}
+		}
+	}
+	return m
+}
+
+// makeNarrowTree is makeLargeTree(width, depth) at the end of a chain of
+// `chain` single-child maps, so that its root has only one child.
+func makeNarrowTree(chain, width, depth int) interface{} {
+	tree := makeLargeTree(width, depth)
+	for i := 0; i < chain; i++ {
+		tree = map[string]interface{}{"only": tree}
+	}
+	return tree
+}
+
+func doubleNumbers(keypath []string, val interface{}) (interface{}, error) {
+	if f, isFloat := val.(float64); isFloat {
+		return f * 2, nil
+	} else if s, isString := val.(string); isString {
+		return s + strings.Join(keypath, "."), nil
+	}
+	return val, nil
+}
+
+func TestMapTreeParallel(t *testing.T) {
+	tree := makeLargeTree(6, 4)
+
+	for name, tree := range map[string]interface{}{
+		"wide root":   tree,
+		"narrow root": makeNarrowTree(3, 6, 3),
+		"scalar":      1.0,
+		"slice root":  []interface{}{makeLargeTree(2, 2), "x"},
+	} {
+		for _, workers := range []int{1, 4, 64} {
+			expected, err := mapTree(DeepCopyJSValue(tree), doubleNumbers)
+			require.NoError(t, err)
+
+			actual, err := mapTreeParallel(DeepCopyJSValue(tree), workers, doubleNumbers)
+			require.NoError(t, err)
+
+			require.Equal(t, expected, actual, "%v, %v workers", name, workers)
+		}
+	}
+
+	t.Run("errors are propagated", func(t *testing.T) {
+		expectedErr := errors.New("oh no")
+		_, err := mapTreeParallel(DeepCopyJSValue(tree), 4, func(keypath []string, val interface{}) (interface{}, error) {
+			if len(keypath) == 3 {
+				return nil, expectedErr
+			}
+			return val, nil
+		})
+		require.Equal(t, expectedErr, err)
+	})
+
+	t.Run("panics are re-raised", func(t *testing.T) {
+		require.PanicsWithValue(t, "oh no", func() {
+			_, _ = mapTreeParallel(DeepCopyJSValue(tree), 4, func(keypath []string, val interface{}) (interface{}, error) {
+				if len(keypath) == 3 {
+					panic("oh no")
+				}
+				return val, nil
+			})
+		})
+	})
+}
+
+func BenchmarkMapTree(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tree := makeLargeTree(8, 4)
+		b.StartTimer()
+		_, _ = mapTree(tree, doubleNumbers)
+	}
+}
+
+func BenchmarkMapTreeParallel(b *testing.B) {
+	for name, makeTree := range map[string]func() interface{}{
+		"wide root":   func() interface{} { return makeLargeTree(8, 4) },
+		"narrow root": func() interface{} { return makeNarrowTree(3, 8, 4) },
+	} {
+		makeTree := makeTree
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tree := makeTree()
+				b.StartTimer()
+				_, _ = mapTreeParallel(tree, 8, doubleNumbers)
+			}
+		})
+	}
+}
+
+func TestDeepEqualJSValue(t *testing.T) {
+	var a, b interface{}
+	err := json.Unmarshal([]byte(`{"foo": {"x": 1, "y": [1, "two", {"z": null}]}, "bar": true}`), &a)
+	require.NoError(t, err)
+	err = json.Unmarshal([]byte(`{"bar": true, "foo": {"y": [1, "two", {"z": null}], "x": 1}}`), &b)
+	require.NoError(t, err)
+
+	require.True(t, DeepEqualJSValue(a, b))
+
+	t.Run("numeric types", func(t *testing.T) {
+		require.True(t, DeepEqualJSValue(map[string]interface{}{"x": 1}, map[string]interface{}{"x": float64(1)}))
+		require.False(t, DeepEqualJSValue(map[string]interface{}{"x": 1}, map[string]interface{}{"x": 1.5}))
+		require.False(t, DeepEqualJSValue(1, "1"))
+		require.True(t, DeepEqualJSValue(json.Number("1e3"), 1000))
+		require.True(t, DeepEqualJSValue(uint64(math.MaxUint64), json.Number("18446744073709551615")))
+	})
+
+	t.Run("large integers", func(t *testing.T) {
+		// These are the same once rounded to a float64
+		require.False(t, DeepEqualJSValue(int64(1<<53), int64(1<<53+1)))
+		require.False(t, DeepEqualJSValue(float64(1<<53), int64(1<<53+1)))
+		require.True(t, DeepEqualJSValue(float64(1<<53), int64(1<<53)))
+	})
+
+	t.Run("uncomparable leaves", func(t *testing.T) {
+		require.True(t, DeepEqualJSValue([]byte("abc"), []byte("abc")))
+		require.False(t, DeepEqualJSValue([]byte("abc"), []byte("abd")))
+		require.False(t, DeepEqualJSValue([]byte("abc"), "abc"))
+		require.True(t, DeepEqualJSValue([]string{"a"}, []string{"a"}))
+		require.False(t, DeepEqualJSValue([]string{"a"}, map[string]string{"0": "a"}))
+	})
+
+	t.Run("slices", func(t *testing.T) {
+		require.False(t, DeepEqualJSValue([]interface{}{"a", "b"}, []interface{}{"b", "a"}))
+		require.False(t, DeepEqualJSValue([]interface{}{"a"}, []interface{}{"a", "b"}))
+		require.False(t, DeepEqualJSValue([]interface{}{"a"}, map[string]interface{}{"0": "a"}))
+	})
+
+	t.Run("maps", func(t *testing.T) {
+		require.False(t, DeepEqualJSValue(map[string]interface{}{"a": nil}, map[string]interface{}{"b": nil}))
+		require.False(t, DeepEqualJSValue(map[string]interface{}{"a": 1}, map[string]interface{}{"a": 1, "b": 2}))
+	})
+}
+
+type testPathError struct{ path string }
+
+func (e *testPathError) Error() string { return "bad path " + e.path }
+
+func TestMultiError(t *testing.T) {
+	sentinel := errors.New("sentinel")
+	other := errors.New("other")
+	pathErr := &testPathError{path: "/foo"}
+
+	err := combineErrors([]error{
+		other,
+		nil,
+		errors.Wrap(sentinel, "wrapped"),
+		errors.WithStack(pathErr),
+	})
+	require.Error(t, err)
+	require.Equal(t, "other\nwrapped: sentinel\nbad path /foo", err.Error())
+
+	var multi MultiError
+	require.True(t, errors.As(err, &multi))
+	require.Len(t, multi, 3)
+
+	require.True(t, errors.Is(err, sentinel))
+	require.True(t, errors.Is(err, other))
+	require.False(t, errors.Is(err, errors.New("sentinel")))
+
+	var asPathErr *testPathError
+	require.True(t, errors.As(err, &asPathErr))
+	require.Equal(t, pathErr, asPathErr)
+
+	// Aggregates can be wrapped and nested
+	nested := errors.Wrap(combineErrors([]error{other, err}), "outer")
+	require.True(t, errors.Is(nested, sentinel))
+
+	t.Run("no errors", func(t *testing.T) {
+		require.NoError(t, combineErrors(nil))
+		require.NoError(t, combineErrors([]error{nil, nil}))
+	})
+}
+
+func TestFanOut(t *testing.T) {
+	t.Run("calls everything once with bounded concurrency", func(t *testing.T) {
+		const n, workers = 100, 4
+
+		var (
+			calls        [n]int32
+			active, peak int32
+		)
+		fanOut(n, workers, func(i int) {
+			now := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				prev := atomic.LoadInt32(&peak)
+				if now <= prev || atomic.CompareAndSwapInt32(&peak, prev, now) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&calls[i], 1)
+		}, nil)
+
+		for i := range calls {
+			require.Equal(t, int32(1), calls[i], "call %v", i)
+		}
+		require.LessOrEqual(t, atomic.LoadInt32(&peak), int32(workers))
+		require.Greater(t, atomic.LoadInt32(&peak), int32(1))
+	})
+
+	t.Run("panics are recovered", func(t *testing.T) {
+		for _, workers := range []int{1, 3} {
+			var (
+				ran       int32
+				mu        sync.Mutex
+				recovered []interface{}
+			)
+			fanOut(10, workers, func(i int) {
+				if i%4 == 0 {
+					panic(i)
+				}
+				atomic.AddInt32(&ran, 1)
+			}, func(r interface{}, stack []byte) {
+				mu.Lock()
+				defer mu.Unlock()
+				recovered = append(recovered, r)
+				require.NotEmpty(t, stack)
+			})
+
+			require.Equal(t, int32(7), ran)
+			require.ElementsMatch(t, []interface{}{0, 4, 8}, recovered)
+		}
+	})
+
+	t.Run("no work", func(t *testing.T) {
+		fanOut(0, 4, func(i int) { t.Fatal("shouldn't be called") }, nil)
+	})
+}
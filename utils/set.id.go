@@ -24,6 +24,11 @@ func (s IDSet) Remove(val types.ID) IDSet {
 	return s
 }
 
+func (s IDSet) Contains(val types.ID) bool {
+	_, exists := s[val]
+	return exists
+}
+
 func (s IDSet) Any() types.ID {
 	for x := range s {
 		return x
@@ -46,3 +51,15 @@ func (s IDSet) Copy() IDSet {
 	}
 	return set
 }
+
+func (s IDSet) Equal(other IDSet) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for x := range s {
+		if !other.Contains(x) {
+			return false
+		}
+	}
+	return true
+}